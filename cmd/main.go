@@ -5,44 +5,74 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"log/slog"
-	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/andychao217/agent/internal/tlsconfig"
 	"github.com/andychao217/agent/pkg/agent"
 	"github.com/andychao217/agent/pkg/agent/api"
+	grpcapi "github.com/andychao217/agent/pkg/agent/api/grpc"
 	"github.com/andychao217/agent/pkg/bootstrap"
 	"github.com/andychao217/agent/pkg/conn"
 	"github.com/andychao217/agent/pkg/edgex"
+	"github.com/andychao217/agent/pkg/terminal"
 	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/andychao217/magistrala/pkg/messaging"
 	"github.com/andychao217/magistrala/pkg/messaging/brokers"
 	"github.com/caarlos0/env/v9"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kit/kit/metrics"
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 type config struct {
 	ConfigFile             string `env:"MG_AGENT_CONFIG_FILE" envDefault:"config.toml"`
 	LogLevel               string `env:"MG_AGENT_LOG_LEVEL" envDefault:"info"`
 	EdgexURL               string `env:"MG_AGENT_EDGEX_URL" envDefault:"http://localhost:48090/api/v1/"`
+	EdgexDataURL           string `env:"MG_AGENT_EDGEX_DATA_URL" envDefault:"http://localhost:48080/api/v1/"`
+	EdgexCommandURL        string `env:"MG_AGENT_EDGEX_COMMAND_URL" envDefault:"http://localhost:48082/api/v1/"`
+	EdgexPollInterval      string `env:"MG_AGENT_EDGEX_POLL_INTERVAL" envDefault:"0s"`
 	MqttURL                string `env:"MG_AGENT_MQTT_URL" envDefault:"localhost:1883"`
 	HTTPPort               string `env:"MG_AGENT_HTTP_PORT" envDefault:"9999"`
+	HTTPAuthToken          string `env:"MG_AGENT_HTTP_AUTH_TOKEN" envDefault:""`
+	HTTPCORSOrigins        string `env:"MG_AGENT_HTTP_CORS_ORIGINS" envDefault:""`
+	HTTPCORSMethods        string `env:"MG_AGENT_HTTP_CORS_METHODS" envDefault:""`
+	HTTPCORSHeaders        string `env:"MG_AGENT_HTTP_CORS_HEADERS" envDefault:""`
+	HTTPMetricsEnabled     string `env:"MG_AGENT_HTTP_METRICS_ENABLED" envDefault:"true"`
+	HTTPHealthEnabled      string `env:"MG_AGENT_HTTP_HEALTH_ENABLED" envDefault:"true"`
+	GRPCPort               string `env:"MG_AGENT_GRPC_PORT" envDefault:""`
 	BootstrapURL           string `env:"MG_AGENT_BOOTSTRAP_URL" envDefault:"http://localhost:9013/things/bootstrap"`
 	BootstrapID            string `env:"MG_AGENT_BOOTSTRAP_ID" envDefault:""`
 	BootstrapKey           string `env:"MG_AGENT_BOOTSTRAP_KEY" envDefault:""`
+	BootstrapKeyFile       string `env:"MG_AGENT_BOOTSTRAP_KEY_FILE" envDefault:""`
 	BootstrapRetries       string `env:"MG_AGENT_BOOTSTRAP_RETRIES" envDefault:"5"`
 	BootstrapSkipTLS       string `env:"MG_AGENT_BOOTSTRAP_SKIP_TLS" envDefault:"false"`
 	BootstrapRetryDelaySec string `env:"MG_AGENT_BOOTSTRAP_RETRY_DELAY_SECONDS" envDefault:"10"`
+	BootstrapDryRun        bool   `env:"MG_AGENT_BOOTSTRAP_DRY_RUN" envDefault:"false"`
+	BootstrapForceExport   bool   `env:"MG_AGENT_BOOTSTRAP_FORCE_EXPORT_UPDATE" envDefault:"false"`
+	BootstrapProxyURL      string `env:"MG_AGENT_BOOTSTRAP_PROXY_URL" envDefault:""`
+	BootstrapSource        string `env:"MG_AGENT_BOOTSTRAP_SOURCE" envDefault:""`
+	BootstrapLocalConfig   string `env:"MG_AGENT_BOOTSTRAP_LOCAL_CONFIG_PATH" envDefault:""`
+	BootstrapWatchInterval string `env:"MG_AGENT_BOOTSTRAP_WATCH_INTERVAL" envDefault:"0s"`
+	BootstrapTrustedPubKey string `env:"MG_AGENT_BOOTSTRAP_TRUSTED_PUB_KEY" envDefault:""`
+	BootstrapTLSMinVersion string `env:"MG_AGENT_BOOTSTRAP_TLS_MIN_VERSION" envDefault:""`
+	BootstrapCipherSuites  string `env:"MG_AGENT_BOOTSTRAP_TLS_CIPHER_SUITES" envDefault:""`
+	BootstrapHeaders       string `env:"MG_AGENT_BOOTSTRAP_HEADERS" envDefault:""`
+	ExportConfigPath       string `env:"MG_AGENT_EXPORT_CONFIG_PATH" envDefault:"/configs/export/config.toml"`
 	ControlChannel         string `env:"MG_AGENT_CONTROL_CHANNEL" envDefault:""`
 	DataChannel            string `env:"MG_AGENT_DATA_CHANNEL" envDefault:""`
 	Encryption             string `env:"MG_AGENT_ENCRYPTION" envDefault:"false"`
@@ -52,19 +82,67 @@ type config struct {
 	MqttSkipTLSVer         string `env:"MG_AGENT_MQTT_SKIP_TLS" envDefault:"true"`
 	MqttMTLS               string `env:"MG_AGENT_MQTT_MTLS" envDefault:"false"`
 	MqttCA                 string `env:"MG_AGENT_MQTT_CA" envDefault:"ca.crt"`
+	TLSFallbackCA          string `env:"MG_AGENT_TLS_FALLBACK_CA" envDefault:""`
 	MqttQoS                string `env:"MG_AGENT_MQTT_QOS" envDefault:"0"`
 	MqttRetain             string `env:"MG_AGENT_MQTT_RETAIN" envDefault:"false"`
 	MqttCert               string `env:"MG_AGENT_MQTT_CLIENT_CERT" envDefault:"thing.cert"`
 	MqttPrivateKey         string `env:"MG_AGENT_MQTT_CLIENT_CERT" envDefault:"thing.key"`
+	MqttTopicNamespace     string `env:"MG_AGENT_MQTT_TOPIC_NAMESPACE" envDefault:""`
+	MqttPublishBuffer      string `env:"MG_AGENT_MQTT_PUBLISH_BUFFER" envDefault:"100"`
+	MqttQueueDir           string `env:"MG_AGENT_MQTT_QUEUE_DIR" envDefault:""`
+	MqttQueueMaxBytes      string `env:"MG_AGENT_MQTT_QUEUE_MAX_BYTES" envDefault:"10485760"`
+	MqttKeepAlive          string `env:"MG_AGENT_MQTT_KEEP_ALIVE" envDefault:"30s"`
+	MqttPingTimeout        string `env:"MG_AGENT_MQTT_PING_TIMEOUT" envDefault:"10s"`
+	MqttConnectTimeout     string `env:"MG_AGENT_MQTT_CONNECT_TIMEOUT" envDefault:"30s"`
+	MqttConnectRetry       string `env:"MG_AGENT_MQTT_CONNECT_RETRY_TIMEOUT" envDefault:"2m"`
+	MqttBatchWindow        string `env:"MG_AGENT_MQTT_BATCH_WINDOW" envDefault:"0s"`
+	MqttBatchTopics        string `env:"MG_AGENT_MQTT_BATCH_TOPICS" envDefault:""`
+	MqttCredentialsFile    string `env:"MG_AGENT_MQTT_CREDENTIALS_FILE" envDefault:""`
+	MqttTerminalTopic      string `env:"MG_AGENT_MQTT_TERMINAL_TOPIC" envDefault:""`
+	MqttDataTopic          string `env:"MG_AGENT_MQTT_DATA_TOPIC" envDefault:""`
 	HeartbeatInterval      string `env:"MG_AGENT_HEARTBEAT_INTERVAL" envDefault:"10s"`
+	HeartbeatPubInterval   string `env:"MG_AGENT_HEARTBEAT_PUBLISH_INTERVAL" envDefault:"0s"`
+	HeartbeatTopic         string `env:"MG_AGENT_HEARTBEAT_TOPIC" envDefault:"heartbeat"`
 	TermSessionTimeout     string `env:"MG_AGENT_TERMINAL_SESSION_TIMEOUT" envDefault:"60s"`
+	TermMaxDuration        string `env:"MG_AGENT_TERMINAL_MAX_DURATION" envDefault:"0s"`
+	TermFormat             string `env:"MG_AGENT_TERMINAL_FORMAT" envDefault:"json"`
+	TermAckWindow          string `env:"MG_AGENT_TERMINAL_ACK_WINDOW" envDefault:"0"`
+	TermReplayBuffer       string `env:"MG_AGENT_TERMINAL_REPLAY_BUFFER" envDefault:"0"`
+	TermShell              string `env:"MG_AGENT_TERMINAL_SHELL" envDefault:"bash"`
+	TermInputRate          string `env:"MG_AGENT_TERMINAL_INPUT_RATE" envDefault:"0"`
+	TermMaxInput           string `env:"MG_AGENT_TERMINAL_MAX_INPUT" envDefault:"0"`
+	TermMaxSessions        string `env:"MG_AGENT_TERMINAL_MAX_SESSIONS" envDefault:"0"`
+	TermBanner             string `env:"MG_AGENT_TERMINAL_BANNER" envDefault:""`
+	ExecTimeout            string `env:"MG_AGENT_EXEC_TIMEOUT" envDefault:"60s"`
+	ExecMaxOutputBytes     string `env:"MG_AGENT_EXEC_MAX_OUTPUT_BYTES" envDefault:"1048576"`
+	ExecDir                string `env:"MG_AGENT_EXEC_DIR" envDefault:""`
+	ExecBaseDir            string `env:"MG_AGENT_EXEC_BASE_DIR" envDefault:""`
+	ExecEnvPolicy          string `env:"MG_AGENT_EXEC_ENV_POLICY" envDefault:"inherit"`
+	ExecEnvAllowlist       string `env:"MG_AGENT_EXEC_ENV_ALLOWLIST" envDefault:"PATH,HOME,LANG,TERM"`
+	ExecEnvDenylist        string `env:"MG_AGENT_EXEC_ENV_DENYLIST" envDefault:"MG_AGENT_*"`
+	ExecContinueOnError    string `env:"MG_AGENT_EXEC_CONTINUE_ON_ERROR" envDefault:"false"`
+	ExecUser               string `env:"MG_AGENT_EXEC_USER" envDefault:""`
+	ExecCompressThreshold  string `env:"MG_AGENT_EXEC_COMPRESS_THRESHOLD" envDefault:"0"`
+	ExecMaxConcurrent      string `env:"MG_AGENT_EXEC_MAX_CONCURRENT" envDefault:"0"`
+	ExecQueueTimeout       string `env:"MG_AGENT_EXEC_QUEUE_TIMEOUT" envDefault:"0s"`
+	RateLimit              string `env:"MG_AGENT_RATE_LIMIT" envDefault:"0"`
+	RateBurst              string `env:"MG_AGENT_RATE_BURST" envDefault:"10"`
 }
 
 var (
 	errFailedToSetupMTLS       = errors.New("Failed to set up mtls certs")
 	errFetchingBootstrapFailed = errors.New("Fetching bootstrap failed with error")
 	errFailedToReadConfig      = errors.New("Failed to read config")
+	errFailedToWatchBootstrap  = errors.New("Failed to watch bootstrap config")
+	errInvalidTrustedPubKey    = errors.New("Invalid bootstrap trusted public key")
+	errInvalidBootstrapHeaders = errors.New("Invalid bootstrap headers")
 	errFailedToConfigHeartbeat = errors.New("Failed to configure heartbeat")
+	errFailedToConfigEdgex     = errors.New("Failed to configure EdgeX")
+)
+
+const (
+	minConnectBackoff = time.Second
+	maxConnectBackoff = 30 * time.Second
 )
 
 func main() {
@@ -81,35 +159,108 @@ func main() {
 		log.Fatalf(fmt.Sprintf("Failed to load config: %s", err))
 	}
 
-	logger, err := initLogger(c.LogLevel)
+	logger, level, err := initLogger(c.LogLevel)
 	if err != nil {
 		log.Fatalf(fmt.Sprintf("Failed to create logger: %s", err))
 	}
 
+	envCfg := cfg
 	cfg, err = loadBootConfig(c, cfg, logger)
 	if err != nil {
 		logger.Error("Failed to load config", slog.Any("error", err))
 	}
-
-	pubsub, err := brokers.NewPubSub(ctx, cfg.Server.BrokerURL, logger)
+	cfg, err = safeModeFallback(cfg, logger)
 	if err != nil {
-		log.Fatal("Failed to connect to Broker", slog.Any("error", err), slog.String("broker_url", cfg.Server.BrokerURL))
+		log.Fatalf(fmt.Sprintf("Failed to load safe mode config: %s", err))
 	}
-	defer pubsub.Close()
 
-	mqttClient, err := connectToMQTTBroker(cfg.MQTT, logger)
-	if err != nil {
-		logger.Error(err.Error())
-		return
+	var pubsub messaging.PubSub
+	if !cfg.SafeMode {
+		pubsub, err = brokers.NewPubSub(ctx, cfg.Server.BrokerURL, logger)
+		if err != nil {
+			log.Fatal("Failed to connect to Broker", slog.Any("error", err), slog.String("broker_url", cfg.Server.BrokerURL))
+		}
+		defer pubsub.Close()
+	}
+
+	// Clean session client loses its subscriptions on every reconnect,
+	// including the ones caused by MQTT credentials rotation.
+	var mqttBroker atomic.Value
+	resubscribe := func() {
+		if b, ok := mqttBroker.Load().(conn.MqttBroker); ok {
+			if err := b.Resubscribe(); err != nil {
+				logger.Warn("Failed to resubscribe to MQTT broker", slog.Any("error", err))
+			}
+		}
+	}
+
+	mqttMetrics := agent.MQTTMetrics{
+		Connected: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "agent",
+			Subsystem: "mqtt",
+			Name:      "connected",
+			Help:      "Whether the MQTT connection is open.",
+		}, []string{}),
+		Latency: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "agent",
+			Subsystem: "mqtt",
+			Name:      "publish_latency_seconds",
+			Help:      "Latency of MQTT publishes in seconds.",
+			Buckets:   []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		}, []string{}),
+		Failed: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "mqtt",
+			Name:      "publish_error_count",
+			Help:      "Number of failed MQTT publishes.",
+		}, []string{}),
+		Dropped: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "agent",
+			Subsystem: "mqtt",
+			Name:      "publish_dropped_count",
+			Help:      "Number of messages dropped without being published.",
+		}, []string{}),
+	}
+
+	creds := agent.NewCredentials(cfg.MQTT)
+	// MQTT client isn't ever connected in safe mode.
+	mqttClient := mqtt.NewClient(mqtt.NewClientOptions())
+	if !cfg.SafeMode {
+		mqttClient, err = connectToMQTTBroker(cfg.MQTT, creds, resubscribe, mqttMetrics.Connected, logger)
+		if err != nil {
+			logger.Error(err.Error())
+			return
+		}
 	}
-	edgexClient := edgex.NewClient(cfg.Edgex.URL, logger)
+	edgexClient := edgex.NewClient(cfg.Edgex.URL, cfg.Edgex.DataURL, cfg.Edgex.CommandURL, logger)
 
-	svc, err := agent.New(ctx, mqttClient, &cfg, edgexClient, pubsub, logger)
+	sessions := terminal.NewSessionManager(terminal.Metrics{
+		Sessions: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "agent",
+			Subsystem: "terminal",
+			Name:      "sessions",
+			Help:      "Number of open terminal sessions.",
+		}, []string{}),
+		Duration: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "agent",
+			Subsystem: "terminal",
+			Name:      "session_duration_seconds",
+			Help:      "Duration of terminal sessions in seconds.",
+			Buckets:   []float64{10, 30, 60, 300, 900, 1800, 3600, 14400},
+		}, []string{}),
+	}, logger)
+
+	svc, err := agent.New(ctx, mqttClient, creds, &cfg, agent.NewFileStore(c.ConfigFile), edgexClient, pubsub, sessions, mqttMetrics, logger, level)
 	if err != nil {
 		logger.Error("Error in agent service", slog.Any("error", err))
 		return
 	}
 
+	svc, err = rateLimit(svc, c)
+	if err != nil {
+		logger.Error("Failed to configure rate limit", slog.Any("error", err))
+		return
+	}
 	svc = api.LoggingMiddleware(svc, logger)
 	svc = api.MetricsMiddleware(
 		svc,
@@ -119,31 +270,73 @@ func main() {
 			Name:      "request_count",
 			Help:      "Number of requests received.",
 		}, []string{"method"}),
-		kitprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+		kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
 			Namespace: "agent",
 			Subsystem: "api",
-			Name:      "request_latency_microseconds",
-			Help:      "Total duration of requests in microseconds.",
+			Name:      "request_error_count",
+			Help:      "Number of failed requests.",
 		}, []string{"method"}),
+		api.NewLatencyHistogram("agent"),
 	)
-	b := conn.NewBroker(svc, mqttClient, cfg.Channels.Control, pubsub, logger)
+	svc = api.StatsMiddleware(svc, api.DefaultStats)
+	if !cfg.SafeMode {
+		b := conn.NewBroker(svc, mqttClient, cfg.Channels.Control, pubsub, logger)
+		mqttBroker.Store(b)
+
+		g.Go(func() error {
+			return b.Subscribe(ctx)
+		})
+	}
 
-	srv := &http.Server{
-		Addr:    fmt.Sprintf(":%s", cfg.Server.Port),
-		Handler: api.MakeHandler(svc),
+	handlerOpts, err := handlerOptions(c)
+	if err != nil {
+		logger.Error("Failed to configure HTTP API", slog.Any("error", err))
+		return
 	}
 
 	g.Go(func() error {
-		return b.Subscribe(ctx)
+		logger.Info("Agent service started", slog.String("port", cfg.Server.Port))
+		cors := api.CORSConfig{
+			AllowedOrigins: splitList(c.HTTPCORSOrigins),
+			AllowedMethods: splitList(c.HTTPCORSMethods),
+			AllowedHeaders: splitList(c.HTTPCORSHeaders),
+		}
+		handler := api.CORSHandler(cors, api.MakeHandler(svc, cfg.Server.AuthToken, handlerOpts...))
+		return api.RunServer(ctx, handler, fmt.Sprintf(":%s", cfg.Server.Port))
 	})
 
+	if c.GRPCPort != "" {
+		g.Go(func() error {
+			logger.Info("Agent gRPC service started", slog.String("port", c.GRPCPort))
+			srv := grpcapi.MakeServer(svc, cfg.Server.AuthToken)
+			return grpcapi.RunServer(ctx, srv, fmt.Sprintf(":%s", c.GRPCPort))
+		})
+	}
+
 	g.Go(func() error {
-		logger.Info("Agent service started", slog.String("port", cfg.Server.Port))
-		return srv.ListenAndServe()
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), api.ShutdownTimeout)
+		defer cancel()
+		err := sessions.CloseAll(shutdownCtx)
+		// Output of the closed sessions may be batched as well.
+		if err := svc.FlushBatches(); err != nil {
+			logger.Warn("Failed to flush batched messages", slog.Any("error", err))
+		}
+		return err
 	})
 
+	if !cfg.SafeMode {
+		if err := watchBootstrap(ctx, g, c, envCfg, svc, logger); err != nil {
+			logger.Error("Failed to watch bootstrap config", slog.Any("error", err))
+			return
+		}
+	}
+
+	go UnlockSignalHandler(ctx, svc, logger)
+	go ReloadSignalHandler(ctx, svc, logger)
+
 	g.Go(func() error {
-		return StopSignalHandler(ctx, cancel, logger, "agent", srv)
+		return StopSignalHandler(ctx, cancel, logger, "agent")
 	})
 
 	if err := g.Wait(); err != nil {
@@ -151,10 +344,59 @@ func main() {
 	}
 }
 
+// splitList splits comma separated list, ignoring empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// handlerOptions returns the options of the HTTP API handler, disabling the
+// endpoints that aren't enabled.
+func handlerOptions(cfg config) ([]api.HandlerOption, error) {
+	metrics, err := strconv.ParseBool(cfg.HTTPMetricsEnabled)
+	if err != nil {
+		return nil, err
+	}
+	health, err := strconv.ParseBool(cfg.HTTPHealthEnabled)
+	if err != nil {
+		return nil, err
+	}
+	opts := []api.HandlerOption{api.WithCORSOrigins(splitList(cfg.HTTPCORSOrigins))}
+	if !metrics {
+		opts = append(opts, api.WithoutMetrics())
+	}
+	if !health {
+		opts = append(opts, api.WithoutHealth())
+	}
+	return opts, nil
+}
+
+// rateLimit wraps service with rate limiting middleware, unless rate limit is disabled.
+func rateLimit(svc agent.Service, cfg config) (agent.Service, error) {
+	limit, err := strconv.ParseFloat(cfg.RateLimit, 64)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		return svc, nil
+	}
+	burst, err := strconv.Atoi(cfg.RateBurst)
+	if err != nil {
+		return nil, err
+	}
+	return api.RateLimitMiddleware(svc, rate.Limit(limit), burst), nil
+}
+
 func loadEnvConfig(cfg config) (agent.Config, error) {
 	sc := agent.ServerConfig{
 		BrokerURL: cfg.NatsURL,
 		Port:      cfg.HTTPPort,
+		AuthToken: cfg.HTTPAuthToken,
 	}
 	cc := agent.ChanConfig{
 		Control: cfg.ControlChannel,
@@ -165,17 +407,106 @@ func loadEnvConfig(cfg config) (agent.Config, error) {
 		return agent.Config{}, errors.Wrap(errFailedToConfigHeartbeat, err)
 	}
 
+	pubInterval, err := time.ParseDuration(cfg.HeartbeatPubInterval)
+	if err != nil {
+		return agent.Config{}, errors.Wrap(errFailedToConfigHeartbeat, err)
+	}
+
 	ch := agent.HeartbeatConfig{
-		Interval: interval,
+		Interval:        interval,
+		PublishInterval: pubInterval,
+		Topic:           cfg.HeartbeatTopic,
 	}
 	termSessionTimeout, err := time.ParseDuration(cfg.TermSessionTimeout)
 	if err != nil {
 		return agent.Config{}, err
 	}
+	termMaxDuration, err := time.ParseDuration(cfg.TermMaxDuration)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	termAckWindow, err := strconv.Atoi(cfg.TermAckWindow)
+	if err != nil {
+		termAckWindow = 0
+	}
+	termReplayBuffer, err := strconv.Atoi(cfg.TermReplayBuffer)
+	if err != nil {
+		termReplayBuffer = 0
+	}
+	termInputRate, err := strconv.Atoi(cfg.TermInputRate)
+	if err != nil {
+		termInputRate = 0
+	}
+	termMaxInput, err := strconv.Atoi(cfg.TermMaxInput)
+	if err != nil {
+		termMaxInput = 0
+	}
+	termMaxSessions, err := strconv.Atoi(cfg.TermMaxSessions)
+	if err != nil {
+		termMaxSessions = 0
+	}
 	ct := agent.TerminalConfig{
 		SessionTimeout: termSessionTimeout,
+		MaxDuration:    termMaxDuration,
+		Format:         cfg.TermFormat,
+		AckWindow:      termAckWindow,
+		ReplayBuffer:   termReplayBuffer,
+		Shell:          cfg.TermShell,
+		InputRate:      termInputRate,
+		MaxInput:       termMaxInput,
+		MaxSessions:    termMaxSessions,
+		Banner:         cfg.TermBanner,
+	}
+	execTimeout, err := time.ParseDuration(cfg.ExecTimeout)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	execMaxOutputBytes, err := strconv.Atoi(cfg.ExecMaxOutputBytes)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	execContinueOnError, err := strconv.ParseBool(cfg.ExecContinueOnError)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	execCompressThreshold, err := strconv.Atoi(cfg.ExecCompressThreshold)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	execMaxConcurrent, err := strconv.Atoi(cfg.ExecMaxConcurrent)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	execQueueTimeout, err := time.ParseDuration(cfg.ExecQueueTimeout)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	xc := agent.ExecConfig{
+		Timeout:        execTimeout,
+		MaxOutputBytes: execMaxOutputBytes,
+		Dir:            cfg.ExecDir,
+		BaseDir:        cfg.ExecBaseDir,
+		Env: agent.EnvConfig{
+			Policy:    cfg.ExecEnvPolicy,
+			Allowlist: splitList(cfg.ExecEnvAllowlist),
+			Denylist:  splitList(cfg.ExecEnvDenylist),
+		},
+		ContinueOnError:   execContinueOnError,
+		User:              cfg.ExecUser,
+		CompressThreshold: execCompressThreshold,
+		MaxConcurrent:     execMaxConcurrent,
+		QueueTimeout:      execQueueTimeout,
+	}
+	pollInterval, err := time.ParseDuration(cfg.EdgexPollInterval)
+	if err != nil {
+		return agent.Config{}, errors.Wrap(errFailedToConfigEdgex, err)
+	}
+	ec := agent.EdgexConfig{
+		URL:          cfg.EdgexURL,
+		DataURL:      cfg.EdgexDataURL,
+		CommandURL:   cfg.EdgexCommandURL,
+		PollInterval: pollInterval,
 	}
-	ec := agent.EdgexConfig{URL: cfg.EdgexURL}
 	lc := agent.LogConfig{Level: cfg.LogLevel}
 
 	mtls, err := strconv.ParseBool(cfg.MqttMTLS)
@@ -198,54 +529,183 @@ func loadEnvConfig(cfg config) (agent.Config, error) {
 		retain = false
 	}
 
+	publishBuffer, err := strconv.Atoi(cfg.MqttPublishBuffer)
+	if err != nil {
+		publishBuffer = 0
+	}
+
+	queueMaxBytes, err := strconv.ParseInt(cfg.MqttQueueMaxBytes, 10, 64)
+	if err != nil {
+		queueMaxBytes = 0
+	}
+
+	keepAlive, err := time.ParseDuration(cfg.MqttKeepAlive)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	pingTimeout, err := time.ParseDuration(cfg.MqttPingTimeout)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	connectTimeout, err := time.ParseDuration(cfg.MqttConnectTimeout)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	connectRetry, err := time.ParseDuration(cfg.MqttConnectRetry)
+	if err != nil {
+		return agent.Config{}, err
+	}
+	batchWindow, err := time.ParseDuration(cfg.MqttBatchWindow)
+	if err != nil {
+		return agent.Config{}, err
+	}
+
+	var fallbackCA []byte
+	if cfg.TLSFallbackCA != "" {
+		if fallbackCA, err = os.ReadFile(cfg.TLSFallbackCA); err != nil {
+			return agent.Config{}, errors.Wrap(errFailedToSetupMTLS, err)
+		}
+	}
+
 	mc := agent.MQTTConfig{
-		URL:         cfg.MqttURL,
-		Username:    cfg.MqttUsername,
-		Password:    cfg.MqttPassword,
-		MTLS:        mtls,
-		CAPath:      cfg.MqttCA,
-		CertPath:    cfg.MqttCert,
-		PrivKeyPath: cfg.MqttPrivateKey,
-		SkipTLSVer:  skipTLSVer,
-		QoS:         byte(qos),
-		Retain:      retain,
+		URL:                 cfg.MqttURL,
+		Username:            cfg.MqttUsername,
+		Password:            cfg.MqttPassword,
+		MTLS:                mtls,
+		CAPath:              cfg.MqttCA,
+		FallbackCA:          fallbackCA,
+		CertPath:            cfg.MqttCert,
+		PrivKeyPath:         cfg.MqttPrivateKey,
+		SkipTLSVer:          skipTLSVer,
+		QoS:                 byte(qos),
+		Retain:              retain,
+		TopicNamespace:      cfg.MqttTopicNamespace,
+		PublishBuffer:       publishBuffer,
+		QueueDir:            cfg.MqttQueueDir,
+		QueueMaxBytes:       queueMaxBytes,
+		KeepAlive:           keepAlive,
+		PingTimeout:         pingTimeout,
+		ConnectTimeout:      connectTimeout,
+		ConnectRetryTimeout: connectRetry,
+		BatchWindow:         batchWindow,
+		BatchTopics:         splitList(cfg.MqttBatchTopics),
+		CredentialsFile:     cfg.MqttCredentialsFile,
+		TerminalTopic:       cfg.MqttTerminalTopic,
+		DataTopic:           cfg.MqttDataTopic,
 	}
 
 	file := cfg.ConfigFile
-	c := agent.NewConfig(sc, cc, ec, lc, mc, ch, ct, file)
+	c := agent.NewConfig(sc, cc, ec, lc, mc, ch, ct, xc, file)
 	mc, err = loadCertificate(c.MQTT)
 	if err != nil {
 		return c, errors.Wrap(errFailedToSetupMTLS, err)
 	}
 
 	c.MQTT = mc
-	if err = agent.SaveConfig(c); err != nil {
+	if err = agent.NewFileStore(file).Save(c); err != nil {
 		return c, err
 	}
 	return c, nil
 }
 
+// bootstrapConfig returns the bootstrap parameters, falling back to the env
+// config c.
+func bootstrapConfig(cfg config, c agent.Config) (bootstrap.Config, error) {
+	skipTLS, err := strconv.ParseBool(cfg.BootstrapSkipTLS)
+	if err != nil {
+		return bootstrap.Config{}, err
+	}
+	var pubKey ed25519.PublicKey
+	if cfg.BootstrapTrustedPubKey != "" {
+		pubKey, err = base64.StdEncoding.DecodeString(cfg.BootstrapTrustedPubKey)
+		if err != nil {
+			return bootstrap.Config{}, errors.Wrap(errInvalidTrustedPubKey, err)
+		}
+		if len(pubKey) != ed25519.PublicKeySize {
+			return bootstrap.Config{}, errors.Wrap(errInvalidTrustedPubKey, fmt.Errorf("key has %d bytes instead of %d", len(pubKey), ed25519.PublicKeySize))
+		}
+	}
+	minVersion, err := tlsconfig.ParseVersion(cfg.BootstrapTLSMinVersion)
+	if err != nil {
+		return bootstrap.Config{}, err
+	}
+	var names []string
+	if cfg.BootstrapCipherSuites != "" {
+		names = strings.Split(strings.ReplaceAll(cfg.BootstrapCipherSuites, " ", ""), ",")
+	}
+	cipherSuites, err := tlsconfig.ParseCipherSuites(names)
+	if err != nil {
+		return bootstrap.Config{}, err
+	}
+	headers, err := parseHeaders(cfg.BootstrapHeaders)
+	if err != nil {
+		return bootstrap.Config{}, errors.Wrap(errInvalidBootstrapHeaders, err)
+	}
+	return bootstrap.Config{
+		URL:               cfg.BootstrapURL,
+		ID:                cfg.BootstrapID,
+		Key:               cfg.BootstrapKey,
+		KeyFile:           cfg.BootstrapKeyFile,
+		Retries:           cfg.BootstrapRetries,
+		RetryDelaySec:     cfg.BootstrapRetryDelaySec,
+		Encrypt:           cfg.Encryption,
+		SkipTLS:           skipTLS,
+		CA:                c.MQTT.CA,
+		FallbackCA:        c.MQTT.FallbackCA,
+		MinTLSVersion:     minVersion,
+		CipherSuites:      cipherSuites,
+		Fallback:          c,
+		DryRun:            cfg.BootstrapDryRun,
+		ForceExportUpdate: cfg.BootstrapForceExport,
+		ExportConfigPath:  cfg.ExportConfigPath,
+		ProxyURL:          cfg.BootstrapProxyURL,
+		Source:            cfg.BootstrapSource,
+		LocalConfigPath:   cfg.BootstrapLocalConfig,
+		TrustedPubKey:     pubKey,
+		Store:             agent.NewFileStore(cfg.ConfigFile),
+		Headers:           headers,
+	}, nil
+}
+
+// parseHeaders parses comma separated "Name: value" headers.
+func parseHeaders(s string) (map[string]string, error) {
+	list := splitList(s)
+	if len(list) == 0 {
+		return nil, nil
+	}
+	headers := make(map[string]string, len(list))
+	for _, h := range list {
+		name, value, ok := strings.Cut(h, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("header %q isn't in \"Name: value\" format", h)
+		}
+		headers[name] = strings.TrimSpace(value)
+	}
+	return headers, nil
+}
+
 func loadBootConfig(cfg config, c agent.Config, logger *slog.Logger) (agent.Config, error) {
 	file := cfg.ConfigFile
-	skipTLS, err := strconv.ParseBool(cfg.BootstrapSkipTLS)
+	bsConfig, err := bootstrapConfig(cfg, c)
 	if err != nil {
 		return agent.Config{}, err
 	}
-	bsConfig := bootstrap.Config{
-		URL:           cfg.BootstrapURL,
-		ID:            cfg.BootstrapID,
-		Key:           cfg.BootstrapKey,
-		Retries:       cfg.BootstrapRetries,
-		RetryDelaySec: cfg.BootstrapRetryDelaySec,
-		Encrypt:       cfg.Encryption,
-		SkipTLS:       skipTLS,
-	}
 
-	if err := bootstrap.Bootstrap(bsConfig, logger, file); err != nil {
+	bsConfig.RetriesCounter = kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "agent",
+		Subsystem: "bootstrap",
+		Name:      "retries",
+		Help:      "Number of retries consumed fetching bootstrap config.",
+	}, []string{})
+
+	res, err := bootstrap.BootstrapWithResult(bsConfig, logger, file)
+	logger.Info("Bootstrap finished", slog.String("outcome", res.Outcome), slog.Int("attempts", res.Attempts))
+	if err != nil && !errors.Contains(err, bootstrap.ErrConfigUnchanged) {
 		return c, errors.Wrap(errFetchingBootstrapFailed, err)
 	}
 
-	bsc, err := agent.ReadConfig(file)
+	bsc, err := bsConfig.Store.Load()
 	if err != nil {
 		return c, errors.Wrap(errFailedToReadConfig, err)
 	}
@@ -255,25 +715,258 @@ func loadBootConfig(cfg config, c agent.Config, logger *slog.Logger) (agent.Conf
 		return bsc, errors.Wrap(errFailedToSetupMTLS, err)
 	}
 
+	bsc = fillConfig(bsc, c)
+
+	if mc.PublishBuffer <= 0 {
+		mc.PublishBuffer = c.MQTT.PublishBuffer
+	}
+
+	if mc.QueueDir == "" {
+		mc.QueueDir = c.MQTT.QueueDir
+	}
+
+	if mc.QueueMaxBytes <= 0 {
+		mc.QueueMaxBytes = c.MQTT.QueueMaxBytes
+	}
+
+	if mc.KeepAlive <= 0 {
+		mc.KeepAlive = c.MQTT.KeepAlive
+	}
+
+	if mc.PingTimeout <= 0 {
+		mc.PingTimeout = c.MQTT.PingTimeout
+	}
+
+	if mc.ConnectTimeout <= 0 {
+		mc.ConnectTimeout = c.MQTT.ConnectTimeout
+	}
+
+	if mc.ConnectRetryTimeout <= 0 {
+		mc.ConnectRetryTimeout = c.MQTT.ConnectRetryTimeout
+	}
+
+	if mc.BatchWindow <= 0 {
+		mc.BatchWindow = c.MQTT.BatchWindow
+	}
+
+	if len(mc.BatchTopics) == 0 {
+		mc.BatchTopics = c.MQTT.BatchTopics
+	}
+
+	if mc.CredentialsFile == "" {
+		mc.CredentialsFile = c.MQTT.CredentialsFile
+	}
+
+	if mc.TerminalTopic == "" {
+		mc.TerminalTopic = c.MQTT.TerminalTopic
+	}
+
+	if mc.DataTopic == "" {
+		mc.DataTopic = c.MQTT.DataTopic
+	}
+
+	// Fallback CA is set in the environment only.
+	mc.FallbackCA = c.MQTT.FallbackCA
+
+	bsc.MQTT = mc
+	return bsc, nil
+}
+
+// safeModeFallback returns the config c if it's valid, and the safe mode
+// config otherwise, so the device stays reachable over the HTTP API for
+// recovery. HTTP port and auth token of c are kept.
+func safeModeFallback(c agent.Config, logger *slog.Logger) (agent.Config, error) {
+	verr := c.Validate()
+	if verr == nil {
+		return c, nil
+	}
+	sc, err := agent.SafeModeConfig()
+	if err != nil {
+		return c, err
+	}
+	if c.Server.Port != "" {
+		sc.Server.Port = c.Server.Port
+	}
+	sc.Server.AuthToken = c.Server.AuthToken
+	sc.File = c.File
+	logger.Error("Agent is running in SAFE MODE: no valid config from bootstrap or the local config file, MQTT is disabled and only the local HTTP API is reachable. Add valid config with POST /config and restart the agent to recover.",
+		slog.Any("error", verr), slog.String("port", sc.Server.Port))
+	return sc, nil
+}
+
+// fillConfig fills the settings missing from the bootstrapped config bsc
+// with the ones of the env config c.
+func fillConfig(bsc, c agent.Config) agent.Config {
 	if bsc.Heartbeat.Interval <= 0 {
 		bsc.Heartbeat.Interval = c.Heartbeat.Interval
 	}
 
+	if bsc.Heartbeat.PublishInterval <= 0 {
+		bsc.Heartbeat.PublishInterval = c.Heartbeat.PublishInterval
+	}
+
+	if bsc.Heartbeat.Topic == "" {
+		bsc.Heartbeat.Topic = c.Heartbeat.Topic
+	}
+
+	if bsc.Edgex.DataURL == "" {
+		bsc.Edgex.DataURL = c.Edgex.DataURL
+	}
+
+	if bsc.Edgex.CommandURL == "" {
+		bsc.Edgex.CommandURL = c.Edgex.CommandURL
+	}
+
+	if bsc.Edgex.PollInterval <= 0 {
+		bsc.Edgex.PollInterval = c.Edgex.PollInterval
+	}
+
 	if bsc.Terminal.SessionTimeout <= 0 {
 		bsc.Terminal.SessionTimeout = c.Terminal.SessionTimeout
 	}
 
-	bsc.MQTT = mc
-	return bsc, nil
+	if bsc.Server.AuthToken == "" {
+		bsc.Server.AuthToken = c.Server.AuthToken
+	}
+
+	if bsc.Exec.Timeout <= 0 {
+		bsc.Exec.Timeout = c.Exec.Timeout
+	}
+
+	if bsc.Exec.MaxOutputBytes <= 0 {
+		bsc.Exec.MaxOutputBytes = c.Exec.MaxOutputBytes
+	}
+
+	if bsc.Exec.Dir == "" {
+		bsc.Exec.Dir = c.Exec.Dir
+	}
+
+	if bsc.Exec.BaseDir == "" {
+		bsc.Exec.BaseDir = c.Exec.BaseDir
+	}
+
+	if !bsc.Exec.ContinueOnError {
+		bsc.Exec.ContinueOnError = c.Exec.ContinueOnError
+	}
+
+	if bsc.Exec.User == "" {
+		bsc.Exec.User = c.Exec.User
+	}
+
+	if bsc.Exec.CompressThreshold <= 0 {
+		bsc.Exec.CompressThreshold = c.Exec.CompressThreshold
+	}
+
+	if bsc.Exec.MaxConcurrent <= 0 {
+		bsc.Exec.MaxConcurrent = c.Exec.MaxConcurrent
+	}
+
+	if bsc.Exec.QueueTimeout <= 0 {
+		bsc.Exec.QueueTimeout = c.Exec.QueueTimeout
+	}
+
+	if bsc.Exec.Env.Policy == "" {
+		bsc.Exec.Env = c.Exec.Env
+	}
+
+	if bsc.Terminal.Format == "" {
+		bsc.Terminal.Format = c.Terminal.Format
+	}
+
+	if bsc.Terminal.Shell == "" {
+		bsc.Terminal.Shell = c.Terminal.Shell
+	}
+
+	if bsc.Terminal.MaxSessions <= 0 {
+		bsc.Terminal.MaxSessions = c.Terminal.MaxSessions
+	}
+
+	if bsc.Terminal.Banner == "" {
+		bsc.Terminal.Banner = c.Terminal.Banner
+	}
+
+	return bsc
 }
 
-func connectToMQTTBroker(conf agent.MQTTConfig, logger *slog.Logger) (mqtt.Client, error) {
+// watchBootstrap keeps the service config in sync with the bootstrap server
+// if the watch interval is set, filling the missing settings from the env
+// config c.
+func watchBootstrap(ctx context.Context, g *errgroup.Group, cfg config, c agent.Config, svc agent.Service, logger *slog.Logger) error {
+	interval, err := time.ParseDuration(cfg.BootstrapWatchInterval)
+	if err != nil {
+		return errors.Wrap(errFailedToWatchBootstrap, err)
+	}
+	if interval <= 0 {
+		return nil
+	}
+	bsConfig, err := bootstrapConfig(cfg, c)
+	if err != nil {
+		return errors.Wrap(errFailedToWatchBootstrap, err)
+	}
+	apply := func(bsc agent.Config) error {
+		return svc.UpdateConfig(agent.PatchOf(fillConfig(bsc, c)))
+	}
+	g.Go(func() error {
+		bootstrap.BootstrapWatch(ctx, bsConfig, interval, apply, logger, cfg.ConfigFile)
+		return nil
+	})
+	return nil
+}
+
+// connectToMQTTBroker connects to the MQTT broker. Credentials are read from creds
+// on every connect, so they can be rotated in place by the agent service.
+// Connection state is reported to the connected gauge. Failed connect is
+// retried for conf.ConnectRetryTimeout.
+func connectToMQTTBroker(conf agent.MQTTConfig, creds *agent.Credentials, onConnect func(), connected metrics.Gauge, logger *slog.Logger) (mqtt.Client, error) {
+	opts, err := mqttOptions(conf, creds, onConnect, connected, logger)
+	if err != nil {
+		return nil, err
+	}
+	client := mqtt.NewClient(opts)
+	connect := func() error {
+		token := client.Connect()
+		token.Wait()
+		return token.Error()
+	}
+	if err := retryConnect(connect, conf.ConnectRetryTimeout, minConnectBackoff, logger); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+// retryConnect calls connect until it succeeds or the timeout elapses,
+// doubling the backoff between the attempts from minBackoff up to
+// maxConnectBackoff. It returns the error of the last attempt.
+func retryConnect(connect func() error, timeout, minBackoff time.Duration, logger *slog.Logger) error {
+	deadline := time.Now().Add(timeout)
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		err := connect()
+		if err == nil {
+			return nil
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return err
+		}
+		wait := min(backoff, left)
+		logger.Warn(fmt.Sprintf("Failed to connect to MQTT broker, retrying in %s", wait), slog.Int("attempt", attempt), slog.Any("error", err))
+		time.Sleep(wait)
+		backoff = min(2*backoff, maxConnectBackoff)
+	}
+}
+
+// mqttOptions returns options of the MQTT client connecting with conf.
+func mqttOptions(conf agent.MQTTConfig, creds *agent.Credentials, onConnect func(), connected metrics.Gauge, logger *slog.Logger) (*mqtt.ClientOptions, error) {
 	name := fmt.Sprintf("agent-%s", conf.Username)
 	conn := func(client mqtt.Client) {
+		connected.Set(1)
 		logger.Info("Client connected", slog.String("client_name", name))
+		onConnect()
 	}
 
 	lost := func(client mqtt.Client, err error) {
+		connected.Set(0)
 		logger.Info("Client disconnected", slog.String("client_name", name))
 	}
 
@@ -285,35 +978,36 @@ func connectToMQTTBroker(conf agent.MQTTConfig, logger *slog.Logger) (mqtt.Clien
 		SetOnConnectHandler(conn).
 		SetConnectionLostHandler(lost)
 
-	if conf.Username != "" && conf.Password != "" {
-		opts.SetUsername(conf.Username)
-		opts.SetPassword(conf.Password)
-	}
+	opts.SetCredentialsProvider(creds.Get)
 
 	if conf.MTLS {
-		cfg := &tls.Config{
-			InsecureSkipVerify: conf.SkipTLSVer,
+		tlsOpts := tlsconfig.Options{
+			SkipVerify: conf.SkipTLSVer,
+			CA:         conf.CA,
+			FallbackCA: conf.FallbackCA,
+			Logger:     logger,
 		}
-
-		if conf.CA != nil {
-			cfg.RootCAs = x509.NewCertPool()
-			cfg.RootCAs.AppendCertsFromPEM(conf.CA)
+		if creds.HasCertificate() {
+			tlsOpts.GetClientCertificate = creds.ClientCertificate
 		}
-		if conf.Cert.Certificate != nil {
-			cfg.Certificates = []tls.Certificate{conf.Cert}
+		cfg, err := tlsconfig.Build(tlsOpts)
+		if err != nil {
+			return nil, errors.Wrap(errFailedToSetupMTLS, err)
 		}
 
 		opts.SetTLSConfig(cfg)
 		opts.SetProtocolVersion(4)
 	}
-	client := mqtt.NewClient(opts)
-	token := client.Connect()
-	token.Wait()
-
-	if token.Error() != nil {
-		return nil, token.Error()
+	if conf.KeepAlive > 0 {
+		opts.SetKeepAlive(conf.KeepAlive)
 	}
-	return client, nil
+	if conf.PingTimeout > 0 {
+		opts.SetPingTimeout(conf.PingTimeout)
+	}
+	if conf.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(conf.ConnectTimeout)
+	}
+	return opts, nil
 }
 
 func loadCertificate(cnfg agent.MQTTConfig) (agent.MQTTConfig, error) {
@@ -373,32 +1067,67 @@ func loadCertificate(cnfg agent.MQTTConfig) (agent.MQTTConfig, error) {
 	return c, nil
 }
 
-func StopSignalHandler(ctx context.Context, cancel context.CancelFunc, logger *slog.Logger, svcName string, server *http.Server) error {
+// UnlockSignalHandler leaves lockdown on SIGUSR1. Lockdown can only be lifted
+// by local action, so the signal is the only way out of it.
+func UnlockSignalHandler(ctx context.Context, svc agent.Service, logger *slog.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-c:
+			if err := svc.Unlock(); err != nil {
+				logger.Error(fmt.Sprintf("Failed to unlock agent: %s", err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ReloadSignalHandler reloads the config file on SIGHUP.
+func ReloadSignalHandler(ctx context.Context, svc agent.Service, logger *slog.Logger) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-c:
+			if _, err := svc.Reload(); err != nil {
+				logger.Error(fmt.Sprintf("Failed to reload config: %s", err))
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// StopSignalHandler cancels the context on signal, which shuts the server down.
+func StopSignalHandler(ctx context.Context, cancel context.CancelFunc, logger *slog.Logger, svcName string) error {
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, syscall.SIGINT, syscall.SIGABRT)
 	select {
 	case sig := <-c:
 		defer cancel()
-		shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 5*time.Second)
-		defer shutdownCancel()
-		if err := server.Shutdown(shutdownCtx); err != nil {
-			return fmt.Errorf("Failed to shutdown %s server: %v", svcName, err)
-		}
 		return fmt.Errorf("%s service shutdown by signal: %s", svcName, sig)
 	case <-ctx.Done():
 		return nil
 	}
 }
 
-func initLogger(levelText string) (*slog.Logger, error) {
+// initLogger returns logger along with its level, which can be changed at
+// runtime.
+func initLogger(levelText string) (*slog.Logger, *slog.LevelVar, error) {
 	var level slog.Level
 	if err := level.UnmarshalText([]byte(levelText)); err != nil {
-		return &slog.Logger{}, fmt.Errorf(`{"level":"error","message":"%s: %s","ts":"%s"}`, err, levelText, time.Now())
+		return &slog.Logger{}, nil, fmt.Errorf(`{"level":"error","message":"%s: %s","ts":"%s"}`, err, levelText, time.Now())
 	}
+	lv := new(slog.LevelVar)
+	lv.Set(level)
 
 	logHandler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: level,
+		Level: lv,
 	})
 
-	return slog.New(logHandler), nil
+	return slog.New(logHandler), lv, nil
 }
@@ -0,0 +1,164 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/terminal"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/caarlos0/env/v9"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTOptions(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cases := []struct {
+		desc           string
+		conf           agent.MQTTConfig
+		keepAlive      int64
+		pingTimeout    time.Duration
+		connectTimeout time.Duration
+	}{
+		{
+			desc:           "options with keep-alive settings",
+			conf:           agent.MQTTConfig{URL: "localhost:1883", KeepAlive: 20 * time.Second, PingTimeout: 5 * time.Second, ConnectTimeout: 15 * time.Second},
+			keepAlive:      20,
+			pingTimeout:    5 * time.Second,
+			connectTimeout: 15 * time.Second,
+		},
+		{
+			desc:           "options with client defaults",
+			conf:           agent.MQTTConfig{URL: "localhost:1883"},
+			keepAlive:      30,
+			pingTimeout:    10 * time.Second,
+			connectTimeout: 30 * time.Second,
+		},
+	}
+
+	for _, tc := range cases {
+		opts, err := mqttOptions(tc.conf, agent.NewCredentials(tc.conf), func() {}, discard.NewGauge(), logger)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.keepAlive, opts.KeepAlive, fmt.Sprintf("%s: unexpected keep-alive", tc.desc))
+		assert.Equal(t, tc.pingTimeout, opts.PingTimeout, fmt.Sprintf("%s: unexpected ping timeout", tc.desc))
+		assert.Equal(t, tc.connectTimeout, opts.ConnectTimeout, fmt.Sprintf("%s: unexpected connect timeout", tc.desc))
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	cases := []struct {
+		desc    string
+		s       string
+		headers map[string]string
+		err     bool
+	}{
+		{desc: "parse empty headers", s: ""},
+		{desc: "parse headers", s: "X-Api-Key: key, X-Tenant:tenant", headers: map[string]string{"X-Api-Key": "key", "X-Tenant": "tenant"}},
+		{desc: "parse header without value", s: "X-Api-Key", err: true},
+		{desc: "parse header without name", s: ": key", err: true},
+	}
+
+	for _, tc := range cases {
+		headers, err := parseHeaders(tc.s)
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error %v", tc.desc, err))
+		assert.Equal(t, tc.headers, headers, fmt.Sprintf("%s: unexpected headers", tc.desc))
+	}
+}
+
+func TestSafeModeFallback(t *testing.T) {
+	// Closed server simulates the bootstrap server being unreachable.
+	srv := httptest.NewServer(nil)
+	srv.Close()
+	t.Setenv("MG_AGENT_CONFIG_FILE", filepath.Join(t.TempDir(), "config.toml"))
+	t.Setenv("MG_AGENT_BOOTSTRAP_URL", srv.URL)
+	t.Setenv("MG_AGENT_BOOTSTRAP_RETRIES", "1")
+	t.Setenv("MG_AGENT_BOOTSTRAP_RETRY_DELAY_SECONDS", "0")
+	t.Setenv("MG_AGENT_HTTP_PORT", "9998")
+
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+	c := config{}
+	err := env.Parse(&c)
+	require.Nil(t, err, fmt.Sprintf("unexpected error parsing env: %s", err))
+	cfg, err := loadEnvConfig(c)
+	require.Nil(t, err, fmt.Sprintf("unexpected error loading env config: %s", err))
+	// Bootstrap retries are exhausted, leaving the env config without
+	// channels.
+	cfg, err = loadBootConfig(c, cfg, logger)
+	require.Nil(t, err, fmt.Sprintf("unexpected error loading config: %s", err))
+
+	cfg, err = safeModeFallback(cfg, logger)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.True(t, cfg.SafeMode, "expected safe mode to activate")
+	assert.Empty(t, cfg.MQTT.URL, "expected MQTT to be disabled in safe mode")
+	assert.Equal(t, "9998", cfg.Server.Port, "expected HTTP port to be kept in safe mode")
+	assert.Contains(t, buf.String(), "SAFE MODE", "expected safe mode to be logged")
+
+	svc, err := agent.New(context.TODO(), mqtt.NewClient(mqtt.NewClientOptions()), agent.NewCredentials(cfg.MQTT), &cfg, agent.NewFileStore(cfg.File), nil, nil, terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service in safe mode: %s", err))
+	assert.True(t, svc.Healthz().SafeMode, "expected health to report safe mode")
+
+	t.Setenv("MG_AGENT_CONTROL_CHANNEL", "control")
+	t.Setenv("MG_AGENT_DATA_CHANNEL", "data")
+	c = config{}
+	err = env.Parse(&c)
+	require.Nil(t, err, fmt.Sprintf("unexpected error parsing env: %s", err))
+	cfg, err = loadEnvConfig(c)
+	require.Nil(t, err, fmt.Sprintf("unexpected error loading env config: %s", err))
+	cfg, err = safeModeFallback(cfg, logger)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.False(t, cfg.SafeMode, "expected valid config not to activate safe mode")
+}
+
+func TestRetryConnect(t *testing.T) {
+	errConnect := errors.New("connection refused")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cases := []struct {
+		desc     string
+		failures int
+		timeout  time.Duration
+		attempts int
+		err      error
+	}{
+		{desc: "connect on first attempt", timeout: time.Second, attempts: 1},
+		{desc: "connect after failures", failures: 3, timeout: time.Second, attempts: 4},
+		{desc: "connect without retries", failures: 3, attempts: 1, err: errConnect},
+		{desc: "connect failing until timeout", failures: 100, timeout: 50 * time.Millisecond, err: errConnect},
+	}
+
+	for _, tc := range cases {
+		attempts := 0
+		// Dialer fails the first tc.failures attempts.
+		connect := func() error {
+			attempts++
+			if attempts <= tc.failures {
+				return errConnect
+			}
+			return nil
+		}
+		begin := time.Now()
+		err := retryConnect(connect, tc.timeout, time.Millisecond, logger)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		if tc.attempts > 0 {
+			assert.Equal(t, tc.attempts, attempts, fmt.Sprintf("%s: unexpected number of attempts", tc.desc))
+		}
+		if tc.err != nil {
+			assert.Less(t, time.Since(begin), tc.timeout+time.Second, fmt.Sprintf("%s: expected retries to stop once timeout elapses", tc.desc))
+		}
+	}
+}
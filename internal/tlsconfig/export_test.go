@@ -0,0 +1,18 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tlsconfig
+
+import (
+	"crypto/x509"
+	"sync"
+)
+
+// SetSystemCertPool replaces the system certificate pool and resets the
+// empty pool warning, returning the function restoring the pool.
+func SetSystemCertPool(pool func() (*x509.CertPool, error)) func() {
+	prev := systemCertPool
+	systemCertPool = pool
+	emptyPoolWarning = sync.Once{}
+	return func() { systemCertPool = prev }
+}
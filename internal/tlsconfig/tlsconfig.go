@@ -0,0 +1,161 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package tlsconfig builds TLS client configurations shared by the agent
+// connections, so they trust the same certificates.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+var (
+	// ErrInvalidCA indicates that CA certificates couldn't be parsed.
+	ErrInvalidCA = errors.New("failed to parse CA certificates")
+
+	// ErrInvalidVersion indicates unsupported TLS version.
+	ErrInvalidVersion = errors.New("unsupported TLS version")
+
+	// ErrInvalidCipherSuite indicates unknown or insecure cipher suite.
+	ErrInvalidCipherSuite = errors.New("unsupported TLS cipher suite")
+)
+
+// systemCertPool returns the system certificate pool, replaced by the tests
+// simulating systems without CA certificates.
+var systemCertPool = x509.SystemCertPool
+
+// emptyPoolWarning is logged once, rather than on every connection.
+var emptyPoolWarning sync.Once
+
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Options configures TLS client.
+type Options struct {
+	// SkipVerify disables verification of the server certificate.
+	SkipVerify bool
+
+	// CA holds PEM encoded certificates trusted in addition to the system
+	// certificate pool.
+	CA []byte
+
+	// FallbackCA holds PEM encoded certificates trusted instead of the
+	// system certificate pool if it's empty, e.g. on scratch and distroless
+	// images shipping no CA certificates.
+	FallbackCA []byte
+
+	// Logger warns that the system certificate pool is empty, nil disables
+	// the warning.
+	Logger *slog.Logger
+
+	// Certificates are presented to the server requesting client certificate.
+	Certificates []tls.Certificate
+
+	// GetClientCertificate provides client certificate on every handshake,
+	// taking precedence over Certificates. It allows rotating certificate
+	// without reconnecting.
+	GetClientCertificate func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
+
+	// MinVersion is the minimum TLS version accepted, Go default if zero.
+	MinVersion uint16
+
+	// CipherSuites restricts the cipher suites of TLS 1.2 and lower, Go
+	// default if empty. TLS 1.3 cipher suites aren't configurable.
+	CipherSuites []uint16
+}
+
+// ParseVersion returns TLS version of the string, such as "1.2". Empty
+// string returns zero, the Go default. Returns ErrInvalidVersion if the
+// version isn't supported.
+func ParseVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := versions[s]
+	if !ok {
+		return 0, errors.Wrap(ErrInvalidVersion, fmt.Errorf("%q", s))
+	}
+	return v, nil
+}
+
+// ParseCipherSuites returns IDs of the cipher suites with the names, such
+// as "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256". Returns
+// ErrInvalidCipherSuite if any of them is unknown or insecure.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, errors.Wrap(ErrInvalidCipherSuite, fmt.Errorf("%q", name))
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+func cipherSuite(name string) (uint16, bool) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name == name {
+			return cs.ID, true
+		}
+	}
+	return 0, false
+}
+
+// Build returns TLS client configuration trusting the system certificate
+// pool, or FallbackCA if the pool is empty or not available, and the CA
+// certificates. If there are none of them, server certificate can't be
+// verified, which is logged once as a warning unless verification is
+// skipped. Returns ErrInvalidCA if CA or FallbackCA is set but contains no
+// valid certificate.
+func Build(opts Options) (*tls.Config, error) {
+	rootCAs, err := systemCertPool()
+	if err != nil || rootCAs == nil {
+		rootCAs = x509.NewCertPool()
+	}
+	// Subjects lists the certificates loaded from the files on Linux, where
+	// the agent runs.
+	if len(rootCAs.Subjects()) == 0 {
+		switch {
+		case len(opts.FallbackCA) > 0:
+			if !rootCAs.AppendCertsFromPEM(opts.FallbackCA) {
+				return nil, errors.Wrap(ErrInvalidCA, fmt.Errorf("fallback CA"))
+			}
+		case len(opts.CA) == 0 && !opts.SkipVerify && opts.Logger != nil:
+			emptyPoolWarning.Do(func() {
+				args := []any{}
+				if err != nil {
+					args = append(args, slog.Any("error", err))
+				}
+				opts.Logger.Warn("System certificate pool is empty, so TLS connections will fail to verify the server certificate. "+
+					"Minimal images, such as scratch or distroless, ship no CA certificates: install them, point SSL_CERT_FILE to a bundle, "+
+					"or configure the fallback CA bundle or the private CA of the server", args...)
+			})
+		}
+	}
+	if len(opts.CA) > 0 && !rootCAs.AppendCertsFromPEM(opts.CA) {
+		return nil, ErrInvalidCA
+	}
+
+	return &tls.Config{
+		InsecureSkipVerify:   opts.SkipVerify,
+		RootCAs:              rootCAs,
+		Certificates:         opts.Certificates,
+		GetClientCertificate: opts.GetClientCertificate,
+		MinVersion:           opts.MinVersion,
+		CipherSuites:         opts.CipherSuites,
+	}, nil
+}
@@ -0,0 +1,325 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package tlsconfig_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/internal/tlsconfig"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCertificate returns certificate signed by the parent, self-signed if the
+// parent is nil, and its PEM encoding.
+func newCertificate(t *testing.T, cn string, isCA bool, parent *tls.Certificate) (tls.Certificate, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err, fmt.Sprintf("unexpected error generating key: %s", err))
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	parentCert, parentKey := tmpl, any(key)
+	if parent != nil {
+		parentCert = parent.Leaf
+		parentKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating certificate: %s", err))
+	leaf, err := x509.ParseCertificate(der)
+	require.Nil(t, err, fmt.Sprintf("unexpected error parsing certificate: %s", err))
+
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+	return cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+type handshake struct {
+	ok    bool
+	peers []*x509.Certificate
+}
+
+// serve accepts a single TLS connection and reports the handshake result.
+func serve(t *testing.T, cfg *tls.Config) (string, <-chan handshake) {
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error listening: %s", err))
+	t.Cleanup(func() { lis.Close() })
+
+	res := make(chan handshake, 1)
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tc := conn.(*tls.Conn)
+		if err := tc.Handshake(); err != nil {
+			res <- handshake{}
+			return
+		}
+		res <- handshake{ok: true, peers: tc.ConnectionState().PeerCertificates}
+	}()
+	return lis.Addr().String(), res
+}
+
+func TestBuild(t *testing.T) {
+	ca, caPEM := newCertificate(t, "ca", true, nil)
+	server, _ := newCertificate(t, "server", false, &ca)
+	client, _ := newCertificate(t, "client", false, &ca)
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.Leaf)
+
+	getClient := func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		return &client, nil
+	}
+
+	cases := []struct {
+		desc       string
+		opts       tlsconfig.Options
+		clientAuth bool
+		connect    bool
+		clientCN   string
+	}{
+		{
+			desc:    "connect without private CA",
+			opts:    tlsconfig.Options{},
+			connect: false,
+		},
+		{
+			desc:    "connect with skip verify",
+			opts:    tlsconfig.Options{SkipVerify: true},
+			connect: true,
+		},
+		{
+			desc:    "connect with private CA",
+			opts:    tlsconfig.Options{CA: caPEM},
+			connect: true,
+		},
+		{
+			desc:       "connect with private CA and client certificate",
+			opts:       tlsconfig.Options{CA: caPEM, Certificates: []tls.Certificate{client}},
+			clientAuth: true,
+			connect:    true,
+			clientCN:   "client",
+		},
+		{
+			desc:       "connect with private CA and client certificate callback",
+			opts:       tlsconfig.Options{CA: caPEM, GetClientCertificate: getClient},
+			clientAuth: true,
+			connect:    true,
+			clientCN:   "client",
+		},
+		{
+			desc:       "connect with skip verify and client certificate",
+			opts:       tlsconfig.Options{SkipVerify: true, Certificates: []tls.Certificate{client}},
+			clientAuth: true,
+			connect:    true,
+			clientCN:   "client",
+		},
+		{
+			desc:       "connect with private CA without required client certificate",
+			opts:       tlsconfig.Options{CA: caPEM},
+			clientAuth: true,
+			connect:    false,
+		},
+	}
+
+	for _, tc := range cases {
+		cfg, err := tlsconfig.Build(tc.opts)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.opts.SkipVerify, cfg.InsecureSkipVerify, fmt.Sprintf("%s: unexpected skip verify", tc.desc))
+
+		srvCfg := &tls.Config{Certificates: []tls.Certificate{server}}
+		if tc.clientAuth {
+			srvCfg.ClientAuth = tls.RequireAndVerifyClientCert
+			srvCfg.ClientCAs = caPool
+		}
+		addr, results := serve(t, srvCfg)
+
+		// Server verifies client certificate after the client handshake
+		// completes, so its result is the one checked.
+		conn, err := tls.Dial("tcp", addr, cfg)
+		if err == nil {
+			conn.Close()
+		}
+		res := <-results
+		assert.Equal(t, tc.connect, res.ok, fmt.Sprintf("%s: expected connected %t, client error: %v", tc.desc, tc.connect, err))
+		if tc.clientCN != "" && len(res.peers) > 0 {
+			assert.Equal(t, tc.clientCN, res.peers[0].Subject.CommonName, fmt.Sprintf("%s: unexpected client certificate", tc.desc))
+		}
+	}
+}
+
+func TestBuildInvalidCA(t *testing.T) {
+	_, err := tlsconfig.Build(tlsconfig.Options{CA: []byte("not a certificate")})
+	assert.True(t, errors.Contains(err, tlsconfig.ErrInvalidCA), fmt.Sprintf("expected error %s got %s", tlsconfig.ErrInvalidCA, err))
+}
+
+func TestBuildSystemPool(t *testing.T) {
+	_, caPEM := newCertificate(t, "ca", true, nil)
+
+	cfg, err := tlsconfig.Build(tlsconfig.Options{CA: caPEM})
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	sys, err := x509.SystemCertPool()
+	if err != nil {
+		t.Skipf("system certificate pool unavailable: %s", err)
+	}
+	assert.False(t, cfg.RootCAs.Equal(sys), "expected private CA to extend the system pool")
+	assert.True(t, sys.AppendCertsFromPEM(caPEM))
+	assert.True(t, cfg.RootCAs.Equal(sys), "expected system pool extended with private CA")
+}
+
+func TestBuildEmptySystemPool(t *testing.T) {
+	_, caPEM := newCertificate(t, "ca", true, nil)
+	_, fallbackPEM := newCertificate(t, "fallback", true, nil)
+	fallback := x509.NewCertPool()
+	require.True(t, fallback.AppendCertsFromPEM(fallbackPEM))
+
+	cases := []struct {
+		desc  string
+		pool  func() (*x509.CertPool, error)
+		opts  tlsconfig.Options
+		want  *x509.CertPool
+		warns bool
+		err   error
+	}{
+		{
+			desc:  "build with empty system pool",
+			pool:  func() (*x509.CertPool, error) { return x509.NewCertPool(), nil },
+			want:  x509.NewCertPool(),
+			warns: true,
+		},
+		{
+			desc:  "build with unavailable system pool",
+			pool:  func() (*x509.CertPool, error) { return nil, errors.New("no system roots") },
+			want:  x509.NewCertPool(),
+			warns: true,
+		},
+		{
+			desc: "build with empty system pool and fallback CA",
+			pool: func() (*x509.CertPool, error) { return x509.NewCertPool(), nil },
+			opts: tlsconfig.Options{FallbackCA: fallbackPEM},
+			want: fallback,
+		},
+		{
+			desc: "build with empty system pool and private CA",
+			pool: func() (*x509.CertPool, error) { return x509.NewCertPool(), nil },
+			opts: tlsconfig.Options{CA: caPEM},
+		},
+		{
+			desc: "build with empty system pool skipping verification",
+			pool: func() (*x509.CertPool, error) { return x509.NewCertPool(), nil },
+			opts: tlsconfig.Options{SkipVerify: true},
+			want: x509.NewCertPool(),
+		},
+		{
+			desc: "build with empty system pool and invalid fallback CA",
+			pool: func() (*x509.CertPool, error) { return x509.NewCertPool(), nil },
+			opts: tlsconfig.Options{FallbackCA: []byte("not a certificate")},
+			err:  tlsconfig.ErrInvalidCA,
+		},
+		{
+			desc: "build with system pool ignoring fallback CA",
+			pool: func() (*x509.CertPool, error) {
+				pool := x509.NewCertPool()
+				pool.AppendCertsFromPEM(caPEM)
+				return pool, nil
+			},
+			opts: tlsconfig.Options{FallbackCA: fallbackPEM},
+		},
+	}
+
+	for _, tc := range cases {
+		restore := tlsconfig.SetSystemCertPool(tc.pool)
+		var logs bytes.Buffer
+		tc.opts.Logger = slog.New(slog.NewTextHandler(&logs, nil))
+		cfg, err := tlsconfig.Build(tc.opts)
+		if tc.err != nil {
+			assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+			restore()
+			continue
+		}
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		if tc.want == nil {
+			tc.want = x509.NewCertPool()
+			tc.want.AppendCertsFromPEM(caPEM)
+		}
+		assert.True(t, cfg.RootCAs.Equal(tc.want), fmt.Sprintf("%s: unexpected root CAs", tc.desc))
+		assert.Equal(t, tc.warns, strings.Contains(logs.String(), "System certificate pool is empty"), fmt.Sprintf("%s: unexpected warning %q", tc.desc, logs.String()))
+
+		// Warning isn't repeated on every connection.
+		logs.Reset()
+		_, err = tlsconfig.Build(tc.opts)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Empty(t, logs.String(), fmt.Sprintf("%s: expected warning to be logged once", tc.desc))
+		restore()
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	cases := []struct {
+		desc    string
+		version string
+		want    uint16
+		err     error
+	}{
+		{desc: "parse empty version", version: "", want: 0},
+		{desc: "parse TLS 1.2", version: "1.2", want: tls.VersionTLS12},
+		{desc: "parse TLS 1.3", version: "1.3", want: tls.VersionTLS13},
+		{desc: "parse unknown version", version: "1.4", err: tlsconfig.ErrInvalidVersion},
+		{desc: "parse malformed version", version: "TLSv1.2", err: tlsconfig.ErrInvalidVersion},
+	}
+
+	for _, tc := range cases {
+		v, err := tlsconfig.ParseVersion(tc.version)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		assert.Equal(t, tc.want, v, fmt.Sprintf("%s: expected version %x got %x", tc.desc, tc.want, v))
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	cases := []struct {
+		desc  string
+		names []string
+		want  []uint16
+		err   error
+	}{
+		{desc: "parse no cipher suites"},
+		{
+			desc:  "parse cipher suites",
+			names: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"},
+			want:  []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		},
+		{desc: "parse insecure cipher suite", names: []string{"TLS_RSA_WITH_RC4_128_SHA"}, err: tlsconfig.ErrInvalidCipherSuite},
+		{desc: "parse unknown cipher suite", names: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "AES"}, err: tlsconfig.ErrInvalidCipherSuite},
+	}
+
+	for _, tc := range cases {
+		ids, err := tlsconfig.ParseCipherSuites(tc.names)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		assert.Equal(t, tc.want, ids, fmt.Sprintf("%s: unexpected cipher suites", tc.desc))
+	}
+}
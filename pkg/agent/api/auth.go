@@ -0,0 +1,53 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+const bearerPrefix = "Bearer "
+
+// ErrUnauthorizedAccess indicates missing or invalid bearer token.
+var ErrUnauthorizedAccess = errors.New("missing or invalid bearer token")
+
+// ErrUnauthenticatedAPI indicates that the request needs the API to require
+// the bearer token.
+var ErrUnauthenticatedAPI = errors.New("request requires authenticated API")
+
+// authHandler rejects requests without the bearer token. Empty token
+// disables authentication.
+func authHandler(token string, next http.Handler) http.Handler {
+	return tokenHandler(token, headerToken, next)
+}
+
+// tokenHandler rejects requests without the bearer token returned by
+// requestToken. Empty token disables authentication.
+func tokenHandler(token string, requestToken func(r *http.Request) (string, bool), next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t, ok := requestToken(r)
+		if !ok || subtle.ConstantTimeCompare([]byte(t), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			encodeError(r.Context(), ErrUnauthorizedAccess, w)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// headerToken returns the bearer token of the Authorization header.
+func headerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, bearerPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(header, bearerPrefix), true
+}
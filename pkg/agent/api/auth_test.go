@@ -0,0 +1,56 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuth(t *testing.T) {
+	const token = "secret-token"
+	hs := agent.HealthStatus{Status: agent.HealthPass}
+	svc := healthService{service: resultService{}, hs: hs}
+	ts := httptest.NewServer(api.MakeHandler(svc, token))
+	defer ts.Close()
+
+	body := `{"bn":"1:","n":"exec","vs":"ls,-la"}`
+	cases := []struct {
+		desc   string
+		method string
+		path   string
+		auth   string
+		status int
+	}{
+		{"exec with valid token", http.MethodPost, "/exec", "Bearer " + token, http.StatusOK},
+		{"exec without token", http.MethodPost, "/exec", "", http.StatusUnauthorized},
+		{"exec with invalid token", http.MethodPost, "/exec", "Bearer invalid", http.StatusUnauthorized},
+		{"exec with token of invalid scheme", http.MethodPost, "/exec", token, http.StatusUnauthorized},
+		{"publish without token", http.MethodPost, "/pub", "", http.StatusUnauthorized},
+		{"add config without token", http.MethodPost, "/config", "", http.StatusUnauthorized},
+		{"view config without token", http.MethodGet, "/config", "", http.StatusUnauthorized},
+		{"health without token", http.MethodGet, "/health", "", http.StatusOK},
+		{"metrics without token", http.MethodGet, "/metrics", "", http.StatusOK},
+		{"stats without token", http.MethodGet, "/stats", "", http.StatusOK},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(tc.method, ts.URL+tc.path, strings.NewReader(body))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		if tc.auth != "" {
+			req.Header.Set("Authorization", tc.auth)
+		}
+		res, err := ts.Client().Do(req)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res.Body.Close()
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+const wildcard = "*"
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch}
+	defaultCORSHeaders = []string{"Authorization", "Content-Type"}
+)
+
+// CORSConfig represents CORS policy of the HTTP API.
+type CORSConfig struct {
+	// AllowedOrigins of cross-origin requests, "*" allows any. Empty disables CORS.
+	AllowedOrigins []string
+	// AllowedMethods of cross-origin requests, GET, POST, PUT and PATCH by default.
+	AllowedMethods []string
+	// AllowedHeaders of cross-origin requests, Authorization and Content-Type by default.
+	AllowedHeaders []string
+}
+
+// CORSHandler sets CORS headers on responses to the allowed origins and responds
+// to preflight requests. Requests pass through unchanged if no origin is allowed.
+func CORSHandler(cfg CORSConfig, next http.Handler) http.Handler {
+	if len(cfg.AllowedOrigins) == 0 {
+		return next
+	}
+	if len(cfg.AllowedMethods) == 0 {
+		cfg.AllowedMethods = defaultCORSMethods
+	}
+	if len(cfg.AllowedHeaders) == 0 {
+		cfg.AllowedHeaders = defaultCORSHeaders
+	}
+	methods := strings.Join(cfg.AllowedMethods, ", ")
+	headers := strings.Join(cfg.AllowedHeaders, ", ")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !allowedOrigin(cfg.AllowedOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", methods)
+		w.Header().Set("Access-Control-Allow-Headers", headers)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func allowedOrigin(origins []string, origin string) bool {
+	return slices.Contains(origins, wildcard) || slices.Contains(origins, origin)
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCORS(t *testing.T) {
+	const origin = "https://console.example.com"
+	cors := api.CORSConfig{AllowedOrigins: []string{origin}}
+	ts := httptest.NewServer(api.CORSHandler(cors, api.MakeHandler(resultService{res: agent.ExecResult{}}, "token")))
+	defer ts.Close()
+
+	cases := []struct {
+		desc    string
+		method  string
+		origin  string
+		headers map[string]string
+		status  int
+		allowed bool
+	}{
+		{
+			desc:    "preflight from allowed origin",
+			method:  http.MethodOptions,
+			origin:  origin,
+			headers: map[string]string{"Access-Control-Request-Method": http.MethodPost},
+			status:  http.StatusNoContent,
+			allowed: true,
+		},
+		{
+			desc:    "cross-origin post from allowed origin",
+			method:  http.MethodPost,
+			origin:  origin,
+			headers: map[string]string{"Authorization": "Bearer token"},
+			status:  http.StatusOK,
+			allowed: true,
+		},
+		{
+			desc:    "cross-origin post from other origin",
+			method:  http.MethodPost,
+			origin:  "https://evil.example.com",
+			headers: map[string]string{"Authorization": "Bearer token"},
+			status:  http.StatusOK,
+			allowed: false,
+		},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(tc.method, fmt.Sprintf("%s/exec", ts.URL), strings.NewReader(`{"bn":"1:","n":"exec","vs":"ls,-la"}`))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		req.Header.Set("Origin", tc.origin)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		res, err := ts.Client().Do(req)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res.Body.Close()
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		allowOrigin := res.Header.Get("Access-Control-Allow-Origin")
+		assert.Equal(t, tc.allowed, allowOrigin == tc.origin, fmt.Sprintf("%s: unexpected Access-Control-Allow-Origin %q", tc.desc, allowOrigin))
+		if tc.method == http.MethodOptions {
+			assert.Contains(t, res.Header.Get("Access-Control-Allow-Methods"), http.MethodPost, fmt.Sprintf("%s: expected POST to be allowed", tc.desc))
+			assert.Contains(t, res.Header.Get("Access-Control-Allow-Headers"), "Authorization", fmt.Sprintf("%s: expected Authorization header to be allowed", tc.desc))
+		}
+	}
+}
+
+func TestCORSDisabled(t *testing.T) {
+	ts := httptest.NewServer(api.CORSHandler(api.CORSConfig{}, api.MakeHandler(resultService{}, "")))
+	defer ts.Close()
+
+	req, err := http.NewRequest(http.MethodOptions, fmt.Sprintf("%s/exec", ts.URL), nil)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	req.Header.Set("Origin", "https://console.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	res, err := ts.Client().Do(req)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	res.Body.Close()
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"), "expected no CORS headers by default")
+}
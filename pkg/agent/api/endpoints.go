@@ -12,7 +12,7 @@ import (
 )
 
 func pubEndpoint(svc agent.Service) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(pubReq)
 
 		if err := req.validate(); err != nil {
@@ -22,7 +22,7 @@ func pubEndpoint(svc agent.Service) endpoint.Endpoint {
 		topic := req.Topic
 		payload := req.Payload
 
-		if err := svc.Publish(topic, payload); err != nil {
+		if err := svc.Publish(ctx, topic, payload, req.PublishOpts); err != nil {
 			return genericRes{}, err
 		}
 
@@ -34,7 +34,7 @@ func pubEndpoint(svc agent.Service) endpoint.Endpoint {
 }
 
 func execEndpoint(svc agent.Service) endpoint.Endpoint {
-	return func(_ context.Context, request interface{}) (interface{}, error) {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
 		req := request.(execReq)
 
 		if err := req.validate(); err != nil {
@@ -42,20 +42,45 @@ func execEndpoint(svc agent.Service) endpoint.Endpoint {
 		}
 
 		uuid := strings.TrimSuffix(req.BaseName, ":")
-		out, err := svc.Execute(uuid, req.Value)
+		res, err := svc.ExecuteResult(ctx, uuid, req.Value, req.Dir)
 		if err != nil {
-			return execRes{}, nil
+			return nil, err
 		}
 
 		resp := execRes{
-			BaseName: req.BaseName,
-			Name:     "exec",
-			Value:    out,
+			BaseName:  req.BaseName,
+			Name:      "exec",
+			Value:     res.Stdout,
+			Stderr:    res.Stderr,
+			ExitCode:  res.ExitCode,
+			Truncated: res.Truncated,
 		}
 		return resp, nil
 	}
 }
 
+func execBatchEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(execBatchReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		uuid := strings.TrimSuffix(req.BaseName, ":")
+		results, err := svc.ExecuteBatch(uuid, req.Commands)
+		if err != nil {
+			return nil, err
+		}
+
+		return execBatchRes{
+			BaseName: req.BaseName,
+			Name:     "exec",
+			Results:  results,
+		}, nil
+	}
+}
+
 func addConfigEndpoint(svc agent.Service) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
 		req := request.(addConfigReq)
@@ -64,28 +89,40 @@ func addConfigEndpoint(svc agent.Service) endpoint.Endpoint {
 			return nil, err
 		}
 
-		sc := agent.ServerConfig{Port: req.Agent.Server.Port}
-		cc := agent.ChanConfig{
-			Control: req.Agent.Channels.Control,
-			Data:    req.Agent.Channels.Data,
-		}
-		ec := agent.EdgexConfig{URL: req.Agent.Edgex.Url}
-		lc := agent.LogConfig{Level: req.Agent.Log.Level}
-		mc := agent.MQTTConfig{
-			URL:      req.Agent.Mqtt.Url,
-			Username: req.Agent.Mqtt.Username,
-			Password: req.Agent.Mqtt.Password,
+		// Settings the request doesn't carry are kept from the current
+		// config, so the new one passes validation.
+		c := svc.Config()
+		c.Server.Port = req.Agent.Server.Port
+		c.Channels.Control = req.Agent.Channels.Control
+		c.Channels.Data = req.Agent.Channels.Data
+		c.Edgex.URL = req.Agent.Edgex.Url
+		c.Log = agent.LogConfig{Level: req.Agent.Log.Level}
+		c.MQTT.URL = req.Agent.Mqtt.Url
+		c.MQTT.Username = req.Agent.Mqtt.Username
+		c.MQTT.Password = req.Agent.Mqtt.Password
+		c.IdempotencyKey = req.IdempotencyKey
+
+		if err := svc.AddConfig(c); err != nil {
+			return nil, err
 		}
-		c := agent.Config{
-			Server:   sc,
-			Channels: cc,
-			Edgex:    ec,
-			Log:      lc,
-			MQTT:     mc,
+
+		return genericRes{
+			Service:  "agent",
+			Response: "config",
+		}, nil
+	}
+}
+
+func updateConfigEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(updateConfigReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
 		}
 
-		if err := svc.AddConfig(c); err != nil {
-			return genericRes{}, nil
+		if err := svc.UpdateConfig(req.ConfigPatch); err != nil {
+			return nil, err
 		}
 
 		return genericRes{
@@ -95,15 +132,90 @@ func addConfigEndpoint(svc agent.Service) endpoint.Endpoint {
 	}
 }
 
-func viewConfigEndpoint(svc agent.Service) endpoint.Endpoint {
+// reloadConfigEndpoint reloads the config file, responding with the changes
+// applied.
+func reloadConfigEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(_ context.Context, _ interface{}) (interface{}, error) {
+		changes, err := svc.Reload()
+		if err != nil {
+			return nil, err
+		}
+		if changes == nil {
+			changes = []agent.FieldChange{}
+		}
+
+		return reloadConfigRes{
+			Service: "agent",
+			Changes: changes,
+		}, nil
+	}
+}
+
+// viewConfigEndpoint returns the redacted config, unless the full one is
+// requested from the authenticated API.
+func viewConfigEndpoint(svc agent.Service, authenticated bool) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewConfigReq)
 		c := svc.Config()
+		if !req.full {
+			return c.Redacted(), nil
+		}
+		if !authenticated {
+			return nil, ErrUnauthenticatedAPI
+		}
 		return c, nil
 	}
 }
 
+func viewServiceEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewServiceReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		return svc.Service(req.id)
+	}
+}
+
+func cancelExecEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(cancelExecReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.CancelExecute(req.uuid); err != nil {
+			return genericRes{}, err
+		}
+
+		return genericRes{
+			Service:  "agent",
+			Response: "cancelled",
+		}, nil
+	}
+}
+
+// refreshServicesEndpoint refreshes the services, responding with the ones
+// known once the exited ones are removed. Services answering the heartbeat
+// request are listed once their heartbeat is received.
+func refreshServicesEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(_ context.Context, _ interface{}) (interface{}, error) {
+		if err := svc.RefreshServices(); err != nil {
+			return nil, err
+		}
+		return svc.Services(), nil
+	}
+}
+
 func viewServicesEndpoint(svc agent.Service) endpoint.Endpoint {
 	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(viewServicesReq)
+		if req.status != "" {
+			return svc.ServicesByStatus(req.status), nil
+		}
 		return svc.Services(), nil
 	}
 }
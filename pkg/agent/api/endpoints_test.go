@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -18,6 +19,7 @@ import (
 	"github.com/andychao217/agent/pkg/agent"
 	"github.com/andychao217/agent/pkg/agent/api"
 	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/andychao217/agent/pkg/terminal"
 	paho "github.com/eclipse/paho.mqtt.golang"
 
 	"github.com/andychao217/magistrala/logger"
@@ -68,7 +70,7 @@ func newService(ctx context.Context) (agent.Service, error) {
 	}
 	defer pubsub.Close()
 
-	agentSvc, err := agent.New(ctx, mqttClient, &config, edgexClient, pubsub, logger)
+	agentSvc, err := agent.New(ctx, mqttClient, agent.NewCredentials(config.MQTT), &config, nil, edgexClient, pubsub, terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +79,7 @@ func newService(ctx context.Context) (agent.Service, error) {
 }
 
 func newServer(svc agent.Service) *httptest.Server {
-	mux := api.MakeHandler(svc)
+	mux := api.MakeHandler(svc, "")
 	return httptest.NewServer(mux)
 }
 
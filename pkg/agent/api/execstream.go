@@ -0,0 +1,114 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"encoding/json"
+	goerrors "errors"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+const (
+	streamContentType = "application/x-ndjson"
+
+	stdoutEvent = "stdout"
+	stderrEvent = "stderr"
+	exitEvent   = "exit"
+	errorEvent  = "error"
+)
+
+// execEvent is a line of the streamed command output.
+type execEvent struct {
+	Type     string `json:"type"`
+	Data     string `json:"data,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// execStreamHandler executes the command of the exec request, streaming its
+// output as newline-delimited JSON events, flushed as they're written. The
+// events are stdout and stderr chunks, followed by the exit event carrying
+// the exit code, or by the error event if the command fails after the
+// output started. Errors before any output are responded with the status
+// of the error. Command is cancelled once the client disconnects.
+func execStreamHandler(svc agent.Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := decodeRequestID(r.Context(), r)
+		var req execReq
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			encodeError(ctx, errors.Wrap(agent.ErrMalformedEntity, err), w)
+			return
+		}
+		if err := req.validate(); err != nil {
+			encodeError(ctx, err, w)
+			return
+		}
+
+		s := &eventStream{w: w, header: func() {
+			encodeRequestID(ctx, w)
+			w.Header().Set("Content-Type", streamContentType)
+		}}
+		uuid := strings.TrimSuffix(req.BaseName, ":")
+		code, err := svc.ExecuteStream(ctx, uuid, req.Value, req.Dir, s.writer(stdoutEvent), s.writer(stderrEvent))
+		var exitErr *exec.ExitError
+		switch {
+		case err == nil, goerrors.As(err, &exitErr) && exitErr.Exited():
+			_ = s.send(execEvent{Type: exitEvent, ExitCode: &code})
+		case !s.started():
+			encodeError(ctx, err, w)
+		default:
+			_ = s.send(execEvent{Type: errorEvent, Error: err.Error()})
+		}
+	})
+}
+
+// eventStream writes the events to the response, flushing each of them.
+type eventStream struct {
+	mu     sync.Mutex
+	w      http.ResponseWriter
+	header func()
+	sent   bool
+}
+
+func (s *eventStream) send(e execEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.sent {
+		s.header()
+		s.sent = true
+	}
+	if err := json.NewEncoder(s.w).Encode(e); err != nil {
+		return err
+	}
+	return http.NewResponseController(s.w).Flush()
+}
+
+func (s *eventStream) started() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent
+}
+
+// writer returns writer sending the written chunks as events of the type.
+func (s *eventStream) writer(typ string) eventWriter {
+	return eventWriter{stream: s, typ: typ}
+}
+
+type eventWriter struct {
+	stream *eventStream
+	typ    string
+}
+
+func (ew eventWriter) Write(p []byte) (int, error) {
+	if err := ew.stream.send(execEvent{Type: ew.typ, Data: string(p)}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,65 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package grpc
+
+import (
+	"context"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/go-kit/kit/endpoint"
+)
+
+func execEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(execReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		res, err := svc.ExecuteResult(ctx, req.uuid, req.command, req.dir)
+		if err != nil {
+			return nil, err
+		}
+
+		return execRes{
+			stdout:    res.Stdout,
+			stderr:    res.Stderr,
+			exitCode:  res.ExitCode,
+			truncated: res.Truncated,
+		}, nil
+	}
+}
+
+func controlEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(_ context.Context, request interface{}) (interface{}, error) {
+		req := request.(controlReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.Control(req.uuid, req.command); err != nil {
+			return nil, err
+		}
+
+		return emptyRes{}, nil
+	}
+}
+
+func publishEndpoint(svc agent.Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		req := request.(pubReq)
+
+		if err := req.validate(); err != nil {
+			return nil, err
+		}
+
+		if err := svc.Publish(ctx, req.topic, req.payload, agent.PublishOpts{}); err != nil {
+			return nil, err
+		}
+
+		return emptyRes{}, nil
+	}
+}
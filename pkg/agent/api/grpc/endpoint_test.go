@@ -0,0 +1,228 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package grpc_test
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/andychao217/agent/pkg/agent"
+	grpcapi "github.com/andychao217/agent/pkg/agent/api/grpc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+const token = "token"
+
+type service = agent.Service
+
+// mockService records terminal commands and fails calls with "fail" command.
+type mockService struct {
+	service
+	mu       sync.Mutex
+	terminal []string
+	closed   chan struct{}
+}
+
+func (s *mockService) ExecuteResult(_ context.Context, uuid, cmd, dir string) (agent.ExecResult, error) {
+	if cmd == "fail" {
+		return agent.ExecResult{}, agent.ErrCommandNotAllowed
+	}
+	return agent.ExecResult{Stdout: cmd, Stderr: uuid, ExitCode: -1, Truncated: cmd == "yes"}, nil
+}
+
+func (s *mockService) Control(uuid, cmd string) error {
+	if cmd == "fail" {
+		return agent.ErrLockedDown
+	}
+	return nil
+}
+
+func (s *mockService) Publish(_ context.Context, topic, payload string, _ agent.PublishOpts) error {
+	return nil
+}
+
+func (s *mockService) Config() agent.Config {
+	return agent.Config{Channels: agent.ChanConfig{Control: "control"}}
+}
+
+func (s *mockService) Terminal(uuid, cmd string) error {
+	b, err := base64.StdEncoding.DecodeString(cmd)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.terminal = append(s.terminal, string(b))
+	if string(b) == "close" {
+		close(s.closed)
+	}
+	return nil
+}
+
+func newClient(t *testing.T, svc agent.Service) grpcapi.AgentServiceClient {
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpcapi.MakeServer(svc, token)
+	go func() {
+		_ = srv.Serve(lis)
+	}()
+	t.Cleanup(srv.Stop)
+
+	dialer := func(ctx context.Context, _ string) (net.Conn, error) {
+		return lis.DialContext(ctx)
+	}
+	conn, err := grpc.NewClient("passthrough:///bufnet", grpc.WithContextDialer(dialer), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating client: %s", err))
+	t.Cleanup(func() { conn.Close() })
+
+	return grpcapi.NewAgentServiceClient(conn)
+}
+
+func authCtx(tkn string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+tkn)
+}
+
+func TestExecute(t *testing.T) {
+	client := newClient(t, &mockService{})
+
+	cases := []struct {
+		desc string
+		ctx  context.Context
+		req  *grpcapi.ExecuteReq
+		res  *grpcapi.ExecuteRes
+		code codes.Code
+	}{
+		{
+			desc: "execute command",
+			ctx:  authCtx(token),
+			req:  &grpcapi.ExecuteReq{Uuid: "1", Command: "ls"},
+			res:  &grpcapi.ExecuteRes{Stdout: "ls", Stderr: "1", ExitCode: -1},
+			code: codes.OK,
+		},
+		{
+			desc: "execute command with truncated output",
+			ctx:  authCtx(token),
+			req:  &grpcapi.ExecuteReq{Uuid: "1", Command: "yes"},
+			res:  &grpcapi.ExecuteRes{Stdout: "yes", Stderr: "1", ExitCode: -1, Truncated: true},
+			code: codes.OK,
+		},
+		{
+			desc: "execute command without uuid",
+			ctx:  authCtx(token),
+			req:  &grpcapi.ExecuteReq{Command: "ls"},
+			code: codes.InvalidArgument,
+		},
+		{
+			desc: "execute denied command",
+			ctx:  authCtx(token),
+			req:  &grpcapi.ExecuteReq{Uuid: "1", Command: "fail"},
+			code: codes.PermissionDenied,
+		},
+		{
+			desc: "execute command with invalid token",
+			ctx:  authCtx("invalid"),
+			req:  &grpcapi.ExecuteReq{Uuid: "1", Command: "ls"},
+			code: codes.Unauthenticated,
+		},
+		{
+			desc: "execute command without token",
+			ctx:  context.Background(),
+			req:  &grpcapi.ExecuteReq{Uuid: "1", Command: "ls"},
+			code: codes.Unauthenticated,
+		},
+	}
+
+	for _, tc := range cases {
+		res, err := client.Execute(tc.ctx, tc.req)
+		assert.Equal(t, tc.code, status.Code(err), fmt.Sprintf("%s: expected code %s got %s", tc.desc, tc.code, status.Code(err)))
+		if tc.code == codes.OK {
+			assert.True(t, proto.Equal(tc.res, res), fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.res, res))
+		}
+	}
+}
+
+func TestControl(t *testing.T) {
+	client := newClient(t, &mockService{})
+
+	cases := []struct {
+		desc string
+		req  *grpcapi.ControlReq
+		code codes.Code
+	}{
+		{"run control command", &grpcapi.ControlReq{Uuid: "1", Command: "nodered-deploy"}, codes.OK},
+		{"run empty control command", &grpcapi.ControlReq{Uuid: "1"}, codes.InvalidArgument},
+		{"run control command while locked down", &grpcapi.ControlReq{Uuid: "1", Command: "fail"}, codes.PermissionDenied},
+	}
+
+	for _, tc := range cases {
+		_, err := client.Control(authCtx(token), tc.req)
+		assert.Equal(t, tc.code, status.Code(err), fmt.Sprintf("%s: expected code %s got %s", tc.desc, tc.code, status.Code(err)))
+	}
+}
+
+func TestPublish(t *testing.T) {
+	client := newClient(t, &mockService{})
+
+	cases := []struct {
+		desc string
+		req  *grpcapi.PublishReq
+		code codes.Code
+	}{
+		{"publish message", &grpcapi.PublishReq{Topic: "data", Payload: "payload"}, codes.OK},
+		{"publish message without payload", &grpcapi.PublishReq{Topic: "data"}, codes.InvalidArgument},
+		{"publish message to wildcard topic", &grpcapi.PublishReq{Topic: "data/#", Payload: "payload"}, codes.InvalidArgument},
+	}
+
+	for _, tc := range cases {
+		_, err := client.Publish(authCtx(token), tc.req)
+		assert.Equal(t, tc.code, status.Code(err), fmt.Sprintf("%s: expected code %s got %s", tc.desc, tc.code, status.Code(err)))
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	svc := &mockService{closed: make(chan struct{})}
+	client := newClient(t, svc)
+
+	stream, err := client.Terminal(authCtx(token))
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening stream: %s", err))
+
+	err = stream.Send(&grpcapi.TerminalReq{Uuid: "1", Data: []byte("ls")})
+	require.Nil(t, err, fmt.Sprintf("unexpected error sending input: %s", err))
+	res, err := stream.Recv()
+	require.Nil(t, err, fmt.Sprintf("unexpected error receiving response: %s", err))
+	assert.Equal(t, "channels/control/messages/res/term/1", res.Topic)
+
+	err = stream.Send(&grpcapi.TerminalReq{Data: []byte("a,b\n")})
+	require.Nil(t, err, fmt.Sprintf("unexpected error sending input: %s", err))
+	err = stream.CloseSend()
+	require.Nil(t, err, fmt.Sprintf("unexpected error closing stream: %s", err))
+	_, err = stream.Recv()
+	assert.Equal(t, io.EOF, err, fmt.Sprintf("expected stream end got %s", err))
+
+	<-svc.closed
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+	assert.Equal(t, []string{"open", "c,ls", "c,a,b\n", "close"}, svc.terminal)
+}
+
+func TestTerminalUnauthorized(t *testing.T) {
+	client := newClient(t, &mockService{})
+
+	stream, err := client.Terminal(authCtx("invalid"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening stream: %s", err))
+	_, err = stream.Recv()
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), fmt.Sprintf("expected code %s got %s", codes.Unauthenticated, status.Code(err)))
+}
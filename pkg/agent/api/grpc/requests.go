@@ -0,0 +1,49 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package grpc
+
+import (
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/topic"
+)
+
+type execReq struct {
+	uuid    string
+	command string
+	dir     string
+}
+
+func (req execReq) validate() error {
+	if req.uuid == "" || req.command == "" {
+		return agent.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type controlReq struct {
+	uuid    string
+	command string
+}
+
+func (req controlReq) validate() error {
+	if req.uuid == "" || req.command == "" {
+		return agent.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type pubReq struct {
+	topic   string
+	payload string
+}
+
+func (req pubReq) validate() error {
+	if req.payload == "" {
+		return agent.ErrMalformedEntity
+	}
+
+	return topic.Validate(req.topic)
+}
@@ -0,0 +1,13 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package grpc
+
+type execRes struct {
+	stdout    string
+	stderr    string
+	exitCode  int
+	truncated bool
+}
+
+type emptyRes struct{}
@@ -0,0 +1,273 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package grpc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative agent.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/andychao217/agent/pkg/topic"
+	"github.com/andychao217/magistrala/pkg/errors"
+	kitgrpc "github.com/go-kit/kit/transport/grpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const bearerPrefix = "Bearer "
+
+var _ AgentServiceServer = (*grpcServer)(nil)
+
+type grpcServer struct {
+	UnimplementedAgentServiceServer
+	svc     agent.Service
+	execute kitgrpc.Handler
+	control kitgrpc.Handler
+	publish kitgrpc.Handler
+}
+
+// MakeServer returns gRPC server exposing the service, the counterpart of
+// api.MakeHandler. Calls must carry the bearer token in the authorization
+// metadata, unless the token is empty.
+func MakeServer(svc agent.Service, authToken string, opts ...grpc.ServerOption) *grpc.Server {
+	opts = append(opts,
+		grpc.UnaryInterceptor(unaryAuthInterceptor(authToken)),
+		grpc.StreamInterceptor(streamAuthInterceptor(authToken)),
+	)
+	srv := grpc.NewServer(opts...)
+	RegisterAgentServiceServer(srv, NewServer(svc))
+	return srv
+}
+
+// RunServer serves srv on addr until the context is cancelled, then stops the
+// server gracefully, waiting for in-flight calls to complete for up to
+// api.ShutdownTimeout. It returns the listen error, if any.
+func RunServer(ctx context.Context, srv *grpc.Server, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(lis)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		stopped := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(api.ShutdownTimeout):
+			srv.Stop()
+		}
+		return <-errCh
+	}
+}
+
+// NewServer returns AgentService implementation backed by the service.
+func NewServer(svc agent.Service) AgentServiceServer {
+	return &grpcServer{
+		svc: svc,
+		execute: kitgrpc.NewServer(
+			execEndpoint(svc),
+			decodeExecRequest,
+			encodeExecResponse,
+		),
+		control: kitgrpc.NewServer(
+			controlEndpoint(svc),
+			decodeControlRequest,
+			encodeControlResponse,
+		),
+		publish: kitgrpc.NewServer(
+			publishEndpoint(svc),
+			decodePublishRequest,
+			encodePublishResponse,
+		),
+	}
+}
+
+func (s *grpcServer) Execute(ctx context.Context, req *ExecuteReq) (*ExecuteRes, error) {
+	_, res, err := s.execute.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return res.(*ExecuteRes), nil
+}
+
+func (s *grpcServer) Control(ctx context.Context, req *ControlReq) (*ControlRes, error) {
+	_, res, err := s.control.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return res.(*ControlRes), nil
+}
+
+func (s *grpcServer) Publish(ctx context.Context, req *PublishReq) (*PublishRes, error) {
+	_, res, err := s.publish.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, encodeError(err)
+	}
+	return res.(*PublishRes), nil
+}
+
+// Terminal opens the session on the first message and closes it once the
+// client closes the stream. Session output isn't streamed back, it's
+// published to the MQTT topic sent in the response.
+func (s *grpcServer) Terminal(stream AgentService_TerminalServer) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	uuid := req.GetUuid()
+	if uuid == "" {
+		return encodeError(agent.ErrMalformedEntity)
+	}
+	if err := s.svc.Terminal(uuid, terminalCommand("open")); err != nil {
+		return encodeError(err)
+	}
+	defer s.svc.Terminal(uuid, terminalCommand("close"))
+
+	out := s.svc.Config().TerminalTopic(uuid)
+	if err := stream.Send(&TerminalRes{Topic: out}); err != nil {
+		return err
+	}
+
+	for {
+		if req.GetUuid() != "" && req.GetUuid() != uuid {
+			return encodeError(agent.ErrMalformedEntity)
+		}
+		if len(req.Data) > 0 {
+			if err := s.svc.Terminal(uuid, terminalCommand("c", string(req.Data))); err != nil {
+				return encodeError(err)
+			}
+		}
+		req, err = stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// terminalCommand encodes the terminal command the way MQTT clients do.
+func terminalCommand(args ...string) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Join(args, ",")))
+}
+
+func decodeExecRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*ExecuteReq)
+	return execReq{uuid: req.GetUuid(), command: req.Command, dir: req.Dir}, nil
+}
+
+func encodeExecResponse(_ context.Context, grpcRes interface{}) (interface{}, error) {
+	res := grpcRes.(execRes)
+	return &ExecuteRes{Stdout: res.stdout, Stderr: res.stderr, ExitCode: int32(res.exitCode), Truncated: res.truncated}, nil
+}
+
+func decodeControlRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*ControlReq)
+	return controlReq{uuid: req.GetUuid(), command: req.Command}, nil
+}
+
+func encodeControlResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return &ControlRes{}, nil
+}
+
+func decodePublishRequest(_ context.Context, grpcReq interface{}) (interface{}, error) {
+	req := grpcReq.(*PublishReq)
+	return pubReq{topic: req.Topic, payload: req.Payload}, nil
+}
+
+func encodePublishResponse(_ context.Context, _ interface{}) (interface{}, error) {
+	return &PublishRes{}, nil
+}
+
+func unaryAuthInterceptor(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := authorize(ctx, token); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+func streamAuthInterceptor(token string) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := authorize(ss.Context(), token); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// authorize checks the bearer token of the call. Empty token disables
+// authentication.
+func authorize(ctx context.Context, token string) error {
+	if token == "" {
+		return nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, header := range md.Get("authorization") {
+		if strings.HasPrefix(header, bearerPrefix) &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(header, bearerPrefix)), []byte(token)) == 1 {
+			return nil
+		}
+	}
+	return encodeError(api.ErrUnauthorizedAccess)
+}
+
+func encodeError(err error) error {
+	switch {
+	case errors.Contains(err, agent.ErrMalformedEntity),
+		errors.Contains(err, topic.ErrInvalidTopic),
+		errors.Contains(err, agent.ErrInvalidCommand),
+		errors.Contains(err, agent.ErrUnknownControlVerb),
+		errors.Contains(err, agent.ErrInvalidWorkDir),
+		errors.Contains(err, agent.ErrInvalidQueryParams):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Contains(err, api.ErrUnauthorizedAccess):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Contains(err, agent.ErrCommandNotAllowed),
+		errors.Contains(err, agent.ErrTopicNotAllowed),
+		errors.Contains(err, agent.ErrLockedDown):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Contains(err, agent.ErrConfigNotFound),
+		errors.Contains(err, agent.ErrNoSuchService),
+		errors.Contains(err, agent.ErrNoSuchExecution):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Contains(err, agent.ErrExecCancelled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Contains(err, api.ErrRateLimited),
+		errors.Contains(err, agent.ErrTooManyExecutions):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Contains(err, agent.ErrExecTimeout):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case errors.Contains(err, agent.ErrPublishFailed):
+		return status.Error(codes.Unavailable, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
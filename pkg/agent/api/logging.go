@@ -5,12 +5,22 @@ package api
 
 import (
 	"context"
+	"io"
 	"log/slog"
+	"strings"
 	"time"
 
 	"github.com/andychao217/agent/pkg/agent"
 )
 
+const redacted = "[redacted]"
+
+// Commands carrying secrets, mapped to the number of leading arguments safe to log.
+var secretCommands = map[string]int{
+	"rotate-credentials": 0,
+	"save":               2,
+}
+
 var _ agent.Service = (*loggingMiddleware)(nil)
 
 type loggingMiddleware struct {
@@ -23,40 +33,161 @@ func LoggingMiddleware(svc agent.Service, logger *slog.Logger) agent.Service {
 	return &loggingMiddleware{logger, svc}
 }
 
-func (lm loggingMiddleware) Publish(topic string, payload string) (err error) {
+// withRequestID appends request ID carried by the context to the log args.
+func withRequestID(ctx context.Context, args []any) []any {
+	if id := agent.RequestID(ctx); id != "" {
+		args = append(args, slog.String("request_id", id))
+	}
+	return args
+}
+
+func (lm loggingMiddleware) Publish(ctx context.Context, topic string, payload string, opts agent.PublishOpts) (err error) {
+	defer func(begin time.Time) {
+		args := withRequestID(ctx, []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("topic", topic),
+			slog.String("payload", payload),
+		})
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Publish message failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Publish message completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.Publish(ctx, topic, payload, opts)
+}
+
+func (lm loggingMiddleware) PublishWait(ctx context.Context, topic, payload string, timeout time.Duration) (err error) {
+	defer func(begin time.Time) {
+		args := withRequestID(ctx, []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("topic", topic),
+			slog.String("payload", payload),
+			slog.String("timeout", timeout.String()),
+		})
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Publish message with acknowledgment failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Publish message with acknowledgment completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.PublishWait(ctx, topic, payload, timeout)
+}
+
+func (lm loggingMiddleware) PublishTo(channelName, topic, payload string) (err error) {
 	defer func(begin time.Time) {
 		args := []any{
 			slog.String("duration", time.Since(begin).String()),
+			slog.String("channel", channelName),
 			slog.String("topic", topic),
 			slog.String("payload", payload),
 		}
 		if err != nil {
 			args = append(args, slog.Any("error", err))
-			lm.logger.Warn("Publish message failed to complete successfully.", args...)
+			lm.logger.Error("Publish message to channel failed to complete successfully.", args...)
 			return
 		}
-		lm.logger.Info("Publish message completed successfully.", args...)
+		lm.logger.Info("Publish message to channel completed successfully.", args...)
 	}(time.Now())
 
-	return lm.svc.Publish(topic, payload)
+	return lm.svc.PublishTo(channelName, topic, payload)
 }
 
-func (lm loggingMiddleware) Execute(uuid, cmd string) (str string, err error) {
+func (lm loggingMiddleware) Execute(ctx context.Context, uuid, cmd string) (str string, err error) {
+	defer func(begin time.Time) {
+		args := withRequestID(ctx, []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("uuid", uuid),
+			slog.String("cmd", cmd),
+		})
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Execute command failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Execute command completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.Execute(ctx, uuid, cmd)
+}
+
+func (lm loggingMiddleware) ExecuteStream(ctx context.Context, uuid, cmd, dir string, stdout, stderr io.Writer) (code int, err error) {
 	defer func(begin time.Time) {
 		args := []any{
 			slog.String("duration", time.Since(begin).String()),
 			slog.String("uuid", uuid),
 			slog.String("cmd", cmd),
+			slog.Int("exit_code", code),
 		}
 		if err != nil {
 			args = append(args, slog.Any("error", err))
-			lm.logger.Warn("Execute command failed to complete successfully.", args...)
+			lm.logger.Error("Execute stream command failed to complete successfully.", args...)
 			return
 		}
-		lm.logger.Info("Execute command completed successfully.", args...)
+		lm.logger.Info("Execute stream command completed successfully.", args...)
 	}(time.Now())
 
-	return lm.svc.Execute(uuid, cmd)
+	return lm.svc.ExecuteStream(ctx, uuid, cmd, dir, stdout, stderr)
+}
+
+func (lm loggingMiddleware) ExecuteResult(ctx context.Context, uuid, cmd, dir string) (res agent.ExecResult, err error) {
+	defer func(begin time.Time) {
+		args := withRequestID(ctx, []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("uuid", uuid),
+			slog.String("cmd", cmd),
+			slog.String("dir", dir),
+		})
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Execute command with result failed to complete successfully.", args...)
+			return
+		}
+		args = append(args, slog.Int("exit_code", res.ExitCode))
+		lm.logger.Info("Execute command with result completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.ExecuteResult(ctx, uuid, cmd, dir)
+}
+
+func (lm loggingMiddleware) ExecuteBatch(uuid string, cmds []string) (res []agent.ExecResult, err error) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("uuid", uuid),
+			slog.Any("cmds", cmds),
+			slog.Int("executed", len(res)),
+		}
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Execute batch of commands failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Execute batch of commands completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.ExecuteBatch(uuid, cmds)
+}
+
+func (lm loggingMiddleware) CancelExecute(uuid string) (err error) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("uuid", uuid),
+		}
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Cancel execute failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Cancel execute completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.CancelExecute(uuid)
 }
 
 func (lm loggingMiddleware) Control(uuid, cmd string) (err error) {
@@ -64,11 +195,11 @@ func (lm loggingMiddleware) Control(uuid, cmd string) (err error) {
 		args := []any{
 			slog.String("duration", time.Since(begin).String()),
 			slog.String("uuid", uuid),
-			slog.String("cmd", cmd),
+			slog.String("cmd", sanitizeCommand(cmd)),
 		}
 		if err != nil {
 			args = append(args, slog.Any("error", err))
-			lm.logger.Warn("Control command failed to complete successfully.", args...)
+			lm.logger.Error("Control command failed to complete successfully.", args...)
 			return
 		}
 		lm.logger.Info("Control command completed successfully.", args...)
@@ -77,19 +208,58 @@ func (lm loggingMiddleware) Control(uuid, cmd string) (err error) {
 	return lm.svc.Control(uuid, cmd)
 }
 
+func (lm loggingMiddleware) RegisterControl(verb string, h agent.ControlHandler) (err error) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("verb", verb),
+		}
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Register control failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Register control completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.RegisterControl(verb, h)
+}
+
 func (lm loggingMiddleware) AddConfig(c agent.Config) (err error) {
 	defer func(begin time.Time) {
-		duration := slog.String("duration", time.Since(begin).String())
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("file", c.File),
+			slog.Group("mqtt",
+				slog.String("url", c.MQTT.URL),
+				slog.String("username", c.MQTT.Username),
+				slog.String("password", redacted),
+			),
+		}
 		if err != nil {
-			lm.logger.Warn("Add config failed to complete successfully.", duration, slog.Any("error", err))
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Add config failed to complete successfully.", args...)
 			return
 		}
-		lm.logger.Info("Add config completed successfully.", duration)
+		lm.logger.Info("Add config completed successfully.", args...)
 	}(time.Now())
 
 	return lm.svc.AddConfig(c)
 }
 
+func (lm loggingMiddleware) UpdateConfig(patch agent.ConfigPatch) (err error) {
+	defer func(begin time.Time) {
+		duration := slog.String("duration", time.Since(begin).String())
+		if err != nil {
+			lm.logger.Error("Update config failed to complete successfully.", duration, slog.Any("error", err))
+			return
+		}
+		lm.logger.Info("Update config completed successfully.", duration)
+	}(time.Now())
+
+	return lm.svc.UpdateConfig(patch)
+}
+
 func (lm loggingMiddleware) Config() agent.Config {
 	defer func(begin time.Time) {
 		lm.logger.Info("Retrieve config completed successfully.", slog.String("duration", time.Since(begin).String()))
@@ -103,11 +273,11 @@ func (lm loggingMiddleware) ServiceConfig(ctx context.Context, uuid, cmdStr stri
 		args := []any{
 			slog.String("duration", time.Since(begin).String()),
 			slog.String("uuid", uuid),
-			slog.String("cmd", cmdStr),
+			slog.String("cmd", sanitizeCommand(cmdStr)),
 		}
 		if err != nil {
 			args = append(args, slog.Any("error", err))
-			lm.logger.Warn("Save config failed to complete successfully.", args...)
+			lm.logger.Error("Save config failed to complete successfully.", args...)
 			return
 		}
 		lm.logger.Info("Save config completed successfully.", args...)
@@ -116,6 +286,18 @@ func (lm loggingMiddleware) ServiceConfig(ctx context.Context, uuid, cmdStr stri
 	return lm.svc.ServiceConfig(ctx, uuid, cmdStr)
 }
 
+func (lm loggingMiddleware) Healthz() (hs agent.HealthStatus) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("status", hs.Status),
+		}
+		lm.logger.Info("Health check completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.Healthz()
+}
+
 func (lm loggingMiddleware) Services() []agent.Info {
 	defer func(begin time.Time) {
 		duration := slog.String("duration", time.Since(begin).String())
@@ -125,6 +307,90 @@ func (lm loggingMiddleware) Services() []agent.Info {
 	return lm.svc.Services()
 }
 
+func (lm loggingMiddleware) ServicesByStatus(status string) []agent.Info {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("status", status),
+		}
+		lm.logger.Info("Retrieve services by status completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.ServicesByStatus(status)
+}
+
+func (lm loggingMiddleware) RefreshServices() (err error) {
+	defer func(begin time.Time) {
+		duration := slog.String("duration", time.Since(begin).String())
+		if err != nil {
+			lm.logger.Error("Refresh services failed to complete successfully.", duration, slog.Any("error", err))
+			return
+		}
+		lm.logger.Info("Refresh services completed successfully.", duration)
+	}(time.Now())
+
+	return lm.svc.RefreshServices()
+}
+
+func (lm loggingMiddleware) QueueDepth() (depth int) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.Int("depth", depth),
+		}
+		lm.logger.Info("Retrieve queue depth completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.QueueDepth()
+}
+
+func (lm loggingMiddleware) FlushBatches() (err error) {
+	defer func(begin time.Time) {
+		duration := slog.String("duration", time.Since(begin).String())
+		if err != nil {
+			lm.logger.Error("Flush batches failed to complete successfully.", duration, slog.Any("error", err))
+			return
+		}
+		lm.logger.Info("Flush batches completed successfully.", duration)
+	}(time.Now())
+
+	return lm.svc.FlushBatches()
+}
+
+func (lm loggingMiddleware) ReapSessions() (n int, err error) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.Int("reaped", n),
+		}
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Reap terminal sessions failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Reap terminal sessions completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.ReapSessions()
+}
+
+func (lm loggingMiddleware) Service(id string) (info agent.Info, err error) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("id", id),
+		}
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Retrieve service failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Retrieve service completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.Service(id)
+}
+
 func (lm loggingMiddleware) Terminal(uuid, cmdStr string) (err error) {
 	defer func(begin time.Time) {
 		args := []any{
@@ -134,7 +400,7 @@ func (lm loggingMiddleware) Terminal(uuid, cmdStr string) (err error) {
 		}
 		if err != nil {
 			args = append(args, slog.Any("error", err))
-			lm.logger.Warn("Terminal failed to complete successfully.", args...)
+			lm.logger.Error("Terminal failed to complete successfully.", args...)
 			return
 		}
 		lm.logger.Info("Terminal completed successfully.", args...)
@@ -142,3 +408,90 @@ func (lm loggingMiddleware) Terminal(uuid, cmdStr string) (err error) {
 
 	return lm.svc.Terminal(uuid, cmdStr)
 }
+
+func (lm loggingMiddleware) AttachTerminal(ctx context.Context, uuid string, in io.Reader, out func(payload string) error) (err error) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("uuid", uuid),
+		}
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Attach terminal failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Attach terminal completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.AttachTerminal(ctx, uuid, in, out)
+}
+
+func (lm loggingMiddleware) RotateMQTTCredentials(creds agent.MQTTCredentials) (err error) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.String("username", creds.Username),
+		}
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Rotate MQTT credentials failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Rotate MQTT credentials completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.RotateMQTTCredentials(creds)
+}
+
+func (lm loggingMiddleware) Lockdown(disconnect bool) (err error) {
+	defer func(begin time.Time) {
+		args := []any{
+			slog.String("duration", time.Since(begin).String()),
+			slog.Bool("disconnect", disconnect),
+		}
+		if err != nil {
+			args = append(args, slog.Any("error", err))
+			lm.logger.Error("Lockdown failed to complete successfully.", args...)
+			return
+		}
+		lm.logger.Info("Lockdown completed successfully.", args...)
+	}(time.Now())
+
+	return lm.svc.Lockdown(disconnect)
+}
+
+func (lm loggingMiddleware) Unlock() (err error) {
+	defer func(begin time.Time) {
+		duration := slog.String("duration", time.Since(begin).String())
+		if err != nil {
+			lm.logger.Error("Unlock failed to complete successfully.", duration, slog.Any("error", err))
+			return
+		}
+		lm.logger.Info("Unlock completed successfully.", duration)
+	}(time.Now())
+
+	return lm.svc.Unlock()
+}
+
+func (lm loggingMiddleware) Reload() (changes []agent.FieldChange, err error) {
+	defer func(begin time.Time) {
+		duration := slog.String("duration", time.Since(begin).String())
+		if err != nil {
+			lm.logger.Error("Reload failed to complete successfully.", duration, slog.Any("error", err))
+			return
+		}
+		lm.logger.Info("Reload completed successfully.", duration, slog.Int("changes", len(changes)))
+	}(time.Now())
+
+	return lm.svc.Reload()
+}
+
+// sanitizeCommand redacts arguments of commands carrying secrets.
+func sanitizeCommand(cmd string) string {
+	args := strings.Split(strings.ReplaceAll(cmd, " ", ""), ",")
+	safe, ok := secretCommands[args[0]]
+	if !ok || len(args) <= safe+1 {
+		return cmd
+	}
+	return strings.Join(append(args[:safe+1], redacted), ",")
+}
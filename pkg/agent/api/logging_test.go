@@ -0,0 +1,89 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"testing"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errFailed = errors.New("failed")
+
+// service is embedded by stub services so that the stubs only need to
+// override the methods under test.
+type service = agent.Service
+
+// failingService fails every call it overrides.
+type failingService struct {
+	service
+}
+
+func (failingService) Execute(_ context.Context, uuid, cmd string) (string, error) {
+	return "", errFailed
+}
+
+func (failingService) Control(uuid, cmd string) error {
+	return errFailed
+}
+
+func (failingService) AddConfig(c agent.Config) error {
+	return errFailed
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	svc := api.LoggingMiddleware(failingService{}, logger)
+
+	cfg := agent.Config{}
+	cfg.MQTT.Username = "thing"
+	cfg.MQTT.Password = "secret-password"
+
+	cases := []struct {
+		desc string
+		call func() error
+	}{
+		{
+			desc: "execute",
+			call: func() error {
+				_, err := svc.Execute(context.Background(), "1", "ls,-la")
+				return err
+			},
+		},
+		{
+			desc: "control with secret arguments",
+			call: func() error {
+				return svc.Control("1", "rotate-credentials,dGhpbmc=,c2VjcmV0LXBhc3N3b3Jk")
+			},
+		},
+		{
+			desc: "add config",
+			call: func() error {
+				return svc.AddConfig(cfg)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		buf.Reset()
+		err := tc.call()
+		assert.True(t, errors.Contains(err, errFailed), fmt.Sprintf("%s: expected %s got %s", tc.desc, errFailed, err))
+
+		var entry map[string]any
+		require.Nil(t, json.Unmarshal(buf.Bytes(), &entry), fmt.Sprintf("%s: failed to decode log entry", tc.desc))
+		assert.Equal(t, slog.LevelError.String(), entry["level"], fmt.Sprintf("%s: expected error level", tc.desc))
+		assert.NotContains(t, buf.String(), "secret-password", fmt.Sprintf("%s: password leaked to log", tc.desc))
+		assert.NotContains(t, buf.String(), "c2VjcmV0LXBhc3N3b3Jk", fmt.Sprintf("%s: password leaked to log", tc.desc))
+	}
+}
@@ -8,59 +8,177 @@ package api
 
 import (
 	"context"
+	"io"
 	"time"
 
 	"github.com/andychao217/agent/pkg/agent"
 	"github.com/go-kit/kit/metrics"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
 )
 
+// LatencyBuckets are upper bounds of request latency buckets in seconds,
+// growing roughly exponentially from fast calls to long running commands.
+var LatencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
 var _ agent.Service = (*metricsMiddleware)(nil)
 
 type metricsMiddleware struct {
-	counter metrics.Counter
-	latency metrics.Histogram
-	svc     agent.Service
+	counter    metrics.Counter
+	errCounter metrics.Counter
+	latency    metrics.Histogram
+	svc        agent.Service
+}
+
+// NewLatencyHistogram returns Prometheus histogram of request latencies in
+// seconds, labeled by method and bucketed by LatencyBuckets, to be passed to
+// MetricsMiddleware. Histogram is registered with the default registry.
+func NewLatencyHistogram(namespace string) metrics.Histogram {
+	return kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "api",
+		Name:      "request_latency_seconds",
+		Help:      "Duration of requests in seconds.",
+		Buckets:   LatencyBuckets,
+	}, []string{"method"})
 }
 
-// MetricsMiddleware instruments core service by tracking request count and latency.
-func MetricsMiddleware(svc agent.Service, counter metrics.Counter, latency metrics.Histogram) agent.Service {
+// MetricsMiddleware instruments core service by tracking request count, failed
+// request count and latency, which is observed in seconds.
+func MetricsMiddleware(svc agent.Service, counter, errCounter metrics.Counter, latency metrics.Histogram) agent.Service {
 	return &metricsMiddleware{
-		svc:     svc,
-		counter: counter,
-		latency: latency,
+		svc:        svc,
+		counter:    counter,
+		errCounter: errCounter,
+		latency:    latency,
 	}
 }
 
-func (ms *metricsMiddleware) Execute(uuid, cmdStr string) (string, error) {
+// StatsMiddleware instruments core service by tracking request count, failed
+// request count and latency in stats.
+func StatsMiddleware(svc agent.Service, stats *Stats) agent.Service {
+	return MetricsMiddleware(
+		svc,
+		statsCounter{stats: stats},
+		statsCounter{stats: stats, errors: true},
+		statsHistogram{stats: stats},
+	)
+}
+
+func (ms *metricsMiddleware) Execute(ctx context.Context, uuid, cmdStr string) (_ string, err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "execute").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "execute").Add(1)
+		}
 		ms.latency.With("method", "execute").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return ms.svc.Execute(uuid, cmdStr)
+	return ms.svc.Execute(ctx, uuid, cmdStr)
+}
+
+func (ms *metricsMiddleware) ExecuteStream(ctx context.Context, uuid, cmdStr, dir string, stdout, stderr io.Writer) (code int, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "execute_stream").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "execute_stream").Add(1)
+		}
+		ms.latency.With("method", "execute_stream").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ExecuteStream(ctx, uuid, cmdStr, dir, stdout, stderr)
 }
 
-func (ms *metricsMiddleware) Control(uuid, cmdStr string) error {
+func (ms *metricsMiddleware) ExecuteResult(ctx context.Context, uuid, cmdStr, dir string) (_ agent.ExecResult, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "execute_result").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "execute_result").Add(1)
+		}
+		ms.latency.With("method", "execute_result").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ExecuteResult(ctx, uuid, cmdStr, dir)
+}
+
+func (ms *metricsMiddleware) ExecuteBatch(uuid string, cmds []string) (_ []agent.ExecResult, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "execute_batch").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "execute_batch").Add(1)
+		}
+		ms.latency.With("method", "execute_batch").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ExecuteBatch(uuid, cmds)
+}
+
+func (ms *metricsMiddleware) CancelExecute(uuid string) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "cancel_execute").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "cancel_execute").Add(1)
+		}
+		ms.latency.With("method", "cancel_execute").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.CancelExecute(uuid)
+}
+
+func (ms *metricsMiddleware) Control(uuid, cmdStr string) (err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "control").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "control").Add(1)
+		}
 		ms.latency.With("method", "control").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
 	return ms.svc.Control(uuid, cmdStr)
 }
 
-func (ms *metricsMiddleware) AddConfig(ec agent.Config) error {
+func (ms *metricsMiddleware) RegisterControl(verb string, h agent.ControlHandler) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "register_control").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "register_control").Add(1)
+		}
+		ms.latency.With("method", "register_control").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.RegisterControl(verb, h)
+}
+
+func (ms *metricsMiddleware) AddConfig(ec agent.Config) (err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "add_config").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "add_config").Add(1)
+		}
 		ms.latency.With("method", "add_config").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
 	return ms.svc.AddConfig(ec)
 }
 
-func (ms *metricsMiddleware) ServiceConfig(ctx context.Context, uuid, cmdStr string) error {
+func (ms *metricsMiddleware) UpdateConfig(patch agent.ConfigPatch) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "update_config").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "update_config").Add(1)
+		}
+		ms.latency.With("method", "update_config").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.UpdateConfig(patch)
+}
+
+func (ms *metricsMiddleware) ServiceConfig(ctx context.Context, uuid, cmdStr string) (err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "service_config").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "service_config").Add(1)
+		}
 		ms.latency.With("method", "service_config").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
@@ -76,6 +194,15 @@ func (ms *metricsMiddleware) Config() agent.Config {
 	return ms.svc.Config()
 }
 
+func (ms *metricsMiddleware) Healthz() agent.HealthStatus {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "healthz").Add(1)
+		ms.latency.With("method", "healthz").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.Healthz()
+}
+
 func (ms *metricsMiddleware) Services() []agent.Info {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "services").Add(1)
@@ -85,20 +212,176 @@ func (ms *metricsMiddleware) Services() []agent.Info {
 	return ms.svc.Services()
 }
 
-func (ms *metricsMiddleware) Publish(topic, payload string) error {
+func (ms *metricsMiddleware) ServicesByStatus(status string) []agent.Info {
 	defer func(begin time.Time) {
-		ms.counter.With("method", "publish").Add(1)
-		ms.latency.With("method", "publish").Observe(time.Since(begin).Seconds())
+		ms.counter.With("method", "services_by_status").Add(1)
+		ms.latency.With("method", "services_by_status").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return ms.svc.Publish(topic, payload)
+	return ms.svc.ServicesByStatus(status)
 }
 
-func (ms *metricsMiddleware) Terminal(topic, payload string) error {
+func (ms *metricsMiddleware) RefreshServices() (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "refresh_services").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "refresh_services").Add(1)
+		}
+		ms.latency.With("method", "refresh_services").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.RefreshServices()
+}
+
+func (ms *metricsMiddleware) QueueDepth() int {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "queue_depth").Add(1)
+		ms.latency.With("method", "queue_depth").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.QueueDepth()
+}
+
+func (ms *metricsMiddleware) FlushBatches() (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "flush_batches").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "flush_batches").Add(1)
+		}
+		ms.latency.With("method", "flush_batches").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.FlushBatches()
+}
+
+func (ms *metricsMiddleware) ReapSessions() (_ int, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "reap_sessions").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "reap_sessions").Add(1)
+		}
+		ms.latency.With("method", "reap_sessions").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.ReapSessions()
+}
+
+func (ms *metricsMiddleware) Service(id string) (_ agent.Info, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "service").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "service").Add(1)
+		}
+		ms.latency.With("method", "service").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.Service(id)
+}
+
+func (ms *metricsMiddleware) Publish(ctx context.Context, topic, payload string, opts agent.PublishOpts) (err error) {
 	defer func(begin time.Time) {
 		ms.counter.With("method", "publish").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "publish").Add(1)
+		}
 		ms.latency.With("method", "publish").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
+	return ms.svc.Publish(ctx, topic, payload, opts)
+}
+
+func (ms *metricsMiddleware) PublishWait(ctx context.Context, topic, payload string, timeout time.Duration) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "publish_wait").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "publish_wait").Add(1)
+		}
+		ms.latency.With("method", "publish_wait").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.PublishWait(ctx, topic, payload, timeout)
+}
+
+func (ms *metricsMiddleware) PublishTo(channelName, topic, payload string) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "publish_to").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "publish_to").Add(1)
+		}
+		ms.latency.With("method", "publish_to").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.PublishTo(channelName, topic, payload)
+}
+
+func (ms *metricsMiddleware) Terminal(topic, payload string) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "terminal").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "terminal").Add(1)
+		}
+		ms.latency.With("method", "terminal").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
 	return ms.svc.Terminal(topic, payload)
 }
+
+func (ms *metricsMiddleware) AttachTerminal(ctx context.Context, uuid string, in io.Reader, out func(payload string) error) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "attach_terminal").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "attach_terminal").Add(1)
+		}
+		ms.latency.With("method", "attach_terminal").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.AttachTerminal(ctx, uuid, in, out)
+}
+
+func (ms *metricsMiddleware) RotateMQTTCredentials(creds agent.MQTTCredentials) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "rotate_mqtt_credentials").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "rotate_mqtt_credentials").Add(1)
+		}
+		ms.latency.With("method", "rotate_mqtt_credentials").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.RotateMQTTCredentials(creds)
+}
+
+func (ms *metricsMiddleware) Lockdown(disconnect bool) (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "lockdown").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "lockdown").Add(1)
+		}
+		ms.latency.With("method", "lockdown").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.Lockdown(disconnect)
+}
+
+func (ms *metricsMiddleware) Unlock() (err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "unlock").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "unlock").Add(1)
+		}
+		ms.latency.With("method", "unlock").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.Unlock()
+}
+
+func (ms *metricsMiddleware) Reload() (changes []agent.FieldChange, err error) {
+	defer func(begin time.Time) {
+		ms.counter.With("method", "reload").Add(1)
+		if err != nil {
+			ms.errCounter.With("method", "reload").Add(1)
+		}
+		ms.latency.With("method", "reload").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return ms.svc.Reload()
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !test
+// +build !test
+
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/go-kit/kit/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder counts observations per label values.
+type recorder struct {
+	mu     *sync.Mutex
+	counts map[string]int
+	labels []string
+}
+
+func newRecorder() *recorder {
+	return &recorder{mu: &sync.Mutex{}, counts: map[string]int{}}
+}
+
+func (r *recorder) With(labelValues ...string) metrics.Counter {
+	return &recorder{mu: r.mu, counts: r.counts, labels: append(r.labels, labelValues...)}
+}
+
+func (r *recorder) Add(delta float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counts[strings.Join(r.labels, "=")]++
+}
+
+func (r *recorder) Observe(value float64) {
+	r.Add(value)
+}
+
+func (r *recorder) count(method string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts["method="+method]
+}
+
+// histogram adapts recorder to metrics.Histogram.
+type histogram struct {
+	*recorder
+}
+
+func (h histogram) With(labelValues ...string) metrics.Histogram {
+	return histogram{h.recorder.With(labelValues...).(*recorder)}
+}
+
+// terminalService succeeds on Terminal and Publish calls.
+type terminalService struct {
+	failingService
+}
+
+func (terminalService) Terminal(uuid, cmd string) error {
+	return nil
+}
+
+func (terminalService) Publish(_ context.Context, topic, payload string, _ agent.PublishOpts) error {
+	return nil
+}
+
+func TestMetricsMiddleware(t *testing.T) {
+	counter, errCounter, latency := newRecorder(), newRecorder(), newRecorder()
+	svc := api.MetricsMiddleware(terminalService{failingService{}}, counter, errCounter, histogram{latency})
+
+	err := svc.Terminal("1", "open")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.Execute(context.Background(), "1", "ls,-la")
+	assert.NotNil(t, err, "expected error from execute")
+	err = svc.AddConfig(agent.Config{})
+	assert.NotNil(t, err, "expected error from add config")
+
+	cases := []struct {
+		method string
+		count  int
+		errors int
+	}{
+		{method: "terminal", count: 1, errors: 0},
+		{method: "publish", count: 0, errors: 0},
+		{method: "execute", count: 1, errors: 1},
+		{method: "add_config", count: 1, errors: 1},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.count, counter.count(tc.method), fmt.Sprintf("%s: unexpected request count", tc.method))
+		assert.Equal(t, tc.count, latency.count(tc.method), fmt.Sprintf("%s: unexpected latency observations", tc.method))
+		assert.Equal(t, tc.errors, errCounter.count(tc.method), fmt.Sprintf("%s: unexpected error count", tc.method))
+	}
+}
+
+func TestNewLatencyHistogram(t *testing.T) {
+	h := api.NewLatencyHistogram("latency_test")
+	h.With("method", "execute").Observe(0.002)
+	h.With("method", "execute").Observe(100)
+
+	ts := httptest.NewServer(promhttp.Handler())
+	defer ts.Close()
+	res, err := ts.Client().Get(ts.URL)
+	require.Nil(t, err, fmt.Sprintf("unexpected error scraping metrics: %s", err))
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading metrics: %s", err))
+
+	buckets := []struct {
+		le    string
+		count int
+	}{
+		{"0.001", 0},
+		{"0.0025", 1},
+		{"60", 1},
+		{"120", 2},
+		{"300", 2},
+		{"+Inf", 2},
+	}
+	for _, b := range buckets {
+		line := fmt.Sprintf(`latency_test_api_request_latency_seconds_bucket{method="execute",le="%s"} %d`, b.le, b.count)
+		assert.Contains(t, string(body), line, fmt.Sprintf("expected bucket %s with %d observations", b.le, b.count))
+	}
+	assert.Equal(t, len(api.LatencyBuckets)+1, strings.Count(string(body), "latency_test_api_request_latency_seconds_bucket{"), "expected configured buckets")
+}
@@ -0,0 +1,208 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+// Rate limited methods.
+const (
+	ExecuteMethod  = "execute"
+	ControlMethod  = "control"
+	PublishMethod  = "publish"
+	TerminalMethod = "terminal"
+)
+
+// ErrRateLimited indicates that request is rejected since the rate limit is exceeded.
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+var _ agent.Service = (*rateLimitMiddleware)(nil)
+
+// RateLimitOption customizes rate limiting middleware.
+type RateLimitOption func(map[string]*rate.Limiter)
+
+// WithMethodLimit overrides rate limit of the method.
+func WithMethodLimit(method string, limit rate.Limit, burst int) RateLimitOption {
+	return func(limiters map[string]*rate.Limiter) {
+		limiters[method] = rate.NewLimiter(limit, burst)
+	}
+}
+
+// rateLimitMiddleware passes calls of the methods which aren't rate limited
+// straight through to the wrapped service.
+type rateLimitMiddleware struct {
+	limiters map[string]*rate.Limiter
+	svc      agent.Service
+}
+
+// RateLimitMiddleware limits the rate of high-cost service calls. Each of the rate
+// limited methods has its own limiter allowing limit calls per second with bursts
+// of up to burst calls, unless overridden by options.
+func RateLimitMiddleware(svc agent.Service, limit rate.Limit, burst int, opts ...RateLimitOption) agent.Service {
+	limiters := map[string]*rate.Limiter{}
+	for _, m := range []string{ExecuteMethod, ControlMethod, PublishMethod, TerminalMethod} {
+		limiters[m] = rate.NewLimiter(limit, burst)
+	}
+	for _, opt := range opts {
+		opt(limiters)
+	}
+	return &rateLimitMiddleware{
+		limiters: limiters,
+		svc:      svc,
+	}
+}
+
+func (rm *rateLimitMiddleware) Execute(ctx context.Context, uuid, cmdStr string) (string, error) {
+	if !rm.limiters[ExecuteMethod].Allow() {
+		return "", ErrRateLimited
+	}
+	return rm.svc.Execute(ctx, uuid, cmdStr)
+}
+
+// ExecuteStream shares the limiter with Execute.
+func (rm *rateLimitMiddleware) ExecuteStream(ctx context.Context, uuid, cmdStr, dir string, stdout, stderr io.Writer) (int, error) {
+	if !rm.limiters[ExecuteMethod].Allow() {
+		return 0, ErrRateLimited
+	}
+	return rm.svc.ExecuteStream(ctx, uuid, cmdStr, dir, stdout, stderr)
+}
+
+// ExecuteResult shares the limiter with Execute.
+func (rm *rateLimitMiddleware) ExecuteResult(ctx context.Context, uuid, cmdStr, dir string) (agent.ExecResult, error) {
+	if !rm.limiters[ExecuteMethod].Allow() {
+		return agent.ExecResult{}, ErrRateLimited
+	}
+	return rm.svc.ExecuteResult(ctx, uuid, cmdStr, dir)
+}
+
+// ExecuteBatch shares the limiter with Execute, taking a token per command.
+func (rm *rateLimitMiddleware) ExecuteBatch(uuid string, cmds []string) ([]agent.ExecResult, error) {
+	if !rm.limiters[ExecuteMethod].AllowN(time.Now(), len(cmds)) {
+		return nil, ErrRateLimited
+	}
+	return rm.svc.ExecuteBatch(uuid, cmds)
+}
+
+// CancelExecute isn't limited, so runaway commands can always be stopped.
+func (rm *rateLimitMiddleware) CancelExecute(uuid string) error {
+	return rm.svc.CancelExecute(uuid)
+}
+
+func (rm *rateLimitMiddleware) Control(uuid, cmdStr string) error {
+	if !rm.limiters[ControlMethod].Allow() {
+		return ErrRateLimited
+	}
+	return rm.svc.Control(uuid, cmdStr)
+}
+
+func (rm *rateLimitMiddleware) RegisterControl(verb string, h agent.ControlHandler) error {
+	return rm.svc.RegisterControl(verb, h)
+}
+
+func (rm *rateLimitMiddleware) Publish(ctx context.Context, topic, payload string, opts agent.PublishOpts) error {
+	if !rm.limiters[PublishMethod].Allow() {
+		return ErrRateLimited
+	}
+	return rm.svc.Publish(ctx, topic, payload, opts)
+}
+
+func (rm *rateLimitMiddleware) PublishWait(ctx context.Context, topic, payload string, timeout time.Duration) error {
+	if !rm.limiters[PublishMethod].Allow() {
+		return ErrRateLimited
+	}
+	return rm.svc.PublishWait(ctx, topic, payload, timeout)
+}
+
+func (rm *rateLimitMiddleware) PublishTo(channelName, topic, payload string) error {
+	if !rm.limiters[PublishMethod].Allow() {
+		return ErrRateLimited
+	}
+	return rm.svc.PublishTo(channelName, topic, payload)
+}
+
+func (rm *rateLimitMiddleware) Terminal(uuid, cmdStr string) error {
+	if !rm.limiters[TerminalMethod].Allow() {
+		return ErrRateLimited
+	}
+	return rm.svc.Terminal(uuid, cmdStr)
+}
+
+// AttachTerminal shares the limiter with Terminal.
+func (rm *rateLimitMiddleware) AttachTerminal(ctx context.Context, uuid string, in io.Reader, out func(payload string) error) error {
+	if !rm.limiters[TerminalMethod].Allow() {
+		return ErrRateLimited
+	}
+	return rm.svc.AttachTerminal(ctx, uuid, in, out)
+}
+
+func (rm *rateLimitMiddleware) AddConfig(c agent.Config) error {
+	return rm.svc.AddConfig(c)
+}
+
+func (rm *rateLimitMiddleware) UpdateConfig(patch agent.ConfigPatch) error {
+	return rm.svc.UpdateConfig(patch)
+}
+
+func (rm *rateLimitMiddleware) Config() agent.Config {
+	return rm.svc.Config()
+}
+
+func (rm *rateLimitMiddleware) ServiceConfig(ctx context.Context, uuid, cmdStr string) error {
+	return rm.svc.ServiceConfig(ctx, uuid, cmdStr)
+}
+
+func (rm *rateLimitMiddleware) Services() []agent.Info {
+	return rm.svc.Services()
+}
+
+func (rm *rateLimitMiddleware) ServicesByStatus(status string) []agent.Info {
+	return rm.svc.ServicesByStatus(status)
+}
+
+func (rm *rateLimitMiddleware) RefreshServices() error {
+	return rm.svc.RefreshServices()
+}
+
+func (rm *rateLimitMiddleware) QueueDepth() int {
+	return rm.svc.QueueDepth()
+}
+
+func (rm *rateLimitMiddleware) FlushBatches() error {
+	return rm.svc.FlushBatches()
+}
+
+func (rm *rateLimitMiddleware) ReapSessions() (int, error) {
+	return rm.svc.ReapSessions()
+}
+
+func (rm *rateLimitMiddleware) Service(id string) (agent.Info, error) {
+	return rm.svc.Service(id)
+}
+
+func (rm *rateLimitMiddleware) RotateMQTTCredentials(creds agent.MQTTCredentials) error {
+	return rm.svc.RotateMQTTCredentials(creds)
+}
+
+func (rm *rateLimitMiddleware) Lockdown(disconnect bool) error {
+	return rm.svc.Lockdown(disconnect)
+}
+
+func (rm *rateLimitMiddleware) Unlock() error {
+	return rm.svc.Unlock()
+}
+
+func (rm *rateLimitMiddleware) Reload() ([]agent.FieldChange, error) {
+	return rm.svc.Reload()
+}
+
+func (rm *rateLimitMiddleware) Healthz() agent.HealthStatus {
+	return rm.svc.Healthz()
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+)
+
+// okService succeeds on every rate limited call.
+type okService struct {
+	service
+}
+
+func (okService) Execute(_ context.Context, uuid, cmd string) (string, error) {
+	return "", nil
+}
+
+func (okService) Control(uuid, cmd string) error {
+	return nil
+}
+
+func (okService) Publish(_ context.Context, topic, payload string, _ agent.PublishOpts) error {
+	return nil
+}
+
+func (okService) Terminal(uuid, cmd string) error {
+	return nil
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	const window = 100 * time.Millisecond
+	svc := api.RateLimitMiddleware(okService{}, rate.Every(window), 2, api.WithMethodLimit(api.PublishMethod, rate.Inf, 0))
+
+	for i := 0; i < 2; i++ {
+		_, err := svc.Execute(context.Background(), "1", "ls")
+		assert.Nil(t, err, fmt.Sprintf("call %d: unexpected error: %s", i, err))
+	}
+	_, err := svc.Execute(context.Background(), "1", "ls")
+	assert.True(t, errors.Contains(err, api.ErrRateLimited), fmt.Sprintf("expected %s got %s", api.ErrRateLimited, err))
+
+	// Limiters are independent per method.
+	err = svc.Terminal("1", "open")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	for i := 0; i < 10; i++ {
+		err := svc.Publish(context.Background(), "topic", "payload", agent.PublishOpts{})
+		assert.Nil(t, err, fmt.Sprintf("publish %d: unexpected error: %s", i, err))
+	}
+
+	time.Sleep(window + window/2)
+	_, err = svc.Execute(context.Background(), "1", "ls")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error after the window: %s", err))
+}
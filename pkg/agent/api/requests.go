@@ -5,15 +5,52 @@ package api
 
 import (
 	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/topic"
 )
 
 type pubReq struct {
 	Topic   string `json:"topic"`
 	Payload string `json:"payload"`
+	agent.PublishOpts
 }
 
 func (req pubReq) validate() error {
-	if req.Topic == "" || req.Payload == "" {
+	if req.Payload == "" {
+		return agent.ErrMalformedEntity
+	}
+	if err := req.PublishOpts.Validate(); err != nil {
+		return err
+	}
+
+	return topic.Validate(req.Topic)
+}
+
+type cancelExecReq struct {
+	uuid string
+}
+
+func (req cancelExecReq) validate() error {
+	if req.uuid == "" {
+		return agent.ErrMalformedEntity
+	}
+
+	return nil
+}
+
+type viewConfigReq struct {
+	full bool
+}
+
+type viewServicesReq struct {
+	status string
+}
+
+type viewServiceReq struct {
+	id string
+}
+
+func (req viewServiceReq) validate() error {
+	if req.id == "" {
 		return agent.ErrMalformedEntity
 	}
 
@@ -24,6 +61,7 @@ type execReq struct {
 	BaseName string `json:"bn"`
 	Name     string `json:"n"`
 	Value    string `json:"vs"`
+	Dir      string `json:"dir,omitempty"`
 }
 
 func (req execReq) validate() error {
@@ -34,8 +72,40 @@ func (req execReq) validate() error {
 	return nil
 }
 
+type execBatchReq struct {
+	BaseName string   `json:"bn"`
+	Name     string   `json:"n"`
+	Commands []string `json:"cmds"`
+}
+
+func (req execBatchReq) validate() error {
+	if req.BaseName == "" || req.Name != "exec" || len(req.Commands) == 0 {
+		return agent.ErrMalformedEntity
+	}
+	for _, cmd := range req.Commands {
+		if cmd == "" {
+			return agent.ErrMalformedEntity
+		}
+	}
+
+	return nil
+}
+
+type updateConfigReq struct {
+	agent.ConfigPatch
+}
+
+func (req updateConfigReq) validate() error {
+	if req.Empty() {
+		return agent.ErrMalformedEntity
+	}
+
+	return nil
+}
+
 type addConfigReq struct {
-	Agent agentConfig
+	Agent          agentConfig
+	IdempotencyKey string `json:"idempotency_key"`
 }
 
 func (req addConfigReq) validate() error {
@@ -3,13 +3,33 @@
 
 package api
 
+import "github.com/andychao217/agent/pkg/agent"
+
+type errorRes struct {
+	Err string `json:"error"`
+}
+
 type genericRes struct {
 	Service  string `json:"service"`
 	Response string `json:"response"`
 }
 
 type execRes struct {
-	BaseName string `json:"bn"`
-	Name     string `json:"n"`
-	Value    string `json:"vs"`
+	BaseName  string `json:"bn"`
+	Name      string `json:"n"`
+	Value     string `json:"vs"`
+	Stderr    string `json:"stderr"`
+	ExitCode  int    `json:"exit_code"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+type execBatchRes struct {
+	BaseName string             `json:"bn"`
+	Name     string             `json:"n"`
+	Results  []agent.ExecResult `json:"results"`
+}
+
+type reloadConfigRes struct {
+	Service string              `json:"service"`
+	Changes []agent.FieldChange `json:"changes"`
 }
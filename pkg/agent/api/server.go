@@ -0,0 +1,44 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// ShutdownTimeout bounds the time in-flight requests are given to complete
+// once the server is stopped.
+const ShutdownTimeout = 5 * time.Second
+
+// RunServer serves handler on addr until the context is cancelled, then shuts
+// the server down gracefully, waiting for in-flight requests to complete for
+// up to ShutdownTimeout. It returns the listen error, if any.
+func RunServer(ctx context.Context, handler http.Handler, addr string) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+		if err := <-errCh; err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestRunServer(t *testing.T) {
+	started := make(chan struct{})
+	var completed atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		completed.Store(true)
+		w.WriteHeader(http.StatusOK)
+	})
+
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- api.RunServer(ctx, handler, addr)
+	}()
+
+	res := make(chan int, 1)
+	go func() {
+		var resp *http.Response
+		var err error
+		// Retry until the server is listening.
+		for i := 0; i < 50; i++ {
+			if resp, err = http.Get(fmt.Sprintf("http://%s/exec", addr)); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			res <- 0
+			return
+		}
+		resp.Body.Close()
+		res <- resp.StatusCode
+	}()
+
+	select {
+	case <-started:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request didn't reach the server")
+	}
+	cancel()
+
+	err := <-done
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.True(t, completed.Load(), "expected in-flight request to complete before shutdown returned")
+	assert.Equal(t, http.StatusOK, <-res, "expected in-flight request to succeed")
+}
+
+func TestRunServerListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	defer ln.Close()
+
+	err = api.RunServer(context.Background(), http.NotFoundHandler(), ln.Addr().String())
+	assert.NotNil(t, err, "expected listen error for address in use")
+}
@@ -0,0 +1,173 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// statsWindow is the number of the latest latencies per method the
+// percentiles are computed from.
+const statsWindow = 1024
+
+// DefaultStats is the summary served on /stats.
+var DefaultStats = NewStats()
+
+// MethodStats is the summary of calls of a service method. Percentiles are
+// latencies in seconds.
+type MethodStats struct {
+	Calls  uint64  `json:"calls"`
+	Errors uint64  `json:"errors"`
+	P50    float64 `json:"p50"`
+	P95    float64 `json:"p95"`
+	P99    float64 `json:"p99"`
+}
+
+// Stats keeps per method call counts, error counts and latencies in memory,
+// to be summarized without a Prometheus scraper.
+type Stats struct {
+	mu      sync.Mutex
+	methods map[string]*methodStats
+}
+
+type methodStats struct {
+	calls     uint64
+	errors    uint64
+	latencies []float64
+	next      int
+}
+
+// NewStats returns empty stats.
+func NewStats() *Stats {
+	return &Stats{methods: map[string]*methodStats{}}
+}
+
+// Summary returns the stats of the methods called so far.
+func (s *Stats) Summary() map[string]MethodStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	summary := make(map[string]MethodStats, len(s.methods))
+	for method, ms := range s.methods {
+		latencies := append([]float64(nil), ms.latencies...)
+		sort.Float64s(latencies)
+		summary[method] = MethodStats{
+			Calls:  ms.calls,
+			Errors: ms.errors,
+			P50:    percentile(latencies, 50),
+			P95:    percentile(latencies, 95),
+			P99:    percentile(latencies, 99),
+		}
+	}
+	return summary
+}
+
+func (s *Stats) method(name string) *methodStats {
+	ms, ok := s.methods[name]
+	if !ok {
+		ms = &methodStats{}
+		s.methods[name] = ms
+	}
+	return ms
+}
+
+func (s *Stats) addCall(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.method(method).calls++
+}
+
+func (s *Stats) addError(method string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.method(method).errors++
+}
+
+func (s *Stats) observe(method string, latency float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := s.method(method)
+	if len(ms.latencies) < statsWindow {
+		ms.latencies = append(ms.latencies, latency)
+		return
+	}
+	ms.latencies[ms.next] = latency
+	ms.next = (ms.next + 1) % statsWindow
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	return sorted[max(rank, 1)-1]
+}
+
+var (
+	_ metrics.Counter   = (*statsCounter)(nil)
+	_ metrics.Histogram = (*statsHistogram)(nil)
+)
+
+// statsCounter counts the calls, or the errors, of the method it's labeled
+// with, to be passed to MetricsMiddleware.
+type statsCounter struct {
+	stats  *Stats
+	method string
+	errors bool
+}
+
+func (c statsCounter) With(labelValues ...string) metrics.Counter {
+	c.method = methodLabel(c.method, labelValues)
+	return c
+}
+
+func (c statsCounter) Add(float64) {
+	if c.errors {
+		c.stats.addError(c.method)
+		return
+	}
+	c.stats.addCall(c.method)
+}
+
+// statsHistogram records the latencies of the method it's labeled with, to
+// be passed to MetricsMiddleware.
+type statsHistogram struct {
+	stats  *Stats
+	method string
+}
+
+func (h statsHistogram) With(labelValues ...string) metrics.Histogram {
+	h.method = methodLabel(h.method, labelValues)
+	return h
+}
+
+func (h statsHistogram) Observe(value float64) {
+	h.stats.observe(h.method, value)
+}
+
+func methodLabel(method string, labelValues []string) string {
+	for i := 0; i+1 < len(labelValues); i += 2 {
+		if labelValues[i] == "method" {
+			method = labelValues[i+1]
+		}
+	}
+	return method
+}
+
+// StatsHandler serves the stats summary as JSON object keyed by method.
+func StatsHandler(stats *Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		if err := json.NewEncoder(w).Encode(stats.Summary()); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+}
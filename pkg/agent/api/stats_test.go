@@ -0,0 +1,74 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !test
+// +build !test
+
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowService takes delay to run the control commands and fails the rest.
+type slowService struct {
+	failingService
+	delay time.Duration
+}
+
+func (s slowService) Control(uuid, cmd string) error {
+	time.Sleep(s.delay)
+	return nil
+}
+
+func TestStatsMiddleware(t *testing.T) {
+	stats := api.NewStats()
+	for i := 0; i < 3; i++ {
+		_, err := api.StatsMiddleware(failingService{}, stats).Execute(context.Background(), "1", "ls,-la")
+		assert.NotNil(t, err, "expected error from execute")
+	}
+	// Every 20th call is slow, so only the 99th percentile is.
+	for i := 0; i < 40; i++ {
+		delay := time.Duration(0)
+		if i%20 == 0 {
+			delay = 50 * time.Millisecond
+		}
+		err := api.StatsMiddleware(slowService{delay: delay}, stats).Control("1", "nodered-deploy")
+		assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+
+	ts := httptest.NewServer(api.StatsHandler(stats))
+	defer ts.Close()
+	res, err := ts.Client().Get(ts.URL)
+	require.Nil(t, err, fmt.Sprintf("unexpected error getting stats: %s", err))
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	var summary map[string]api.MethodStats
+	err = json.NewDecoder(res.Body).Decode(&summary)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding stats: %s", err))
+	assert.Len(t, summary, 2, "expected stats of called methods only")
+
+	execute := summary["execute"]
+	assert.Equal(t, uint64(3), execute.Calls, "unexpected execute calls")
+	assert.Equal(t, uint64(3), execute.Errors, "unexpected execute errors")
+
+	control := summary["control"]
+	assert.Equal(t, uint64(40), control.Calls, "unexpected control calls")
+	assert.Equal(t, uint64(0), control.Errors, "unexpected control errors")
+	assert.Less(t, control.P50, 0.025, "expected fast median")
+	assert.Less(t, control.P95, 0.025, "expected fast 95th percentile")
+	assert.GreaterOrEqual(t, control.P99, 0.05, "expected slow 99th percentile")
+	assert.LessOrEqual(t, control.P50, control.P95)
+	assert.LessOrEqual(t, control.P95, control.P99)
+}
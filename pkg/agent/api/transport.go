@@ -6,59 +6,222 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 
 	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/topic"
 	"github.com/andychao217/magistrala"
+	"github.com/andychao217/magistrala/pkg/errors"
 	"github.com/go-zoo/bone"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"net/http"
+	"strconv"
 
 	kithttp "github.com/go-kit/kit/transport/http"
 )
 
-// MakeHandler returns a HTTP handler for API endpoints.
-func MakeHandler(svc agent.Service) http.Handler {
+const (
+	contentType       = "application/json"
+	healthContentType = "application/health+json"
+	requestIDHeader   = "X-Request-ID"
+
+	configDownloadFile = "agent-config.json"
+)
+
+// HandlerOption configures the handler returned by MakeHandler.
+type HandlerOption func(*handlerConfig)
+
+type handlerConfig struct {
+	metrics bool
+	health  bool
+	origins []string
+}
+
+// WithCORSOrigins allows WebSocket terminal connections from the CORS allowed
+// origins, as CORSHandler doesn't apply to them.
+func WithCORSOrigins(origins []string) HandlerOption {
+	return func(hc *handlerConfig) {
+		hc.origins = origins
+	}
+}
+
+// WithoutMetrics disables the /metrics endpoint.
+func WithoutMetrics() HandlerOption {
+	return func(hc *handlerConfig) {
+		hc.metrics = false
+	}
+}
+
+// WithoutHealth disables the /health endpoint.
+func WithoutHealth() HandlerOption {
+	return func(hc *handlerConfig) {
+		hc.health = false
+	}
+}
+
+// MakeHandler returns a HTTP handler for API endpoints, configured with the
+// handler options. If authToken isn't empty, all the endpoints except
+// /health, /metrics and /stats require it as a bearer token. GET /config
+// returns the config without secrets, unless the full one is requested with
+// ?full=true, which requires the bearer token. GET /config/download returns
+// the same config as JSON file attachment. Disabled endpoints respond with
+// 404 Not Found.
+func MakeHandler(svc agent.Service, authToken string, options ...HandlerOption) http.Handler {
+	hc := handlerConfig{metrics: true, health: true}
+	for _, o := range options {
+		o(&hc)
+	}
+
+	opts := []kithttp.ServerOption{
+		kithttp.ServerErrorEncoder(encodeError),
+		kithttp.ServerBefore(decodeRequestID),
+		kithttp.ServerAfter(encodeRequestID),
+	}
+
 	r := bone.New()
 
-	r.Post("/pub", kithttp.NewServer(
+	r.Post("/pub", authHandler(authToken, kithttp.NewServer(
 		pubEndpoint(svc),
 		decodePublishRequest,
 		encodeResponse,
-	))
+		opts...,
+	)))
 
-	r.Post("/exec", kithttp.NewServer(
+	r.Post("/exec", authHandler(authToken, kithttp.NewServer(
 		execEndpoint(svc),
 		decodeExecRequest,
 		encodeResponse,
-	))
+		opts...,
+	)))
+
+	r.Post("/exec/batch", authHandler(authToken, kithttp.NewServer(
+		execBatchEndpoint(svc),
+		decodeExecBatchRequest,
+		encodeResponse,
+		opts...,
+	)))
+
+	r.Post("/exec/stream", authHandler(authToken, execStreamHandler(svc)))
+
+	r.Delete("/exec/:uuid", authHandler(authToken, kithttp.NewServer(
+		cancelExecEndpoint(svc),
+		decodeCancelExecRequest,
+		encodeResponse,
+		opts...,
+	)))
 
-	r.Post("/config", kithttp.NewServer(
+	r.Post("/config", authHandler(authToken, kithttp.NewServer(
 		addConfigEndpoint(svc),
 		decodeAddConfigRequest,
 		encodeResponse,
-	))
+		opts...,
+	)))
 
-	r.Get("/config", kithttp.NewServer(
-		viewConfigEndpoint(svc),
-		decodeRequest,
+	updateConfig := authHandler(authToken, kithttp.NewServer(
+		updateConfigEndpoint(svc),
+		decodeUpdateConfigRequest,
 		encodeResponse,
+		opts...,
 	))
+	r.Put("/config", updateConfig)
+	r.Patch("/config", updateConfig)
+
+	r.Post("/config/reload", authHandler(authToken, kithttp.NewServer(
+		reloadConfigEndpoint(svc),
+		kithttp.NopRequestDecoder,
+		encodeResponse,
+		opts...,
+	)))
+
+	r.Get("/config", authHandler(authToken, kithttp.NewServer(
+		viewConfigEndpoint(svc, authToken != ""),
+		decodeViewConfigRequest,
+		encodeResponse,
+		opts...,
+	)))
+
+	r.Get("/config/download", authHandler(authToken, kithttp.NewServer(
+		viewConfigEndpoint(svc, authToken != ""),
+		decodeViewConfigRequest,
+		encodeConfigDownload,
+		opts...,
+	)))
 
-	r.Get("/services", kithttp.NewServer(
+	r.Get("/services", authHandler(authToken, kithttp.NewServer(
 		viewServicesEndpoint(svc),
-		decodeRequest,
+		decodeViewServicesRequest,
 		encodeResponse,
-	))
+		opts...,
+	)))
+
+	r.Post("/services/refresh", authHandler(authToken, kithttp.NewServer(
+		refreshServicesEndpoint(svc),
+		kithttp.NopRequestDecoder,
+		encodeResponse,
+		opts...,
+	)))
 
-	r.Handle("/metrics", promhttp.Handler())
-	r.GetFunc("/health", magistrala.Health("agent", ""))
+	r.Get("/services/:id", authHandler(authToken, kithttp.NewServer(
+		viewServiceEndpoint(svc),
+		decodeViewServiceRequest,
+		encodeResponse,
+		opts...,
+	)))
+
+	r.Get("/terminal/ws", tokenHandler(authToken, wsToken, terminalHandler(svc, hc.origins)))
+
+	if hc.metrics {
+		r.Handle("/metrics", promhttp.Handler())
+	}
+	r.Get("/stats", StatsHandler(DefaultStats))
+	if hc.health {
+		r.Get("/health", healthHandler(svc))
+		r.Head("/health", healthHandler(svc))
+	}
 
 	return r
 }
 
-func decodeRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return nil, nil
+// decodeRequestID puts ID of the request into the context, generating a new
+// one if the request doesn't carry X-Request-ID header.
+func decodeRequestID(ctx context.Context, r *http.Request) context.Context {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = uuid.NewString()
+	}
+	return agent.WithRequestID(ctx, id)
+}
+
+func encodeRequestID(ctx context.Context, w http.ResponseWriter) context.Context {
+	if id := agent.RequestID(ctx); id != "" {
+		w.Header().Set(requestIDHeader, id)
+	}
+	return ctx
+}
+
+func decodeCancelExecRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return cancelExecReq{uuid: bone.GetValue(r, "uuid")}, nil
+}
+
+func decodeViewConfigRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := viewConfigReq{}
+	if full := r.URL.Query().Get("full"); full != "" {
+		var err error
+		if req.full, err = strconv.ParseBool(full); err != nil {
+			return nil, errors.Wrap(agent.ErrInvalidQueryParams, err)
+		}
+	}
+	return req, nil
+}
+
+func decodeViewServicesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return viewServicesReq{status: r.URL.Query().Get("status")}, nil
+}
+
+func decodeViewServiceRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return viewServiceReq{id: bone.GetValue(r, "id")}, nil
 }
 
 func decodePublishRequest(_ context.Context, r *http.Request) (interface{}, error) {
@@ -79,6 +242,15 @@ func decodeExecRequest(_ context.Context, r *http.Request) (interface{}, error)
 	return req, nil
 }
 
+func decodeExecBatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := execBatchReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+
+	return req, nil
+}
+
 func decodeAddConfigRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	req := addConfigReq{}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -88,6 +260,105 @@ func decodeAddConfigRequest(_ context.Context, r *http.Request) (interface{}, er
 	return req, nil
 }
 
+func decodeUpdateConfigRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	req := updateConfigReq{}
+	if err := json.NewDecoder(r.Body).Decode(&req.ConfigPatch); err != nil {
+		return nil, errors.Wrap(agent.ErrMalformedEntity, err)
+	}
+
+	return req, nil
+}
+
 func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
 	return json.NewEncoder(w).Encode(response)
 }
+
+// encodeConfigDownload encodes the config as indented JSON, served as the
+// file attachment.
+func encodeConfigDownload(_ context.Context, w http.ResponseWriter, response interface{}) error {
+	data, err := json.MarshalIndent(response, "", "  ")
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", configDownloadFile))
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	encodeRequestID(ctx, w)
+	w.Header().Set("Content-Type", contentType)
+	switch {
+	// Rejected config wraps the validation error, so it's checked first.
+	case errors.Contains(err, agent.ErrConfigRejected):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Contains(err, agent.ErrMalformedEntity),
+		errors.Contains(err, agent.ErrInvalidConfig),
+		errors.Contains(err, topic.ErrInvalidTopic),
+		errors.Contains(err, agent.ErrInvalidCommand),
+		errors.Contains(err, agent.ErrUnknownControlVerb),
+		errors.Contains(err, agent.ErrInvalidWorkDir),
+		errors.Contains(err, agent.ErrInvalidQueryParams):
+		w.WriteHeader(http.StatusBadRequest)
+	case errors.Contains(err, ErrUnauthorizedAccess):
+		w.WriteHeader(http.StatusUnauthorized)
+	case errors.Contains(err, agent.ErrCommandNotAllowed),
+		errors.Contains(err, agent.ErrTopicNotAllowed),
+		errors.Contains(err, agent.ErrLockedDown),
+		errors.Contains(err, ErrUnauthenticatedAPI):
+		w.WriteHeader(http.StatusForbidden)
+	case errors.Contains(err, agent.ErrConfigNotFound),
+		errors.Contains(err, agent.ErrNoSuchService),
+		errors.Contains(err, agent.ErrNoSuchExecution):
+		w.WriteHeader(http.StatusNotFound)
+	case errors.Contains(err, agent.ErrExecCancelled):
+		w.WriteHeader(http.StatusConflict)
+	case errors.Contains(err, ErrRateLimited),
+		errors.Contains(err, agent.ErrTooManyExecutions):
+		w.WriteHeader(http.StatusTooManyRequests)
+	case errors.Contains(err, agent.ErrExecTimeout):
+		w.WriteHeader(http.StatusGatewayTimeout)
+	case errors.Contains(err, agent.ErrPublishFailed):
+		w.WriteHeader(http.StatusBadGateway)
+	default:
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	if err := json.NewEncoder(w).Encode(errorRes{Err: err.Error()}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+// healthInfo extends magistrala.HealthInfo with the status of the agent dependencies.
+type healthInfo struct {
+	magistrala.HealthInfo
+	Dependencies map[string]agent.DependencyStatus `json:"dependencies"`
+}
+
+// healthHandler reports health of the agent, responding with 503 if any of its
+// critical dependencies is down.
+func healthHandler(svc agent.Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hs := svc.Healthz()
+		res := healthInfo{
+			HealthInfo: magistrala.HealthInfo{
+				Status:      hs.Status,
+				Version:     magistrala.Version,
+				Commit:      magistrala.Commit,
+				Description: "agent service",
+				BuildTime:   magistrala.BuildTime,
+			},
+			Dependencies: hs.Dependencies,
+		}
+
+		w.Header().Set("Content-Type", healthContentType)
+		status := http.StatusOK
+		if !hs.Healthy() {
+			status = http.StatusServiceUnavailable
+		}
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
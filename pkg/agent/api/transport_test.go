@@ -0,0 +1,990 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/api"
+	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/agent/pkg/terminal"
+	"github.com/andychao217/agent/pkg/topic"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// resultService returns the configured execution result.
+type resultService struct {
+	service
+	res agent.ExecResult
+}
+
+func (s resultService) ExecuteResult(_ context.Context, uuid, cmd, dir string) (agent.ExecResult, error) {
+	return s.res, nil
+}
+
+// healthService reports the configured health status.
+type healthService struct {
+	service
+	hs agent.HealthStatus
+}
+
+func (s healthService) Healthz() agent.HealthStatus {
+	return s.hs
+}
+
+// patchService records the config patch.
+type patchService struct {
+	service
+	patch *agent.ConfigPatch
+}
+
+func (s patchService) UpdateConfig(patch agent.ConfigPatch) error {
+	*s.patch = patch
+	return nil
+}
+
+// servicesService knows an online and an offline service.
+type servicesService struct {
+	service
+}
+
+var serviceInfos = []agent.Info{
+	{Name: "export", Status: "online", Type: "export", Version: "0.1.0", PID: 42, LastStartedAt: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	{Name: "duster", Status: "offline", Type: "test"},
+}
+
+func (servicesService) Services() []agent.Info {
+	return serviceInfos
+}
+
+func (servicesService) ServicesByStatus(status string) []agent.Info {
+	infos := []agent.Info{}
+	for _, info := range serviceInfos {
+		if info.Status == status {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
+func (servicesService) Service(id string) (agent.Info, error) {
+	if id != "export" {
+		return agent.Info{}, agent.ErrNoSuchService
+	}
+	return serviceInfos[0], nil
+}
+
+// errService fails ExecuteResult with the configured error.
+type errService struct {
+	service
+	err error
+}
+
+func (s errService) ExecuteResult(_ context.Context, uuid, cmd, dir string) (agent.ExecResult, error) {
+	return agent.ExecResult{}, s.err
+}
+
+func TestEncodeError(t *testing.T) {
+	cases := []struct {
+		desc   string
+		err    error
+		status int
+	}{
+		{"invalid command", agent.ErrInvalidCommand, http.StatusBadRequest},
+		{"invalid working directory", agent.ErrInvalidWorkDir, http.StatusBadRequest},
+		{"command not allowed", agent.ErrCommandNotAllowed, http.StatusForbidden},
+		{"locked down", agent.ErrLockedDown, http.StatusForbidden},
+		{"config not found", agent.ErrConfigNotFound, http.StatusNotFound},
+		{"reloaded config rejected", errors.Wrap(agent.ErrConfigRejected, agent.ErrInvalidConfig), http.StatusConflict},
+		{"rate limited", api.ErrRateLimited, http.StatusTooManyRequests},
+		{"execution timeout", agent.ErrExecTimeout, http.StatusGatewayTimeout},
+		{"wrapped publish failure", errors.Wrap(agent.ErrPublishFailed, errors.New("broker")), http.StatusBadGateway},
+		{"execution failure", agent.ErrExecFailed, http.StatusInternalServerError},
+	}
+
+	for _, tc := range cases {
+		ts := httptest.NewServer(api.MakeHandler(errService{err: tc.err}, ""))
+		body := `{"bn":"1:","n":"exec","vs":"ls,-la"}`
+		res, err := ts.Client().Post(fmt.Sprintf("%s/exec", ts.URL), "application/json", strings.NewReader(body))
+		ts.Close()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+// batchService returns results of the commands up to the first failing one.
+type batchService struct {
+	service
+}
+
+func (batchService) ExecuteBatch(uuid string, cmds []string) ([]agent.ExecResult, error) {
+	results := []agent.ExecResult{}
+	for _, cmd := range cmds {
+		res := agent.ExecResult{Stdout: cmd}
+		if strings.HasPrefix(cmd, "false") {
+			res.ExitCode = 1
+		}
+		results = append(results, res)
+		if res.ExitCode != 0 {
+			break
+		}
+	}
+	return results, nil
+}
+
+func TestExecBatch(t *testing.T) {
+	ts := httptest.NewServer(api.MakeHandler(batchService{}, ""))
+	defer ts.Close()
+
+	cases := []struct {
+		desc    string
+		body    string
+		status  int
+		results []agent.ExecResult
+	}{
+		{
+			desc:    "execute batch",
+			body:    `{"bn":"1:","n":"exec","cmds":["echo,a","false,b","echo,c"]}`,
+			status:  http.StatusOK,
+			results: []agent.ExecResult{{Stdout: "echo,a"}, {Stdout: "false,b", ExitCode: 1}},
+		},
+		{
+			desc:   "execute empty batch",
+			body:   `{"bn":"1:","n":"exec","cmds":[]}`,
+			status: http.StatusBadRequest,
+		},
+		{
+			desc:   "execute batch with empty command",
+			body:   `{"bn":"1:","n":"exec","cmds":["echo,a",""]}`,
+			status: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range cases {
+		resp, err := ts.Client().Post(fmt.Sprintf("%s/exec/batch", ts.URL), "application/json", strings.NewReader(tc.body))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var out struct {
+			Results []agent.ExecResult `json:"results"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, resp.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, resp.StatusCode))
+		assert.Equal(t, tc.results, out.Results, fmt.Sprintf("%s: unexpected results", tc.desc))
+	}
+}
+
+func TestExecExitCode(t *testing.T) {
+	res := agent.ExecResult{ExitCode: 3, Stdout: "out", Stderr: "err"}
+	ts := httptest.NewServer(api.MakeHandler(resultService{res: res}, ""))
+	defer ts.Close()
+
+	body := `{"bn":"1:","n":"exec","vs":"ls,-la"}`
+	resp, err := ts.Client().Post(fmt.Sprintf("%s/exec", ts.URL), "application/json", strings.NewReader(body))
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, fmt.Sprintf("expected status code %d got %d", http.StatusOK, resp.StatusCode))
+
+	var out struct {
+		Value    string `json:"vs"`
+		Stderr   string `json:"stderr"`
+		ExitCode int    `json:"exit_code"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	assert.Equal(t, res.ExitCode, out.ExitCode, fmt.Sprintf("expected exit code %d got %d", res.ExitCode, out.ExitCode))
+	assert.Equal(t, res.Stdout, out.Value, fmt.Sprintf("expected stdout %s got %s", res.Stdout, out.Value))
+	assert.Equal(t, res.Stderr, out.Stderr, fmt.Sprintf("expected stderr %s got %s", res.Stderr, out.Stderr))
+}
+
+func TestHealth(t *testing.T) {
+	cases := []struct {
+		desc   string
+		mqtt   string
+		status int
+	}{
+		{"health with connected MQTT client", agent.HealthPass, http.StatusOK},
+		{"health with disconnected MQTT client", agent.HealthFail, http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range cases {
+		hs := agent.HealthStatus{
+			Status: tc.mqtt,
+			Dependencies: map[string]agent.DependencyStatus{
+				"mqtt": {Status: tc.mqtt, Critical: true},
+			},
+		}
+		ts := httptest.NewServer(api.MakeHandler(healthService{hs: hs}, ""))
+		res, err := ts.Client().Get(fmt.Sprintf("%s/health", ts.URL))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var body struct {
+			Status       string                            `json:"status"`
+			Dependencies map[string]agent.DependencyStatus `json:"dependencies"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		ts.Close()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		assert.Equal(t, tc.mqtt, body.Status, fmt.Sprintf("%s: expected status %s got %s", tc.desc, tc.mqtt, body.Status))
+		assert.Equal(t, tc.mqtt, body.Dependencies["mqtt"].Status, fmt.Sprintf("%s: expected MQTT status %s", tc.desc, tc.mqtt))
+	}
+}
+
+func TestHandlerOptions(t *testing.T) {
+	hs := agent.HealthStatus{Status: agent.HealthPass}
+	cases := []struct {
+		desc    string
+		options []api.HandlerOption
+		metrics int
+		health  int
+	}{
+		{desc: "handler with all endpoints", metrics: http.StatusOK, health: http.StatusOK},
+		{desc: "handler without metrics", options: []api.HandlerOption{api.WithoutMetrics()}, metrics: http.StatusNotFound, health: http.StatusOK},
+		{desc: "handler without health", options: []api.HandlerOption{api.WithoutHealth()}, metrics: http.StatusOK, health: http.StatusNotFound},
+		{desc: "handler without metrics and health", options: []api.HandlerOption{api.WithoutMetrics(), api.WithoutHealth()}, metrics: http.StatusNotFound, health: http.StatusNotFound},
+	}
+
+	for _, tc := range cases {
+		ts := httptest.NewServer(api.MakeHandler(healthService{hs: hs}, "", tc.options...))
+		for _, req := range []struct {
+			method string
+			path   string
+			status int
+		}{
+			{http.MethodGet, "/metrics", tc.metrics},
+			{http.MethodGet, "/health", tc.health},
+			{http.MethodHead, "/health", tc.health},
+		} {
+			r, err := http.NewRequest(req.method, ts.URL+req.path, nil)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating request: %s", tc.desc, err))
+			res, err := ts.Client().Do(r)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+			res.Body.Close()
+			assert.Equal(t, req.status, res.StatusCode, fmt.Sprintf("%s: %s %s: expected status code %d got %d", tc.desc, req.method, req.path, req.status, res.StatusCode))
+		}
+		ts.Close()
+	}
+}
+
+func TestUpdateConfig(t *testing.T) {
+	var patch agent.ConfigPatch
+	ts := httptest.NewServer(api.MakeHandler(patchService{patch: &patch}, ""))
+	defer ts.Close()
+
+	cases := []struct {
+		desc   string
+		method string
+		body   string
+		status int
+	}{
+		{"update config with put", http.MethodPut, `{"log":{"level":"debug"}}`, http.StatusOK},
+		{"update config with patch", http.MethodPatch, `{"log":{"level":"debug"}}`, http.StatusOK},
+		{"update config with empty patch", http.MethodPatch, `{}`, http.StatusBadRequest},
+		{"update config with invalid duration", http.MethodPatch, `{"heartbeat":{"interval":"1x"}}`, http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		patch = agent.ConfigPatch{}
+		req, err := http.NewRequest(tc.method, fmt.Sprintf("%s/config", ts.URL), strings.NewReader(tc.body))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res, err := ts.Client().Do(req)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res.Body.Close()
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		if tc.status == http.StatusOK {
+			assert.Equal(t, "debug", *patch.Log.Level, fmt.Sprintf("%s: expected log level patch", tc.desc))
+			assert.Nil(t, patch.Heartbeat, fmt.Sprintf("%s: expected omitted fields to stay unset", tc.desc))
+		}
+	}
+}
+
+// configService returns the configured config.
+type configService struct {
+	service
+	config agent.Config
+}
+
+func (s configService) Config() agent.Config {
+	return s.config
+}
+
+func TestViewConfig(t *testing.T) {
+	const token = "token"
+	c := agent.Config{
+		Server: agent.ServerConfig{Port: "9999", AuthToken: token},
+		MQTT:   agent.MQTTConfig{Username: "thing", Password: "mqtt-secret", ClientKey: "key-secret"},
+	}
+	secrets := []string{"mqtt-secret", "key-secret", `"auth_token":"token"`}
+
+	cases := []struct {
+		desc     string
+		token    string
+		query    string
+		status   int
+		redacted bool
+	}{
+		{desc: "view config", status: http.StatusOK, redacted: true},
+		{desc: "view config of authenticated API", token: token, status: http.StatusOK, redacted: true},
+		{desc: "view full config of authenticated API", token: token, query: "?full=true", status: http.StatusOK},
+		{desc: "view full config of unauthenticated API", query: "?full=true", status: http.StatusForbidden},
+		{desc: "view config with invalid full flag", query: "?full=yes", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		ts := httptest.NewServer(api.MakeHandler(configService{config: c}, tc.token))
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/config%s", ts.URL, tc.query), nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		res, err := ts.Client().Do(req)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var body bytes.Buffer
+		_, err = body.ReadFrom(res.Body)
+		res.Body.Close()
+		ts.Close()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		if tc.status != http.StatusOK {
+			continue
+		}
+		for _, secret := range secrets {
+			if tc.redacted {
+				assert.NotContains(t, body.String(), secret, fmt.Sprintf("%s: expected secret to be redacted", tc.desc))
+				continue
+			}
+			assert.Contains(t, body.String(), secret, fmt.Sprintf("%s: expected full config", tc.desc))
+		}
+		assert.Contains(t, body.String(), `"username":"thing"`, fmt.Sprintf("%s: expected non-secret fields", tc.desc))
+	}
+}
+
+func TestDownloadConfig(t *testing.T) {
+	const token = "token"
+	c := agent.Config{
+		Server: agent.ServerConfig{Port: "9999", AuthToken: token},
+		MQTT:   agent.MQTTConfig{Username: "thing", Password: "mqtt-secret", ClientKey: "key-secret"},
+	}
+	secrets := []string{"mqtt-secret", "key-secret", `"auth_token": "token"`}
+
+	cases := []struct {
+		desc     string
+		token    string
+		query    string
+		status   int
+		redacted bool
+	}{
+		{desc: "download config", status: http.StatusOK, redacted: true},
+		{desc: "download config of authenticated API", token: token, status: http.StatusOK, redacted: true},
+		{desc: "download full config of authenticated API", token: token, query: "?full=true", status: http.StatusOK},
+		{desc: "download full config of unauthenticated API", query: "?full=true", status: http.StatusForbidden},
+	}
+
+	for _, tc := range cases {
+		ts := httptest.NewServer(api.MakeHandler(configService{config: c}, tc.token))
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/config/download%s", ts.URL, tc.query), nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		req.Header.Set("Authorization", "Bearer "+tc.token)
+		res, err := ts.Client().Do(req)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var body bytes.Buffer
+		_, err = body.ReadFrom(res.Body)
+		res.Body.Close()
+		ts.Close()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		if tc.status != http.StatusOK {
+			assert.Empty(t, res.Header.Get("Content-Disposition"), fmt.Sprintf("%s: expected error not to be attachment", tc.desc))
+			continue
+		}
+		assert.Equal(t, `attachment; filename="agent-config.json"`, res.Header.Get("Content-Disposition"), fmt.Sprintf("%s: expected config attachment", tc.desc))
+		var downloaded map[string]any
+		err = json.Unmarshal(body.Bytes(), &downloaded)
+		require.Nil(t, err, fmt.Sprintf("%s: expected config JSON got %s", tc.desc, err))
+		assert.Contains(t, body.String(), `"username": "thing"`, fmt.Sprintf("%s: expected non-secret fields", tc.desc))
+		for _, secret := range secrets {
+			if tc.redacted {
+				assert.NotContains(t, body.String(), secret, fmt.Sprintf("%s: expected secret to be redacted", tc.desc))
+				continue
+			}
+			assert.Contains(t, body.String(), secret, fmt.Sprintf("%s: expected full config", tc.desc))
+		}
+	}
+}
+
+// publishService records the publish options.
+type publishService struct {
+	service
+	opts *agent.PublishOpts
+}
+
+func (s publishService) Publish(_ context.Context, topic, payload string, opts agent.PublishOpts) error {
+	*s.opts = opts
+	return nil
+}
+
+func TestPublishOpts(t *testing.T) {
+	var opts agent.PublishOpts
+	ts := httptest.NewServer(api.MakeHandler(publishService{opts: &opts}, ""))
+	defer ts.Close()
+	qos := byte(2)
+	retained := true
+
+	cases := []struct {
+		desc   string
+		body   string
+		opts   agent.PublishOpts
+		status int
+	}{
+		{"publish with configured options", `{"topic":"data","payload":"payload"}`, agent.PublishOpts{}, http.StatusOK},
+		{"publish retained message with QoS 2", `{"topic":"data","payload":"payload","qos":2,"retained":true}`, agent.PublishOpts{QoS: &qos, Retained: &retained}, http.StatusOK},
+		{"publish with QoS out of range", `{"topic":"data","payload":"payload","qos":3}`, agent.PublishOpts{}, http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		opts = agent.PublishOpts{}
+		res, err := ts.Client().Post(fmt.Sprintf("%s/pub", ts.URL), "application/json", strings.NewReader(tc.body))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res.Body.Close()
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		assert.Equal(t, tc.opts, opts, fmt.Sprintf("%s: unexpected publish options", tc.desc))
+	}
+}
+
+func TestPublishTopicValidation(t *testing.T) {
+	ts := httptest.NewServer(api.MakeHandler(okService{}, ""))
+	defer ts.Close()
+
+	cases := []struct {
+		desc   string
+		topic  string
+		status int
+	}{
+		{"publish to valid topic", "term/1", http.StatusOK},
+		{"publish to empty topic", "", http.StatusBadRequest},
+		{"publish to wildcard topic", "term/#", http.StatusBadRequest},
+		{"publish to overly long topic", strings.Repeat("a", topic.MaxLength+1), http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		body := fmt.Sprintf(`{"topic":%q,"payload":"payload"}`, tc.topic)
+		res, err := ts.Client().Post(fmt.Sprintf("%s/pub", ts.URL), "application/json", strings.NewReader(body))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var out struct {
+			Err string `json:"error"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&out)
+		res.Body.Close()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		if tc.status == http.StatusBadRequest {
+			assert.Contains(t, out.Err, topic.ErrInvalidTopic.Error(), fmt.Sprintf("%s: expected clear error message", tc.desc))
+		}
+	}
+}
+
+func TestViewService(t *testing.T) {
+	ts := httptest.NewServer(api.MakeHandler(servicesService{}, ""))
+	defer ts.Close()
+
+	cases := []struct {
+		desc   string
+		id     string
+		status int
+	}{
+		{"view registered service", "export", http.StatusOK},
+		{"view unknown service", "unknown", http.StatusNotFound},
+	}
+
+	for _, tc := range cases {
+		res, err := ts.Client().Get(fmt.Sprintf("%s/services/%s", ts.URL, tc.id))
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var info agent.Info
+		err = json.NewDecoder(res.Body).Decode(&info)
+		res.Body.Close()
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		if tc.status == http.StatusOK {
+			assert.Equal(t, serviceInfos[0], info, fmt.Sprintf("%s: unexpected service info", tc.desc))
+		}
+	}
+}
+
+// cancelService cancels the execution with UUID "1" only.
+type cancelService struct {
+	service
+}
+
+func (cancelService) CancelExecute(uuid string) error {
+	if uuid != "1" {
+		return agent.ErrNoSuchExecution
+	}
+	return nil
+}
+
+func TestCancelExec(t *testing.T) {
+	ts := httptest.NewServer(api.MakeHandler(cancelService{}, ""))
+	defer ts.Close()
+
+	cases := []struct {
+		desc   string
+		uuid   string
+		status int
+	}{
+		{"cancel running execution", "1", http.StatusOK},
+		{"cancel unknown execution", "2", http.StatusNotFound},
+	}
+
+	for _, tc := range cases {
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/exec/%s", ts.URL, tc.uuid), nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res, err := ts.Client().Do(req)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res.Body.Close()
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+	}
+}
+
+func TestViewServicesByStatus(t *testing.T) {
+	ts := httptest.NewServer(api.MakeHandler(servicesService{}, ""))
+	defer ts.Close()
+
+	cases := []struct {
+		desc  string
+		query string
+		names []string
+	}{
+		{"view all services", "", []string{"export", "duster"}},
+		{"view online services", "?status=online", []string{"export"}},
+		{"view offline services", "?status=offline", []string{"duster"}},
+		{"view services with unknown status", "?status=unknown", []string{}},
+	}
+
+	for _, tc := range cases {
+		res, err := ts.Client().Get(fmt.Sprintf("%s/services%s", ts.URL, tc.query))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var infos []agent.Info
+		err = json.NewDecoder(res.Body).Decode(&infos)
+		res.Body.Close()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, http.StatusOK, res.StatusCode))
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		assert.Equal(t, tc.names, names, fmt.Sprintf("%s: unexpected services", tc.desc))
+	}
+}
+
+// refreshService knows an online service and an offline one once refreshed.
+type refreshService struct {
+	servicesService
+	refreshed *bool
+	err       error
+}
+
+func (s refreshService) RefreshServices() error {
+	if s.err != nil {
+		return s.err
+	}
+	*s.refreshed = true
+	return nil
+}
+
+func (s refreshService) Services() []agent.Info {
+	if !*s.refreshed {
+		return serviceInfos[:1]
+	}
+	return serviceInfos
+}
+
+func TestRefreshServices(t *testing.T) {
+	cases := []struct {
+		desc   string
+		err    error
+		status int
+		names  []string
+	}{
+		{desc: "refresh services", status: http.StatusOK, names: []string{"export", "duster"}},
+		{desc: "refresh services with broker failure", err: agent.ErrPublishFailed, status: http.StatusBadGateway},
+	}
+
+	for _, tc := range cases {
+		refreshed := false
+		ts := httptest.NewServer(api.MakeHandler(refreshService{refreshed: &refreshed, err: tc.err}, ""))
+		res, err := ts.Client().Post(fmt.Sprintf("%s/services/refresh", ts.URL), "application/json", nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var body bytes.Buffer
+		_, err = body.ReadFrom(res.Body)
+		res.Body.Close()
+		ts.Close()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		if tc.status != http.StatusOK {
+			continue
+		}
+		var infos []agent.Info
+		err = json.Unmarshal(body.Bytes(), &infos)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		names := []string{}
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+		assert.Equal(t, tc.names, names, fmt.Sprintf("%s: expected refreshed services", tc.desc))
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	cases := []struct {
+		desc   string
+		svc    agent.Service
+		id     string
+		status int
+	}{
+		{"exec with request ID", resultService{}, "request-1", http.StatusOK},
+		{"exec without request ID", resultService{}, "", http.StatusOK},
+		{"failing exec with request ID", errService{err: agent.ErrExecFailed}, "request-2", http.StatusInternalServerError},
+	}
+
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		logger := slog.New(slog.NewJSONHandler(&buf, nil))
+		ts := httptest.NewServer(api.MakeHandler(api.LoggingMiddleware(tc.svc, logger), ""))
+		req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/exec", ts.URL), strings.NewReader(`{"bn":"1:","n":"exec","vs":"ls,-la"}`))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		if tc.id != "" {
+			req.Header.Set("X-Request-ID", tc.id)
+		}
+		res, err := ts.Client().Do(req)
+		ts.Close()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		res.Body.Close()
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+
+		id := res.Header.Get("X-Request-ID")
+		assert.NotEmpty(t, id, fmt.Sprintf("%s: expected request ID in response", tc.desc))
+		if tc.id != "" {
+			assert.Equal(t, tc.id, id, fmt.Sprintf("%s: expected request ID %s got %s", tc.desc, tc.id, id))
+		}
+		var entry map[string]any
+		err = json.Unmarshal(buf.Bytes(), &entry)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding log %s", tc.desc, err))
+		assert.Equal(t, id, entry["request_id"], fmt.Sprintf("%s: expected request ID %s to be logged", tc.desc, id))
+	}
+}
+
+func TestExecRequestIDWorkDir(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Heartbeat.Interval = time.Second
+	cfg.Exec.Retryable = []string{"sh"}
+	cfg.Exec.RetryExitCodes = []int{75}
+	cfg.Exec.MaxRetries = 1
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	svc, err := agent.New(context.Background(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+	ts := httptest.NewServer(api.MakeHandler(api.LoggingMiddleware(svc, logger), ""))
+
+	// Command fails with the transient exit code until it runs in the
+	// working directory for the second time.
+	dir := t.TempDir()
+	cmd := "sh,-c,echo\t>>\truns;\ttest\t$(wc\t-l\t<\truns)\t-ge\t2\t||\texit\t75"
+	body := fmt.Sprintf(`{"bn":"1:","n":"exec","vs":%q,"dir":%q}`, cmd, dir)
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/exec", ts.URL), strings.NewReader(body))
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	req.Header.Set("X-Request-ID", "request-1")
+	res, err := ts.Client().Do(req)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	var out struct {
+		ExitCode int `json:"exit_code"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&out)
+	res.Body.Close()
+	// Closing the server waits for the handler to log the call.
+	ts.Close()
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding response %s", err))
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected status code %d got %d", http.StatusOK, res.StatusCode))
+	assert.Equal(t, 0, out.ExitCode, "expected command to succeed once retried")
+
+	var retried, logged bool
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		err := json.Unmarshal([]byte(line), &entry)
+		require.Nil(t, err, fmt.Sprintf("unexpected error decoding log %s", err))
+		switch {
+		case strings.HasPrefix(fmt.Sprint(entry["msg"]), "Retrying"):
+			retried = true
+			assert.Equal(t, "request-1", entry["request_id"], "expected retry to be logged with request ID")
+		case strings.HasPrefix(fmt.Sprint(entry["msg"]), "Execute command with result"):
+			logged = true
+			assert.Equal(t, "request-1", entry["request_id"], "expected call to be logged with request ID")
+		}
+	}
+	assert.True(t, retried, fmt.Sprintf("expected command to be retried: %s", buf.String()))
+	assert.True(t, logged, fmt.Sprintf("expected call to be logged: %s", buf.String()))
+}
+
+func TestTerminalWebSocket(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Heartbeat.Interval = time.Second
+	cfg.Terminal.SessionTimeout = 5 * time.Second
+	logger := slog.Default()
+	svc, err := agent.New(context.Background(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+	ts := httptest.NewServer(api.MakeHandler(svc, ""))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/terminal/ws"
+
+	_, res, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NotNil(t, err, "expected dial without uuid to fail")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, fmt.Sprintf("expected status code %d got %d", http.StatusBadRequest, res.StatusCode))
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?uuid=ws", nil)
+	require.Nil(t, err, fmt.Sprintf("unexpected error dialing: %s", err))
+	defer conn.Close()
+
+	// Quotes tell the output apart from the echoed input.
+	err = conn.WriteMessage(websocket.TextMessage, []byte("echo hel''lo\n"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing: %s", err))
+	err = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	var out strings.Builder
+	for !strings.Contains(out.String(), "hello") {
+		_, msg, err := conn.ReadMessage()
+		require.Nil(t, err, fmt.Sprintf("unexpected error reading output %q: %s", out.String(), err))
+		rec, err := encoder.DecodeSenML(msg)
+		require.Nil(t, err, fmt.Sprintf("unexpected error decoding output: %s", err))
+		assert.Equal(t, "ws", rec.BaseName)
+		assert.Equal(t, "term", rec.Name)
+		out.WriteString(rec.Value)
+	}
+
+	// Session with the same UUID can't be attached twice.
+	other, _, err := websocket.DefaultDialer.Dial(url+"?uuid=ws", nil)
+	require.Nil(t, err, fmt.Sprintf("unexpected error dialing: %s", err))
+	err = other.SetReadDeadline(time.Now().Add(5 * time.Second))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, _, err = other.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseInternalServerErr), fmt.Sprintf("expected internal error closure got %s", err))
+	other.Close()
+
+	// Session without input times out.
+	err = conn.SetReadDeadline(time.Now().Add(15 * time.Second))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), fmt.Sprintf("expected normal closure once session ended got %s", err))
+}
+
+func TestTerminalWebSocketAuth(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Heartbeat.Interval = time.Second
+	cfg.Terminal.SessionTimeout = 5 * time.Second
+	cfg.Terminal.Shell = "sh"
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	svc, err := agent.New(context.Background(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+	ts := httptest.NewServer(api.MakeHandler(svc, "token", api.WithCORSOrigins([]string{"http://console.example.com"})))
+	defer ts.Close()
+	url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/terminal/ws"
+
+	cases := []struct {
+		desc      string
+		query     string
+		header    http.Header
+		protocols []string
+		status    int
+	}{
+		{desc: "dial with bearer token header", header: http.Header{"Authorization": {"Bearer token"}}, status: http.StatusSwitchingProtocols},
+		{desc: "dial with bearer subprotocol", protocols: []string{"bearer", "token"}, status: http.StatusSwitchingProtocols},
+		{desc: "dial with token query parameter", query: "&token=token", status: http.StatusSwitchingProtocols},
+		{desc: "dial without token", status: http.StatusUnauthorized},
+		{desc: "dial with invalid bearer subprotocol", protocols: []string{"bearer", "invalid"}, status: http.StatusUnauthorized},
+		{desc: "dial with bearer subprotocol without token", protocols: []string{"bearer"}, status: http.StatusUnauthorized},
+		{desc: "dial with invalid token query parameter", query: "&token=invalid", status: http.StatusUnauthorized},
+		{desc: "dial from CORS allowed origin", query: "&token=token", header: http.Header{"Origin": {"http://console.example.com"}}, status: http.StatusSwitchingProtocols},
+		{desc: "dial from other origin", query: "&token=token", header: http.Header{"Origin": {"http://example.com"}}, status: http.StatusForbidden},
+	}
+
+	for i, tc := range cases {
+		dialer := websocket.Dialer{Subprotocols: tc.protocols}
+		conn, res, err := dialer.Dial(fmt.Sprintf("%s?uuid=ws-%d%s", url, i, tc.query), tc.header)
+		require.NotNil(t, res, fmt.Sprintf("%s: unexpected error dialing: %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		if conn == nil {
+			continue
+		}
+		if len(tc.protocols) > 0 {
+			assert.Equal(t, "bearer", conn.Subprotocol(), fmt.Sprintf("%s: expected bearer subprotocol to be selected", tc.desc))
+		}
+		conn.Close()
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	cfg := agent.Config{File: filepath.Join(t.TempDir(), "config.toml")}
+	cfg.Heartbeat.Interval = 10 * time.Second
+	cfg.Terminal.SessionTimeout = time.Minute
+	cfg.Log.Level = "info"
+	cfg.MQTT.URL = "localhost:1883"
+	cfg.Channels = agent.ChanConfig{Control: "control", Data: "data"}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	svc, err := agent.New(context.Background(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, agent.NewFileStore(cfg.File), mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+	ts := httptest.NewServer(api.MakeHandler(svc, ""))
+	defer ts.Close()
+
+	cases := []struct {
+		desc    string
+		config  string
+		status  int
+		changes []agent.FieldChange
+		level   string
+	}{
+		{
+			desc:    "reload config",
+			config:  "[log]\n  level = \"debug\"\n\n[heartbeat]\n  interval = \"10s\"\n",
+			status:  http.StatusOK,
+			changes: []agent.FieldChange{{Path: "log.level", Old: "info", New: "debug"}},
+			level:   "debug",
+		},
+		{
+			desc:    "reload unchanged config",
+			config:  "[log]\n  level = \"debug\"\n\n[heartbeat]\n  interval = \"10s\"\n",
+			status:  http.StatusOK,
+			changes: []agent.FieldChange{},
+			level:   "debug",
+		},
+		{
+			desc:   "reload invalid config",
+			config: "[log]\n  level = \"verbose\"\n\n[heartbeat]\n  interval = \"10s\"\n",
+			status: http.StatusConflict,
+			level:  "debug",
+		},
+		{
+			desc:   "reload malformed config",
+			config: "[log\n",
+			status: http.StatusConflict,
+			level:  "debug",
+		},
+	}
+
+	for _, tc := range cases {
+		err := os.WriteFile(cfg.File, []byte(tc.config), 0o644)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error writing config: %s", tc.desc, err))
+		res, err := ts.Client().Post(fmt.Sprintf("%s/config/reload", ts.URL), "application/json", nil)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		var body struct {
+			Changes []agent.FieldChange `json:"changes"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding response: %s", tc.desc, err))
+		assert.Equal(t, tc.status, res.StatusCode, fmt.Sprintf("%s: expected status code %d got %d", tc.desc, tc.status, res.StatusCode))
+		assert.Equal(t, tc.changes, body.Changes, fmt.Sprintf("%s: expected changes applied", tc.desc))
+		assert.Equal(t, tc.level, svc.Config().Log.Level, fmt.Sprintf("%s: expected log level %s", tc.desc, tc.level))
+	}
+}
+
+func TestExecStream(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Heartbeat.Interval = time.Second
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	svc, err := agent.New(context.Background(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+	ts := httptest.NewServer(api.MakeHandler(svc, ""))
+	defer ts.Close()
+
+	type event struct {
+		Type     string `json:"type"`
+		Data     string `json:"data"`
+		ExitCode *int   `json:"exit_code"`
+	}
+	// Spaces are stripped from commands, tabs separate shell words instead.
+	script := "for\ti\tin\t1\t2\t3;\tdo\techo\tline$i;\tsleep\t0.2;\tdone;\techo\toops>&2;\texit\t2"
+	body, err := json.Marshal(map[string]string{"bn": "1:", "n": "exec", "vs": "sh,-c," + script})
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	res, err := ts.Client().Post(fmt.Sprintf("%s/exec/stream", ts.URL), "application/json", bytes.NewReader(body))
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode, fmt.Sprintf("expected status code %d got %d", http.StatusOK, res.StatusCode))
+	assert.Equal(t, []string{"chunked"}, res.TransferEncoding, "expected chunked response")
+	assert.Equal(t, "application/x-ndjson", res.Header.Get("Content-Type"))
+
+	var events []event
+	var first time.Time
+	dec := json.NewDecoder(res.Body)
+	for dec.More() {
+		var e event
+		err := dec.Decode(&e)
+		require.Nil(t, err, fmt.Sprintf("unexpected error decoding event: %s", err))
+		if first.IsZero() {
+			first = time.Now()
+		}
+		events = append(events, e)
+	}
+	end := time.Now()
+	require.NotEmpty(t, events, "expected streamed events")
+	assert.Less(t, first, end.Add(-300*time.Millisecond), "expected events before the command completed")
+
+	var stdout, stderr strings.Builder
+	for _, e := range events[:len(events)-1] {
+		switch e.Type {
+		case "stdout":
+			stdout.WriteString(e.Data)
+		case "stderr":
+			stderr.WriteString(e.Data)
+		default:
+			t.Errorf("unexpected event %s before the exit", e.Type)
+		}
+	}
+	assert.Equal(t, "line1\nline2\nline3\n", stdout.String(), "expected standard output events")
+	assert.Equal(t, "oops\n", stderr.String(), "expected standard error events")
+	last := events[len(events)-1]
+	assert.Equal(t, "exit", last.Type, "expected exit event last")
+	require.NotNil(t, last.ExitCode, "expected exit code")
+	assert.Equal(t, 2, *last.ExitCode, "expected exit code of the command")
+
+	res, err = ts.Client().Post(fmt.Sprintf("%s/exec/stream", ts.URL), "application/json", strings.NewReader(`{"bn":"1:","n":"exec","vs":"ls"}`))
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode, "expected invalid command to be rejected before streaming")
+
+	// Disconnected client cancels the command.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	body = []byte(`{"bn":"2:","n":"exec","vs":"sh,-c,echo\tstarted;sleep\t10"}`)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/exec/stream", ts.URL), bytes.NewReader(body))
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	res, err = ts.Client().Do(req)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	var e event
+	err = json.NewDecoder(res.Body).Decode(&e)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding event: %s", err))
+	assert.Equal(t, "started\n", e.Data, "expected output of the command")
+	cancel()
+	res.Body.Close()
+	assert.Eventually(t, func() bool {
+		return errors.Contains(svc.CancelExecute("2"), agent.ErrNoSuchExecution)
+	}, 5*time.Second, 50*time.Millisecond, "expected command to be cancelled once the client disconnected")
+}
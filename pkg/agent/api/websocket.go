@@ -0,0 +1,133 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	closeTimeout = time.Second
+	// maxCloseReason is the maximum length of the close frame reason.
+	maxCloseReason = 123
+)
+
+// bearerProtocol is the WebSocket subprotocol followed by the bearer token
+// in the Sec-WebSocket-Protocol header, since browsers can't set the
+// Authorization header on the WebSocket connections.
+const bearerProtocol = "bearer"
+
+// newUpgrader returns upgrader rejecting cross-origin requests, unless they
+// are from one of the CORS allowed origins, so other sites can't open the
+// terminal in the name of the browser user.
+func newUpgrader(origins []string) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		Subprotocols: []string{bearerProtocol},
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || allowedOrigin(origins, origin) {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		},
+	}
+}
+
+// wsToken returns the bearer token of the WebSocket upgrade request, sent in
+// the Authorization header, as the subprotocol following the bearer one, or
+// in the token query parameter.
+func wsToken(r *http.Request) (string, bool) {
+	if token, ok := headerToken(r); ok {
+		return token, true
+	}
+	protocols := websocket.Subprotocols(r)
+	if i := slices.Index(protocols, bearerProtocol); i >= 0 && i+1 < len(protocols) {
+		return protocols[i+1], true
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, true
+	}
+	return "", false
+}
+
+// terminalHandler attaches the WebSocket connection to a new terminal session
+// with the uuid query parameter. The client messages are written to the
+// session shell, and the session output SenML messages are sent as text
+// messages, or binary if not UTF-8, such as CBOR ones. The connection is
+// closed with normal closure once the session ends, and with internal error
+// if the session fails.
+func terminalHandler(svc agent.Service, origins []string) http.Handler {
+	upgrader := newUpgrader(origins)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuid := r.URL.Query().Get("uuid")
+		if uuid == "" {
+			encodeError(r.Context(), agent.ErrMalformedEntity, w)
+			return
+		}
+		// Upgrade replies to the client on failure.
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var mu sync.Mutex
+		out := func(payload string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			typ := websocket.TextMessage
+			if !utf8.ValidString(payload) {
+				typ = websocket.BinaryMessage
+			}
+			return conn.WriteMessage(typ, []byte(payload))
+		}
+		code, reason := websocket.CloseNormalClosure, "session ended"
+		if err := svc.AttachTerminal(r.Context(), uuid, &wsReader{conn: conn}, out); err != nil {
+			code, reason = websocket.CloseInternalServerErr, err.Error()
+			if len(reason) > maxCloseReason {
+				reason = reason[:maxCloseReason]
+			}
+		}
+		msg := websocket.FormatCloseMessage(code, reason)
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+	})
+}
+
+// wsReader reads the data messages of the connection as a stream.
+type wsReader struct {
+	conn *websocket.Conn
+	r    io.Reader
+}
+
+func (wr *wsReader) Read(p []byte) (int, error) {
+	for {
+		if wr.r == nil {
+			_, r, err := wr.conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			wr.r = r
+		}
+		n, err := wr.r.Read(p)
+		if err == io.EOF {
+			wr.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/absmach/senml"
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/agent/pkg/topic"
+)
+
+// sendFunc publishes the message to the topic, waiting for it until ctx is
+// done.
+type sendFunc func(ctx context.Context, topic string, qos byte, retain bool, payload string) error
+
+// batcher coalesces SenML JSON messages published to the same batched topic
+// within the window into a single SenML pack, reducing the number of MQTT
+// publishes. Messages to the other topics, and the ones that aren't SenML
+// JSON packs, are sent right away.
+//
+// Batches are sent with the lock held, so the messages to a topic keep
+// their order.
+type batcher struct {
+	window  time.Duration
+	topics  []string
+	send    sendFunc
+	logger  *slog.Logger
+	mu      sync.Mutex
+	batches map[string]*batch
+}
+
+type batch struct {
+	qos     byte
+	retain  bool
+	records []senml.Record
+}
+
+// newBatcher returns batcher of the messages to cfg.BatchTopics, sending
+// them with send. Zero cfg.BatchWindow disables batching.
+func newBatcher(cfg MQTTConfig, send sendFunc, logger *slog.Logger) *batcher {
+	return &batcher{
+		window:  cfg.BatchWindow,
+		topics:  cfg.BatchTopics,
+		send:    send,
+		logger:  logger,
+		batches: make(map[string]*batch),
+	}
+}
+
+// publish sends the message, or adds it to the batch of the topic. Sending
+// the message, and the pending batch before it, is cancelled with ctx, while
+// the batches sent once their window elapses aren't.
+func (b *batcher) publish(ctx context.Context, t string, qos byte, retain bool, payload string) error {
+	if !b.batched(t) {
+		return b.send(ctx, t, qos, retain, payload)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	records, err := encoder.SplitSenML([]byte(payload))
+	if err != nil {
+		// Pending messages are sent first to keep the order.
+		if err := b.flushTopic(ctx, t); err != nil {
+			return err
+		}
+		return b.send(ctx, t, qos, retain, payload)
+	}
+	bt, ok := b.batches[t]
+	if ok && (bt.qos != qos || bt.retain != retain) {
+		if err := b.flushTopic(ctx, t); err != nil {
+			return err
+		}
+		ok = false
+	}
+	if !ok {
+		bt = &batch{qos: qos, retain: retain}
+		b.batches[t] = bt
+		time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			// Batch may have been flushed meanwhile, along with the new
+			// one started since.
+			if b.batches[t] != bt {
+				return
+			}
+			if err := b.flushTopic(context.Background(), t); err != nil {
+				b.logger.Warn(fmt.Sprintf("Failed to publish batched messages to %s: %s", t, err))
+			}
+		})
+	}
+	bt.records = append(bt.records, records...)
+	return nil
+}
+
+// flush sends all the pending batches, returning the first error.
+func (b *batcher) flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var first error
+	for t := range b.batches {
+		if err := b.flushTopic(context.Background(), t); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// pending returns the number of records waiting to be sent.
+func (b *batcher) pending() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, bt := range b.batches {
+		n += len(bt.records)
+	}
+	return n
+}
+
+// flushTopic sends the pending batch of the topic, it must be called with
+// b.mu held.
+func (b *batcher) flushTopic(ctx context.Context, t string) error {
+	bt, ok := b.batches[t]
+	if !ok {
+		return nil
+	}
+	delete(b.batches, t)
+	payload, err := encoder.JoinSenML(bt.records)
+	if err != nil {
+		return err
+	}
+	return b.send(ctx, t, bt.qos, bt.retain, string(payload))
+}
+
+// batched reports whether messages to the topic are batched.
+func (b *batcher) batched(t string) bool {
+	if b.window <= 0 {
+		return false
+	}
+	for _, f := range b.topics {
+		if topic.Match(f, t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/senml"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sent struct {
+	topic   string
+	payload string
+}
+
+// recorder records the messages sent by the batcher.
+type recorder struct {
+	mu   sync.Mutex
+	msgs []sent
+}
+
+func (r *recorder) send(_ context.Context, topic string, _ byte, _ bool, payload string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, sent{topic: topic, payload: payload})
+	return nil
+}
+
+func (r *recorder) sent() []sent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]sent{}, r.msgs...)
+}
+
+func newTestBatcher(window time.Duration, rec *recorder) *batcher {
+	cfg := MQTTConfig{BatchWindow: window, BatchTopics: []string{"channels/1/messages/#"}}
+	return newBatcher(cfg, rec.send, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func pack(t *testing.T, value string) string {
+	b, err := senml.Encode(senml.Pack{Records: []senml.Record{{BaseName: "1:", Name: "exec", StringValue: &value}}}, senml.JSON)
+	require.Nil(t, err, fmt.Sprintf("unexpected error encoding pack: %s", err))
+	return string(b)
+}
+
+func TestBatcherWindow(t *testing.T) {
+	rec := &recorder{}
+	b := newTestBatcher(50*time.Millisecond, rec)
+
+	n := 5
+	for i := 0; i < n; i++ {
+		err := b.publish(context.Background(), "channels/1/messages/res", 0, false, pack(t, fmt.Sprint(i)))
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+	assert.Empty(t, rec.sent(), "expected messages not to be sent within the window")
+
+	assert.Eventually(t, func() bool {
+		return len(rec.sent()) > 0
+	}, time.Second, 10*time.Millisecond, "expected batch to be sent once the window elapses")
+	msgs := rec.sent()
+	require.Len(t, msgs, 1, "expected messages to be sent as a single batch")
+	assert.Equal(t, "channels/1/messages/res", msgs[0].topic, "expected batch to be sent to the topic")
+	p, err := senml.Decode([]byte(msgs[0].payload), senml.JSON)
+	require.Nil(t, err, fmt.Sprintf("expected batch to be SenML pack: %s", err))
+	require.Len(t, p.Records, n, "expected batch to carry all the records")
+	for i, r := range p.Records {
+		assert.Equal(t, fmt.Sprint(i), *r.StringValue, fmt.Sprintf("record %d: expected order to be preserved", i))
+	}
+	assert.Equal(t, "1:", p.Records[0].BaseName, "expected base name to be kept")
+}
+
+func TestBatcherFlush(t *testing.T) {
+	rec := &recorder{}
+	b := newTestBatcher(time.Hour, rec)
+
+	for _, topic := range []string{"channels/1/messages/res", "channels/1/messages/res", "channels/1/messages/res/term"} {
+		err := b.publish(context.Background(), topic, 0, false, pack(t, "a"))
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+	assert.Equal(t, 3, b.pending(), "expected records to be pending")
+
+	err := b.flush()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Len(t, rec.sent(), 2, "expected a batch per topic to be sent")
+	assert.Equal(t, 0, b.pending(), "expected flush to empty the buffer")
+
+	err = b.flush()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Len(t, rec.sent(), 2, "expected nothing to be sent flushing empty buffer")
+}
+
+func TestBatcherUnbatched(t *testing.T) {
+	rec := &recorder{}
+	b := newTestBatcher(time.Hour, rec)
+
+	err := b.publish(context.Background(), "channels/2/messages/res", 0, false, pack(t, "a"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Len(t, rec.sent(), 1, "expected message to topic not batched to be sent right away")
+
+	err = b.publish(context.Background(), "channels/1/messages/res", 0, false, pack(t, "b"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	err = b.publish(context.Background(), "channels/1/messages/res", 0, false, "raw")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	msgs := rec.sent()
+	require.Len(t, msgs, 3, "expected message that isn't SenML pack to be sent right away, after the pending batch")
+	assert.Equal(t, pack(t, "b"), msgs[1].payload, "expected pending batch to be sent first")
+	assert.Equal(t, "raw", msgs[2].payload, "expected message that isn't SenML pack to be sent as is")
+
+	b = newTestBatcher(0, rec)
+	err = b.publish(context.Background(), "channels/1/messages/res", 0, false, pack(t, "c"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Len(t, rec.sent(), 4, "expected zero window to disable batching")
+}
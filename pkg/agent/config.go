@@ -7,9 +7,15 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/agent/pkg/topic"
 	"github.com/andychao217/magistrala/pkg/errors"
 	"github.com/pelletier/go-toml"
 )
@@ -17,15 +23,28 @@ import (
 type ServerConfig struct {
 	Port      string `toml:"port" json:"port"`
 	BrokerURL string `toml:"broker_url" json:"broker_url"`
+	// AuthToken is a bearer token required by HTTP API, empty disables authentication.
+	AuthToken string `toml:"auth_token" json:"auth_token"`
 }
 
 type ChanConfig struct {
 	Control string `toml:"control"`
 	Data    string `toml:"data"`
+
+	// DataChannels maps names of additional data channels to their IDs.
+	DataChannels map[string]string `toml:"data_channels,omitempty"`
 }
 
 type EdgexConfig struct {
 	URL string `toml:"url"`
+	// DataURL is the base URL of EdgeX core data readings are polled from.
+	DataURL string `toml:"data_url" json:"data_url"`
+	// CommandURL is the base URL of EdgeX core command device commands are
+	// forwarded to.
+	CommandURL string `toml:"command_url" json:"command_url"`
+	// PollInterval of EdgeX readings published to the data channel, zero
+	// disables polling.
+	PollInterval time.Duration `toml:"poll_interval" json:"poll_interval"`
 }
 
 type LogConfig struct {
@@ -44,32 +63,397 @@ type MQTTConfig struct {
 	CertPath    string          `json:"cert_path" toml:"cert_path" mapstructure:"cert_path"`
 	PrivKeyPath string          `json:"priv_key_path" toml:"priv_key_path" mapstructure:"priv_key_path"`
 	CA          []byte          `json:"-" toml:"-"`
+	FallbackCA  []byte          `json:"-" toml:"-"`
 	Cert        tls.Certificate `json:"-" toml:"-"`
 	ClientCert  string          `json:"client_cert" toml:"client_cert"`
 	ClientKey   string          `json:"client_key" toml:"client_key"`
 	CaCert      string          `json:"ca_cert" toml:"ca_cert"`
+	// TopicNamespace is a topic prefix the configured username is allowed to
+	// publish to. The "{username}" placeholder is replaced with the username.
+	TopicNamespace string `json:"topic_namespace" toml:"topic_namespace" mapstructure:"topic_namespace"`
+	// TerminalTopic is the template of the topic terminal session output is
+	// published to, with {prefix} and {channel} of the control channel and
+	// {uuid} of the session as placeholders. Empty uses DefaultTerminalTopic.
+	TerminalTopic string `json:"terminal_topic" toml:"terminal_topic" mapstructure:"terminal_topic"`
+	// DataTopic is the template of the topic messages are published to on
+	// the data channels, with {prefix} and {channel} placeholders. Empty
+	// uses DefaultDataTopic.
+	DataTopic string `json:"data_topic" toml:"data_topic" mapstructure:"data_topic"`
+	// PublishBuffer is the number of messages kept while disconnected from
+	// the broker and published on reconnect. Zero disables buffering.
+	PublishBuffer int `json:"publish_buffer" toml:"publish_buffer" mapstructure:"publish_buffer"`
+	// QueueDir is a directory messages published while disconnected from
+	// the broker are persisted to, so they survive restarts. It takes
+	// precedence over PublishBuffer.
+	QueueDir string `json:"queue_dir" toml:"queue_dir" mapstructure:"queue_dir"`
+	// QueueMaxBytes caps the disk usage of the queue.
+	QueueMaxBytes int64 `json:"queue_max_bytes" toml:"queue_max_bytes" mapstructure:"queue_max_bytes"`
+	// BatchWindow is the time SenML messages published to the same batched
+	// topic are collected for, before they're published as a single pack.
+	// Zero disables batching.
+	BatchWindow time.Duration `json:"batch_window" toml:"batch_window" mapstructure:"batch_window"`
+	// BatchTopics are the topics, or the filters with "+" and "#"
+	// wildcards, of the batched messages.
+	BatchTopics []string `json:"batch_topics" toml:"batch_topics" mapstructure:"batch_topics"`
+	// KeepAlive is the interval of the pings keeping the connection open
+	// through NAT gateways, in whole seconds. Zero keeps the client default.
+	KeepAlive time.Duration `json:"keep_alive" toml:"keep_alive" mapstructure:"keep_alive"`
+	// PingTimeout after which the connection without ping response is
+	// considered lost. Zero keeps the client default.
+	PingTimeout time.Duration `json:"ping_timeout" toml:"ping_timeout" mapstructure:"ping_timeout"`
+	// ConnectTimeout bounds connecting to the broker. Zero keeps the client
+	// default.
+	ConnectTimeout time.Duration `json:"connect_timeout" toml:"connect_timeout" mapstructure:"connect_timeout"`
+	// ConnectRetryTimeout is the time the initial connect to the broker is
+	// retried for, with exponential backoff, before giving up. Zero disables
+	// retrying.
+	ConnectRetryTimeout time.Duration `json:"connect_retry_timeout" toml:"connect_retry_timeout" mapstructure:"connect_retry_timeout"`
+	// CredentialsFile, if set, keeps MQTT username and password instead of
+	// the config file. It's written readable by the owner only.
+	CredentialsFile string `json:"credentials_file" toml:"credentials_file" mapstructure:"credentials_file"`
+}
+
+// MQTTCredentials represents MQTT credentials that can be rotated in place.
+type MQTTCredentials struct {
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	ClientCert string `json:"client_cert"`
+	ClientKey  string `json:"client_key"`
 }
 
 type HeartbeatConfig struct {
+	// Interval after which service that stopped sending heartbeats is
+	// marked offline.
 	Interval time.Duration `toml:"interval"`
+	// PublishInterval of the agent's own heartbeats, zero disables them.
+	PublishInterval time.Duration `toml:"publish_interval" json:"publish_interval"`
+	// Topic the agent's own heartbeats are published to.
+	Topic string `toml:"topic" json:"topic"`
+}
+
+type ExecConfig struct {
+	// Timeout bounds execution of commands, zero disables it.
+	Timeout time.Duration `toml:"timeout" json:"timeout"`
+	// Allowlist of command names or glob patterns, empty allows all the commands.
+	Allowlist []string `toml:"allowlist" json:"allowlist"`
+	// Denylist of command names or glob patterns, takes precedence over Allowlist.
+	Denylist []string `toml:"denylist" json:"denylist"`
+	// MaxOutputBytes bounds combined output of commands, which are killed
+	// once they exceed it. Zero disables it.
+	MaxOutputBytes int `toml:"max_output_bytes" json:"max_output_bytes"`
+	// Dir is the default working directory of commands, empty runs them in
+	// the agent working directory.
+	Dir string `toml:"dir" json:"dir"`
+	// BaseDir confines working directories of commands, empty allows all.
+	BaseDir string `toml:"base_dir" json:"base_dir"`
+	// Env is the policy of environment of the commands and terminal shells.
+	Env EnvConfig `toml:"env" json:"env"`
+	// ContinueOnError keeps executing the batch of commands after one exits
+	// with non-zero code.
+	ContinueOnError bool `toml:"continue_on_error" json:"continue_on_error"`
+	// Cacheable lists names or glob patterns of the read-only commands
+	// whose results are cached for CacheTTL.
+	Cacheable []string `toml:"cacheable" json:"cacheable"`
+	// CacheTTL is how long results of the cacheable commands are reused,
+	// zero disables caching.
+	CacheTTL time.Duration `toml:"cache_ttl" json:"cache_ttl"`
+	// User, name or numeric ID, the commands and terminal shells run as.
+	// Empty runs them as the agent user.
+	User string `toml:"user" json:"user"`
+	// CompressThreshold is the output size in bytes from which the command
+	// output published over MQTT is gzip compressed, zero disables it.
+	CompressThreshold int `toml:"compress_threshold" json:"compress_threshold"`
+	// MaxConcurrent bounds the number of commands running at once, zero
+	// leaves it unbounded.
+	MaxConcurrent int `toml:"max_concurrent" json:"max_concurrent"`
+	// QueueTimeout is how long commands above MaxConcurrent wait for a
+	// running one to complete. Zero rejects them at once.
+	QueueTimeout time.Duration `toml:"queue_timeout" json:"queue_timeout"`
+	// Retryable lists names or glob patterns of the commands which are run
+	// again once they exit with one of RetryExitCodes.
+	Retryable []string `toml:"retryable" json:"retryable"`
+	// RetryExitCodes are the exit codes of the transient failures of the
+	// retryable commands.
+	RetryExitCodes []int `toml:"retry_exit_codes" json:"retry_exit_codes"`
+	// MaxRetries bounds the number of times the retryable command is run
+	// again, zero disables retries.
+	MaxRetries int `toml:"max_retries" json:"max_retries"`
+	// RetryDelay is how long to wait before running the command again.
+	RetryDelay time.Duration `toml:"retry_delay" json:"retry_delay"`
 }
 
 type TerminalConfig struct {
+	// SessionTimeout closes session without input, output doesn't reset it.
 	SessionTimeout time.Duration `toml:"session_timeout" json:"session_timeout"`
+	// MaxDuration closes session regardless of the activity, zero disables it.
+	MaxDuration time.Duration `toml:"max_duration" json:"max_duration"`
+	// Format of terminal output SenML messages, "json" (default) or "cbor".
+	Format string `toml:"format" json:"format"`
+	// AckWindow enables acknowledged terminal output when positive.
+	AckWindow int `toml:"ack_window" json:"ack_window"`
+	// ReplayBuffer is the number of the most recent output bytes kept for
+	// replay to the reconnecting clients, zero disables it.
+	ReplayBuffer int `toml:"replay_buffer" json:"replay_buffer"`
+	// Shell run by the terminal sessions, bash if not set.
+	Shell string `toml:"shell" json:"shell"`
+	// InputRate paces the input written to the shell in bytes per second,
+	// zero leaves it unlimited.
+	InputRate int `toml:"input_rate" json:"input_rate"`
+	// MaxInput is the maximum size of the input sent at once in bytes, zero
+	// leaves it unlimited.
+	MaxInput int `toml:"max_input" json:"max_input"`
+	// MaxSessions bounds the number of open sessions, zero leaves it
+	// unbounded.
+	MaxSessions int `toml:"max_sessions" json:"max_sessions"`
+	// Banner is sent to new sessions before the shell output, with
+	// {uuid}, {thing} and {hostname} placeholders. Empty disables it.
+	Banner string `toml:"banner" json:"banner"`
 }
 
 type Config struct {
 	Server    ServerConfig    `toml:"server" json:"server"`
 	Terminal  TerminalConfig  `toml:"terminal" json:"terminal"`
+	Exec      ExecConfig      `toml:"exec" json:"exec"`
 	Heartbeat HeartbeatConfig `toml:"heartbeat" json:"heartbeat"`
 	Channels  ChanConfig      `toml:"channels" json:"channels"`
 	Edgex     EdgexConfig     `toml:"edgex" json:"edgex"`
 	Log       LogConfig       `toml:"log" json:"log"`
 	MQTT      MQTTConfig      `toml:"mqtt" json:"mqtt"`
-	File      string
+	// IdempotencyKey is the key of the last config added, stored with the
+	// config so repeated additions are ignored after a restart as well.
+	IdempotencyKey string `toml:"idempotency_key" json:"idempotency_key"`
+	File           string
+	// SafeMode reports that the agent runs the SafeModeConfig, so MQTT and
+	// the message broker are disabled.
+	SafeMode bool `toml:"-" json:"safe_mode"`
+}
+
+// Default topic templates, rendering the topics the agent always used.
+const (
+	DefaultTerminalTopic = "{prefix}/term/{uuid}"
+	DefaultDataTopic     = "{prefix}"
+)
+
+// TerminalTopic returns the topic output of the terminal session is
+// published to.
+func (c Config) TerminalTopic(uuid string) string {
+	tmpl := c.MQTT.TerminalTopic
+	if tmpl == "" {
+		tmpl = DefaultTerminalTopic
+	}
+	return topic.Render(tmpl, map[string]string{
+		topic.Prefix:  responsePrefix(c.Channels.Control),
+		topic.Channel: c.Channels.Control,
+		topic.UUID:    uuid,
+	})
+}
+
+// TerminalBanner returns the banner of the terminal session, with UUID of
+// the session, MQTT username, which is the thing ID, and host name in place
+// of their placeholders.
+func (c Config) TerminalBanner(uuid string) string {
+	if c.Terminal.Banner == "" {
+		return ""
+	}
+	hostname, _ := os.Hostname()
+	return topic.Render(c.Terminal.Banner, map[string]string{
+		topic.UUID: uuid,
+		"thing":    c.MQTT.Username,
+		"hostname": hostname,
+	})
+}
+
+// DataTopic returns the topic messages are published to on the data channel
+// with the ID.
+func (c Config) DataTopic(channel string) string {
+	tmpl := c.MQTT.DataTopic
+	if tmpl == "" {
+		tmpl = DefaultDataTopic
+	}
+	return topic.Render(tmpl, map[string]string{
+		topic.Prefix:  responsePrefix(channel),
+		topic.Channel: channel,
+	})
+}
+
+// topicErrors returns errors of the topic templates.
+func (c MQTTConfig) topicErrors() fieldErrors {
+	var errs fieldErrors
+	if c.TerminalTopic != "" {
+		if err := topic.ValidateTemplate(c.TerminalTopic, topic.Prefix, topic.Channel, topic.UUID); err != nil {
+			errs = append(errs, fmt.Errorf("mqtt.terminal_topic: %w", err))
+		}
+	}
+	if c.DataTopic != "" {
+		if err := topic.ValidateTemplate(c.DataTopic, topic.Prefix, topic.Channel); err != nil {
+			errs = append(errs, fmt.Errorf("mqtt.data_topic: %w", err))
+		}
+	}
+	return errs
+}
+
+func responsePrefix(channel string) string {
+	return fmt.Sprintf("channels/%s/messages/res", channel)
+}
+
+// ErrInvalidConfig indicates that config is missing required fields or has
+// invalid values.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// MaxReplayBuffer bounds the terminal replay buffer kept for every session.
+const MaxReplayBuffer = 1 << 20
+
+// Redacted replaces the secrets in the redacted config.
+const Redacted = "[redacted]"
+
+// fieldErrors aggregates errors of the individual config fields.
+type fieldErrors []error
+
+func (fe fieldErrors) Error() string {
+	msgs := make([]string, len(fe))
+	for i, err := range fe {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (fe fieldErrors) Unwrap() []error {
+	return fe
+}
+
+// Redacted returns copy of the config with the set secrets replaced by
+// Redacted, safe to be shown or logged.
+func (c Config) Redacted() Config {
+	for _, secret := range []*string{&c.Server.AuthToken, &c.MQTT.Password, &c.MQTT.ClientKey} {
+		if *secret != "" {
+			*secret = Redacted
+		}
+	}
+	c.MQTT.Cert = tls.Certificate{}
+	return c
+}
+
+// Validate checks that config has the required fields set and sane values.
+// Returns ErrInvalidConfig wrapping the errors of all the invalid fields.
+func (c Config) Validate() error {
+	var errs fieldErrors
+	if c.Channels.Control == "" {
+		errs = append(errs, fmt.Errorf("channels.control is required"))
+	}
+	if c.Channels.Data == "" {
+		errs = append(errs, fmt.Errorf("channels.data is required"))
+	}
+	for name, id := range c.Channels.DataChannels {
+		if name == "" || id == "" {
+			errs = append(errs, fmt.Errorf("channels.data_channels must have non-empty names and IDs, got %q = %q", name, id))
+		}
+	}
+	if c.MQTT.URL == "" {
+		errs = append(errs, fmt.Errorf("mqtt.url is required"))
+	}
+	var level slog.Level
+	if c.Log.Level != "" && level.UnmarshalText([]byte(c.Log.Level)) != nil {
+		errs = append(errs, fmt.Errorf("log.level must be debug, info, warn or error, got %q", c.Log.Level))
+	}
+	if c.MQTT.QoS > 2 {
+		errs = append(errs, fmt.Errorf("mqtt.qos must be 0, 1 or 2, got %d", c.MQTT.QoS))
+	}
+	// Keep-alive is sent to the broker in seconds.
+	if c.MQTT.KeepAlive < 0 || c.MQTT.KeepAlive%time.Second != 0 {
+		errs = append(errs, fmt.Errorf("mqtt.keep_alive must be a non-negative number of seconds, got %s", c.MQTT.KeepAlive))
+	}
+	if c.MQTT.PingTimeout < 0 {
+		errs = append(errs, fmt.Errorf("mqtt.ping_timeout must not be negative, got %s", c.MQTT.PingTimeout))
+	}
+	if c.MQTT.ConnectTimeout < 0 {
+		errs = append(errs, fmt.Errorf("mqtt.connect_timeout must not be negative, got %s", c.MQTT.ConnectTimeout))
+	}
+	if c.MQTT.ConnectRetryTimeout < 0 {
+		errs = append(errs, fmt.Errorf("mqtt.connect_retry_timeout must not be negative, got %s", c.MQTT.ConnectRetryTimeout))
+	}
+	if c.MQTT.BatchWindow < 0 {
+		errs = append(errs, fmt.Errorf("mqtt.batch_window must not be negative, got %s", c.MQTT.BatchWindow))
+	}
+	if slices.Contains(c.MQTT.BatchTopics, "") {
+		errs = append(errs, fmt.Errorf("mqtt.batch_topics must not contain empty topics"))
+	}
+	errs = append(errs, c.MQTT.topicErrors()...)
+	if c.Heartbeat.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("heartbeat.interval must be positive, got %s", c.Heartbeat.Interval))
+	}
+	if c.Heartbeat.PublishInterval < 0 {
+		errs = append(errs, fmt.Errorf("heartbeat.publish_interval must not be negative, got %s", c.Heartbeat.PublishInterval))
+	}
+	// Terminal session timeout is counted down in seconds.
+	if c.Terminal.SessionTimeout < time.Second || c.Terminal.SessionTimeout%time.Second != 0 {
+		errs = append(errs, fmt.Errorf("terminal.session_timeout must be a positive number of seconds, got %s", c.Terminal.SessionTimeout))
+	}
+	if c.Terminal.ReplayBuffer < 0 || c.Terminal.ReplayBuffer > MaxReplayBuffer {
+		errs = append(errs, fmt.Errorf("terminal.replay_buffer must be between 0 and %d bytes, got %d", MaxReplayBuffer, c.Terminal.ReplayBuffer))
+	}
+	if c.Terminal.MaxDuration < 0 {
+		errs = append(errs, fmt.Errorf("terminal.max_duration must not be negative, got %s", c.Terminal.MaxDuration))
+	}
+	if c.Terminal.InputRate < 0 {
+		errs = append(errs, fmt.Errorf("terminal.input_rate must not be negative, got %d", c.Terminal.InputRate))
+	}
+	if c.Terminal.MaxInput < 0 {
+		errs = append(errs, fmt.Errorf("terminal.max_input must not be negative, got %d", c.Terminal.MaxInput))
+	}
+	if c.Terminal.MaxSessions < 0 {
+		errs = append(errs, fmt.Errorf("terminal.max_sessions must not be negative, got %d", c.Terminal.MaxSessions))
+	}
+	if f := c.Terminal.Format; f != "" && f != encoder.JSON && f != encoder.CBOR {
+		errs = append(errs, fmt.Errorf("terminal.format must be json or cbor, got %q", f))
+	}
+	if c.Exec.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("exec.timeout must not be negative, got %s", c.Exec.Timeout))
+	}
+	if c.Exec.CacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("exec.cache_ttl must not be negative, got %s", c.Exec.CacheTTL))
+	}
+	if c.Exec.MaxOutputBytes < 0 {
+		errs = append(errs, fmt.Errorf("exec.max_output_bytes must not be negative, got %d", c.Exec.MaxOutputBytes))
+	}
+	if c.Exec.Dir != "" && !filepath.IsAbs(c.Exec.Dir) {
+		errs = append(errs, fmt.Errorf("exec.dir must be an absolute path, got %s", c.Exec.Dir))
+	}
+	if c.Exec.BaseDir != "" && !filepath.IsAbs(c.Exec.BaseDir) {
+		errs = append(errs, fmt.Errorf("exec.base_dir must be an absolute path, got %s", c.Exec.BaseDir))
+	}
+	switch c.Exec.Env.Policy {
+	case "", EnvInherit, EnvClean:
+	default:
+		errs = append(errs, fmt.Errorf("exec.env.policy must be %s or %s, got %s", EnvInherit, EnvClean, c.Exec.Env.Policy))
+	}
+	if c.Exec.CompressThreshold < 0 {
+		errs = append(errs, fmt.Errorf("exec.compress_threshold must not be negative, got %d", c.Exec.CompressThreshold))
+	}
+	if c.Exec.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("exec.max_concurrent must not be negative, got %d", c.Exec.MaxConcurrent))
+	}
+	if c.Exec.QueueTimeout < 0 {
+		errs = append(errs, fmt.Errorf("exec.queue_timeout must not be negative, got %s", c.Exec.QueueTimeout))
+	}
+	if c.Edgex.PollInterval < 0 {
+		errs = append(errs, fmt.Errorf("edgex.poll_interval must not be negative, got %s", c.Edgex.PollInterval))
+	}
+	if c.Exec.MaxRetries < 0 {
+		errs = append(errs, fmt.Errorf("exec.max_retries must not be negative, got %d", c.Exec.MaxRetries))
+	}
+	if c.Exec.RetryDelay < 0 {
+		errs = append(errs, fmt.Errorf("exec.retry_delay must not be negative, got %s", c.Exec.RetryDelay))
+	}
+	if _, err := credential(c.Exec.User); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return wrap(ErrInvalidConfig, errs)
+	}
+	return nil
 }
 
-func NewConfig(sc ServerConfig, cc ChanConfig, ec EdgexConfig, lc LogConfig, mc MQTTConfig, hc HeartbeatConfig, tc TerminalConfig, file string) Config {
+func NewConfig(sc ServerConfig, cc ChanConfig, ec EdgexConfig, lc LogConfig, mc MQTTConfig, hc HeartbeatConfig, tc TerminalConfig, xc ExecConfig, file string) Config {
 	return Config{
 		Server:    sc,
 		Channels:  cc,
@@ -78,12 +462,20 @@ func NewConfig(sc ServerConfig, cc ChanConfig, ec EdgexConfig, lc LogConfig, mc
 		MQTT:      mc,
 		Heartbeat: hc,
 		Terminal:  tc,
+		Exec:      xc,
 		File:      file,
 	}
 }
 
-// Save - store config in a file.
+// Save - store config in a file. MQTT credentials are stored in the
+// credentials file instead, if it's set.
 func SaveConfig(c Config) error {
+	if c.MQTT.CredentialsFile != "" {
+		if err := writeCredentials(c.MQTT.CredentialsFile, c.MQTT.Username, c.MQTT.Password); err != nil {
+			return err
+		}
+		c.MQTT.Username, c.MQTT.Password = "", ""
+	}
 	b, err := toml.Marshal(c)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error reading config file: %s", err))
@@ -94,10 +486,14 @@ func SaveConfig(c Config) error {
 	return nil
 }
 
-// Read - retrieve config from a file.
+// Read - retrieve config from a file, along with MQTT credentials from the
+// credentials file if it's set. Returns ErrConfigNotFound if file doesn't exist.
 func ReadConfig(file string) (Config, error) {
 	data, err := os.ReadFile(file)
 	c := Config{}
+	if os.IsNotExist(err) {
+		return c, wrap(ErrConfigNotFound, err)
+	}
 	if err != nil {
 		return c, errors.New(fmt.Sprintf("Error reading config file: %s", err))
 	}
@@ -105,6 +501,11 @@ func ReadConfig(file string) (Config, error) {
 	if err := toml.Unmarshal(data, &c); err != nil {
 		return Config{}, errors.New(fmt.Sprintf("Error unmarshaling toml: %s", err))
 	}
+	if c.MQTT.CredentialsFile != "" {
+		if c.MQTT.Username, c.MQTT.Password, err = readCredentials(c.MQTT.CredentialsFile); err != nil {
+			return Config{}, err
+		}
+	}
 	return c, nil
 }
 
@@ -114,48 +515,134 @@ func (d *HeartbeatConfig) UnmarshalJSON(b []byte) error {
 	if err := json.Unmarshal(b, &v); err != nil {
 		return err
 	}
+	if topic, ok := v["topic"].(string); ok {
+		d.Topic = topic
+	}
+	if value, ok := v["publish_interval"]; ok {
+		interval, err := parseDuration(value)
+		if err != nil {
+			return err
+		}
+		d.PublishInterval = interval
+	}
 	interval, ok := v["interval"]
 	if !ok {
 		return errors.New("missing value")
 	}
-	switch value := interval.(type) {
+	var err error
+	d.Interval, err = parseDuration(interval)
+	return err
+}
+
+// parseDuration parses JSON duration given either as a number of
+// nanoseconds or as a duration string.
+func parseDuration(v interface{}) (time.Duration, error) {
+	switch value := v.(type) {
 	case float64:
-		d.Interval = time.Duration(value)
-		return nil
+		return time.Duration(value), nil
 	case string:
-		var err error
-		d.Interval, err = time.ParseDuration(value)
-		if err != nil {
-			return err
-		}
-		return nil
+		return time.ParseDuration(value)
 	default:
-		return errors.New("invalid duration")
+		return 0, errors.New("invalid duration")
 	}
 }
 
-// UnmarshalJSON parses the duration from JSON.
+// UnmarshalJSON parses the durations from JSON.
 func (d *TerminalConfig) UnmarshalJSON(b []byte) error {
-	var v map[string]interface{}
+	type alias TerminalConfig
+	v := struct {
+		SessionTimeout interface{} `json:"session_timeout"`
+		MaxDuration    interface{} `json:"max_duration"`
+		*alias
+	}{alias: (*alias)(d)}
 	if err := json.Unmarshal(b, &v); err != nil {
 		return err
 	}
-	session_timeout, ok := v["session_timeout"]
-	if !ok {
+	if v.MaxDuration != nil {
+		var err error
+		if d.MaxDuration, err = parseDuration(v.MaxDuration); err != nil {
+			return err
+		}
+	}
+	if v.SessionTimeout == nil {
 		return errors.New("missing value")
 	}
-	switch value := session_timeout.(type) {
-	case float64:
-		d.SessionTimeout = time.Duration(value)
-		return nil
-	case string:
+	var err error
+	d.SessionTimeout, err = parseDuration(v.SessionTimeout)
+	return err
+}
+
+// UnmarshalJSON parses the durations from JSON.
+func (d *MQTTConfig) UnmarshalJSON(b []byte) error {
+	type alias MQTTConfig
+	v := struct {
+		KeepAlive           interface{} `json:"keep_alive"`
+		PingTimeout         interface{} `json:"ping_timeout"`
+		ConnectTimeout      interface{} `json:"connect_timeout"`
+		ConnectRetryTimeout interface{} `json:"connect_retry_timeout"`
+		BatchWindow         interface{} `json:"batch_window"`
+		*alias
+	}{alias: (*alias)(d)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	durations := []struct {
+		value interface{}
+		d     *time.Duration
+	}{
+		{v.KeepAlive, &d.KeepAlive},
+		{v.PingTimeout, &d.PingTimeout},
+		{v.ConnectTimeout, &d.ConnectTimeout},
+		{v.ConnectRetryTimeout, &d.ConnectRetryTimeout},
+		{v.BatchWindow, &d.BatchWindow},
+	}
+	for _, dur := range durations {
+		if dur.value == nil {
+			continue
+		}
 		var err error
-		d.SessionTimeout, err = time.ParseDuration(value)
-		if err != nil {
+		if *dur.d, err = parseDuration(dur.value); err != nil {
 			return err
 		}
+	}
+	return nil
+}
+
+// UnmarshalJSON parses the durations from JSON.
+func (d *ExecConfig) UnmarshalJSON(b []byte) error {
+	type alias ExecConfig
+	v := struct {
+		Timeout      interface{} `json:"timeout"`
+		CacheTTL     interface{} `json:"cache_ttl"`
+		QueueTimeout interface{} `json:"queue_timeout"`
+		RetryDelay   interface{} `json:"retry_delay"`
+		*alias
+	}{alias: (*alias)(d)}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	if v.CacheTTL != nil {
+		var err error
+		if d.CacheTTL, err = parseDuration(v.CacheTTL); err != nil {
+			return err
+		}
+	}
+	if v.QueueTimeout != nil {
+		var err error
+		if d.QueueTimeout, err = parseDuration(v.QueueTimeout); err != nil {
+			return err
+		}
+	}
+	if v.RetryDelay != nil {
+		var err error
+		if d.RetryDelay, err = parseDuration(v.RetryDelay); err != nil {
+			return err
+		}
+	}
+	if v.Timeout == nil {
 		return nil
-	default:
-		return errors.New("invalid duration")
 	}
+	var err error
+	d.Timeout, err = parseDuration(v.Timeout)
+	return err
 }
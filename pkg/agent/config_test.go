@@ -0,0 +1,662 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecConfigUnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		desc string
+		data string
+		cfg  agent.ExecConfig
+		err  bool
+	}{
+		{
+			desc: "unmarshal timeout and command lists",
+			data: `{"timeout":"30s","allowlist":["ls","edgex-*"],"denylist":["rm"]}`,
+			cfg: agent.ExecConfig{
+				Timeout:   30 * time.Second,
+				Allowlist: []string{"ls", "edgex-*"},
+				Denylist:  []string{"rm"},
+			},
+		},
+		{
+			desc: "unmarshal without timeout",
+			data: `{"allowlist":["ls"]}`,
+			cfg:  agent.ExecConfig{Allowlist: []string{"ls"}},
+		},
+		{
+			desc: "unmarshal cache ttl",
+			data: `{"cacheable":["uptime"],"cache_ttl":"5s"}`,
+			cfg:  agent.ExecConfig{Cacheable: []string{"uptime"}, CacheTTL: 5 * time.Second},
+		},
+		{
+			desc: "unmarshal concurrency limit",
+			data: `{"max_concurrent":2,"queue_timeout":"3s"}`,
+			cfg:  agent.ExecConfig{MaxConcurrent: 2, QueueTimeout: 3 * time.Second},
+		},
+		{
+			desc: "unmarshal retries",
+			data: `{"retryable":["systemctl"],"retry_exit_codes":[75],"max_retries":3,"retry_delay":"500ms"}`,
+			cfg:  agent.ExecConfig{Retryable: []string{"systemctl"}, RetryExitCodes: []int{75}, MaxRetries: 3, RetryDelay: 500 * time.Millisecond},
+		},
+		{
+			desc: "unmarshal invalid timeout",
+			data: `{"timeout":true}`,
+			err:  true,
+		},
+		{
+			desc: "unmarshal invalid cache ttl",
+			data: `{"cache_ttl":"5x"}`,
+			err:  true,
+		},
+		{
+			desc: "unmarshal invalid retry delay",
+			data: `{"retry_delay":"soon"}`,
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		var cfg agent.ExecConfig
+		err := json.Unmarshal([]byte(tc.data), &cfg)
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		if !tc.err {
+			assert.Equal(t, tc.cfg, cfg, fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.cfg, cfg))
+		}
+	}
+}
+
+func TestMQTTConfigUnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		desc string
+		data string
+		cfg  agent.MQTTConfig
+		err  bool
+	}{
+		{
+			desc: "unmarshal keep-alive settings",
+			data: `{"url":"localhost:1883","keep_alive":"20s","ping_timeout":"5s","connect_timeout":15000000000,"connect_retry_timeout":"2m"}`,
+			cfg:  agent.MQTTConfig{URL: "localhost:1883", KeepAlive: 20 * time.Second, PingTimeout: 5 * time.Second, ConnectTimeout: 15 * time.Second, ConnectRetryTimeout: 2 * time.Minute},
+		},
+		{
+			desc: "unmarshal batching settings",
+			data: `{"url":"localhost:1883","batch_window":"200ms","batch_topics":["channels/+/messages/#"]}`,
+			cfg:  agent.MQTTConfig{URL: "localhost:1883", BatchWindow: 200 * time.Millisecond, BatchTopics: []string{"channels/+/messages/#"}},
+		},
+		{
+			desc: "unmarshal without keep-alive settings",
+			data: `{"url":"localhost:1883"}`,
+			cfg:  agent.MQTTConfig{URL: "localhost:1883"},
+		},
+		{
+			desc: "unmarshal invalid keep-alive",
+			data: `{"keep_alive":"20x"}`,
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		var cfg agent.MQTTConfig
+		err := json.Unmarshal([]byte(tc.data), &cfg)
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		if !tc.err {
+			assert.Equal(t, tc.cfg, cfg, fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.cfg, cfg))
+		}
+	}
+}
+
+func TestTerminalConfigUnmarshalJSON(t *testing.T) {
+	cases := []struct {
+		desc string
+		data string
+		cfg  agent.TerminalConfig
+		err  bool
+	}{
+		{
+			desc: "unmarshal session settings",
+			data: `{"session_timeout":"1m","max_duration":"1h","format":"cbor","ack_window":8,"replay_buffer":1024,"shell":"sh","input_rate":2048,"max_input":4096,"max_sessions":3,"banner":"hello {uuid}"}`,
+			cfg: agent.TerminalConfig{
+				SessionTimeout: time.Minute,
+				MaxDuration:    time.Hour,
+				Format:         "cbor",
+				AckWindow:      8,
+				ReplayBuffer:   1024,
+				Shell:          "sh",
+				InputRate:      2048,
+				MaxInput:       4096,
+				MaxSessions:    3,
+				Banner:         "hello {uuid}",
+			},
+		},
+		{
+			desc: "unmarshal session timeout in nanoseconds",
+			data: `{"session_timeout":10000000000}`,
+			cfg:  agent.TerminalConfig{SessionTimeout: 10 * time.Second},
+		},
+		{
+			desc: "unmarshal invalid session timeout",
+			data: `{"session_timeout":"10x"}`,
+			err:  true,
+		},
+		{
+			desc: "unmarshal without session timeout",
+			data: `{"shell":"sh"}`,
+			err:  true,
+		},
+	}
+
+	for _, tc := range cases {
+		var cfg agent.TerminalConfig
+		err := json.Unmarshal([]byte(tc.data), &cfg)
+		assert.Equal(t, tc.err, err != nil, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		if !tc.err {
+			assert.Equal(t, tc.cfg, cfg, fmt.Sprintf("%s: expected %v got %v", tc.desc, tc.cfg, cfg))
+		}
+	}
+}
+
+func TestTerminalConfigJSONRoundTrip(t *testing.T) {
+	cfg := agent.TerminalConfig{
+		SessionTimeout: time.Minute,
+		MaxDuration:    time.Hour,
+		Format:         "cbor",
+		AckWindow:      8,
+		ReplayBuffer:   1024,
+		Shell:          "sh",
+		InputRate:      2048,
+		MaxInput:       4096,
+		MaxSessions:    3,
+		Banner:         "hello {uuid}",
+	}
+	// Every field is set, so the ones the decoder drops fail the comparison.
+	v := reflect.ValueOf(cfg)
+	for i := 0; i < v.NumField(); i++ {
+		require.False(t, v.Field(i).IsZero(), fmt.Sprintf("expected field %s to be set in the test config", v.Type().Field(i).Name))
+	}
+
+	b, err := json.Marshal(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error marshalling config: %s", err))
+	var c agent.TerminalConfig
+	err = json.Unmarshal(b, &c)
+	require.Nil(t, err, fmt.Sprintf("unexpected error unmarshalling config: %s", err))
+	assert.Equal(t, cfg, c, "expected config to survive JSON round trip")
+}
+
+func validConfig() agent.Config {
+	return agent.Config{
+		Channels:  agent.ChanConfig{Control: "control", Data: "data"},
+		MQTT:      agent.MQTTConfig{URL: "localhost:1883"},
+		Heartbeat: agent.HeartbeatConfig{Interval: 10 * time.Second},
+		Terminal:  agent.TerminalConfig{SessionTimeout: time.Minute},
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	cases := []struct {
+		desc   string
+		modify func(c *agent.Config)
+		fields []string
+	}{
+		{
+			desc:   "validate valid config",
+			modify: func(c *agent.Config) {},
+		},
+		{
+			desc:   "validate config without data channel",
+			modify: func(c *agent.Config) { c.Channels.Data = "" },
+			fields: []string{"channels.data"},
+		},
+		{
+			desc:   "validate config with data channel without ID",
+			modify: func(c *agent.Config) { c.Channels.DataChannels = map[string]string{"temperature": ""} },
+			fields: []string{"channels.data_channels"},
+		},
+		{
+			desc:   "validate config without MQTT URL",
+			modify: func(c *agent.Config) { c.MQTT.URL = "" },
+			fields: []string{"mqtt.url"},
+		},
+		{
+			desc:   "validate config with invalid log level",
+			modify: func(c *agent.Config) { c.Log.Level = "verbose" },
+			fields: []string{"log.level"},
+		},
+		{
+			desc:   "validate config with invalid QoS",
+			modify: func(c *agent.Config) { c.MQTT.QoS = 3 },
+			fields: []string{"mqtt.qos"},
+		},
+		{
+			desc:   "validate config with zero heartbeat interval",
+			modify: func(c *agent.Config) { c.Heartbeat.Interval = 0 },
+			fields: []string{"heartbeat.interval"},
+		},
+		{
+			desc:   "validate config with sub-second session timeout",
+			modify: func(c *agent.Config) { c.Terminal.SessionTimeout = 1500 * time.Millisecond },
+			fields: []string{"terminal.session_timeout"},
+		},
+		{
+			desc:   "validate config with negative terminal max duration",
+			modify: func(c *agent.Config) { c.Terminal.MaxDuration = -time.Second },
+			fields: []string{"terminal.max_duration"},
+		},
+		{
+			desc: "validate config with invalid MQTT keep-alive settings",
+			modify: func(c *agent.Config) {
+				c.MQTT.KeepAlive, c.MQTT.PingTimeout, c.MQTT.ConnectTimeout = 1500*time.Millisecond, -time.Second, -time.Second
+				c.MQTT.ConnectRetryTimeout = -time.Second
+			},
+			fields: []string{"mqtt.keep_alive", "mqtt.ping_timeout", "mqtt.connect_timeout", "mqtt.connect_retry_timeout"},
+		},
+		{
+			desc: "validate config with invalid batching settings",
+			modify: func(c *agent.Config) {
+				c.MQTT.BatchWindow, c.MQTT.BatchTopics = -time.Second, []string{""}
+			},
+			fields: []string{"mqtt.batch_window", "mqtt.batch_topics"},
+		},
+		{
+			desc:   "validate config with negative terminal input limits",
+			modify: func(c *agent.Config) { c.Terminal.InputRate, c.Terminal.MaxInput = -1, -1 },
+			fields: []string{"terminal.input_rate", "terminal.max_input"},
+		},
+		{
+			desc: "validate config with negative concurrency limits",
+			modify: func(c *agent.Config) {
+				c.Exec.MaxConcurrent, c.Exec.QueueTimeout, c.Terminal.MaxSessions = -1, -time.Second, -1
+			},
+			fields: []string{"exec.max_concurrent", "exec.queue_timeout", "terminal.max_sessions"},
+		},
+		{
+			desc:   "validate config with negative exec retries",
+			modify: func(c *agent.Config) { c.Exec.MaxRetries, c.Exec.RetryDelay = -1, -time.Second },
+			fields: []string{"exec.max_retries", "exec.retry_delay"},
+		},
+		{
+			desc:   "validate config with negative cache TTL and poll interval",
+			modify: func(c *agent.Config) { c.Exec.CacheTTL, c.Edgex.PollInterval = -time.Second, -time.Second },
+			fields: []string{"exec.cache_ttl", "edgex.poll_interval"},
+		},
+		{
+			desc: "validate config with topic templates",
+			modify: func(c *agent.Config) {
+				c.MQTT.TerminalTopic, c.MQTT.DataTopic = "site/{channel}/term/{uuid}", "site/{prefix}"
+			},
+		},
+		{
+			desc: "validate config with invalid topic templates",
+			modify: func(c *agent.Config) {
+				c.MQTT.TerminalTopic, c.MQTT.DataTopic = "{prefix}/term/{session}", "{prefix}/{uuid}"
+			},
+			fields: []string{"mqtt.terminal_topic", "mqtt.data_topic"},
+		},
+		{
+			desc:   "validate config with unsupported terminal format",
+			modify: func(c *agent.Config) { c.Terminal.Format = "xml" },
+			fields: []string{"terminal.format"},
+		},
+		{
+			desc:   "validate config with negative exec timeout",
+			modify: func(c *agent.Config) { c.Exec.Timeout = -time.Second },
+			fields: []string{"exec.timeout"},
+		},
+		{
+			desc:   "validate config with negative exec max output",
+			modify: func(c *agent.Config) { c.Exec.MaxOutputBytes = -1 },
+			fields: []string{"exec.max_output_bytes"},
+		},
+		{
+			desc:   "validate config with unsupported env policy",
+			modify: func(c *agent.Config) { c.Exec.Env.Policy = "none" },
+			fields: []string{"exec.env.policy"},
+		},
+		{
+			desc:   "validate config with relative exec directories",
+			modify: func(c *agent.Config) { c.Exec.Dir, c.Exec.BaseDir = "work", "base" },
+			fields: []string{"exec.dir", "exec.base_dir"},
+		},
+		{
+			desc:   "validate config with user ID",
+			modify: func(c *agent.Config) { c.Exec.User = "0" },
+		},
+		{
+			desc:   "validate config with missing user",
+			modify: func(c *agent.Config) { c.Exec.User = "agent-test-missing-user" },
+			fields: []string{"exec.user"},
+		},
+		{
+			desc:   "validate empty config",
+			modify: func(c *agent.Config) { *c = agent.Config{} },
+			fields: []string{"channels.control", "channels.data", "mqtt.url", "heartbeat.interval", "terminal.session_timeout"},
+		},
+	}
+
+	for _, tc := range cases {
+		cfg := validConfig()
+		tc.modify(&cfg)
+		err := cfg.Validate()
+		if len(tc.fields) == 0 {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+			continue
+		}
+		assert.True(t, errors.Contains(err, agent.ErrInvalidConfig), fmt.Sprintf("%s: expected error %s got %s", tc.desc, agent.ErrInvalidConfig, err))
+		for _, f := range tc.fields {
+			assert.True(t, strings.Contains(err.Error(), f), fmt.Sprintf("%s: expected error for %s in %s", tc.desc, f, err))
+		}
+		assert.Equal(t, len(tc.fields), strings.Count(err.Error(), ";")+1, fmt.Sprintf("%s: expected %d field errors in %s", tc.desc, len(tc.fields), err))
+	}
+}
+
+func TestConfigTopics(t *testing.T) {
+	cases := []struct {
+		desc     string
+		terminal string
+		data     string
+		termOut  string
+		dataOut  string
+	}{
+		{
+			desc:    "default topics",
+			termOut: "channels/control/messages/res/term/1",
+			dataOut: "channels/data/messages/res",
+		},
+		{
+			desc:     "topics with prefix",
+			terminal: "site/{prefix}/term/{uuid}",
+			data:     "site/{prefix}",
+			termOut:  "site/channels/control/messages/res/term/1",
+			dataOut:  "site/channels/data/messages/res",
+		},
+		{
+			desc:     "topics with channel",
+			terminal: "{channel}/sessions/{uuid}/out",
+			data:     "devices/{channel}",
+			termOut:  "control/sessions/1/out",
+			dataOut:  "devices/data",
+		},
+	}
+
+	for _, tc := range cases {
+		cfg := validConfig()
+		cfg.MQTT.TerminalTopic, cfg.MQTT.DataTopic = tc.terminal, tc.data
+		assert.Equal(t, tc.termOut, cfg.TerminalTopic("1"), fmt.Sprintf("%s: expected terminal topic", tc.desc))
+		assert.Equal(t, tc.dataOut, cfg.DataTopic(cfg.Channels.Data), fmt.Sprintf("%s: expected data topic", tc.desc))
+	}
+}
+
+func TestTerminalBanner(t *testing.T) {
+	hostname, err := os.Hostname()
+	require.Nil(t, err, fmt.Sprintf("unexpected error getting host name: %s", err))
+
+	cases := []struct {
+		desc   string
+		banner string
+		out    string
+	}{
+		{desc: "no banner"},
+		{desc: "banner", banner: "Authorized use only", out: "Authorized use only"},
+		{desc: "banner with placeholders", banner: "Session {uuid} on {thing}@{hostname}", out: fmt.Sprintf("Session 1 on thing@%s", hostname)},
+		{desc: "banner with unknown placeholder", banner: "Device {id}", out: "Device {id}"},
+	}
+
+	for _, tc := range cases {
+		cfg := validConfig()
+		cfg.MQTT.Username = "thing"
+		cfg.Terminal.Banner = tc.banner
+		assert.Equal(t, tc.out, cfg.TerminalBanner("1"), fmt.Sprintf("%s: unexpected banner", tc.desc))
+	}
+}
+
+func TestAddConfigValidation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	svc, _ := newService(t, agent.Config{File: file})
+
+	cfg := validConfig()
+	cfg.MQTT.URL = ""
+	cfg.File = file
+	err := svc.AddConfig(cfg)
+	assert.True(t, errors.Contains(err, agent.ErrInvalidConfig), fmt.Sprintf("expected error %s got %s", agent.ErrInvalidConfig, err))
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err), "expected invalid config not to be saved")
+
+	cfg = validConfig()
+	cfg.File = file
+	err = svc.AddConfig(cfg)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	_, err = os.Stat(file)
+	assert.Nil(t, err, fmt.Sprintf("expected config to be saved: %s", err))
+}
+
+func TestAddConfigIdempotency(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	svc, _ := newService(t, agent.Config{File: file})
+
+	cases := []struct {
+		desc  string
+		key   string
+		port  string
+		saved bool
+	}{
+		{desc: "add config with key", key: "1", port: "9999", saved: true},
+		{desc: "add config with duplicate key", key: "1", port: "9998", saved: false},
+		{desc: "add config with new key", key: "2", port: "9997", saved: true},
+		{desc: "add config without key", port: "9996", saved: true},
+		{desc: "add config without key again", port: "9995", saved: true},
+	}
+
+	for _, tc := range cases {
+		before, _ := agent.ReadConfig(file)
+		cfg := validConfig()
+		cfg.Server.Port = tc.port
+		cfg.IdempotencyKey = tc.key
+		cfg.File = file
+		err := svc.AddConfig(cfg)
+		assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		saved, err := agent.ReadConfig(file)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error reading config: %s", tc.desc, err))
+		if !tc.saved {
+			assert.Equal(t, before, saved, fmt.Sprintf("%s: expected config not to be saved", tc.desc))
+			continue
+		}
+		assert.Equal(t, tc.port, saved.Server.Port, fmt.Sprintf("%s: expected config to be saved", tc.desc))
+		assert.Equal(t, tc.key, saved.IdempotencyKey, fmt.Sprintf("%s: expected key to be saved", tc.desc))
+	}
+}
+
+func TestAddConfigIdempotencyAfterRestart(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	svc, _ := newService(t, agent.Config{File: file})
+
+	cfg := validConfig()
+	cfg.Server.Port = "9999"
+	cfg.IdempotencyKey = "1"
+	cfg.File = file
+	err := svc.AddConfig(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+
+	// The restarted agent runs the saved config.
+	saved, err := agent.ReadConfig(file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading config: %s", err))
+	svc, _ = newService(t, saved)
+
+	cfg.Server.Port = "9998"
+	err = svc.AddConfig(cfg)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	saved, err = agent.ReadConfig(file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading config: %s", err))
+	assert.Equal(t, "9999", saved.Server.Port, "expected duplicate config not to be saved after restart")
+}
+
+func TestPatchOf(t *testing.T) {
+	c := validConfig()
+	c.Server.Port = "9999"
+	c.Log.Level = "debug"
+	c.Exec.Allowlist = []string{"ls"}
+	c.Edgex.PollInterval = time.Second
+	c.Terminal.InputRate = 1024
+	c.Terminal.Banner = "hello {uuid}"
+	c.MQTT.QoS = 1
+	c.File = "config.toml"
+
+	var got agent.Config
+	agent.PatchOf(c).Apply(&got)
+
+	// MQTT connection settings and the file aren't patchable.
+	want := c
+	want.MQTT = agent.MQTTConfig{QoS: 1}
+	want.File = ""
+	assert.Equal(t, want, got)
+}
+
+func TestConfigDiff(t *testing.T) {
+	base := agent.Config{File: "config.toml"}
+	base.MQTT.URL = "localhost:1883"
+	base.MQTT.Username = "thing"
+	base.MQTT.Password = "key"
+	base.Channels = agent.ChanConfig{Control: "control", Data: "data"}
+	base.Exec.Allowlist = []string{"ls"}
+	base.Exec.Env.Policy = agent.EnvInherit
+	base.Heartbeat.Interval = 10 * time.Second
+
+	cases := []struct {
+		desc    string
+		modify  func(c *agent.Config)
+		changes []agent.FieldChange
+	}{
+		{
+			desc:   "diff equal configs",
+			modify: func(c *agent.Config) {},
+		},
+		{
+			desc: "diff configs with nested changes",
+			modify: func(c *agent.Config) {
+				c.Channels.Data = "data2"
+				c.Exec.Env.Policy = agent.EnvClean
+				c.Exec.Allowlist = []string{"ls", "uptime"}
+				c.Heartbeat.Interval = 30 * time.Second
+			},
+			changes: []agent.FieldChange{
+				{Path: "exec.allowlist", Old: []string{"ls"}, New: []string{"ls", "uptime"}},
+				{Path: "exec.env.policy", Old: agent.EnvInherit, New: agent.EnvClean},
+				{Path: "heartbeat.interval", Old: "10s", New: "30s"},
+				{Path: "channels.data", Old: "data", New: "data2"},
+			},
+		},
+		{
+			desc: "diff configs with changed secrets",
+			modify: func(c *agent.Config) {
+				c.MQTT.Username = "thing2"
+				c.MQTT.Password = "key2"
+				c.Server.AuthToken = "token"
+			},
+			changes: []agent.FieldChange{
+				{Path: "server.auth_token", Old: "", New: agent.Redacted},
+				{Path: "mqtt.username", Old: "thing", New: "thing2"},
+				{Path: "mqtt.password", Old: agent.Redacted, New: agent.Redacted},
+			},
+		},
+		{
+			desc: "diff configs with removed secret",
+			modify: func(c *agent.Config) {
+				c.MQTT.Password = ""
+			},
+			changes: []agent.FieldChange{
+				{Path: "mqtt.password", Old: agent.Redacted, New: ""},
+			},
+		},
+		{
+			desc: "diff configs with fields not saved",
+			modify: func(c *agent.Config) {
+				c.File = "other.toml"
+				c.MQTT.CA = []byte("ca")
+				c.Exec.Denylist = []string{}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		other := base
+		other.Exec.Allowlist = slices.Clone(base.Exec.Allowlist)
+		tc.modify(&other)
+		changes := base.Diff(other)
+		assert.Equal(t, tc.changes, changes, fmt.Sprintf("%s: unexpected changes", tc.desc))
+	}
+}
+
+func TestSaveConfigCredentialsFile(t *testing.T) {
+	dir := t.TempDir()
+	cfg := agent.Config{File: filepath.Join(dir, "config.toml")}
+	cfg.MQTT.URL = "localhost:1883"
+	cfg.MQTT.Username = "thing-id"
+	cfg.MQTT.Password = "thing-key"
+	cfg.MQTT.CredentialsFile = filepath.Join(dir, "credentials.toml")
+
+	// Permissions of the existing file are restricted too.
+	err := os.WriteFile(cfg.MQTT.CredentialsFile, []byte(""), 0o644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing credentials: %s", err))
+
+	err = agent.SaveConfig(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error saving config: %s", err))
+
+	data, err := os.ReadFile(cfg.File)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading config: %s", err))
+	assert.NotContains(t, string(data), "thing-id", "expected config file not to contain username")
+	assert.NotContains(t, string(data), "thing-key", "expected config file not to contain password")
+
+	fi, err := os.Stat(cfg.MQTT.CredentialsFile)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading credentials: %s", err))
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm(), "expected credentials file readable by owner only")
+	data, err = os.ReadFile(cfg.MQTT.CredentialsFile)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading credentials: %s", err))
+	assert.Contains(t, string(data), "thing-key", "expected credentials file to contain password")
+
+	c, err := agent.ReadConfig(cfg.File)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading config: %s", err))
+	assert.Equal(t, "thing-id", c.MQTT.Username)
+	assert.Equal(t, "thing-key", c.MQTT.Password)
+
+	err = os.Remove(cfg.MQTT.CredentialsFile)
+	require.Nil(t, err, fmt.Sprintf("unexpected error removing credentials: %s", err))
+	_, err = agent.ReadConfig(cfg.File)
+	assert.NotNil(t, err, "expected error reading config without credentials file")
+}
+
+func TestCredentialsFile(t *testing.T) {
+	mc := agent.MQTTConfig{Username: "thing-id", Password: "thing-key", CredentialsFile: filepath.Join(t.TempDir(), "credentials.toml")}
+	creds := agent.NewCredentials(mc)
+
+	username, password := creds.Get()
+	assert.Equal(t, "thing-id", username, "expected credentials set if file is missing")
+	assert.Equal(t, "thing-key", password, "expected credentials set if file is missing")
+
+	// Modification time must advance past the time credentials were set.
+	time.Sleep(10 * time.Millisecond)
+	err := os.WriteFile(mc.CredentialsFile, []byte("username = \"new-id\"\npassword = \"new-key\"\n"), 0o600)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing credentials: %s", err))
+	username, password = creds.Get()
+	assert.Equal(t, "new-id", username, "expected credentials read from updated file")
+	assert.Equal(t, "new-key", password, "expected credentials read from updated file")
+
+	creds.Set(agent.MQTTConfig{Username: "rotated-id", Password: "rotated-key", CredentialsFile: mc.CredentialsFile})
+	username, password = creds.Get()
+	assert.Equal(t, "rotated-id", username, "expected credentials set after file update")
+	assert.Equal(t, "rotated-key", password, "expected credentials set after file update")
+}
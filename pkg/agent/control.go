@@ -0,0 +1,173 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/andychao217/magistrala/pkg/messaging"
+)
+
+const (
+	reload   = "reload"
+	setLevel = "set-level"
+	restart  = "restart"
+)
+
+// ErrUnknownControlVerb indicates that no handler is registered for the control verb.
+var ErrUnknownControlVerb = errors.New("unknown control verb")
+
+// ControlHandler handles the control verb called with the args and returns
+// the response published to the control channel.
+type ControlHandler func(args []string) (string, error)
+
+// controlFunc handles the control verb and publishes its response itself.
+type controlFunc func(uuid string, args []string) error
+
+// parseControl splits the control string into the verb and its args. Args
+// are separated by commas, with the spaces stripped, or by whitespace if
+// there are no commas, so both "set-level, debug" and "set-level debug" work.
+func parseControl(cmdStr string) (string, []string, error) {
+	fields := strings.Fields(cmdStr)
+	if strings.Contains(cmdStr, ",") {
+		fields = strings.Split(strings.ReplaceAll(cmdStr, " ", ""), ",")
+	}
+	if len(fields) == 0 || fields[0] == "" {
+		return "", nil, ErrInvalidCommand
+	}
+	return fields[0], fields[1:], nil
+}
+
+func (a *agent) Control(uuid, cmdStr string) error {
+	if err := a.checkLockdown(); err != nil {
+		return err
+	}
+	verb, args, err := parseControl(cmdStr)
+	if err != nil {
+		return err
+	}
+	// Lockdown must remain available regardless of the command lists.
+	if verb != lockdown {
+		if err := a.checkCommand(verb); err != nil {
+			return err
+		}
+	}
+	a.controlsMu.RLock()
+	handle, ok := a.controls[verb]
+	a.controlsMu.RUnlock()
+	if !ok {
+		return wrap(ErrUnknownControlVerb, fmt.Errorf("%q", verb))
+	}
+	return handle(uuid, args)
+}
+
+func (a *agent) RegisterControl(verb string, h ControlHandler) error {
+	if verb == "" || strings.ContainsAny(verb, ", \t\n") || h == nil {
+		return ErrMalformedEntity
+	}
+	a.registerControl(verb, func(uuid string, args []string) error {
+		resp, err := h(args)
+		if err != nil {
+			return err
+		}
+		return a.processResponse(uuid, verb, resp)
+	})
+	return nil
+}
+
+func (a *agent) registerControl(verb string, f controlFunc) {
+	a.controlsMu.Lock()
+	defer a.controlsMu.Unlock()
+	if a.controls == nil {
+		a.controls = make(map[string]controlFunc)
+	}
+	a.controls[verb] = f
+}
+
+// registerControls registers handlers of the built-in control verbs.
+func (a *agent) registerControls() {
+	a.registerControl(rotateCredentials, a.rotateCredentials)
+	a.registerControl(lockdown, a.lockdown)
+	a.registerControl(reapSessions, func(uuid string, _ []string) error {
+		n, err := a.ReapSessions()
+		if err != nil {
+			return err
+		}
+		return a.processResponse(uuid, reapSessions, strconv.Itoa(n))
+	})
+	a.registerControl(reload, func(uuid string, _ []string) error {
+		if _, err := a.Reload(); err != nil {
+			return err
+		}
+		return a.processResponse(uuid, reload, "ok")
+	})
+	a.registerControl(setLevel, a.setLevel)
+	a.registerControl(restart, a.restart)
+	a.registerControl(edgexCommand, a.edgexCommand)
+	a.registerControl("edgex-operation", a.edgexControl("edgex-operation", func(args []string) (string, error) {
+		return a.edgexClient.PushOperation(args)
+	}))
+	a.registerControl("edgex-config", a.edgexControl("edgex-config", func(args []string) (string, error) {
+		return a.edgexClient.FetchConfig(args)
+	}))
+	a.registerControl("edgex-metrics", a.edgexControl("edgex-metrics", func(args []string) (string, error) {
+		return a.edgexClient.FetchMetrics(args)
+	}))
+	a.registerControl("edgex-ping", a.edgexControl("edgex-ping", func([]string) (string, error) {
+		return a.edgexClient.Ping()
+	}))
+}
+
+// edgexControl returns handler running EdgeX operation within the exec timeout.
+func (a *agent) edgexControl(verb string, op func(args []string) (string, error)) controlFunc {
+	return func(uuid string, args []string) error {
+		resp, err := a.withTimeout(func() (string, error) { return op(args) })
+		if err == ErrExecTimeout {
+			return err
+		}
+		if err != nil {
+			return errors.Wrap(errEdgexFailed, err)
+		}
+		return a.processResponse(uuid, verb, resp)
+	}
+}
+
+// Message for this command
+// [{"bn":"1:", "n":"control", "vs":"set-level debug"}]
+// Level is saved to the config file, so it survives restart.
+func (a *agent) setLevel(uuid string, args []string) error {
+	if len(args) != 1 {
+		return ErrInvalidCommand
+	}
+	level := args[0]
+	if err := a.UpdateConfig(ConfigPatch{Log: &LogPatch{Level: &level}}); err != nil {
+		return err
+	}
+	return a.processResponse(uuid, setLevel, "ok")
+}
+
+// Message for this command
+// [{"bn":"1:", "n":"control", "vs":"restart export"}]
+// Restart is requested from the service over the broker, on the same subject
+// prefix as its config commands.
+func (a *agent) restart(uuid string, args []string) error {
+	if len(args) != 1 {
+		return ErrInvalidCommand
+	}
+	service := args[0]
+	a.svcsMu.RLock()
+	_, ok := a.svcs[service]
+	a.svcsMu.RUnlock()
+	if !ok {
+		return ErrNoSuchService
+	}
+	if err := a.broker.Publish(context.Background(), fmt.Sprintf("%s.%s.%s", Commands, service, restart), &messaging.Message{}); err != nil {
+		return errors.Wrap(ErrPublishFailed, err)
+	}
+	return a.processResponse(uuid, restart, "ok")
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/pelletier/go-toml"
+)
+
+// Credentials holds MQTT client credentials. MQTT client reads them on every
+// connect, so the agent service can rotate them in place.
+type Credentials struct {
+	mu       sync.RWMutex
+	username string
+	password string
+	cert     tls.Certificate
+	file     string
+	set      time.Time
+}
+
+// credentialsFile holds MQTT credentials kept apart from the config file.
+type credentialsFile struct {
+	Username string `toml:"username"`
+	Password string `toml:"password"`
+}
+
+// NewCredentials returns credentials initialized from MQTT config.
+func NewCredentials(mc MQTTConfig) *Credentials {
+	c := &Credentials{}
+	c.Set(mc)
+	return c
+}
+
+// Set replaces credentials with the ones from MQTT config.
+func (c *Credentials) Set(mc MQTTConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.username = mc.Username
+	c.password = mc.Password
+	c.cert = mc.Cert
+	c.file = mc.CredentialsFile
+	c.set = time.Now()
+}
+
+// Get returns MQTT username and password. It can be used as MQTT client credentials provider.
+// If MQTT config sets the credentials file, the credentials are read from it if it was
+// modified since they were last set, so it can be updated without restart.
+func (c *Credentials) Get() (string, string) {
+	c.mu.RLock()
+	username, password, file, set := c.username, c.password, c.file, c.set
+	c.mu.RUnlock()
+	if file == "" {
+		return username, password
+	}
+	if fi, err := os.Stat(file); err != nil || !fi.ModTime().After(set) {
+		return username, password
+	}
+	if u, p, err := readCredentials(file); err == nil {
+		return u, p
+	}
+	return username, password
+}
+
+// HasCertificate returns true if client certificate is set.
+func (c *Credentials) HasCertificate() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert.Certificate != nil
+}
+
+// ClientCertificate returns client certificate. It can be used as TLS config GetClientCertificate callback.
+func (c *Credentials) ClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cert := c.cert
+	return &cert, nil
+}
+
+// readCredentials returns MQTT username and password read from the file.
+func readCredentials(file string) (string, string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", "", errors.New(fmt.Sprintf("Error reading credentials file: %s", err))
+	}
+	var cf credentialsFile
+	if err := toml.Unmarshal(data, &cf); err != nil {
+		return "", "", errors.New(fmt.Sprintf("Error unmarshaling credentials: %s", err))
+	}
+	return cf.Username, cf.Password, nil
+}
+
+// writeCredentials writes MQTT username and password to the file readable
+// by the owner only. The file is replaced at once, so it never holds partial
+// credentials.
+func writeCredentials(file, username, password string) error {
+	b, err := toml.Marshal(credentialsFile{Username: username, Password: password})
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error marshaling credentials: %s", err))
+	}
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return errors.New(fmt.Sprintf("Error writing credentials file: %s", err))
+	}
+	// Permissions of the file left over by an interrupted write are kept by
+	// WriteFile.
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		return errors.New(fmt.Sprintf("Error writing credentials file: %s", err))
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return errors.New(fmt.Sprintf("Error writing credentials file: %s", err))
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"reflect"
+	"strings"
+	"time"
+)
+
+// FieldChange is the change of the config field, identified by its path in
+// the config file, such as "mqtt.username".
+type FieldChange struct {
+	Path string `json:"path"`
+	Old  any    `json:"old"`
+	New  any    `json:"new"`
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Diff returns the fields changed in other config, in the order of the
+// config file. Values of the secrets are redacted, so only whether they
+// were set is reported. Fields not saved to the config file are ignored.
+func (c Config) Diff(other Config) []FieldChange {
+	var changes []FieldChange
+	diffFields("", values{reflect.ValueOf(c), reflect.ValueOf(c.Redacted())}, values{reflect.ValueOf(other), reflect.ValueOf(other.Redacted())}, &changes)
+	return changes
+}
+
+// values holds the config value along with its redacted one.
+type values struct {
+	raw      reflect.Value
+	redacted reflect.Value
+}
+
+func (v values) field(i int) values {
+	return values{v.raw.Field(i), v.redacted.Field(i)}
+}
+
+// secret reports whether the value is replaced by redaction.
+func (v values) secret() bool {
+	return !reflect.DeepEqual(v.raw.Interface(), v.redacted.Interface())
+}
+
+func diffFields(prefix string, prev, next values, changes *[]FieldChange) {
+	t := prev.raw.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("toml"), ",")
+		if !f.IsExported() || name == "" || name == "-" {
+			continue
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		o, n := prev.field(i), next.field(i)
+		if f.Type.Kind() == reflect.Struct {
+			diffFields(name, o, n, changes)
+			continue
+		}
+		if equal(o.raw, n.raw) {
+			continue
+		}
+		if o.secret() || n.secret() {
+			o.raw, n.raw = o.redacted, n.redacted
+		}
+		*changes = append(*changes, FieldChange{Path: name, Old: value(o.raw), New: value(n.raw)})
+	}
+}
+
+// equal treats nil and empty lists and maps as equal, since they're saved
+// the same.
+func equal(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Slice, reflect.Map:
+		if a.Len() == 0 && b.Len() == 0 {
+			return true
+		}
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// value returns durations formatted the same way as in the config file.
+func value(v reflect.Value) any {
+	if v.Type() == durationType {
+		return time.Duration(v.Int()).String()
+	}
+	return v.Interface()
+}
@@ -0,0 +1,124 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/magistrala/pkg/errors"
+	model "github.com/edgexfoundry/go-mod-core-contracts/models"
+)
+
+// edgexReadingsLimit bounds the number of readings fetched per poll.
+const edgexReadingsLimit = 100
+
+// pollReadings fetches the EdgeX readings created since the previous poll
+// every cfg.PollInterval and publishes them as SenML pack to the data
+// channel until the context is cancelled. Non-positive interval disables
+// polling.
+func (a *agent) pollReadings(ctx context.Context, clk clock, cfg EdgexConfig) {
+	if cfg.PollInterval <= 0 {
+		return
+	}
+	since := clk.Now()
+	ticks, stop := clk.NewTicker(cfg.PollInterval)
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticks:
+			readings, err := a.edgexClient.FetchReadings(since.UnixMilli(), now.UnixMilli(), edgexReadingsLimit)
+			if err != nil {
+				// Keep the start of the range, so the readings are fetched
+				// on the next poll.
+				a.logger.Warn(fmt.Sprintf("Failed to fetch EdgeX readings: %s", err))
+				continue
+			}
+			// The range is inclusive, so the next one starts right after it.
+			// If the limit is hit, the next poll continues after the latest
+			// reading fetched.
+			since = now.Add(time.Millisecond)
+			if len(readings) == edgexReadingsLimit {
+				since = time.UnixMilli(latestReading(readings) + 1)
+			}
+			if len(readings) == 0 {
+				continue
+			}
+			payload, err := encodeReadings(readings)
+			if err != nil {
+				a.logger.Warn(fmt.Sprintf("Failed to encode EdgeX readings: %s", err))
+				continue
+			}
+			if err := a.Publish(ctx, data, string(payload), PublishOpts{}); err != nil {
+				a.logger.Warn(fmt.Sprintf("Failed to publish EdgeX readings: %s", err))
+			}
+		}
+	}
+}
+
+// encodeReadings encodes the readings as SenML pack, with one record per
+// reading named by the device and the reading name.
+func encodeReadings(readings []model.Reading) ([]byte, error) {
+	records := make([]encoder.Record, len(readings))
+	for i, r := range readings {
+		records[i] = encoder.Record{
+			BaseName: r.Device + ":",
+			Name:     r.Name,
+			Value:    r.Value,
+			Time:     readingTime(r),
+		}
+	}
+	return encoder.EncodeSenMLBatch(records)
+}
+
+// readingTime returns the time the reading was taken in seconds, falling
+// back to the time it was stored if the origin is unknown. EdgeX origin is
+// in nanoseconds and creation time in milliseconds.
+func readingTime(r model.Reading) float64 {
+	if r.Origin > 0 {
+		return float64(r.Origin) / float64(time.Second)
+	}
+	return float64(r.Created) / 1e3
+}
+
+func latestReading(readings []model.Reading) int64 {
+	var latest int64
+	for _, r := range readings {
+		latest = max(latest, r.Created)
+	}
+	return latest
+}
+
+// Message for this command
+// [{"bn":"1:", "n":"control", "vs":"edgex-command, device, command, name=value, ..."}]
+// The command is read if no name=value parameters are given and set with
+// the parameters otherwise.
+func (a *agent) edgexCommand(uuid string, args []string) error {
+	if len(args) < 2 {
+		return ErrInvalidCommand
+	}
+	params := make(map[string]string, len(args)-2)
+	for _, p := range args[2:] {
+		name, value, ok := strings.Cut(p, "=")
+		if !ok || name == "" {
+			return ErrInvalidCommand
+		}
+		params[name] = value
+	}
+
+	resp, err := a.withTimeout(func() (string, error) { return a.edgexClient.Command(args[0], args[1], params) })
+	if err == ErrExecTimeout {
+		return err
+	}
+	if err != nil {
+		return errors.Wrap(errEdgexFailed, err)
+	}
+	return a.processResponse(uuid, edgexCommand, resp)
+}
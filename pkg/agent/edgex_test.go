@@ -0,0 +1,199 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/senml"
+	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/andychao217/agent/pkg/edgex"
+	"github.com/andychao217/magistrala/pkg/errors"
+	model "github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// edgexStub serves EdgeX core data readings and records core command requests.
+type edgexStub struct {
+	mu       sync.Mutex
+	readings []model.Reading
+	ranges   []string
+	commands []string
+}
+
+func (s *edgexStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var start, end, limit int64
+	if _, err := fmt.Sscanf(r.URL.Path, "/data/reading/%d/%d/%d", &start, &end, &limit); err == nil {
+		s.ranges = append(s.ranges, fmt.Sprintf("%d-%d", start, end))
+		readings := []model.Reading{}
+		for _, rd := range s.readings {
+			if rd.Created >= start && rd.Created <= end {
+				readings = append(readings, rd)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(readings)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	s.commands = append(s.commands, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, body))
+	_, _ = w.Write([]byte("ok"))
+}
+
+func newEdgexTestAgent(t *testing.T) (*agent, *mocks.MQTTClient, *edgexStub) {
+	cfg := Config{}
+	cfg.Channels.Control = "control"
+	cfg.Channels.Data = "data"
+	cfg.MQTT.Username = "thing"
+	a, mqttClient := newTestAgent(t, cfg)
+
+	stub := &edgexStub{}
+	ts := httptest.NewServer(stub)
+	t.Cleanup(ts.Close)
+	a.edgexClient = edgex.NewClient(ts.URL+"/sma/", ts.URL+"/data/", ts.URL+"/command/", slog.Default())
+	return a, mqttClient, stub
+}
+
+func TestPollReadings(t *testing.T) {
+	a, mqttClient, stub := newEdgexTestAgent(t)
+	clk := newFakeClock()
+	startMs := clk.Now().UnixMilli()
+	stub.readings = []model.Reading{
+		{Device: "thermostat", Name: "temperature", Value: "21.5", Created: startMs + 500, Origin: (startMs + 400) * int64(time.Millisecond)},
+		{Device: "thermostat", Name: "humidity", Value: "40", Created: startMs + 2500},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{}, 1)
+	go func() {
+		a.pollReadings(ctx, clk, EdgexConfig{PollInterval: time.Second})
+		done <- struct{}{}
+	}()
+
+	assert.Eventually(t, func() bool {
+		clk.mu.Lock()
+		defer clk.mu.Unlock()
+		return clk.interval > 0
+	}, time.Second, time.Millisecond, "expected poll ticker to be created")
+
+	clk.advance(3*time.Second + 500*time.Millisecond)
+	// Polls finding no readings publish nothing.
+	assert.Eventually(t, func() bool {
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		return len(stub.ranges) == 3
+	}, time.Second, time.Millisecond, "expected 3 polls")
+	cancel()
+	<-done
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("%d-%d", startMs, startMs+1000),
+		fmt.Sprintf("%d-%d", startMs+1001, startMs+2000),
+		fmt.Sprintf("%d-%d", startMs+2001, startMs+3000),
+	}, stub.ranges, "expected consecutive ranges of readings")
+
+	expected := []struct {
+		name  string
+		value string
+		time  float64
+	}{
+		{name: "thermostat:temperature", value: "21.5", time: float64(startMs+400) / 1e3},
+		{name: "thermostat:humidity", value: "40", time: float64(startMs+2500) / 1e3},
+	}
+	msgs := mqttClient.Messages()
+	require.Len(t, msgs, len(expected), "expected one message per poll with readings")
+	for i, msg := range msgs {
+		assert.Equal(t, "channels/data/messages/res", msg.Topic)
+		pack, err := senml.Decode([]byte(msg.Payload.(string)), senml.JSON)
+		require.Nil(t, err, fmt.Sprintf("unexpected error decoding readings: %s", err))
+		pack, err = senml.Normalize(pack)
+		require.Nil(t, err, fmt.Sprintf("unexpected error normalizing readings: %s", err))
+		require.Len(t, pack.Records, 1)
+		assert.Equal(t, expected[i].name, pack.Records[0].Name)
+		assert.Equal(t, expected[i].value, *pack.Records[0].StringValue)
+		assert.InDelta(t, expected[i].time, pack.Records[0].Time, 1e-3)
+	}
+}
+
+func TestPollReadingsDisabled(t *testing.T) {
+	a, _, stub := newEdgexTestAgent(t)
+
+	done := make(chan struct{}, 1)
+	go func() {
+		a.pollReadings(context.Background(), newFakeClock(), EdgexConfig{})
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected polling to be disabled by zero interval")
+	}
+	assert.Empty(t, stub.ranges, "expected no polls")
+}
+
+func TestEdgexCommand(t *testing.T) {
+	a, mqttClient, stub := newEdgexTestAgent(t)
+
+	cases := []struct {
+		desc    string
+		cmd     string
+		request string
+		err     error
+	}{
+		{
+			desc:    "read command",
+			cmd:     "edgex-command, lamp, switch",
+			request: "GET /command/device/name/lamp/command/switch ",
+		},
+		{
+			desc:    "set command",
+			cmd:     "edgex-command, lamp, switch, on=true",
+			request: `PUT /command/device/name/lamp/command/switch {"on":"true"}`,
+		},
+		{
+			desc: "command without name",
+			cmd:  "edgex-command, lamp",
+			err:  ErrInvalidCommand,
+		},
+		{
+			desc: "command with malformed parameter",
+			cmd:  "edgex-command, lamp, switch, on",
+			err:  ErrInvalidCommand,
+		},
+	}
+
+	for _, tc := range cases {
+		stub.mu.Lock()
+		stub.commands = nil
+		stub.mu.Unlock()
+		sent := len(mqttClient.Messages())
+
+		err := a.Control("1", tc.cmd)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %s got %s", tc.desc, tc.err, err))
+
+		stub.mu.Lock()
+		commands := stub.commands
+		stub.mu.Unlock()
+		if tc.err != nil {
+			assert.Empty(t, commands, fmt.Sprintf("%s: expected no command forwarded", tc.desc))
+			continue
+		}
+		assert.Equal(t, []string{tc.request}, commands, fmt.Sprintf("%s: unexpected command forwarded", tc.desc))
+		msgs := mqttClient.Messages()
+		require.Len(t, msgs, sent+1, fmt.Sprintf("%s: expected response published", tc.desc))
+		assert.Contains(t, msgs[sent].Payload, `"vs":"ok"`, fmt.Sprintf("%s: unexpected response", tc.desc))
+	}
+}
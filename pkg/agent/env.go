@@ -0,0 +1,46 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import "strings"
+
+// Environment policies of the executed commands and terminal shells.
+const (
+	// EnvInherit passes the agent environment except the denied variables.
+	EnvInherit = "inherit"
+	// EnvClean passes only the allowed variables of the agent environment.
+	EnvClean = "clean"
+)
+
+// EnvConfig is the policy of environment passed to the executed commands and
+// terminal shells.
+type EnvConfig struct {
+	// Policy is either EnvInherit (default) or EnvClean.
+	Policy string `toml:"policy" json:"policy"`
+	// Allowlist of variable names or glob patterns passed by EnvClean policy.
+	Allowlist []string `toml:"allowlist" json:"allowlist"`
+	// Denylist of variable names or glob patterns withheld by EnvInherit policy.
+	Denylist []string `toml:"denylist" json:"denylist"`
+}
+
+// Environ returns the variables of environ, given as "key=value" strings,
+// passed by the policy.
+func (c EnvConfig) Environ(environ []string) []string {
+	env := []string{}
+	for _, kv := range environ {
+		name, _, _ := strings.Cut(kv, "=")
+		switch c.Policy {
+		case EnvClean:
+			if !matchPattern(c.Allowlist, name) {
+				continue
+			}
+		default:
+			if matchPattern(c.Denylist, name) {
+				continue
+			}
+		}
+		env = append(env, kv)
+	}
+	return env
+}
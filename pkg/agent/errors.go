@@ -0,0 +1,53 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"encoding/json"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+var _ errors.Error = (*wrappedError)(nil)
+
+// wrappedError wraps an error with one of the sentinel errors of the package.
+// Unlike errors.Wrap, it keeps the sentinel itself in the chain, so the result
+// matches both errors.Contains and standard library errors.Is.
+type wrappedError struct {
+	sentinel errors.Error
+	err      error
+}
+
+func wrap(sentinel errors.Error, err error) error {
+	return &wrappedError{sentinel: sentinel, err: err}
+}
+
+func (we *wrappedError) Error() string {
+	return we.sentinel.Error() + " : " + we.err.Error()
+}
+
+func (we *wrappedError) Msg() string {
+	return we.sentinel.Msg()
+}
+
+func (we *wrappedError) Err() errors.Error {
+	if e, ok := we.err.(errors.Error); ok {
+		return e
+	}
+	return errors.New(we.err.Error())
+}
+
+func (we *wrappedError) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&struct {
+		Err string `json:"error"`
+		Msg string `json:"message"`
+	}{
+		Err: we.err.Error(),
+		Msg: we.Msg(),
+	})
+}
+
+func (we *wrappedError) Unwrap() []error {
+	return []error{we.sentinel, we.err}
+}
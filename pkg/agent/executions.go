@@ -0,0 +1,71 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+var (
+	// ErrNoSuchExecution indicates that no command with the UUID is running.
+	ErrNoSuchExecution = errors.New("no such execution")
+
+	// ErrExecCancelled indicates that command was cancelled by CancelExecute.
+	ErrExecCancelled = errors.New("command execution cancelled")
+)
+
+// executions keeps cancel functions of the running commands by the UUID of
+// their request. Commands started with the same UUID are cancelled together.
+type executions struct {
+	mu      sync.Mutex
+	next    uint64
+	running map[string]map[uint64]context.CancelCauseFunc
+}
+
+// add registers cancel function of the command and returns the function
+// unregistering it once the command completes.
+func (e *executions) add(uuid string, cancel context.CancelCauseFunc) func() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running == nil {
+		e.running = make(map[string]map[uint64]context.CancelCauseFunc)
+	}
+	if e.running[uuid] == nil {
+		e.running[uuid] = make(map[uint64]context.CancelCauseFunc)
+	}
+	id := e.next
+	e.next++
+	e.running[uuid][id] = cancel
+
+	return func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		delete(e.running[uuid], id)
+		if len(e.running[uuid]) == 0 {
+			delete(e.running, uuid)
+		}
+	}
+}
+
+// cancel cancels the commands with the UUID.
+func (e *executions) cancel(uuid string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	running, ok := e.running[uuid]
+	if !ok {
+		return wrap(ErrNoSuchExecution, fmt.Errorf("uuid %s", uuid))
+	}
+	for _, cancel := range running {
+		cancel(ErrExecCancelled)
+	}
+	return nil
+}
+
+func (a *agent) CancelExecute(uuid string) error {
+	return a.execs.cancel(uuid)
+}
@@ -0,0 +1,99 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"time"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+const (
+	// HealthPass indicates that the agent or its dependency is healthy.
+	HealthPass = "pass"
+	// HealthFail indicates that the agent or its dependency is unhealthy.
+	HealthFail = "fail"
+
+	mqttDependency  = "mqtt"
+	edgexDependency = "edgex"
+
+	healthTimeout = 2 * time.Second
+)
+
+var (
+	errMQTTDisconnected   = errors.New("MQTT client is disconnected")
+	errHealthCheckTimeout = errors.New("health check timed out")
+)
+
+// DependencyStatus represents status of the agent dependency.
+type DependencyStatus struct {
+	Status   string `json:"status"`
+	Critical bool   `json:"critical"`
+	Error    string `json:"error,omitempty"`
+}
+
+// HealthStatus represents status of the agent and its dependencies. The agent
+// is unhealthy if any of its critical dependencies is down.
+type HealthStatus struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+	// QueueDepth is the number of messages waiting for MQTT broker.
+	QueueDepth int `json:"queue_depth"`
+	// SafeMode reports that the agent runs the safe mode config.
+	SafeMode bool `json:"safe_mode,omitempty"`
+}
+
+// Healthy reports whether all the critical dependencies are up.
+func (hs HealthStatus) Healthy() bool {
+	return hs.Status == HealthPass
+}
+
+func (a *agent) Healthz() HealthStatus {
+	hs := HealthStatus{
+		Status:       HealthPass,
+		Dependencies: map[string]DependencyStatus{},
+		QueueDepth:   a.QueueDepth(),
+		SafeMode:     a.Config().SafeMode,
+	}
+	var mqttErr error
+	if !a.mqttClient.IsConnected() {
+		mqttErr = errMQTTDisconnected
+	}
+	hs.add(mqttDependency, true, mqttErr)
+	if a.Config().Edgex.URL != "" {
+		hs.add(edgexDependency, false, a.pingEdgex())
+	}
+	return hs
+}
+
+func (hs *HealthStatus) add(name string, critical bool, err error) {
+	ds := DependencyStatus{
+		Status:   HealthPass,
+		Critical: critical,
+	}
+	if err != nil {
+		ds.Status = HealthFail
+		ds.Error = err.Error()
+		if critical {
+			hs.Status = HealthFail
+		}
+	}
+	hs.Dependencies[name] = ds
+}
+
+// pingEdgex pings EdgeX, giving up after healthTimeout so a hung EdgeX
+// doesn't block health checks.
+func (a *agent) pingEdgex() error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.edgexClient.Ping()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(healthTimeout):
+		return errHealthCheckTimeout
+	}
+}
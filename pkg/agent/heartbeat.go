@@ -4,7 +4,10 @@
 package agent
 
 import (
+	"encoding/json"
+	goerrors "errors"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -20,6 +23,7 @@ type svc struct {
 	info     Info
 	interval time.Duration
 	ticker   *time.Ticker
+	stop     chan struct{}
 	mu       sync.Mutex
 }
 
@@ -29,28 +33,61 @@ type Info struct {
 	Status   string    `json:"status"`
 	Type     string    `json:"type"`
 	Terminal int       `json:"terminal"`
+	// Version and PID are reported by the service heartbeats, if at all.
+	Version string `json:"version,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+	// LastStartedAt is when the service was registered or its PID changed.
+	LastStartedAt time.Time `json:"last_started_at"`
+}
+
+// HeartbeatPayload is the optional JSON payload of service heartbeat
+// describing the service process.
+type HeartbeatPayload struct {
+	Version string `json:"version"`
+	PID     int    `json:"pid"`
+}
+
+// parseHeartbeat returns the heartbeat payload. Heartbeats of the services
+// not describing their process are empty or not JSON, so payload which
+// doesn't parse is ignored.
+func parseHeartbeat(payload []byte) HeartbeatPayload {
+	var hb HeartbeatPayload
+	if err := json.Unmarshal(payload, &hb); err != nil {
+		return HeartbeatPayload{}
+	}
+	return hb
 }
 
 // Heartbeat specifies api for updating status and keeping track on services
 // that are sending heartbeat to NATS.
 type Heartbeat interface {
-	Update()
+	// Update marks the service online, updating its process details with
+	// the ones set in the heartbeat payload.
+	Update(hb HeartbeatPayload)
 	Info() Info
+	// SetInterval changes the interval after which the service is marked
+	// offline.
+	SetInterval(interval time.Duration)
+	// Stop stops tracking status of the service.
+	Stop()
 }
 
 // interval - duration of interval
 // if service doesnt send heartbeat during  interval it is marked offline.
 func NewHeartbeat(name, svcType string, interval time.Duration) Heartbeat {
 	ticker := time.NewTicker(interval)
+	now := time.Now()
 	s := svc{
 		info: Info{
-			Name:     name,
-			Status:   online,
-			Type:     svcType,
-			LastSeen: time.Now(),
+			Name:          name,
+			Status:        online,
+			Type:          svcType,
+			LastSeen:      now,
+			LastStartedAt: now,
 		},
 		ticker:   ticker,
 		interval: interval,
+		stop:     make(chan struct{}, 1),
 	}
 	s.listen()
 	return &s
@@ -58,7 +95,12 @@ func NewHeartbeat(name, svcType string, interval time.Duration) Heartbeat {
 
 func (s *svc) listen() {
 	go func() {
-		for range s.ticker.C {
+		for {
+			select {
+			case <-s.ticker.C:
+			case <-s.stop:
+				return
+			}
 			// TODO - we can disable ticker when the status gets OFFLINE
 			// and on the next heartbeat enable it again.
 			s.mu.Lock()
@@ -70,13 +112,48 @@ func (s *svc) listen() {
 	}()
 }
 
-func (s *svc) Update() {
+func (s *svc) Update(hb HeartbeatPayload) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.info.LastSeen = time.Now()
 	s.info.Status = online
+	if hb.Version != "" {
+		s.info.Version = hb.Version
+	}
+	if hb.PID != 0 && hb.PID != s.info.PID {
+		// The first PID reported is the one of the registered process,
+		// the following ones are of the restarted processes.
+		if s.info.PID != 0 {
+			s.info.LastStartedAt = s.info.LastSeen
+		}
+		s.info.PID = hb.PID
+	}
 }
 
 func (s *svc) Info() Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.info
 }
+
+func (s *svc) SetInterval(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.interval = interval
+	s.ticker.Reset(interval)
+}
+
+func (s *svc) Stop() {
+	s.ticker.Stop()
+	select {
+	case s.stop <- struct{}{}:
+	default:
+	}
+}
+
+// running reports whether the process with the PID is still running, it's
+// assumed to be if that can't be checked.
+func running(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return !goerrors.Is(err, syscall.ESRCH)
+}
@@ -0,0 +1,53 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/andychao217/magistrala/pkg/messaging"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeartbeatInfo(t *testing.T) {
+	a, _ := newTestAgent(t, Config{})
+	handle := a.handle(context.Background(), nil, a.logger)
+
+	cases := []struct {
+		desc    string
+		payload string
+		version string
+		pid     int
+		started bool
+	}{
+		{desc: "heartbeat registering service", payload: "", started: true},
+		{desc: "heartbeat with process details", payload: `{"version":"0.1.0","pid":42}`, version: "0.1.0", pid: 42},
+		{desc: "heartbeat without payload", payload: "", version: "0.1.0", pid: 42},
+		{desc: "heartbeat with malformed payload", payload: "alive", version: "0.1.0", pid: 42},
+		{desc: "heartbeat of restarted service", payload: `{"version":"0.2.0","pid":43}`, version: "0.2.0", pid: 43, started: true},
+	}
+
+	var lastStarted time.Time
+	for _, tc := range cases {
+		before := time.Now()
+		err := handle(&messaging.Message{Channel: "heartbeat.export.service", Payload: []byte(tc.payload)})
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		info, err := a.Service("export")
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, online, info.Status, fmt.Sprintf("%s: expected service online", tc.desc))
+		assert.Equal(t, tc.version, info.Version, fmt.Sprintf("%s: unexpected version", tc.desc))
+		assert.Equal(t, tc.pid, info.PID, fmt.Sprintf("%s: unexpected PID", tc.desc))
+		if tc.started {
+			assert.False(t, info.LastStartedAt.Before(before), fmt.Sprintf("%s: expected start time updated", tc.desc))
+		} else {
+			assert.Equal(t, lastStarted, info.LastStartedAt, fmt.Sprintf("%s: expected start time kept", tc.desc))
+		}
+		lastStarted = info.LastStartedAt
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/magistrala"
+)
+
+// defaultHeartbeatTopic is used unless the heartbeat topic is configured.
+const defaultHeartbeatTopic = "heartbeat"
+
+// clock provides time to the heartbeat publisher, so it can be faked in tests.
+type clock interface {
+	Now() time.Time
+	// NewTicker returns the ticks channel and the function stopping the ticker.
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// publishHeartbeats publishes the agent's liveness messages carrying its
+// uptime, version and the counts of online and offline services every cfg.PublishInterval until the context is
+// cancelled. Non-positive interval disables heartbeats.
+func (a *agent) publishHeartbeats(ctx context.Context, clk clock, cfg HeartbeatConfig) {
+	if cfg.PublishInterval <= 0 {
+		return
+	}
+	topic := cfg.Topic
+	if topic == "" {
+		topic = defaultHeartbeatTopic
+	}
+	started := clk.Now()
+	ticks, stop := clk.NewTicker(cfg.PublishInterval)
+	defer stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticks:
+			up, down := a.servicesSummary()
+			payload, err := encoder.EncodeHeartbeat(a.Config().MQTT.Username+":", now.Sub(started), magistrala.Version, up, down, now)
+			if err != nil {
+				a.logger.Warn(fmt.Sprintf("Failed to encode heartbeat: %s", err))
+				continue
+			}
+			if err := a.Publish(ctx, topic, string(payload), PublishOpts{}); err != nil {
+				a.logger.Warn(fmt.Sprintf("Failed to publish heartbeat: %s", err))
+			}
+		}
+	}
+}
+
+// servicesSummary returns the numbers of online and offline services, which
+// keeps the heartbeat small however many services are tracked.
+func (a *agent) servicesSummary() (up, down int) {
+	for _, info := range a.Services() {
+		if info.Status == online {
+			up++
+			continue
+		}
+		down++
+	}
+	return up, down
+}
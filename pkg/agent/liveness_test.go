@@ -0,0 +1,191 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/senml"
+	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/andychao217/agent/pkg/terminal"
+	"github.com/andychao217/magistrala"
+	"github.com/andychao217/magistrala/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock ticks only when advanced.
+type fakeClock struct {
+	mu       sync.Mutex
+	now      time.Time
+	interval time.Duration
+	ticks    chan time.Time
+	stopped  bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{
+		now:   time.Unix(1000, 0),
+		ticks: make(chan time.Time),
+	}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.interval = d
+	return c.ticks, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.stopped = true
+	}
+}
+
+// advance moves the clock forward, delivering the ticks of the elapsed
+// intervals. Ticks are delivered synchronously, so every tick but the last
+// is handled once advance returns.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		next := c.now.Add(c.interval)
+		if next.After(end) {
+			c.now = end
+			c.mu.Unlock()
+			return
+		}
+		c.now = next
+		c.mu.Unlock()
+		c.ticks <- next
+	}
+}
+
+func newTestAgent(t *testing.T, cfg Config) (*agent, *mocks.MQTTClient) {
+	cfg.Heartbeat.Interval = time.Second
+	mqttClient := mocks.NewMQTTClient()
+	logger, err := logger.New(os.Stdout, "debug")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating logger: %s", err))
+
+	svc, err := New(context.TODO(), mqttClient, NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+	return svc.(*agent), mqttClient
+}
+
+func TestPublishHeartbeats(t *testing.T) {
+	cfg := Config{}
+	cfg.Channels.Control = "control"
+	cfg.MQTT.Username = "thing"
+	a, mqttClient := newTestAgent(t, cfg)
+
+	clk := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	// Package close constant shadows the builtin.
+	done := make(chan struct{}, 1)
+	go func() {
+		a.publishHeartbeats(ctx, clk, HeartbeatConfig{PublishInterval: time.Second, Topic: "alive"})
+		done <- struct{}{}
+	}()
+
+	// Wait for the ticker to be created.
+	assert.Eventually(t, func() bool {
+		clk.mu.Lock()
+		defer clk.mu.Unlock()
+		return clk.interval > 0
+	}, time.Second, time.Millisecond, "expected heartbeat ticker to be created")
+
+	clk.advance(5*time.Second + 500*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		return len(mqttClient.Messages()) == 5
+	}, time.Second, time.Millisecond, "expected 5 heartbeats")
+
+	cancel()
+	<-done
+	clk.mu.Lock()
+	assert.True(t, clk.stopped, "expected heartbeat ticker to be stopped")
+	clk.mu.Unlock()
+	assert.Len(t, mqttClient.Messages(), 5, "expected no heartbeats after shutdown")
+
+	for i, msg := range mqttClient.Messages() {
+		assert.Equal(t, "channels/control/messages/res/alive", msg.Topic)
+		pack, err := senml.Decode([]byte(msg.Payload.(string)), senml.JSON)
+		require.Nil(t, err, fmt.Sprintf("unexpected error decoding heartbeat: %s", err))
+		pack, err = senml.Normalize(pack)
+		require.Nil(t, err, fmt.Sprintf("unexpected error normalizing heartbeat: %s", err))
+		require.Len(t, pack.Records, 4)
+		assert.Equal(t, "thing:uptime", pack.Records[0].Name)
+		assert.Equal(t, float64(i+1), *pack.Records[0].Value, fmt.Sprintf("heartbeat %d: unexpected uptime", i))
+		assert.Equal(t, "thing:version", pack.Records[1].Name)
+		assert.Equal(t, magistrala.Version, *pack.Records[1].StringValue)
+		assert.Equal(t, "thing:services_online", pack.Records[2].Name)
+		assert.Equal(t, float64(0), *pack.Records[2].Value, fmt.Sprintf("heartbeat %d: unexpected online services", i))
+		assert.Equal(t, "thing:services_offline", pack.Records[3].Name)
+		assert.Equal(t, float64(0), *pack.Records[3].Value, fmt.Sprintf("heartbeat %d: unexpected offline services", i))
+	}
+}
+
+func TestPublishHeartbeatsServices(t *testing.T) {
+	cfg := Config{}
+	cfg.Channels.Control = "control"
+	cfg.MQTT.Username = "thing"
+	a, mqttClient := newTestAgent(t, cfg)
+	a.svcsMu.Lock()
+	a.svcs["running"] = &svc{info: Info{Name: "running", Status: online}}
+	a.svcs["failed"] = &svc{info: Info{Name: "failed", Status: offline}}
+	a.svcs["stopped"] = &svc{info: Info{Name: "stopped", Status: offline}}
+	a.svcsMu.Unlock()
+
+	clk := newFakeClock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.publishHeartbeats(ctx, clk, HeartbeatConfig{PublishInterval: time.Second, Topic: "alive"})
+	assert.Eventually(t, func() bool {
+		clk.mu.Lock()
+		defer clk.mu.Unlock()
+		return clk.interval > 0
+	}, time.Second, time.Millisecond, "expected heartbeat ticker to be created")
+
+	clk.advance(time.Second)
+	require.Eventually(t, func() bool {
+		return len(mqttClient.Messages()) == 1
+	}, time.Second, time.Millisecond, "expected heartbeat")
+
+	pack, err := senml.Decode([]byte(mqttClient.Messages()[0].Payload.(string)), senml.JSON)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding heartbeat: %s", err))
+	pack, err = senml.Normalize(pack)
+	require.Nil(t, err, fmt.Sprintf("unexpected error normalizing heartbeat: %s", err))
+	require.Len(t, pack.Records, 4, "expected heartbeat to carry services counts only")
+	assert.Equal(t, float64(1), *pack.Records[2].Value, "expected online service to be counted")
+	assert.Equal(t, float64(2), *pack.Records[3].Value, "expected failed services to be counted as offline")
+}
+
+func TestPublishHeartbeatsDisabled(t *testing.T) {
+	a, mqttClient := newTestAgent(t, Config{})
+
+	done := make(chan struct{}, 1)
+	go func() {
+		a.publishHeartbeats(context.Background(), newFakeClock(), HeartbeatConfig{})
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected heartbeats to be disabled by zero interval")
+	}
+	assert.Empty(t, mqttClient.Messages(), "expected no heartbeats")
+}
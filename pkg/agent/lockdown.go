@@ -0,0 +1,77 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"fmt"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+const (
+	lockdown   = "lockdown"
+	keep       = "keep"
+	disconnect = "disconnect"
+)
+
+// ErrLockedDown indicates that remote operation is refused since the agent is in lockdown.
+var ErrLockedDown = errors.New("agent is in lockdown")
+
+// Message for this command
+// [{"bn":"1:", "n":"control", "vs":"lockdown, keep"}]
+// [{"bn":"1:", "n":"control", "vs":"lockdown, disconnect"}]
+// Lockdown is confirmed before MQTT client is disconnected. Since the command is
+// received in MQTT message handler, disconnect runs in the background.
+func (a *agent) lockdown(uuid string, args []string) error {
+	if len(args) == 0 || args[0] != keep && args[0] != disconnect {
+		return ErrInvalidCommand
+	}
+	disconnectMQTT := args[0] == disconnect
+	if err := a.Lockdown(false); err != nil {
+		return err
+	}
+	if err := a.processResponse(uuid, lockdown, "ok"); err != nil {
+		a.logger.Warn(fmt.Sprintf("Failed to publish lockdown confirmation: %s", err))
+	}
+	if disconnectMQTT {
+		go a.disconnect()
+	}
+	return nil
+}
+
+func (a *agent) Lockdown(disconnectMQTT bool) error {
+	a.locked.Store(true)
+	a.logger.Warn("Agent entered lockdown, remote operations are disabled until unlocked locally")
+	if disconnectMQTT {
+		a.disconnect()
+	}
+	return nil
+}
+
+func (a *agent) Unlock() error {
+	a.locked.Store(false)
+	a.logger.Warn("Agent left lockdown")
+	if !a.mqttClient.IsConnected() {
+		token := a.mqttClient.Connect()
+		token.Wait()
+		if err := token.Error(); err != nil {
+			return errors.New(err.Error())
+		}
+	}
+	return nil
+}
+
+func (a *agent) disconnect() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.mqttClient.Disconnect(disconnectQuiesce)
+}
+
+// checkLockdown returns ErrLockedDown if the agent is in lockdown.
+func (a *agent) checkLockdown() error {
+	if a.locked.Load() {
+		return ErrLockedDown
+	}
+	return nil
+}
@@ -3,6 +3,8 @@
 
 package mocks
 
+import model "github.com/edgexfoundry/go-mod-core-contracts/models"
+
 // mockClient - holds data for Edgex mockClient.
 type mockClient struct {
 }
@@ -31,3 +33,13 @@ func (ec *mockClient) FetchMetrics(cmdArr []string) (string, error) {
 func (ec *mockClient) Ping() (string, error) {
 	return string("body"), nil
 }
+
+// FetchReadings - fetches readings from EdgeX core data.
+func (ec *mockClient) FetchReadings(start, end int64, limit int) ([]model.Reading, error) {
+	return nil, nil
+}
+
+// Command - issues the device command through EdgeX core command.
+func (ec *mockClient) Command(device, command string, params map[string]string) (string, error) {
+	return string("body"), nil
+}
@@ -0,0 +1,188 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+var _ paho.Client = (*MQTTClient)(nil)
+
+// Message - holds data of a message published by MQTTClient.
+type Message struct {
+	Topic    string
+	QoS      byte
+	Retained bool
+	Payload  interface{}
+}
+
+// MQTTClient - holds data for mocked MQTT client.
+type MQTTClient struct {
+	mu        sync.Mutex
+	connected bool
+	err       error
+	connect   func() error
+	messages  []Message
+	ackDelay  time.Duration
+}
+
+// NewMQTTClient - creates new connected mocked MQTT client.
+func NewMQTTClient() *MQTTClient {
+	return &MQTTClient{connected: true}
+}
+
+// Messages - returns messages published so far.
+func (c *MQTTClient) Messages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Message{}, c.messages...)
+}
+
+// SetError - sets error returned by the tokens of subsequent operations.
+func (c *MQTTClient) SetError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.err = err
+}
+
+// SetAckDelay - delays completion of the subsequent publishes by the delay,
+// standing for the broker acknowledgment. Negative delay drops the
+// acknowledgments, so the publishes never complete.
+func (c *MQTTClient) SetAckDelay(delay time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ackDelay = delay
+}
+
+// SetConnectHandler - sets handler deciding the outcome of subsequent connects.
+func (c *MQTTClient) SetConnectHandler(connect func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connect = connect
+}
+
+func (c *MQTTClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *MQTTClient) IsConnectionOpen() bool {
+	return c.IsConnected()
+}
+
+func (c *MQTTClient) Connect() paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.err
+	if err == nil && c.connect != nil {
+		err = c.connect()
+	}
+	if err == nil {
+		c.connected = true
+	}
+	return newToken(err)
+}
+
+func (c *MQTTClient) Disconnect(quiesce uint) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+}
+
+func (c *MQTTClient) Publish(topic string, qos byte, retained bool, payload interface{}) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.connected {
+		return newToken(paho.ErrNotConnected)
+	}
+	if c.err == nil {
+		c.messages = append(c.messages, Message{
+			Topic:    topic,
+			QoS:      qos,
+			Retained: retained,
+			Payload:  payload,
+		})
+	}
+	if c.ackDelay != 0 {
+		return newDelayedToken(c.err, c.ackDelay)
+	}
+	return newToken(c.err)
+}
+
+func (c *MQTTClient) Subscribe(topic string, qos byte, callback paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return newToken(c.err)
+}
+
+func (c *MQTTClient) SubscribeMultiple(filters map[string]byte, callback paho.MessageHandler) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return newToken(c.err)
+}
+
+func (c *MQTTClient) Unsubscribe(topics ...string) paho.Token {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return newToken(c.err)
+}
+
+func (c *MQTTClient) AddRoute(topic string, callback paho.MessageHandler) {}
+
+func (c *MQTTClient) OptionsReader() paho.ClientOptionsReader {
+	return paho.ClientOptionsReader{}
+}
+
+type token struct {
+	err  error
+	done chan struct{}
+}
+
+func newToken(err error) *token {
+	t := &token{
+		err:  err,
+		done: make(chan struct{}),
+	}
+	close(t.done)
+	return t
+}
+
+// newDelayedToken returns token completing after the delay, or never if the
+// delay is negative.
+func newDelayedToken(err error, delay time.Duration) *token {
+	t := &token{
+		err:  err,
+		done: make(chan struct{}),
+	}
+	if delay >= 0 {
+		time.AfterFunc(delay, func() { close(t.done) })
+	}
+	return t
+}
+
+func (t *token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *token) WaitTimeout(d time.Duration) bool {
+	select {
+	case <-t.done:
+		return true
+	case <-time.After(d):
+		return false
+	}
+}
+
+func (t *token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *token) Error() error {
+	return t.err
+}
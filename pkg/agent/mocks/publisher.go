@@ -0,0 +1,108 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+// ErrWaitTimeout indicates that the awaited message wasn't published in time.
+var ErrWaitTimeout = errors.New("timed out waiting for published message")
+
+// Publication - holds topic and payload of a message published by Publisher.
+type Publication struct {
+	Topic   string
+	Payload string
+}
+
+// Publisher - holds data for mocked publish function of terminal sessions and
+// services, safe for concurrent use.
+type Publisher struct {
+	mu        sync.Mutex
+	calls     int
+	err       error
+	failures  map[int]error
+	published []Publication
+	changed   chan struct{}
+}
+
+// NewPublisher - creates new mocked publisher.
+func NewPublisher() *Publisher {
+	return &Publisher{
+		failures: map[int]error{},
+		changed:  make(chan struct{}),
+	}
+}
+
+// Publish - records the message, unless the publish is set to fail.
+func (p *Publisher) Publish(topic, payload string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	if err, ok := p.failures[p.calls]; ok {
+		return err
+	}
+	if p.err != nil {
+		return p.err
+	}
+	p.published = append(p.published, Publication{Topic: topic, Payload: payload})
+	close(p.changed)
+	p.changed = make(chan struct{})
+	return nil
+}
+
+// Published - returns messages published so far.
+func (p *Publisher) Published() []Publication {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Publication{}, p.published...)
+}
+
+// Calls - returns the number of publishes, including the failed ones.
+func (p *Publisher) Calls() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+// SetError - sets error returned by the subsequent publishes, nil makes them
+// succeed again.
+func (p *Publisher) SetError(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.err = err
+}
+
+// FailNth - makes the nth publish, counted from the first one, fail with err.
+func (p *Publisher) FailNth(n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.failures[n] = err
+}
+
+// WaitFor - waits up to timeout for the nth message to be published, counted
+// from the first one, and returns it.
+func (p *Publisher) WaitFor(n int, timeout time.Duration) (Publication, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		p.mu.Lock()
+		if len(p.published) >= n {
+			pub := p.published[n-1]
+			p.mu.Unlock()
+			return pub, nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return Publication{}, ErrWaitTimeout
+		}
+	}
+}
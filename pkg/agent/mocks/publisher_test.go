@@ -0,0 +1,75 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks_test
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errPublish = errors.New("publish failed")
+
+func TestPublisherErrors(t *testing.T) {
+	pub := mocks.NewPublisher()
+	pub.FailNth(2, errPublish)
+
+	cases := []struct {
+		desc    string
+		payload string
+		err     error
+		setErr  error
+	}{
+		{desc: "publish", payload: "1"},
+		{desc: "publish failing as nth", payload: "2", err: errPublish},
+		{desc: "publish after failure", payload: "3"},
+		{desc: "publish with error set", payload: "4", setErr: errPublish, err: errPublish},
+	}
+
+	for _, tc := range cases {
+		pub.SetError(tc.setErr)
+		err := pub.Publish("term/1", tc.payload)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+	}
+
+	want := []mocks.Publication{{Topic: "term/1", Payload: "1"}, {Topic: "term/1", Payload: "3"}}
+	assert.Equal(t, want, pub.Published(), "expected failed publishes not to be recorded")
+	assert.Equal(t, len(cases), pub.Calls(), "expected failed publishes to be counted")
+}
+
+func TestPublisherWaitFor(t *testing.T) {
+	pub := mocks.NewPublisher()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			time.Sleep(time.Duration(i) * time.Millisecond)
+			err := pub.Publish("term/1", fmt.Sprintf("%d", i))
+			assert.Nil(t, err, fmt.Sprintf("unexpected error publishing: %s", err))
+		}(i)
+	}
+
+	msg, err := pub.WaitFor(10, time.Second)
+	require.Nil(t, err, fmt.Sprintf("unexpected error waiting for message: %s", err))
+	assert.Equal(t, "term/1", msg.Topic)
+	wg.Wait()
+	assert.Len(t, pub.Published(), 10, "expected concurrent publishes to be recorded")
+
+	msg, err = pub.WaitFor(1, time.Second)
+	require.Nil(t, err, fmt.Sprintf("unexpected error waiting for published message: %s", err))
+	assert.Equal(t, pub.Published()[0], msg, "expected the first message")
+
+	start := time.Now()
+	_, err = pub.WaitFor(11, 50*time.Millisecond)
+	assert.True(t, errors.Contains(err, mocks.ErrWaitTimeout), fmt.Sprintf("expected error %s got %s", mocks.ErrWaitTimeout, err))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond, "expected waiting for the timeout")
+}
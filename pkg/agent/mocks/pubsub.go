@@ -0,0 +1,67 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package mocks
+
+import (
+	"context"
+	"sync"
+
+	"github.com/andychao217/magistrala/pkg/messaging"
+)
+
+var _ messaging.PubSub = (*PubSub)(nil)
+
+// PubSub - holds data for mocked message broker.
+type PubSub struct {
+	mu       sync.Mutex
+	topics   []string
+	handlers []messaging.MessageHandler
+}
+
+// NewPubSub - creates new mocked message broker.
+func NewPubSub() *PubSub {
+	return &PubSub{}
+}
+
+func (ps *PubSub) Publish(ctx context.Context, topic string, msg *messaging.Message) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.topics = append(ps.topics, topic)
+	return nil
+}
+
+func (ps *PubSub) Subscribe(ctx context.Context, cfg messaging.SubscriberConfig) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.handlers = append(ps.handlers, cfg.Handler)
+	return nil
+}
+
+func (ps *PubSub) Unsubscribe(ctx context.Context, id, topic string) error {
+	return nil
+}
+
+func (ps *PubSub) Close() error {
+	return nil
+}
+
+// Published - returns topics of the messages published so far.
+func (ps *PubSub) Published() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return append([]string{}, ps.topics...)
+}
+
+// Deliver - passes the message to the handlers of subscriptions.
+func (ps *PubSub) Deliver(msg *messaging.Message) error {
+	ps.mu.Lock()
+	handlers := append([]messaging.MessageHandler{}, ps.handlers...)
+	ps.mu.Unlock()
+	for _, h := range handlers {
+		if err := h.Handle(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"io"
+	"sync"
+)
+
+// TruncationMarker is appended to output of the commands exceeding the
+// configured maximum output size.
+const TruncationMarker = "\n[output truncated]\n"
+
+// outputLimit bounds combined output written by the command. Once the limit is
+// exceeded, the rest of the output is discarded and exceeded is called.
+type outputLimit struct {
+	mu        sync.Mutex
+	remaining int
+	truncated bool
+	exceeded  func()
+}
+
+// writer returns writer to w counted against the limit.
+func (l *outputLimit) writer(w io.Writer) io.Writer {
+	return &limitedWriter{limit: l, w: w}
+}
+
+func (l *outputLimit) isTruncated() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.truncated
+}
+
+type limitedWriter struct {
+	limit *outputLimit
+	w     io.Writer
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	l := lw.limit
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.truncated {
+		return len(p), nil
+	}
+	if len(p) <= l.remaining {
+		l.remaining -= len(p)
+		return lw.w.Write(p)
+	}
+	if _, err := lw.w.Write(p[:l.remaining]); err != nil {
+		return 0, err
+	}
+	l.remaining = 0
+	l.truncated = true
+	l.exceeded()
+	return len(p), nil
+}
+
+// sameWriter reports whether the writers are the same, the way os/exec
+// compares command streams, which panics for uncomparable writers.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
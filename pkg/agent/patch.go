@@ -0,0 +1,260 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+// Duration is time.Duration decoded from JSON string such as "30s" or number
+// of nanoseconds.
+type Duration time.Duration
+
+// UnmarshalJSON parses the duration from JSON.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	switch value := v.(type) {
+	case float64:
+		*d = Duration(value)
+		return nil
+	case string:
+		dur, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dur)
+		return nil
+	default:
+		return errors.New("invalid duration")
+	}
+}
+
+// ConfigPatch represents partial update of the agent config. Only the fields
+// which are set are applied, MQTT credentials are changed by credentials
+// rotation instead.
+type ConfigPatch struct {
+	Server    *ServerPatch    `json:"server,omitempty"`
+	Terminal  *TerminalPatch  `json:"terminal,omitempty"`
+	Heartbeat *HeartbeatPatch `json:"heartbeat,omitempty"`
+	Exec      *ExecPatch      `json:"exec,omitempty"`
+	Channels  *ChanPatch      `json:"channels,omitempty"`
+	Edgex     *EdgexPatch     `json:"edgex,omitempty"`
+	Log       *LogPatch       `json:"log,omitempty"`
+	MQTT      *MQTTPatch      `json:"mqtt,omitempty"`
+}
+
+type ServerPatch struct {
+	Port      *string `json:"port,omitempty"`
+	BrokerURL *string `json:"broker_url,omitempty"`
+}
+
+type TerminalPatch struct {
+	SessionTimeout *Duration `json:"session_timeout,omitempty"`
+	MaxDuration    *Duration `json:"max_duration,omitempty"`
+	Format         *string   `json:"format,omitempty"`
+	AckWindow      *int      `json:"ack_window,omitempty"`
+	ReplayBuffer   *int      `json:"replay_buffer,omitempty"`
+	Shell          *string   `json:"shell,omitempty"`
+	InputRate      *int      `json:"input_rate,omitempty"`
+	MaxInput       *int      `json:"max_input,omitempty"`
+	MaxSessions    *int      `json:"max_sessions,omitempty"`
+	Banner         *string   `json:"banner,omitempty"`
+}
+
+type HeartbeatPatch struct {
+	Interval *Duration `json:"interval,omitempty"`
+}
+
+type ExecPatch struct {
+	Timeout           *Duration  `json:"timeout,omitempty"`
+	Allowlist         *[]string  `json:"allowlist,omitempty"`
+	Denylist          *[]string  `json:"denylist,omitempty"`
+	MaxOutputBytes    *int       `json:"max_output_bytes,omitempty"`
+	Dir               *string    `json:"dir,omitempty"`
+	BaseDir           *string    `json:"base_dir,omitempty"`
+	Env               *EnvConfig `json:"env,omitempty"`
+	ContinueOnError   *bool      `json:"continue_on_error,omitempty"`
+	Cacheable         *[]string  `json:"cacheable,omitempty"`
+	CacheTTL          *Duration  `json:"cache_ttl,omitempty"`
+	User              *string    `json:"user,omitempty"`
+	CompressThreshold *int       `json:"compress_threshold,omitempty"`
+	MaxConcurrent     *int       `json:"max_concurrent,omitempty"`
+	QueueTimeout      *Duration  `json:"queue_timeout,omitempty"`
+	Retryable         *[]string  `json:"retryable,omitempty"`
+	RetryExitCodes    *[]int     `json:"retry_exit_codes,omitempty"`
+	MaxRetries        *int       `json:"max_retries,omitempty"`
+	RetryDelay        *Duration  `json:"retry_delay,omitempty"`
+}
+
+type ChanPatch struct {
+	Control *string `json:"control,omitempty"`
+	Data    *string `json:"data,omitempty"`
+}
+
+type EdgexPatch struct {
+	URL          *string   `json:"url,omitempty"`
+	DataURL      *string   `json:"data_url,omitempty"`
+	CommandURL   *string   `json:"command_url,omitempty"`
+	PollInterval *Duration `json:"poll_interval,omitempty"`
+}
+
+type LogPatch struct {
+	Level *string `json:"level,omitempty"`
+}
+
+type MQTTPatch struct {
+	QoS    *byte `json:"qos,omitempty"`
+	Retain *bool `json:"retain,omitempty"`
+}
+
+// Empty reports whether patch doesn't change anything.
+func (p ConfigPatch) Empty() bool {
+	return p == ConfigPatch{}
+}
+
+// Apply merges the fields set in patch into the config.
+func (p ConfigPatch) Apply(c *Config) {
+	if s := p.Server; s != nil {
+		set(&c.Server.Port, s.Port)
+		set(&c.Server.BrokerURL, s.BrokerURL)
+	}
+	if t := p.Terminal; t != nil {
+		setDuration(&c.Terminal.SessionTimeout, t.SessionTimeout)
+		setDuration(&c.Terminal.MaxDuration, t.MaxDuration)
+		set(&c.Terminal.Format, t.Format)
+		set(&c.Terminal.AckWindow, t.AckWindow)
+		set(&c.Terminal.ReplayBuffer, t.ReplayBuffer)
+		set(&c.Terminal.Shell, t.Shell)
+		set(&c.Terminal.InputRate, t.InputRate)
+		set(&c.Terminal.MaxInput, t.MaxInput)
+		set(&c.Terminal.MaxSessions, t.MaxSessions)
+		set(&c.Terminal.Banner, t.Banner)
+	}
+	if h := p.Heartbeat; h != nil {
+		setDuration(&c.Heartbeat.Interval, h.Interval)
+	}
+	if e := p.Exec; e != nil {
+		setDuration(&c.Exec.Timeout, e.Timeout)
+		set(&c.Exec.Allowlist, e.Allowlist)
+		set(&c.Exec.Denylist, e.Denylist)
+		set(&c.Exec.MaxOutputBytes, e.MaxOutputBytes)
+		set(&c.Exec.Dir, e.Dir)
+		set(&c.Exec.BaseDir, e.BaseDir)
+		set(&c.Exec.Env, e.Env)
+		set(&c.Exec.ContinueOnError, e.ContinueOnError)
+		set(&c.Exec.Cacheable, e.Cacheable)
+		setDuration(&c.Exec.CacheTTL, e.CacheTTL)
+		set(&c.Exec.User, e.User)
+		set(&c.Exec.CompressThreshold, e.CompressThreshold)
+		set(&c.Exec.MaxConcurrent, e.MaxConcurrent)
+		setDuration(&c.Exec.QueueTimeout, e.QueueTimeout)
+		set(&c.Exec.Retryable, e.Retryable)
+		set(&c.Exec.RetryExitCodes, e.RetryExitCodes)
+		set(&c.Exec.MaxRetries, e.MaxRetries)
+		setDuration(&c.Exec.RetryDelay, e.RetryDelay)
+	}
+	if ch := p.Channels; ch != nil {
+		set(&c.Channels.Control, ch.Control)
+		set(&c.Channels.Data, ch.Data)
+	}
+	if e := p.Edgex; e != nil {
+		set(&c.Edgex.URL, e.URL)
+		set(&c.Edgex.DataURL, e.DataURL)
+		set(&c.Edgex.CommandURL, e.CommandURL)
+		setDuration(&c.Edgex.PollInterval, e.PollInterval)
+	}
+	if l := p.Log; l != nil {
+		set(&c.Log.Level, l.Level)
+	}
+	if m := p.MQTT; m != nil {
+		set(&c.MQTT.QoS, m.QoS)
+		set(&c.MQTT.Retain, m.Retain)
+	}
+}
+
+// PatchOf returns the patch setting all the patchable fields to the ones of
+// the config.
+func PatchOf(c Config) ConfigPatch {
+	return ConfigPatch{
+		Server: &ServerPatch{
+			Port:      &c.Server.Port,
+			BrokerURL: &c.Server.BrokerURL,
+		},
+		Terminal: &TerminalPatch{
+			SessionTimeout: duration(c.Terminal.SessionTimeout),
+			MaxDuration:    duration(c.Terminal.MaxDuration),
+			Format:         &c.Terminal.Format,
+			AckWindow:      &c.Terminal.AckWindow,
+			ReplayBuffer:   &c.Terminal.ReplayBuffer,
+			Shell:          &c.Terminal.Shell,
+			InputRate:      &c.Terminal.InputRate,
+			MaxInput:       &c.Terminal.MaxInput,
+			MaxSessions:    &c.Terminal.MaxSessions,
+			Banner:         &c.Terminal.Banner,
+		},
+		Heartbeat: &HeartbeatPatch{
+			Interval: duration(c.Heartbeat.Interval),
+		},
+		Exec: &ExecPatch{
+			Timeout:           duration(c.Exec.Timeout),
+			Allowlist:         &c.Exec.Allowlist,
+			Denylist:          &c.Exec.Denylist,
+			MaxOutputBytes:    &c.Exec.MaxOutputBytes,
+			Dir:               &c.Exec.Dir,
+			BaseDir:           &c.Exec.BaseDir,
+			Env:               &c.Exec.Env,
+			ContinueOnError:   &c.Exec.ContinueOnError,
+			Cacheable:         &c.Exec.Cacheable,
+			CacheTTL:          duration(c.Exec.CacheTTL),
+			User:              &c.Exec.User,
+			CompressThreshold: &c.Exec.CompressThreshold,
+			MaxConcurrent:     &c.Exec.MaxConcurrent,
+			QueueTimeout:      duration(c.Exec.QueueTimeout),
+			Retryable:         &c.Exec.Retryable,
+			RetryExitCodes:    &c.Exec.RetryExitCodes,
+			MaxRetries:        &c.Exec.MaxRetries,
+			RetryDelay:        duration(c.Exec.RetryDelay),
+		},
+		Channels: &ChanPatch{
+			Control: &c.Channels.Control,
+			Data:    &c.Channels.Data,
+		},
+		Edgex: &EdgexPatch{
+			URL:          &c.Edgex.URL,
+			DataURL:      &c.Edgex.DataURL,
+			CommandURL:   &c.Edgex.CommandURL,
+			PollInterval: duration(c.Edgex.PollInterval),
+		},
+		Log: &LogPatch{
+			Level: &c.Log.Level,
+		},
+		MQTT: &MQTTPatch{
+			QoS:    &c.MQTT.QoS,
+			Retain: &c.MQTT.Retain,
+		},
+	}
+}
+
+func set[T any](dst *T, v *T) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+func setDuration(dst *time.Duration, v *Duration) {
+	if v != nil {
+		*dst = time.Duration(*v)
+	}
+}
+
+func duration(d time.Duration) *Duration {
+	v := Duration(d)
+	return &v
+}
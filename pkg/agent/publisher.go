@@ -0,0 +1,288 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+const (
+	minPublishBackoff = 100 * time.Millisecond
+	maxPublishBackoff = 30 * time.Second
+
+	// defaultQueueMaxBytes caps disk usage of the queue unless configured.
+	defaultQueueMaxBytes = 10 << 20
+)
+
+// MQTTMetrics instruments the MQTT connection and publishes.
+type MQTTMetrics struct {
+	// Connected is 1 while the MQTT connection is open and 0 otherwise. It's
+	// updated on every publish, so the client handlers should update it on
+	// connect and connection loss too.
+	Connected metrics.Gauge
+
+	// Latency observes latencies of the publishes in seconds.
+	Latency metrics.Histogram
+
+	// Failed counts the failed publishes, including the retried ones.
+	Failed metrics.Counter
+
+	// Dropped counts the messages that are never published, either failing
+	// while disconnected without a queue or dropped by the full queue.
+	Dropped metrics.Counter
+}
+
+// withDefaults returns the metrics with the unset ones discarded.
+func (m MQTTMetrics) withDefaults() MQTTMetrics {
+	if m.Connected == nil {
+		m.Connected = discard.NewGauge()
+	}
+	if m.Latency == nil {
+		m.Latency = discard.NewHistogram()
+	}
+	if m.Failed == nil {
+		m.Failed = discard.NewCounter()
+	}
+	if m.Dropped == nil {
+		m.Dropped = discard.NewCounter()
+	}
+	return m
+}
+
+type outbound struct {
+	seq     uint64
+	topic   string
+	qos     byte
+	retain  bool
+	payload string
+}
+
+// publisher queues messages published while the MQTT connection is down
+// and flushes them once the client reconnects, retrying with exponential
+// backoff. When the queue is full the oldest messages are dropped.
+//
+// Paho client reports itself connected while reconnecting and completes QoS 0
+// publishes without sending them, so the open connection is checked instead.
+type publisher struct {
+	client  paho.Client
+	metrics MQTTMetrics
+	logger  *slog.Logger
+	mu      sync.Mutex
+	queue   queue
+	wake    chan struct{}
+}
+
+// newPublisher returns publisher queueing messages in cfg.QueueDir if set,
+// or up to cfg.PublishBuffer messages in memory otherwise. With neither of
+// them configured, publishes fail while disconnected. Publishes are reported
+// to the metrics.
+func newPublisher(ctx context.Context, client paho.Client, cfg MQTTConfig, m MQTTMetrics, logger *slog.Logger) (*publisher, error) {
+	p := &publisher{
+		client:  client,
+		metrics: m.withDefaults(),
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+	}
+	p.observeConnection()
+	switch {
+	case cfg.QueueDir != "":
+		maxBytes := cfg.QueueMaxBytes
+		if maxBytes <= 0 {
+			maxBytes = defaultQueueMaxBytes
+		}
+		q, err := openFileQueue(cfg.QueueDir, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		p.queue = q
+	case cfg.PublishBuffer > 0:
+		p.queue = newMemQueue(cfg.PublishBuffer)
+	default:
+		return p, nil
+	}
+	go p.run(ctx)
+	// Drain messages left by the previous run.
+	if p.queue.len() > 0 {
+		p.wake <- struct{}{}
+	}
+	return p, nil
+}
+
+// publish sends the message, or queues it while disconnected. Waiting for
+// the message to be sent is cancelled with ctx.
+func (p *publisher) publish(ctx context.Context, topic string, qos byte, retain bool, payload string) error {
+	m := outbound{topic: topic, qos: qos, retain: retain, payload: payload}
+	if p.queue == nil {
+		err := p.send(ctx, m)
+		if err != nil && !p.client.IsConnectionOpen() {
+			p.metrics.Dropped.Add(1)
+		}
+		return err
+	}
+
+	// Queued messages are flushed first to keep the publishing order.
+	p.mu.Lock()
+	direct := p.queue.len() == 0 && p.client.IsConnectionOpen()
+	p.mu.Unlock()
+	if direct {
+		err := p.send(ctx, m)
+		if err == nil || p.client.IsConnectionOpen() {
+			return err
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dropped, err := p.queue.push(m)
+	if dropped > 0 {
+		p.metrics.Dropped.Add(float64(dropped))
+		p.logger.Warn(fmt.Sprintf("Publish queue full, dropped %d oldest messages", dropped))
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// publishWait sends the message right away, without queueing it, and waits
+// up to the timeout for it to complete, unless ctx is done first.
+func (p *publisher) publishWait(ctx context.Context, topic string, qos byte, retain bool, payload string, timeout time.Duration) error {
+	begin := time.Now()
+	token := p.client.Publish(topic, qos, retain, payload)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		p.metrics.Failed.Add(1)
+		return wrap(ErrPublishFailed, ctx.Err())
+	case <-timer.C:
+		p.metrics.Failed.Add(1)
+		return wrap(ErrPublishTimeout, fmt.Errorf("no acknowledgment of message to %s within %s", topic, timeout))
+	}
+	p.metrics.Latency.Observe(time.Since(begin).Seconds())
+	p.observeConnection()
+	if err := token.Error(); err != nil {
+		p.metrics.Failed.Add(1)
+		return wrap(ErrPublishFailed, err)
+	}
+	return nil
+}
+
+// depth returns the number of messages waiting to be published.
+func (p *publisher) depth() int {
+	if p.queue == nil {
+		return 0
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.queue.len()
+}
+
+// send publishes the message, waiting for it to complete until ctx is done.
+func (p *publisher) send(ctx context.Context, m outbound) error {
+	begin := time.Now()
+	token := p.client.Publish(m.topic, m.qos, m.retain, m.payload)
+	select {
+	case <-token.Done():
+	case <-ctx.Done():
+		p.metrics.Failed.Add(1)
+		return ctx.Err()
+	}
+	p.metrics.Latency.Observe(time.Since(begin).Seconds())
+	p.observeConnection()
+	if err := token.Error(); err != nil {
+		p.metrics.Failed.Add(1)
+		return err
+	}
+	return nil
+}
+
+// observeConnection reports the state of the MQTT connection.
+func (p *publisher) observeConnection() {
+	if p.client.IsConnectionOpen() {
+		p.metrics.Connected.Set(1)
+		return
+	}
+	p.metrics.Connected.Set(0)
+}
+
+func (p *publisher) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.wake:
+		}
+		if !p.flush(ctx) {
+			return
+		}
+	}
+}
+
+// flush publishes queued messages oldest first until the queue is empty.
+// It returns false if the context is cancelled meanwhile.
+func (p *publisher) flush(ctx context.Context) bool {
+	backoff := minPublishBackoff
+	for {
+		if p.client.IsConnectionOpen() {
+			m, ok, err := p.next()
+			if !ok {
+				return true
+			}
+			if err == nil {
+				err = p.send(ctx, m)
+			}
+			if err == nil {
+				p.mu.Lock()
+				// Message may have been dropped meanwhile by a full queue.
+				err = p.queue.remove(m.seq)
+				p.mu.Unlock()
+			}
+			if err == nil {
+				backoff = minPublishBackoff
+				continue
+			}
+			p.logger.Debug(fmt.Sprintf("Failed to flush queued message to %s: %s", m.topic, err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxPublishBackoff)
+	}
+}
+
+// next returns the oldest queued message, dropping the unreadable ones since
+// they can't ever be published.
+func (p *publisher) next() (outbound, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for {
+		m, ok, err := p.queue.peek()
+		if err == nil || !ok {
+			return m, ok, nil
+		}
+		p.metrics.Dropped.Add(1)
+		p.logger.Warn(fmt.Sprintf("Dropped unreadable queued message %d: %s", m.seq, err))
+		if err := p.queue.remove(m.seq); err != nil {
+			return m, true, err
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+const queueFileExt = ".msg"
+
+var errMessageTooLarge = errors.New("message exceeds queue capacity")
+
+// queue keeps outbound messages in FIFO order. When full, the oldest
+// messages are dropped to make room for the new one.
+type queue interface {
+	// push appends the message and returns the number of dropped messages.
+	push(m outbound) (int, error)
+
+	// peek returns the oldest message, if any.
+	peek() (outbound, bool, error)
+
+	// remove removes the oldest message if its sequence number is seq.
+	remove(seq uint64) error
+
+	// len returns the number of queued messages.
+	len() int
+}
+
+var (
+	_ queue = (*memQueue)(nil)
+	_ queue = (*fileQueue)(nil)
+)
+
+// memQueue keeps up to size messages in memory.
+type memQueue struct {
+	size int
+	seq  uint64
+	msgs []outbound
+}
+
+func newMemQueue(size int) *memQueue {
+	return &memQueue{size: size}
+}
+
+func (q *memQueue) push(m outbound) (int, error) {
+	q.seq++
+	m.seq = q.seq
+	dropped := 0
+	if len(q.msgs) == q.size {
+		q.msgs = q.msgs[1:]
+		dropped++
+	}
+	q.msgs = append(q.msgs, m)
+	return dropped, nil
+}
+
+func (q *memQueue) peek() (outbound, bool, error) {
+	if len(q.msgs) == 0 {
+		return outbound{}, false, nil
+	}
+	return q.msgs[0], true, nil
+}
+
+func (q *memQueue) remove(seq uint64) error {
+	if len(q.msgs) > 0 && q.msgs[0].seq == seq {
+		q.msgs = q.msgs[1:]
+	}
+	return nil
+}
+
+func (q *memQueue) len() int {
+	return len(q.msgs)
+}
+
+type queueEntry struct {
+	seq  uint64
+	size int64
+}
+
+type queuedMessage struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Retain  bool   `json:"retain"`
+	Payload string `json:"payload"`
+}
+
+// fileQueue keeps messages in dir, one file per message named by its
+// sequence number, so the queue survives restarts. Total size of the
+// message files is kept under maxBytes.
+type fileQueue struct {
+	dir      string
+	maxBytes int64
+	bytes    int64
+	seq      uint64
+	entries  []queueEntry
+}
+
+// openFileQueue opens the queue in dir, creating the directory if needed,
+// and loads the messages left by the previous run.
+func openFileQueue(dir string, maxBytes int64) (*fileQueue, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	q := &fileQueue{dir: dir, maxBytes: maxBytes}
+	for _, f := range files {
+		name := f.Name()
+		if f.IsDir() || !strings.HasSuffix(name, queueFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, queueFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.entries = append(q.entries, queueEntry{seq: seq, size: info.Size()})
+		q.bytes += info.Size()
+	}
+	sort.Slice(q.entries, func(i, j int) bool {
+		return q.entries[i].seq < q.entries[j].seq
+	})
+	if n := len(q.entries); n > 0 {
+		q.seq = q.entries[n-1].seq
+	}
+	return q, nil
+}
+
+func (q *fileQueue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, queueFileExt))
+}
+
+func (q *fileQueue) push(m outbound) (int, error) {
+	data, err := json.Marshal(queuedMessage{
+		Topic:   m.topic,
+		QoS:     m.qos,
+		Retain:  m.retain,
+		Payload: m.payload,
+	})
+	if err != nil {
+		return 0, err
+	}
+	size := int64(len(data))
+	if size > q.maxBytes {
+		return 0, errMessageTooLarge
+	}
+
+	dropped := 0
+	for len(q.entries) > 0 && q.bytes+size > q.maxBytes {
+		if err := q.remove(q.entries[0].seq); err != nil {
+			return dropped, err
+		}
+		dropped++
+	}
+
+	seq := q.seq + 1
+	// Write to temporary file first, so the partially written message isn't
+	// loaded after a crash.
+	tmp := q.path(seq) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return dropped, err
+	}
+	if err := os.Rename(tmp, q.path(seq)); err != nil {
+		return dropped, err
+	}
+	q.seq = seq
+	q.entries = append(q.entries, queueEntry{seq: seq, size: size})
+	q.bytes += size
+	return dropped, nil
+}
+
+func (q *fileQueue) peek() (outbound, bool, error) {
+	if len(q.entries) == 0 {
+		return outbound{}, false, nil
+	}
+	seq := q.entries[0].seq
+	data, err := os.ReadFile(q.path(seq))
+	if err != nil {
+		return outbound{seq: seq}, true, err
+	}
+	var m queuedMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return outbound{seq: seq}, true, err
+	}
+	return outbound{
+		seq:     seq,
+		topic:   m.Topic,
+		qos:     m.QoS,
+		retain:  m.Retain,
+		payload: m.Payload,
+	}, true, nil
+}
+
+func (q *fileQueue) remove(seq uint64) error {
+	if len(q.entries) == 0 || q.entries[0].seq != seq {
+		return nil
+	}
+	if err := os.Remove(q.path(seq)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	q.bytes -= q.entries[0].size
+	q.entries = q.entries[1:]
+	return nil
+}
+
+func (q *fileQueue) len() int {
+	return len(q.entries)
+}
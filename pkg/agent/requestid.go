@@ -0,0 +1,21 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import "context"
+
+type requestIDKey struct{}
+
+// WithRequestID returns context carrying the request ID, which correlates the
+// logs and messages of the single request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns request ID carried by the context, or an empty string if
+// there's none.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,64 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// results caches results of the read-only commands by the command, its
+// working directory and user, so repeated commands don't spawn processes.
+type results struct {
+	mu      sync.Mutex
+	entries map[string]cachedResult
+}
+
+type cachedResult struct {
+	res     ExecResult
+	expires time.Time
+}
+
+// get returns the cached result unless it expired.
+func (r *results) get(key string, now time.Time) (ExecResult, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return ExecResult{}, false
+	}
+	return e.res, true
+}
+
+// put caches the result for ttl, dropping the expired results.
+func (r *results) put(key string, res ExecResult, now time.Time, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.entries == nil {
+		r.entries = make(map[string]cachedResult)
+	}
+	for k, e := range r.entries {
+		if !now.Before(e.expires) {
+			delete(r.entries, k)
+		}
+	}
+	r.entries[key] = cachedResult{res: res, expires: now.Add(ttl)}
+}
+
+// resultKey returns the key of the command result, reporting whether the
+// command is cacheable.
+func (a *agent) resultKey(cmd, dir string) (string, bool) {
+	ec := a.Config().Exec
+	if ec.CacheTTL <= 0 {
+		return "", false
+	}
+	cmd = strings.ReplaceAll(cmd, " ", "")
+	name, _, _ := strings.Cut(cmd, ",")
+	if !matchPattern(ec.Cacheable, name) {
+		return "", false
+	}
+	// Result depends on the user running the command too.
+	return ec.User + "\x00" + dir + "\x00" + cmd, true
+}
@@ -0,0 +1,56 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"bytes"
+	"context"
+	goerrors "errors"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"strings"
+	"time"
+)
+
+// runWithRetry runs the command the same way run does. Retryable command
+// exiting with one of the transient exit codes is run again after the retry
+// delay, at most the configured number of times. Output buffers are reset
+// before each retry, so they hold the output of the last run only.
+func (a *agent) runWithRetry(ctx context.Context, uuid, cmd, dir string, stdout, stderr *bytes.Buffer) (bool, error) {
+	ec := a.Config().Exec
+	retries := 0
+	if a.retryable(ec, cmd) {
+		retries = ec.MaxRetries
+	}
+	for attempt := 0; ; attempt++ {
+		truncated, err := a.run(ctx, uuid, cmd, dir, stdout, stderr)
+		var exitErr *exec.ExitError
+		if attempt == retries || truncated || !goerrors.As(err, &exitErr) || !exitErr.Exited() ||
+			!slices.Contains(ec.RetryExitCodes, exitErr.ExitCode()) {
+			return truncated, err
+		}
+		args := []any{slog.String("uuid", uuid), slog.Int("exit_code", exitErr.ExitCode()), slog.Int("retry", attempt+1)}
+		if id := RequestID(ctx); id != "" {
+			args = append(args, slog.String(requestID, id))
+		}
+		a.logger.Info("Retrying command after transient failure", args...)
+		select {
+		case <-ctx.Done():
+			return truncated, err
+		case <-time.After(ec.RetryDelay):
+		}
+		stdout.Reset()
+		stderr.Reset()
+	}
+}
+
+// retryable reports whether the command is retried on transient failures.
+func (a *agent) retryable(ec ExecConfig, cmd string) bool {
+	if ec.MaxRetries <= 0 || len(ec.RetryExitCodes) == 0 {
+		return false
+	}
+	name, _, _ := strings.Cut(strings.ReplaceAll(cmd, " ", ""), ",")
+	return matchPattern(ec.Retryable, name)
+}
@@ -0,0 +1,54 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"context"
+	_ "embed"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/andychao217/magistrala/pkg/messaging"
+	"github.com/pelletier/go-toml"
+)
+
+//go:embed safemode.toml
+var safeModeConfig []byte
+
+// errSafeMode indicates that the message broker is disabled in safe mode.
+var errSafeMode = errors.New("message broker is disabled in safe mode")
+
+// SafeModeConfig returns the minimal config the agent falls back to if
+// neither bootstrap nor the local config provides a valid one. MQTT and
+// the message broker are disabled in safe mode, leaving only the local HTTP
+// API, so the device stays reachable for recovery.
+func SafeModeConfig() (Config, error) {
+	var c Config
+	if err := toml.Unmarshal(safeModeConfig, &c); err != nil {
+		return Config{}, err
+	}
+	c.SafeMode = true
+	return c, nil
+}
+
+var _ messaging.PubSub = offlinePubSub{}
+
+// offlinePubSub replaces the message broker in safe mode. Subscriptions are
+// ignored and publishes fail.
+type offlinePubSub struct{}
+
+func (offlinePubSub) Publish(context.Context, string, *messaging.Message) error {
+	return errSafeMode
+}
+
+func (offlinePubSub) Subscribe(context.Context, messaging.SubscriberConfig) error {
+	return nil
+}
+
+func (offlinePubSub) Unsubscribe(context.Context, string, string) error {
+	return nil
+}
+
+func (offlinePubSub) Close() error {
+	return nil
+}
@@ -4,14 +4,25 @@
 package agent
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
+	goerrors "errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/andychao217/agent/pkg/edgex"
@@ -36,17 +47,43 @@ const (
 	char    = "c"
 	open    = "open"
 	close   = "close"
+	ack     = "ack"
+	replay  = "replay"
+	resize  = "resize"
+	signal  = "signal"
 	control = "control"
 	data    = "data"
 
+	requestID = "request_id"
+
 	export = "export"
 
 	pubSubID = "agent"
+
+	waitDelay = time.Second
+
+	rotateCredentials = "rotate-credentials"
+	reapSessions      = "reap-sessions"
+	edgexCommand      = "edgex-command"
+	disconnectQuiesce = 250
+
+	usernamePlaceholder = "{username}"
 )
 
+// HeartbeatRequest is the subject services are asked to send their heartbeat
+// on, whenever the agent refreshes the services.
+const HeartbeatRequest = Commands + ".heartbeat"
+
 var (
-	// errInvalidCommand indicates malformed command.
-	errInvalidCommand = errors.New("invalid command")
+	// ErrInvalidCommand indicates malformed command.
+	ErrInvalidCommand = errors.New("invalid command")
+
+	// ErrConfigNotFound indicates that config file doesn't exist.
+	ErrConfigNotFound = errors.New("config not found")
+
+	// ErrConfigRejected indicates that the reloaded config file is invalid,
+	// so the current config is kept.
+	ErrConfigRejected = errors.New("reloaded config rejected")
 
 	// ErrMalformedEntity indicates malformed entity specification.
 	ErrMalformedEntity = errors.New("malformed entity specification")
@@ -54,74 +91,264 @@ var (
 	// ErrInvalidQueryParams indicates malformed URL.
 	ErrInvalidQueryParams = errors.New("invalid query params")
 
-	// errUnknownCommand indicates that command is not found.
-	errUnknownCommand = errors.New("Unknown command")
-
 	// errNatsSubscribing indicates problem with sub to topic for heartbeat.
 	errNatsSubscribing = errors.New("failed to subscribe to heartbeat topic")
 
-	// errNoSuchService indicates service not supported.
-	errNoSuchService = errors.New("no such service")
+	// ErrNoSuchService indicates service not supported or not registered.
+	ErrNoSuchService = errors.New("no such service")
+
+	// ErrNoSuchChannel indicates data channel isn't configured.
+	ErrNoSuchChannel = errors.New("no such channel")
 
 	// errFailedEncode indicates error in encoding.
 	errFailedEncode = errors.New("failed to encode")
 
-	// errFailedToPublish.
-	errFailedToPublish = errors.New("failed to publish")
+	// ErrPublishFailed indicates that message couldn't be published.
+	ErrPublishFailed = errors.New("failed to publish")
+
+	// ErrPublishTimeout indicates that broker didn't acknowledge the message
+	// within the timeout.
+	ErrPublishTimeout = errors.New("publish not acknowledged in time")
 
 	// errEdgexFailed.
 	errEdgexFailed = errors.New("failed to execute edgex operation")
 
-	// errFailedExecute.
-	errFailedExecute = errors.New("failed to execute command")
+	// ErrExecFailed indicates that command failed to run or exited with an error.
+	ErrExecFailed = errors.New("failed to execute command")
+
+	// ErrCommandNotAllowed indicates that command is rejected by allowlist or denylist.
+	ErrCommandNotAllowed = errors.New("command not allowed")
+
+	// ErrInvalidWorkDir indicates that working directory of command doesn't
+	// exist or is outside of the allowed base directory.
+	ErrInvalidWorkDir = errors.New("invalid working directory")
+
+	// ErrExecTimeout indicates that command didn't complete within the configured timeout.
+	ErrExecTimeout = errors.New("command execution timed out")
+
+	// ErrTooManyExecutions indicates that the maximum number of commands is
+	// already running.
+	ErrTooManyExecutions = errors.New("too many concurrent executions")
 
 	// errFailedToCreateTerminalSession.
 	errFailedToCreateTerminalSession = errors.New("failed to create terminal session")
 
+	// errPublisherFailed indicates that the publish queue failed to open.
+	errPublisherFailed = errors.New("failed to create publisher")
+
 	// errNoSuchTerminalSession terminal session doesnt exist error on closing.
 	errNoSuchTerminalSession = errors.New("no such terminal session")
+
+	// errFailedToRotateCredentials indicates that MQTT client failed to connect with new credentials.
+	errFailedToRotateCredentials = errors.New("failed to rotate MQTT credentials")
+
+	// errNoConfigStore indicates that the agent has no store to persist the config in.
+	errNoConfigStore = errors.New("config store isn't set")
+
+	// ErrTopicNotAllowed indicates that topic is outside of the namespace of the configured MQTT identity.
+	ErrTopicNotAllowed = errors.New("topic not allowed for MQTT identity")
 )
 
+// PublishOpts overrides MQTT QoS and retained flag of the published message.
+// Unset options keep the configured ones.
+type PublishOpts struct {
+	QoS      *byte `json:"qos,omitempty"`
+	Retained *bool `json:"retained,omitempty"`
+}
+
+// Validate returns ErrMalformedEntity if QoS is out of range.
+func (o PublishOpts) Validate() error {
+	if o.QoS != nil && *o.QoS > 2 {
+		return wrap(ErrMalformedEntity, fmt.Errorf("QoS %d out of range", *o.QoS))
+	}
+	return nil
+}
+
+// ExecResult represents result of the executed command.
+type ExecResult struct {
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	// Truncated reports that output exceeded the maximum size, in which case
+	// command is killed and ExitCode is -1.
+	Truncated bool `json:"truncated"`
+}
+
 // Service specifies API for publishing messages and subscribing to topics.
+// Errors returned by the service can be matched with errors.Is or errors.Contains.
+// Remote operations return ErrLockedDown while the agent is in lockdown.
 type Service interface {
-	// Execute command.
-	Execute(string, string) (string, error)
-
-	// Control command.
+	// Execute command and publish its output, along with the request ID
+	// carried by the context. Returns ErrInvalidCommand, ErrCommandNotAllowed,
+	// ErrTooManyExecutions, ErrExecTimeout, ErrExecCancelled, ErrExecFailed
+	// or ErrPublishFailed.
+	Execute(ctx context.Context, uuid, cmd string) (string, error)
+
+	// ExecuteStream executes command in the working directory dir, or in the
+	// configured one if dir is empty, writing output of the standard streams
+	// to the writers as it is produced. The same writer can be passed for
+	// both to get the combined output. Returns exit code of the command, -1 if
+	// it was killed once its output exceeded the maximum size. Command is
+	// killed with ErrExecCancelled once the context is done. Returns the same
+	// errors as Execute, except ErrPublishFailed, or ErrInvalidWorkDir, and
+	// ErrExecFailed along with the exit code if the command exits with
+	// non-zero code.
+	ExecuteStream(ctx context.Context, uuid, cmd, dir string, stdout, stderr io.Writer) (int, error)
+
+	// ExecuteResult executes command in the working directory dir, or in the
+	// configured one if dir is empty, returning its exit code and output of the
+	// standard streams. Command exiting with non-zero code isn't an error, other
+	// errors are the same as of ExecuteStream, or ErrInvalidWorkDir.
+	ExecuteResult(ctx context.Context, uuid, cmd, dir string) (ExecResult, error)
+
+	// ExecuteBatch executes commands in order the same way as ExecuteResult,
+	// stopping on the first one exiting with non-zero code unless the exec
+	// continue on error setting is enabled. All the commands are checked
+	// before any is executed. On error, results of the commands executed so
+	// far are returned along with it.
+	ExecuteBatch(uuid string, cmds []string) ([]ExecResult, error)
+
+	// CancelExecute cancels the running commands started with the UUID,
+	// killing their processes. Returns ErrNoSuchExecution if there's none.
+	CancelExecute(uuid string) error
+
+	// Control parses the command into the control verb and its args and
+	// calls the handler registered for the verb. Returns ErrInvalidCommand,
+	// ErrUnknownControlVerb, ErrCommandNotAllowed, ErrExecTimeout or
+	// ErrPublishFailed.
 	Control(string, string) error
 
-	// Update configuration file.
+	// RegisterControl registers handler of the control verb, replacing the
+	// one registered before, built-in included. Response of the handler is
+	// published to the control channel. Returns ErrMalformedEntity if the
+	// verb is empty or contains separators, or the handler is nil.
+	RegisterControl(verb string, h ControlHandler) error
+
+	// Update stored configuration. Returns ErrInvalidConfig if config is invalid.
+	// Config with the non-empty IdempotencyKey of the last config added is
+	// not saved again.
 	AddConfig(Config) error
 
+	// UpdateConfig merges the fields set in patch into the current config and
+	// saves it, logging the changed fields. Returns ErrMalformedEntity if
+	// patch is empty.
+	UpdateConfig(patch ConfigPatch) error
+
 	// Config returns Config struct created from config file.
 	Config() Config
 
-	// Saves config file.
+	// Saves config file. Returns ErrInvalidCommand or ErrPublishFailed.
 	ServiceConfig(ctx context.Context, uuid, cmdStr string) error
 
 	// Services returns service list.
 	Services() []Info
 
-	// Terminal used for terminal control of gateway.
+	// ServicesByStatus returns list of the services with the status. The list
+	// is empty if the status is unknown.
+	ServicesByStatus(status string) []Info
+
+	// RefreshServices rescans the services. Services whose reported process
+	// exited are removed, and all the services are asked to send their
+	// heartbeat, so the ones whose heartbeats were missed are registered
+	// once they answer. Returns ErrPublishFailed if the services can't be
+	// asked.
+	RefreshServices() error
+
+	// QueueDepth returns the number of messages waiting to be published
+	// once the MQTT broker is reachable again.
+	QueueDepth() int
+
+	// FlushBatches publishes the batched messages right away, without
+	// waiting for the batch window to elapse, so they aren't lost on
+	// shutdown. Returns ErrPublishFailed if they can't be published.
+	FlushBatches() error
+
+	// Service returns info of the service with the given name. Returns
+	// ErrNoSuchService if service isn't registered.
+	Service(id string) (Info, error)
+
+	// Terminal used for terminal control of gateway. Returns ErrInvalidCommand.
 	Terminal(string, string) error
 
-	// Publish message.
-	Publish(string, string) error
+	// AttachTerminal starts terminal session with the UUID, writing input
+	// read from in to the session shell and passing the session output
+	// messages to out instead of publishing them. It blocks until the session
+	// ends, in is exhausted or the context is cancelled, hanging the shell up
+	// in the latter cases. Fails if session with the UUID is already open.
+	AttachTerminal(ctx context.Context, uuid string, in io.Reader, out func(payload string) error) error
+
+	// ReapSessions kills shells of the ended terminal sessions which are still
+	// running and returns their number.
+	ReapSessions() (int, error)
+
+	// Publish message with the options overriding the configured QoS and
+	// retained flag. Waiting for the broker to take the message is cancelled
+	// once ctx is done. Returns ErrMalformedEntity, ErrTopicNotAllowed or
+	// ErrPublishFailed.
+	Publish(ctx context.Context, topic, payload string, opts PublishOpts) error
+
+	// PublishWait publishes message like Publish, but bypasses the publish
+	// queue and waits up to the timeout, or until ctx is done, for the broker
+	// to acknowledge it.
+	// Message is sent with QoS 1 at least, so the broker acknowledges it.
+	// Returns ErrTopicNotAllowed, ErrPublishFailed or ErrPublishTimeout.
+	PublishWait(ctx context.Context, topic, payload string, timeout time.Duration) error
+
+	// PublishTo publishes message to the topic of the named data channel, or
+	// of the default data channel if the name is empty. Returns
+	// ErrNoSuchChannel, ErrTopicNotAllowed or ErrPublishFailed.
+	PublishTo(channelName, topic, payload string) error
+
+	// RotateMQTTCredentials replaces MQTT credentials and reconnects MQTT client.
+	// Previous credentials are restored if client fails to connect with the new ones.
+	RotateMQTTCredentials(MQTTCredentials) error
+
+	// Lockdown disables all the remote operations (execute, terminal, control and
+	// config changes) until Unlock is called, and disconnects MQTT client if requested.
+	Lockdown(disconnect bool) error
+
+	// Unlock leaves lockdown and reconnects MQTT client if disconnected. It is meant
+	// to be triggered by a local action only.
+	Unlock() error
+
+	// Reload re-reads the stored config and applies log level, heartbeat
+	// interval and exec settings in place, keeping the connections. Other
+	// settings take effect on restart. Returns the changes applied, or
+	// ErrConfigRejected without applying anything if the stored config can't
+	// be parsed or the resulting config is invalid.
+	Reload() ([]FieldChange, error)
+
+	// Healthz returns status of the agent dependencies.
+	Healthz() HealthStatus
 }
 
 var _ Service = (*agent)(nil)
 
 type agent struct {
 	mqttClient  paho.Client
+	publisher   *publisher
+	batcher     *batcher
+	creds       *Credentials
 	config      *Config
+	store       ConfigStore
 	edgexClient edgex.Client
 	logger      *slog.Logger
+	level       *slog.LevelVar
 	broker      messaging.PubSub
 	svcs        map[string]Heartbeat
-	terminals   map[string]terminal.Session
+	svcsMu      sync.RWMutex
+	controls    map[string]controlFunc
+	controlsMu  sync.RWMutex
+	sessions    *terminal.SessionManager
+	execs       executions
+	running     slots
+	results     results
+	mu          sync.RWMutex
+	rotateMu    sync.Mutex
+	locked      atomic.Bool
 }
 
-func (ag *agent) handle(ctx context.Context, pub messaging.Publisher, logger *slog.Logger, cfg HeartbeatConfig) handleFunc {
+func (ag *agent) handle(ctx context.Context, pub messaging.Publisher, logger *slog.Logger) handleFunc {
 	return func(msg *messaging.Message) error {
 		sub := msg.Channel
 		tok := strings.Split(sub, ".")
@@ -134,13 +361,18 @@ func (ag *agent) handle(ctx context.Context, pub messaging.Publisher, logger *sl
 		// Service name is extracted from the subtopic
 		// if there is multiple instances of the same service
 		// we will have to add another distinction.
+		// Config is read before locking services, which Reload locks while
+		// holding the config lock.
+		interval := ag.Config().Heartbeat.Interval
+		ag.svcsMu.Lock()
 		if _, ok := ag.svcs[svcname]; !ok {
-			svc := NewHeartbeat(svcname, svctype, cfg.Interval)
+			svc := NewHeartbeat(svcname, svctype, interval)
 			ag.svcs[svcname] = svc
 			ag.logger.Info(fmt.Sprintf("Services '%s-%s' registered", svcname, svctype))
 		}
 		serv := ag.svcs[svcname]
-		serv.Update()
+		ag.svcsMu.Unlock()
+		serv.Update(parseHeartbeat(msg.Payload))
 		return nil
 	}
 }
@@ -156,16 +388,48 @@ func (h handleFunc) Cancel() error {
 }
 
 // New returns agent service implementation.
-func New(ctx context.Context, mc paho.Client, cfg *Config, ec edgex.Client, broker messaging.PubSub, logger *slog.Logger) (Service, error) {
+// MQTT client must read its credentials from creds, which are updated on credentials rotation.
+// Config is persisted in store. With nil store, config updates aren't
+// persisted, while adding and reloading config fail. In safe mode of cfg,
+// broker isn't used, so it may be nil. Terminal sessions are kept by sessions.
+// MQTT connection and publishes are reported to the metrics. Level of the logger handler must be
+// level, so log level config changes apply at runtime.
+func New(ctx context.Context, mc paho.Client, creds *Credentials, cfg *Config, store ConfigStore, ec edgex.Client, broker messaging.PubSub, sessions *terminal.SessionManager, metrics MQTTMetrics, logger *slog.Logger, level *slog.LevelVar) (Service, error) {
+	// Commands mustn't run as the agent user if the configured one is
+	// missing.
+	if _, err := credential(cfg.Exec.User); err != nil {
+		return nil, wrap(ErrInvalidConfig, err)
+	}
+	if errs := cfg.MQTT.topicErrors(); len(errs) > 0 {
+		return nil, wrap(ErrInvalidConfig, errs)
+	}
+	if cfg.SafeMode {
+		broker = offlinePubSub{}
+		logger.Warn("Agent is running in safe mode, MQTT and message broker are disabled")
+	}
 	ag := &agent{
 		mqttClient:  mc,
+		creds:       creds,
 		edgexClient: ec,
 		config:      cfg,
+		store:       store,
 		broker:      broker,
 		logger:      logger,
+		level:       level,
 		svcs:        make(map[string]Heartbeat),
-		terminals:   make(map[string]terminal.Session),
+		sessions:    sessions,
+	}
+
+	pub, err := newPublisher(ctx, mc, cfg.MQTT, metrics, logger)
+	if err != nil {
+		return nil, errors.Wrap(errPublisherFailed, err)
 	}
+	ag.publisher = pub
+	ag.batcher = newBatcher(cfg.MQTT, pub.publish, logger)
+	ag.registerControls()
+
+	go ag.publishHeartbeats(ctx, realClock{}, cfg.Heartbeat)
+	go ag.pollReadings(ctx, realClock{}, cfg.Edgex)
 
 	if cfg.Heartbeat.Interval <= 0 {
 		ag.logger.Error(fmt.Sprintf("invalid heartbeat interval %d", cfg.Heartbeat.Interval))
@@ -174,69 +438,252 @@ func New(ctx context.Context, mc paho.Client, cfg *Config, ec edgex.Client, brok
 	subConfig := messaging.SubscriberConfig{
 		ID:             pubSubID,
 		Topic:          Hearbeat,
-		Handler:        ag.handle(ctx, ag.broker, logger, cfg.Heartbeat),
+		Handler:        ag.handle(ctx, ag.broker, logger),
 		DeliveryPolicy: messaging.DeliverAllPolicy,
 	}
 
-	err := ag.broker.Subscribe(ctx, subConfig)
-	if err != nil {
+	if err := ag.broker.Subscribe(ctx, subConfig); err != nil {
 		return ag, errors.Wrap(errNatsSubscribing, err)
 	}
 
 	return ag, nil
 }
 
-func (a *agent) Execute(uuid, cmd string) (string, error) {
-	cmdArr := strings.Split(strings.ReplaceAll(cmd, " ", ""), ",")
-	if len(cmdArr) < 2 {
-		return "", errInvalidCommand
+func (a *agent) Execute(ctx context.Context, uuid, cmd string) (string, error) {
+	var out bytes.Buffer
+	// Context only carries the request ID, it doesn't bound the command. The
+	// same writer for both streams keeps writes sequential.
+	if _, err := a.runWithRetry(context.WithoutCancel(ctx), uuid, cmd, "", &out, &out); err != nil {
+		return "", err
 	}
-
-	out, err := exec.Command(cmdArr[0], cmdArr[1:]...).CombinedOutput()
-	if err != nil {
-		return "", errors.Wrap(errFailedExecute, err)
+	name, _, _ := strings.Cut(strings.ReplaceAll(cmd, " ", ""), ",")
+	threshold := a.Config().Exec.CompressThreshold
+	compress := threshold > 0 && out.Len() >= threshold
+
+	payload, err := encoder.EncodeWithOptions(out.String(), encoder.Options{BaseName: uuid, Name: name, Compress: compress})
+	if id := RequestID(ctx); id != "" {
+		// Request ID is carried by the record following the output.
+		payload, err = encoder.EncodeSenMLBatch([]encoder.Record{
+			{BaseName: uuid, Name: name, Value: out.String(), Compressed: compress},
+			{BaseName: uuid, Name: requestID, Value: id},
+		})
 	}
-
-	payload, err := encoder.EncodeSenML(uuid, cmdArr[0], string(out))
 	if err != nil {
 		return "", errors.Wrap(errFailedEncode, err)
 	}
 
-	if err := a.Publish(control, string(payload)); err != nil {
-		return "", errors.Wrap(errFailedToPublish, err)
+	if err := a.Publish(ctx, control, string(payload), PublishOpts{}); err != nil {
+		return "", err
 	}
 
 	return string(payload), nil
 }
 
-func (a *agent) Control(uuid, cmdStr string) error {
-	cmdArgs := strings.Split(strings.ReplaceAll(cmdStr, " ", ""), ",")
-	if len(cmdArgs) < 2 {
-		return errInvalidCommand
+func (a *agent) ExecuteStream(ctx context.Context, uuid, cmd, dir string, stdout, stderr io.Writer) (int, error) {
+	truncated, err := a.run(ctx, uuid, cmd, dir, stdout, stderr)
+	var exitErr *exec.ExitError
+	switch {
+	case truncated:
+		return -1, err
+	case goerrors.As(err, &exitErr) && exitErr.Exited():
+		return exitErr.ExitCode(), err
 	}
+	return 0, err
+}
 
-	var resp string
-	var err error
+func (a *agent) ExecuteResult(ctx context.Context, uuid, cmd, dir string) (ExecResult, error) {
+	key, cacheable := a.resultKey(cmd, dir)
+	if cacheable {
+		// Cached result is returned only if the command could run now.
+		if err := a.checkLockdown(); err != nil {
+			return ExecResult{}, err
+		}
+		if _, err := a.parseCommand(cmd); err != nil {
+			return ExecResult{}, err
+		}
+		if res, ok := a.results.get(key, time.Now()); ok {
+			return res, nil
+		}
+	}
 
-	cmd := cmdArgs[0]
-	switch cmd {
-	case "edgex-operation":
-		resp, err = a.edgexClient.PushOperation(cmdArgs[1:])
-	case "edgex-config":
-		resp, err = a.edgexClient.FetchConfig(cmdArgs[1:])
-	case "edgex-metrics":
-		resp, err = a.edgexClient.FetchMetrics(cmdArgs[1:])
-	case "edgex-ping":
-		resp, err = a.edgexClient.Ping()
+	var stdout, stderr bytes.Buffer
+	// Command is cancelled along with the request waiting for its result.
+	truncated, err := a.runWithRetry(ctx, uuid, cmd, dir, &stdout, &stderr)
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+	case goerrors.As(err, &exitErr) && exitErr.Exited():
+		// Command ran and failed, which is reported by the exit code.
 	default:
-		err = errUnknownCommand
+		return ExecResult{}, err
 	}
+	res := ExecResult{
+		Stdout:    stdout.String(),
+		Stderr:    stderr.String(),
+		Truncated: truncated,
+	}
+	switch {
+	case truncated:
+		// Command was killed once its output exceeded the limit.
+		res.ExitCode = -1
+	case exitErr != nil:
+		res.ExitCode = exitErr.ExitCode()
+	}
+	if cacheable {
+		a.results.put(key, res, time.Now(), a.Config().Exec.CacheTTL)
+	}
+	return res, nil
+}
 
+func (a *agent) ExecuteBatch(uuid string, cmds []string) ([]ExecResult, error) {
+	if len(cmds) == 0 {
+		return nil, ErrInvalidCommand
+	}
+	// Malformed or disallowed command mustn't leave the batch half done.
+	for _, cmd := range cmds {
+		if _, err := a.parseCommand(cmd); err != nil {
+			return nil, err
+		}
+	}
+	continueOnError := a.Config().Exec.ContinueOnError
+	results := make([]ExecResult, 0, len(cmds))
+	for _, cmd := range cmds {
+		res, err := a.ExecuteResult(context.Background(), uuid, cmd, "")
+		if err != nil {
+			return results, err
+		}
+		results = append(results, res)
+		if res.ExitCode != 0 && !continueOnError {
+			break
+		}
+	}
+	return results, nil
+}
+
+// parseCommand splits command into its name and arguments, checking that
+// it's allowed.
+func (a *agent) parseCommand(cmd string) ([]string, error) {
+	cmdArr := strings.Split(strings.ReplaceAll(cmd, " ", ""), ",")
+	if len(cmdArr) < 2 {
+		return nil, ErrInvalidCommand
+	}
+	if err := a.checkCommand(cmdArr[0]); err != nil {
+		return nil, err
+	}
+	return cmdArr, nil
+}
+
+// run executes command in the working directory dir, writing its output to
+// stdout and stderr writers. If the output exceeds the configured maximum
+// size, command is killed, the output is truncated and marked with
+// TruncationMarker, and run reports it without an error. Command can be
+// cancelled by its UUID while running, or by the context.
+func (a *agent) run(ctx context.Context, uuid, cmd, dir string, stdout, stderr io.Writer) (bool, error) {
+	if err := a.checkLockdown(); err != nil {
+		return false, err
+	}
+	cmdArr, err := a.parseCommand(cmd)
+	if err != nil {
+		return false, err
+	}
+	dir, err = a.workDir(dir)
+	if err != nil {
+		return false, err
+	}
+	ec := a.Config().Exec
+	cred, err := credential(ec.User)
 	if err != nil {
-		return errors.Wrap(errEdgexFailed, err)
+		return false, wrap(ErrExecFailed, err)
 	}
+	// Time spent waiting for a slot doesn't count against the exec timeout.
+	if err := a.running.acquire(ec.MaxConcurrent, ec.QueueTimeout); err != nil {
+		return false, err
+	}
+	defer a.running.release()
+
+	execCtx, cancel := a.execContext()
+	defer cancel()
+	runCtx, cancelExec := context.WithCancelCause(execCtx)
+	defer cancelExec(nil)
+	defer a.execs.add(uuid, cancelExec)()
+	defer context.AfterFunc(ctx, func() { cancelExec(ErrExecCancelled) })()
+	command := exec.CommandContext(runCtx, cmdArr[0], cmdArr[1:]...)
+	command.Env = a.Config().Exec.Env.Environ(os.Environ())
+	command.Dir = dir
+	if cred != nil {
+		command.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	command.Stdout = stdout
+	command.Stderr = stderr
+	var limit *outputLimit
+	if max := a.Config().Exec.MaxOutputBytes; max > 0 {
+		limit = &outputLimit{remaining: max, exceeded: cancel}
+		command.Stdout = limit.writer(stdout)
+		command.Stderr = command.Stdout
+		if !sameWriter(stdout, stderr) {
+			command.Stderr = limit.writer(stderr)
+		}
+	}
+	// Don't wait for children that keep output open after the command is killed.
+	command.WaitDelay = waitDelay
+	err = command.Run()
+	if limit != nil && limit.isTruncated() {
+		if _, err := io.WriteString(stdout, TruncationMarker); err != nil {
+			return true, wrap(ErrExecFailed, err)
+		}
+		return true, nil
+	}
+	if context.Cause(runCtx) == ErrExecCancelled {
+		return false, ErrExecCancelled
+	}
+	if runCtx.Err() == context.DeadlineExceeded {
+		return false, ErrExecTimeout
+	}
+	if err != nil {
+		return false, wrap(ErrExecFailed, err)
+	}
+	return false, nil
+}
 
-	return a.processResponse(uuid, cmd, resp)
+// Message for this command
+// [{"bn":"1:", "n":"control", "vs":"rotate-credentials, username, password"}]
+// [{"bn":"1:", "n":"control", "vs":"rotate-credentials, username, password, client_cert, client_key"}]
+// All the arguments are base64 encoded, client_cert and client_key are PEM blocks.
+// Since the command is received in MQTT message handler, which must not block on
+// MQTT client calls, rotation runs in the background and its result is published
+// once it completes.
+func (a *agent) rotateCredentials(uuid string, args []string) error {
+	if len(args) != 2 && len(args) != 4 {
+		return ErrInvalidCommand
+	}
+	decoded := make([]string, len(args))
+	for i, arg := range args {
+		b, err := base64.StdEncoding.DecodeString(arg)
+		if err != nil {
+			return wrap(ErrInvalidCommand, err)
+		}
+		decoded[i] = string(b)
+	}
+	creds := MQTTCredentials{
+		Username: decoded[0],
+		Password: decoded[1],
+	}
+	if len(decoded) == 4 {
+		creds.ClientCert = decoded[2]
+		creds.ClientKey = decoded[3]
+	}
+
+	go func() {
+		resp := "ok"
+		if err := a.RotateMQTTCredentials(creds); err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to rotate MQTT credentials: %s", err))
+			resp = err.Error()
+		}
+		if err := a.processResponse(uuid, rotateCredentials, resp); err != nil {
+			a.logger.Warn(fmt.Sprintf("Failed to publish MQTT credentials rotation result: %s", err))
+		}
+	}()
+	return nil
 }
 
 // Message for this command
@@ -250,7 +697,7 @@ func (a *agent) Control(uuid, cmdStr string) error {
 func (a *agent) ServiceConfig(ctx context.Context, uuid, cmdStr string) error {
 	cmdArgs := strings.Split(strings.ReplaceAll(cmdStr, " ", ""), ",")
 	if len(cmdArgs) < 1 {
-		return errInvalidCommand
+		return ErrInvalidCommand
 	}
 	resp := ""
 	cmd := cmdArgs[0]
@@ -262,8 +709,11 @@ func (a *agent) ServiceConfig(ctx context.Context, uuid, cmdStr string) error {
 		}
 		resp = string(services)
 	case save:
+		if err := a.checkLockdown(); err != nil {
+			return err
+		}
 		if len(cmdArgs) < 4 {
-			return errInvalidCommand
+			return ErrInvalidCommand
 		}
 		service := cmdArgs[1]
 		fileName := cmdArgs[2]
@@ -276,61 +726,224 @@ func (a *agent) ServiceConfig(ctx context.Context, uuid, cmdStr string) error {
 }
 
 func (a *agent) Terminal(uuid, cmdStr string) error {
+	if err := a.checkLockdown(); err != nil {
+		return err
+	}
 	b, err := base64.StdEncoding.DecodeString(cmdStr)
 	if err != nil {
-		return errors.New(err.Error())
+		return wrap(ErrInvalidCommand, err)
 	}
 	cmdArgs := strings.Split(string(b), ",")
 	if len(cmdArgs) < 1 {
-		return errInvalidCommand
+		return ErrInvalidCommand
 	}
 
 	cmd := cmdArgs[0]
-	ch := ""
-	if len(cmdArgs) > 1 {
-		ch = cmdArgs[1]
-	}
 	switch cmd {
 	case char:
+		// Input may contain commas itself.
+		_, ch, _ := strings.Cut(string(b), ",")
 		if err := a.terminalWrite(uuid, ch); err != nil {
 			return err
 		}
 	case open:
-		if err := a.terminalOpen(uuid, a.config.Terminal.SessionTimeout); err != nil {
+		if _, err := a.terminalOpen(uuid, a.Config().Terminal); err != nil {
 			return err
 		}
 	case close:
 		if err := a.terminalClose(uuid); err != nil {
 			return err
 		}
+	case ack:
+		if err := a.terminalAck(uuid, cmdArgs[1:]); err != nil {
+			return err
+		}
+	case replay:
+		if err := a.terminalReplay(uuid); err != nil {
+			return err
+		}
+	case resize, signal:
+		in, err := parseTerminalInput(cmd, cmdArgs[1:])
+		if err != nil {
+			return err
+		}
+		if err := a.terminalInput(uuid, in); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func (a *agent) terminalOpen(uuid string, timeout time.Duration) error {
-	if _, ok := a.terminals[uuid]; !ok {
-		term, err := terminal.NewSession(uuid, timeout, a.Publish, a.logger)
+// parseTerminalInput parses the terminal control event, either
+// "resize,<rows>,<cols>" or "signal,<name>", where name is one of
+// interrupt, quit, suspend and eof.
+func parseTerminalInput(cmd string, args []string) (terminal.Input, error) {
+	switch {
+	case cmd == resize && len(args) == 2:
+		rows, err := strconv.ParseUint(args[0], 10, 16)
+		if err != nil {
+			return nil, wrap(ErrInvalidCommand, err)
+		}
+		cols, err := strconv.ParseUint(args[1], 10, 16)
 		if err != nil {
-			return errors.Wrap(errors.Wrap(errFailedToCreateTerminalSession, fmt.Errorf(" for %s", uuid)), err)
-		}
-		a.terminals[uuid] = term
-		go func() {
-			for range term.IsDone() {
-				// Terminal is inactive, should be closed.
-				a.logger.Debug((fmt.Sprintf("Closing terminal session %s", uuid)))
-				a.terminalClose(uuid)
-				delete(a.terminals, uuid)
+			return nil, wrap(ErrInvalidCommand, err)
+		}
+		return terminal.InputResize{Rows: uint16(rows), Cols: uint16(cols)}, nil
+	case cmd == signal && len(args) == 1:
+		return terminal.InputSignal(args[0]), nil
+	}
+	return nil, ErrInvalidCommand
+}
+
+// terminalInput routes the control event to the open session.
+func (a *agent) terminalInput(uuid string, in terminal.Input) error {
+	term, ok := a.sessions.Get(uuid)
+	if !ok {
+		return errors.Wrap(errNoSuchTerminalSession, fmt.Errorf("session :%s", uuid))
+	}
+	if err := term.Input(in); err != nil {
+		if errors.Contains(err, terminal.ErrInvalidInput) {
+			return wrap(ErrInvalidCommand, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// terminalReplay publishes the session output kept in the replay buffer as a
+// single "replay" message, so the reconnecting client restores the scrollback.
+func (a *agent) terminalReplay(uuid string) error {
+	term, ok := a.sessions.Get(uuid)
+	if !ok {
+		return errors.Wrap(errNoSuchTerminalSession, fmt.Errorf("session :%s", uuid))
+	}
+	format := a.Config().Terminal.Format
+	if format == "" {
+		format = encoder.JSON
+	}
+	payload, err := encoder.Encode(format, uuid, replay, string(term.Replay()))
+	if err != nil {
+		return errors.Wrap(errFailedEncode, err)
+	}
+	return a.publishTerminal(uuid, string(payload))
+}
+
+// terminalAck handles output acknowledgment "ack,<last>,<highest>", where last is the
+// sequence number up to which all the output has been received and highest is the
+// highest received sequence number.
+func (a *agent) terminalAck(uuid string, args []string) error {
+	if len(args) != 2 {
+		return ErrInvalidCommand
+	}
+	last, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return wrap(ErrInvalidCommand, err)
+	}
+	highest, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return wrap(ErrInvalidCommand, err)
+	}
+	term, ok := a.sessions.Get(uuid)
+	if !ok {
+		return errors.Wrap(errNoSuchTerminalSession, fmt.Errorf("session :%s", uuid))
+	}
+	return term.Ack(last, highest)
+}
+
+func (a *agent) AttachTerminal(ctx context.Context, uuid string, in io.Reader, out func(payload string) error) error {
+	if err := a.checkLockdown(); err != nil {
+		return err
+	}
+	publish := func(_, payload string) error { return out(payload) }
+	cfg, err := a.terminalConfig(a.Config().Terminal)
+	if err != nil {
+		return errors.Wrap(errors.Wrap(errFailedToCreateTerminalSession, fmt.Errorf(" for %s", uuid)), err)
+	}
+	cfg.Banner = a.Config().TerminalBanner(uuid)
+	term, err := a.sessions.Start(uuid, cfg, publish)
+	if err != nil {
+		return errors.Wrap(errors.Wrap(errFailedToCreateTerminalSession, fmt.Errorf(" for %s", uuid)), err)
+	}
+	a.logger.Debug(fmt.Sprintf("Attached terminal session %s", uuid))
+
+	// Package close constant shadows the builtin.
+	input := make(chan struct{}, 1)
+	go func() {
+		defer func() { input <- struct{}{} }()
+		buf := make([]byte, 4096)
+		for {
+			n, err := in.Read(buf)
+			if n > 0 {
+				err := term.Send(buf[:n])
+				if errors.Contains(err, terminal.ErrInputTooLarge) {
+					a.logger.Warn(fmt.Sprintf("Dropped %d bytes of terminal session %s input: %s", n, uuid, err))
+				} else if err != nil {
+					return
+				}
+			}
+			if err != nil {
 				return
 			}
-		}()
+		}
+	}()
+
+	select {
+	case <-term.IsDone():
+	case <-term.Closed():
+	case <-input:
+		a.hangUp(uuid, term)
+	case <-ctx.Done():
+		a.hangUp(uuid, term)
 	}
-	a.logger.Debug(fmt.Sprintf("Opened terminal session %s", uuid))
 	return nil
 }
 
+// hangUp closes the session, which is removed once its shell exits.
+func (a *agent) hangUp(uuid string, term terminal.Session) {
+	if err := term.Close(); err != nil {
+		a.logger.Warn(fmt.Sprintf("Failed to hang up terminal session %s: %s", uuid, err))
+	}
+}
+
+func (a *agent) terminalOpen(uuid string, tc TerminalConfig) (terminal.Session, error) {
+	// Session output outlives the request which opened it.
+	publish := func(_, payload string) error { return a.publishTerminal(uuid, payload) }
+	cfg, err := a.terminalConfig(tc)
+	if err != nil {
+		return nil, errors.Wrap(errors.Wrap(errFailedToCreateTerminalSession, fmt.Errorf(" for %s", uuid)), err)
+	}
+	cfg.Topic = a.Config().TerminalTopic(uuid)
+	cfg.Banner = a.Config().TerminalBanner(uuid)
+	term, err := a.sessions.Open(uuid, cfg, publish)
+	if err != nil {
+		return nil, errors.Wrap(errors.Wrap(errFailedToCreateTerminalSession, fmt.Errorf(" for %s", uuid)), err)
+	}
+	a.logger.Debug(fmt.Sprintf("Opened terminal session %s", uuid))
+	return term, nil
+}
+
+func (a *agent) terminalConfig(tc TerminalConfig) (terminal.Config, error) {
+	cred, err := credential(a.Config().Exec.User)
+	if err != nil {
+		return terminal.Config{}, err
+	}
+	return terminal.Config{
+		Timeout:      tc.SessionTimeout,
+		MaxDuration:  tc.MaxDuration,
+		Format:       tc.Format,
+		AckWindow:    tc.AckWindow,
+		ReplayBuffer: tc.ReplayBuffer,
+		Env:          a.Config().Exec.Env.Environ(os.Environ()),
+		Shell:        tc.Shell,
+		Credential:   cred,
+		InputRate:    tc.InputRate,
+		MaxInput:     tc.MaxInput,
+		MaxSessions:  tc.MaxSessions,
+	}, nil
+}
+
 func (a *agent) terminalClose(uuid string) error {
-	if _, ok := a.terminals[uuid]; ok {
-		delete(a.terminals, uuid)
+	if a.sessions.Close(uuid) {
 		a.logger.Debug(fmt.Sprintf("Terminal session: %s closed", uuid))
 		return nil
 	}
@@ -338,12 +951,112 @@ func (a *agent) terminalClose(uuid string) error {
 }
 
 func (a *agent) terminalWrite(uuid, cmd string) error {
-	if err := a.terminalOpen(uuid, a.config.Terminal.SessionTimeout); err != nil {
+	term, err := a.terminalOpen(uuid, a.Config().Terminal)
+	if err != nil {
 		return err
 	}
-	term := a.terminals[uuid]
-	p := []byte(cmd)
-	return term.Send(p)
+	return term.Input(terminal.InputData(cmd))
+}
+
+// checkCommand returns ErrCommandNotAllowed if command is denied or isn't allowed
+// by the configured command lists.
+func (a *agent) checkCommand(cmd string) error {
+	ec := a.Config().Exec
+	if matchPattern(ec.Denylist, cmd) {
+		return ErrCommandNotAllowed
+	}
+	if len(ec.Allowlist) > 0 && !matchPattern(ec.Allowlist, cmd) {
+		return ErrCommandNotAllowed
+	}
+	return nil
+}
+
+// workDir returns working directory of the command, which is dir, or the
+// configured default or base directory if dir is empty. Relative dir is
+// resolved against the default directory, or the base directory if there's
+// none. Empty working directory runs the command in the agent working directory.
+func (a *agent) workDir(dir string) (string, error) {
+	ec := a.Config().Exec
+	base := ec.Dir
+	if base == "" {
+		base = ec.BaseDir
+	}
+	switch {
+	case dir == "":
+		dir = base
+	case !filepath.IsAbs(dir):
+		dir = filepath.Join(base, dir)
+	}
+	if dir == "" {
+		return "", nil
+	}
+	// Resolving symbolic links prevents escaping the base directory by them.
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", wrap(ErrInvalidWorkDir, err)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", wrap(ErrInvalidWorkDir, err)
+	}
+	if !info.IsDir() {
+		return "", wrap(ErrInvalidWorkDir, fmt.Errorf("%s is not a directory", dir))
+	}
+	if ec.BaseDir == "" {
+		return dir, nil
+	}
+	root, err := filepath.EvalSymlinks(ec.BaseDir)
+	if err != nil {
+		return "", wrap(ErrInvalidWorkDir, err)
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", wrap(ErrInvalidWorkDir, fmt.Errorf("%s is outside of %s", dir, ec.BaseDir))
+	}
+	return dir, nil
+}
+
+// matchPattern reports whether s matches any of the names or glob patterns.
+func matchPattern(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, err := path.Match(p, s); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// execContext returns context bounded by the configured execution timeout.
+func (a *agent) execContext() (context.Context, context.CancelFunc) {
+	timeout := a.Config().Exec.Timeout
+	if timeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// withTimeout runs operation which can't be cancelled, returning ErrExecTimeout if it
+// doesn't complete within the configured execution timeout. Operation keeps running
+// in the background in that case and its result is discarded.
+func (a *agent) withTimeout(op func() (string, error)) (string, error) {
+	ctx, cancel := a.execContext()
+	defer cancel()
+
+	type result struct {
+		resp string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := op()
+		done <- result{resp, err}
+	}()
+	select {
+	case r := <-done:
+		return r.resp, r.err
+	case <-ctx.Done():
+		return "", ErrExecTimeout
+	}
 }
 
 func (a *agent) processResponse(uuid, cmd, resp string) error {
@@ -351,8 +1064,8 @@ func (a *agent) processResponse(uuid, cmd, resp string) error {
 	if err != nil {
 		return errors.Wrap(errFailedEncode, err)
 	}
-	if err := a.Publish(control, string(payload)); err != nil {
-		return errors.Wrap(errFailedToPublish, err)
+	if err := a.Publish(context.Background(), control, string(payload), PublishOpts{}); err != nil {
+		return err
 	}
 	return nil
 }
@@ -374,22 +1087,220 @@ func (a *agent) saveConfig(ctx context.Context, service, fileName, fileCont stri
 		}
 
 	default:
-		return errNoSuchService
+		return ErrNoSuchService
 	}
 
 	return a.broker.Publish(ctx, fmt.Sprintf("%s.%s.%s", Commands, service, config), &messaging.Message{})
 }
 
 func (a *agent) AddConfig(c Config) error {
-	err := SaveConfig(c)
-	return errors.New(err.Error())
+	if err := a.checkLockdown(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if c.IdempotencyKey != "" && c.IdempotencyKey == a.config.IdempotencyKey {
+		return nil
+	}
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	if a.store == nil {
+		return errNoConfigStore
+	}
+	if err := a.store.Save(c); err != nil {
+		return errors.New(err.Error())
+	}
+	a.config.IdempotencyKey = c.IdempotencyKey
+	return nil
+}
+
+func (a *agent) RotateMQTTCredentials(creds MQTTCredentials) error {
+	if err := a.checkLockdown(); err != nil {
+		return err
+	}
+	// Rotations are serialized, but a.mu is only held while the credentials
+	// are swapped, so reconnecting doesn't block publishing and config reads.
+	a.rotateMu.Lock()
+	defer a.rotateMu.Unlock()
+
+	a.mu.RLock()
+	old := a.config.MQTT
+	a.mu.RUnlock()
+	mc := old
+	mc.Username = creds.Username
+	mc.Password = creds.Password
+	if creds.ClientCert != "" || creds.ClientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(creds.ClientCert), []byte(creds.ClientKey))
+		if err != nil {
+			return errors.Wrap(errFailedToRotateCredentials, err)
+		}
+		mc.ClientCert = creds.ClientCert
+		mc.ClientKey = creds.ClientKey
+		mc.Cert = cert
+		// Certificate files take precedence over inline certificate on
+		// startup, so they must not point to the old certificate.
+		mc.CertPath = ""
+		mc.PrivKeyPath = ""
+	}
+
+	if err := a.applyMQTTCredentials(mc); err != nil {
+		a.rollbackMQTTCredentials(old)
+		return errors.Wrap(errFailedToRotateCredentials, err)
+	}
+	if a.store == nil {
+		return nil
+	}
+	a.mu.RLock()
+	err := a.store.Save(*a.config)
+	a.mu.RUnlock()
+	if err != nil {
+		a.rollbackMQTTCredentials(old)
+		return errors.Wrap(errFailedToRotateCredentials, err)
+	}
+	return nil
+}
+
+// applyMQTTCredentials sets credentials of MQTT config and reconnects MQTT
+// client using them. The rest of MQTT config is left as is, so the concurrent
+// config updates aren't lost.
+func (a *agent) applyMQTTCredentials(mc MQTTConfig) error {
+	a.mu.Lock()
+	cur := &a.config.MQTT
+	cur.Username, cur.Password = mc.Username, mc.Password
+	cur.ClientCert, cur.ClientKey, cur.Cert = mc.ClientCert, mc.ClientKey, mc.Cert
+	cur.CertPath, cur.PrivKeyPath = mc.CertPath, mc.PrivKeyPath
+	a.creds.Set(*cur)
+	a.mu.Unlock()
+
+	a.mqttClient.Disconnect(disconnectQuiesce)
+	token := a.mqttClient.Connect()
+	token.Wait()
+	return token.Error()
+}
+
+func (a *agent) rollbackMQTTCredentials(old MQTTConfig) {
+	if err := a.applyMQTTCredentials(old); err != nil {
+		a.logger.Error(fmt.Sprintf("Failed to reconnect with previous MQTT credentials: %s", err))
+	}
+}
+
+func (a *agent) UpdateConfig(patch ConfigPatch) error {
+	if err := a.checkLockdown(); err != nil {
+		return err
+	}
+	if patch.Empty() {
+		return ErrMalformedEntity
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	c := *a.config
+	patch.Apply(&c)
+	if err := c.Validate(); err != nil {
+		return err
+	}
+	var level slog.Level
+	if c.Log.Level != "" {
+		// Validated above.
+		_ = level.UnmarshalText([]byte(c.Log.Level))
+	}
+	if a.store != nil {
+		if err := a.store.Save(c); err != nil {
+			return errors.New(err.Error())
+		}
+	}
+	changes := a.config.Diff(c)
+	*a.config = c
+	if c.Log.Level != "" {
+		a.level.Set(level)
+	}
+	a.logger.Info("Config updated", slog.Any("changes", changes))
+	return nil
+}
+
+func (a *agent) Reload() ([]FieldChange, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.store == nil {
+		return nil, wrap(ErrConfigNotFound, errNoConfigStore)
+	}
+	fc, err := a.store.Load()
+	if errors.Contains(err, ErrConfigNotFound) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(ErrConfigRejected, err)
+	}
+	c := *a.config
+	c.Log = fc.Log
+	c.Heartbeat.Interval = fc.Heartbeat.Interval
+	c.Exec = fc.Exec
+	if err := c.Validate(); err != nil {
+		return nil, errors.Wrap(ErrConfigRejected, err)
+	}
+
+	changes := a.config.Diff(c)
+	*a.config = c
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err == nil {
+		a.level.Set(level)
+	}
+	a.svcsMu.RLock()
+	for _, s := range a.svcs {
+		s.SetInterval(c.Heartbeat.Interval)
+	}
+	a.svcsMu.RUnlock()
+	a.logger.Info("Config reloaded", slog.Any("changes", changes))
+	return changes, nil
 }
 
 func (a *agent) Config() Config {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
 	return *a.config
 }
 
+func (a *agent) ReapSessions() (int, error) {
+	return a.sessions.Reap()
+}
+
+func (a *agent) QueueDepth() int {
+	return a.publisher.depth()
+}
+
+func (a *agent) FlushBatches() error {
+	if err := a.batcher.flush(); err != nil {
+		return wrap(ErrPublishFailed, err)
+	}
+	return nil
+}
+
+func (a *agent) Service(id string) (Info, error) {
+	a.svcsMu.RLock()
+	defer a.svcsMu.RUnlock()
+	s, ok := a.svcs[id]
+	if !ok {
+		return Info{}, ErrNoSuchService
+	}
+	return s.Info(), nil
+}
+
+func (a *agent) ServicesByStatus(status string) []Info {
+	infos := []Info{}
+	for _, info := range a.Services() {
+		if info.Status == status {
+			infos = append(infos, info)
+		}
+	}
+	return infos
+}
+
 func (a *agent) Services() []Info {
+	a.svcsMu.RLock()
+	defer a.svcsMu.RUnlock()
 	svcInfos := []Info{}
 	keys := []string{}
 	for k := range a.svcs {
@@ -403,24 +1314,125 @@ func (a *agent) Services() []Info {
 	return svcInfos
 }
 
-func (a *agent) Publish(t, payload string) error {
+func (a *agent) RefreshServices() error {
+	a.svcsMu.Lock()
+	for name, s := range a.svcs {
+		if pid := s.Info().PID; pid != 0 && !running(pid) {
+			s.Stop()
+			delete(a.svcs, name)
+			a.logger.Info(fmt.Sprintf("Service '%s' removed, its process %d exited", name, pid))
+		}
+	}
+	a.svcsMu.Unlock()
+
+	// Services aren't locked while asked, since their heartbeats may be
+	// handled before the request is published.
+	if err := a.broker.Publish(context.Background(), HeartbeatRequest, &messaging.Message{}); err != nil {
+		return errors.Wrap(ErrPublishFailed, err)
+	}
+	return nil
+}
+
+func (a *agent) Publish(ctx context.Context, t, payload string, opts PublishOpts) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	a.mu.RLock()
 	topic := a.getTopic(t)
 	mqtt := a.config.MQTT
-	token := a.mqttClient.Publish(topic, mqtt.QoS, mqtt.Retain, payload)
-	token.Wait()
-	err := token.Error()
+	a.mu.RUnlock()
+
+	return a.publish(ctx, topic, mqtt, payload, opts)
+}
+
+func (a *agent) PublishWait(ctx context.Context, t, payload string, timeout time.Duration) error {
+	a.mu.RLock()
+	topic := a.getTopic(t)
+	mqtt := a.config.MQTT
+	a.mu.RUnlock()
+	err := checkNamespace(mqtt, topic)
 	if err != nil {
-		return errors.New(err.Error())
+		return err
+	}
+
+	// Lock isn't held while waiting, so the slow broker doesn't block config updates.
+	return a.publisher.publishWait(ctx, topic, max(mqtt.QoS, 1), mqtt.Retain, payload, timeout)
+}
+
+func (a *agent) PublishTo(channelName, t, payload string) error {
+	a.mu.RLock()
+	id := a.config.Channels.Data
+	if channelName != "" {
+		var ok bool
+		if id, ok = a.config.Channels.DataChannels[channelName]; !ok {
+			a.mu.RUnlock()
+			return wrap(ErrNoSuchChannel, fmt.Errorf("channel %s", channelName))
+		}
+	}
+	topic := a.config.DataTopic(id)
+	mqtt := a.config.MQTT
+	a.mu.RUnlock()
+
+	if t != "" {
+		topic = fmt.Sprintf("%s/%s", topic, t)
+	}
+	return a.publish(context.Background(), topic, mqtt, payload, PublishOpts{})
+}
+
+// publishTerminal publishes output of the terminal session to its topic.
+func (a *agent) publishTerminal(uuid, payload string) error {
+	a.mu.RLock()
+	topic := a.config.TerminalTopic(uuid)
+	mqtt := a.config.MQTT
+	a.mu.RUnlock()
+
+	return a.publish(context.Background(), topic, mqtt, payload, PublishOpts{})
+}
+
+// publish publishes payload to the topic, with the options overriding the
+// ones of MQTT config, waiting for it until ctx is done. Config is copied by
+// the caller, so a.mu isn't held while waiting for the slow broker.
+func (a *agent) publish(ctx context.Context, topic string, mqtt MQTTConfig, payload string, opts PublishOpts) error {
+	if err := checkNamespace(mqtt, topic); err != nil {
+		return err
+	}
+	qos, retain := mqtt.QoS, mqtt.Retain
+	if opts.QoS != nil {
+		qos = *opts.QoS
+	}
+	if opts.Retained != nil {
+		retain = *opts.Retained
+	}
+	if err := a.batcher.publish(ctx, topic, qos, retain, payload); err != nil {
+		return wrap(ErrPublishFailed, err)
+	}
+	return nil
+}
+
+// checkNamespace verifies that MQTT username is allowed to publish to the
+// topic, so the message isn't silently dropped by the broker ACL.
+func checkNamespace(mqtt MQTTConfig, topic string) error {
+	if mqtt.TopicNamespace == "" {
+		return nil
+	}
+	// Compare on topic level boundaries, so namespace of username "thing"
+	// doesn't match topics of username "thing2".
+	ns := strings.ReplaceAll(mqtt.TopicNamespace, usernamePlaceholder, mqtt.Username)
+	ns = strings.TrimSuffix(ns, "/")
+	if topic != ns && !strings.HasPrefix(topic, ns+"/") {
+		return wrap(ErrTopicNotAllowed, fmt.Errorf("topic %s is outside of namespace %s", topic, ns))
 	}
 	return nil
 }
 
+// getTopic must be called with a.mu held.
 func (a *agent) getTopic(topic string) (t string) {
 	switch topic {
 	case control:
 		t = fmt.Sprintf("channels/%s/messages/res", a.config.Channels.Control)
 	case data:
-		t = fmt.Sprintf("channels/%s/messages/res", a.config.Channels.Data)
+		t = a.config.DataTopic(a.config.Channels.Data)
 	default:
 		t = fmt.Sprintf("channels/%s/messages/res/%s", a.config.Channels.Control, topic)
 	}
@@ -0,0 +1,1816 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	goerrors "errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/senml"
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/agent/pkg/terminal"
+	"github.com/andychao217/magistrala/logger"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/andychao217/magistrala/pkg/messaging"
+	"github.com/go-kit/kit/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newService(t *testing.T, cfg agent.Config) (agent.Service, *mocks.MQTTClient) {
+	svc, mqttClient, _ := newServiceWithCredentials(t, cfg)
+	return svc, mqttClient
+}
+
+func newServiceWithCredentials(t *testing.T, cfg agent.Config) (agent.Service, *mocks.MQTTClient, *agent.Credentials) {
+	if cfg.Heartbeat.Interval == 0 {
+		cfg.Heartbeat.Interval = time.Second
+	}
+	mqttClient := mocks.NewMQTTClient()
+
+	logger, err := logger.New(os.Stdout, "debug")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating logger: %s", err))
+
+	// Config is saved to the file if it's set, and kept in memory otherwise.
+	store := agent.NewMemoryStore()
+	if cfg.File != "" {
+		store = agent.NewFileStore(cfg.File)
+	}
+	creds := agent.NewCredentials(cfg.MQTT)
+	svc, err := agent.New(context.TODO(), mqttClient, creds, &cfg, store, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+
+	return svc, mqttClient, creds
+}
+
+func TestPublish(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Channels = agent.ChanConfig{Control: "thing", Data: "thing2"}
+	cfg.MQTT.Username = "thing"
+	cfg.MQTT.TopicNamespace = "channels/{username}"
+	svc, mqttClient := newService(t, cfg)
+
+	cases := []struct {
+		desc  string
+		topic string
+		err   error
+	}{
+		{
+			desc:  "publish to topic within namespace",
+			topic: "control",
+			err:   nil,
+		},
+		{
+			desc:  "publish to subtopic within namespace",
+			topic: "term/1",
+			err:   nil,
+		},
+		{
+			desc:  "publish to topic of sibling namespace",
+			topic: "data",
+			err:   agent.ErrTopicNotAllowed,
+		},
+	}
+
+	for _, tc := range cases {
+		sent := len(mqttClient.Messages())
+		err := svc.Publish(context.Background(), tc.topic, "payload", agent.PublishOpts{})
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		published := len(mqttClient.Messages()) - sent
+		if tc.err != nil {
+			assert.Equal(t, 0, published, fmt.Sprintf("%s: expected no message to be published", tc.desc))
+			continue
+		}
+		assert.Equal(t, 1, published, fmt.Sprintf("%s: expected message to be published", tc.desc))
+	}
+}
+
+func TestPublishOpts(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Channels = agent.ChanConfig{Control: "thing", Data: "thing2"}
+	cfg.MQTT.QoS = 1
+	svc, mqttClient := newService(t, cfg)
+	qos0, qos2, qos3, retained := byte(0), byte(2), byte(3), true
+
+	cases := []struct {
+		desc     string
+		opts     agent.PublishOpts
+		qos      byte
+		retained bool
+		err      error
+	}{
+		{desc: "publish with configured options", opts: agent.PublishOpts{}, qos: 1},
+		{desc: "publish with QoS 0", opts: agent.PublishOpts{QoS: &qos0}, qos: 0},
+		{desc: "publish retained message with QoS 2", opts: agent.PublishOpts{QoS: &qos2, Retained: &retained}, qos: 2, retained: true},
+		{desc: "publish with QoS out of range", opts: agent.PublishOpts{QoS: &qos3}, err: agent.ErrMalformedEntity},
+	}
+
+	for _, tc := range cases {
+		sent := len(mqttClient.Messages())
+		err := svc.Publish(context.Background(), "data", "payload", tc.opts)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		messages := mqttClient.Messages()[sent:]
+		if tc.err != nil {
+			assert.Empty(t, messages, fmt.Sprintf("%s: expected no message to be published", tc.desc))
+			continue
+		}
+		require.Len(t, messages, 1, fmt.Sprintf("%s: expected message to be published", tc.desc))
+		assert.Equal(t, tc.qos, messages[0].QoS, fmt.Sprintf("%s: unexpected QoS", tc.desc))
+		assert.Equal(t, tc.retained, messages[0].Retained, fmt.Sprintf("%s: unexpected retained flag", tc.desc))
+	}
+}
+
+func TestPublishWait(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Channels = agent.ChanConfig{Control: "thing", Data: "thing2"}
+	svc, mqttClient := newService(t, cfg)
+
+	cases := []struct {
+		desc      string
+		ackDelay  time.Duration
+		timeout   time.Duration
+		brokerErr error
+		err       error
+	}{
+		{
+			desc:    "publish acknowledged message",
+			timeout: time.Second,
+		},
+		{
+			desc:     "publish message acknowledged with delay",
+			ackDelay: 50 * time.Millisecond,
+			timeout:  time.Second,
+		},
+		{
+			desc:     "publish message acknowledged after timeout",
+			ackDelay: time.Second,
+			timeout:  50 * time.Millisecond,
+			err:      agent.ErrPublishTimeout,
+		},
+		{
+			desc:     "publish message with dropped acknowledgment",
+			ackDelay: -1,
+			timeout:  50 * time.Millisecond,
+			err:      agent.ErrPublishTimeout,
+		},
+		{
+			desc:      "publish message rejected by broker",
+			timeout:   time.Second,
+			brokerErr: goerrors.New("broker failure"),
+			err:       agent.ErrPublishFailed,
+		},
+	}
+
+	for _, tc := range cases {
+		mqttClient.SetAckDelay(tc.ackDelay)
+		mqttClient.SetError(tc.brokerErr)
+		err := svc.PublishWait(context.Background(), "control", "payload", tc.timeout)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+	}
+	mqttClient.SetAckDelay(0)
+	mqttClient.SetError(nil)
+
+	messages := mqttClient.Messages()
+	require.NotEmpty(t, messages, "expected messages to be published")
+	assert.Equal(t, byte(1), messages[0].QoS, "expected message to be published with QoS 1")
+}
+
+func TestPublishTo(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Channels = agent.ChanConfig{
+		Control:      "control",
+		Data:         "data",
+		DataChannels: map[string]string{"temperature": "temp", "humidity": "hum"},
+	}
+	svc, mqttClient := newService(t, cfg)
+
+	cases := []struct {
+		desc    string
+		channel string
+		topic   string
+		sent    string
+		err     error
+	}{
+		{
+			desc:    "publish to named channel",
+			channel: "temperature",
+			sent:    "channels/temp/messages/res",
+		},
+		{
+			desc:    "publish to subtopic of named channel",
+			channel: "humidity",
+			topic:   "sensor/1",
+			sent:    "channels/hum/messages/res/sensor/1",
+		},
+		{
+			desc: "publish to default channel",
+			sent: "channels/data/messages/res",
+		},
+		{
+			desc:    "publish to unknown channel",
+			channel: "pressure",
+			err:     agent.ErrNoSuchChannel,
+		},
+	}
+
+	for _, tc := range cases {
+		sent := len(mqttClient.Messages())
+		err := svc.PublishTo(tc.channel, tc.topic, "payload")
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		msgs := mqttClient.Messages()[sent:]
+		if tc.err != nil {
+			assert.Empty(t, msgs, fmt.Sprintf("%s: expected no message to be published", tc.desc))
+			continue
+		}
+		require.Len(t, msgs, 1, fmt.Sprintf("%s: expected message to be published", tc.desc))
+		assert.Equal(t, tc.sent, msgs[0].Topic, fmt.Sprintf("%s: expected topic %s got %s", tc.desc, tc.sent, msgs[0].Topic))
+	}
+
+	// Publish keeps publishing to the default data channel.
+	sent := len(mqttClient.Messages())
+	err := svc.Publish(context.Background(), "data", "payload", agent.PublishOpts{})
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	msgs := mqttClient.Messages()[sent:]
+	require.Len(t, msgs, 1, "expected message to be published")
+	assert.Equal(t, "channels/data/messages/res", msgs[0].Topic)
+}
+
+func TestPublishBuffer(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.MQTT.PublishBuffer = 3
+	svc, mqttClient := newService(t, cfg)
+
+	// Broker outage.
+	mqttClient.Disconnect(0)
+	for i := 0; i < 5; i++ {
+		err := svc.Publish(context.Background(), "data", fmt.Sprintf("msg-%d", i), agent.PublishOpts{})
+		assert.Nil(t, err, fmt.Sprintf("publish while disconnected: unexpected error %s", err))
+	}
+	assert.Empty(t, mqttClient.Messages(), "expected no message to be published while disconnected")
+
+	// Broker recovery.
+	token := mqttClient.Connect()
+	require.Nil(t, token.Error(), fmt.Sprintf("unexpected error reconnecting: %s", token.Error()))
+	assert.Eventually(t, func() bool {
+		return len(mqttClient.Messages()) == 3
+	}, 5*time.Second, 10*time.Millisecond, "expected buffered messages to be published on reconnect")
+
+	err := svc.Publish(context.Background(), "data", "msg-5", agent.PublishOpts{})
+	assert.Nil(t, err, fmt.Sprintf("publish after reconnect: unexpected error %s", err))
+
+	var payloads []interface{}
+	for _, m := range mqttClient.Messages() {
+		payloads = append(payloads, m.Payload)
+	}
+	assert.Equal(t, []interface{}{"msg-2", "msg-3", "msg-4", "msg-5"}, payloads, "expected oldest messages to be dropped and order to be kept")
+}
+
+func TestPublishBufferDisabled(t *testing.T) {
+	svc, mqttClient := newService(t, agent.Config{})
+
+	mqttClient.Disconnect(0)
+	err := svc.Publish(context.Background(), "data", "payload", agent.PublishOpts{})
+	assert.True(t, errors.Contains(err, agent.ErrPublishFailed), fmt.Sprintf("expected error %s got %s", agent.ErrPublishFailed, err))
+}
+
+func TestPublishCancel(t *testing.T) {
+	svc, mqttClient := newService(t, agent.Config{})
+	// Connection is lost without the client noticing, so the publishes
+	// aren't ever acknowledged.
+	mqttClient.SetAckDelay(-1)
+
+	cases := []struct {
+		desc    string
+		publish func(ctx context.Context) error
+	}{
+		{
+			desc: "cancel publish",
+			publish: func(ctx context.Context) error {
+				return svc.Publish(ctx, "data", "payload", agent.PublishOpts{})
+			},
+		},
+		{
+			desc: "cancel publish waiting for acknowledgment",
+			publish: func(ctx context.Context) error {
+				return svc.PublishWait(ctx, "data", "payload", time.Hour)
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 1)
+		go func() {
+			errs <- tc.publish(ctx)
+		}()
+		select {
+		case err := <-errs:
+			t.Fatalf("%s: expected publish to block, got %v", tc.desc, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		cancel()
+		select {
+		case err := <-errs:
+			assert.True(t, errors.Contains(err, agent.ErrPublishFailed), fmt.Sprintf("%s: expected error %s got %s", tc.desc, agent.ErrPublishFailed, err))
+			assert.True(t, goerrors.Is(err, context.Canceled), fmt.Sprintf("%s: expected error %s got %s", tc.desc, context.Canceled, err))
+		case <-time.After(time.Second):
+			t.Fatalf("%s: expected publish to return once cancelled", tc.desc)
+		}
+	}
+}
+
+func TestPublishMetrics(t *testing.T) {
+	cases := []struct {
+		desc      string
+		buffer    int
+		connected bool
+		publishes int
+		dropped   float64
+		failed    float64
+	}{
+		{desc: "publish while connected", connected: true, publishes: 3},
+		{desc: "publish while disconnected without buffer", publishes: 3, dropped: 3, failed: 3},
+		{desc: "publish while disconnected with full buffer", buffer: 2, publishes: 5, dropped: 3},
+	}
+
+	for _, tc := range cases {
+		connected, latency, failed, dropped := &gauge{}, &histogram{}, &counter{}, &counter{}
+		m := agent.MQTTMetrics{Connected: connected, Latency: latency, Failed: failed, Dropped: dropped}
+		cfg := agent.Config{}
+		cfg.Heartbeat.Interval = time.Second
+		cfg.MQTT.PublishBuffer = tc.buffer
+		mqttClient := mocks.NewMQTTClient()
+		if !tc.connected {
+			mqttClient.Disconnect(0)
+		}
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		svc, err := agent.New(context.TODO(), mqttClient, agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), m, logger, new(slog.LevelVar))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating service: %s", tc.desc, err))
+
+		for i := 0; i < tc.publishes; i++ {
+			_ = svc.Publish(context.Background(), "data", fmt.Sprintf("msg-%d", i), agent.PublishOpts{})
+		}
+		assert.Equal(t, tc.dropped, dropped.value(), fmt.Sprintf("%s: unexpected dropped messages", tc.desc))
+		assert.Equal(t, tc.failed, failed.value(), fmt.Sprintf("%s: unexpected failed publishes", tc.desc))
+		state := 0.0
+		if tc.connected {
+			state = 1
+		}
+		assert.Equal(t, state, connected.value(), fmt.Sprintf("%s: unexpected connection state", tc.desc))
+		if tc.connected {
+			assert.Equal(t, tc.publishes, latency.count(), fmt.Sprintf("%s: expected publish latencies to be observed", tc.desc))
+		}
+	}
+}
+
+type counter struct {
+	mu    sync.Mutex
+	total float64
+}
+
+func (c *counter) With(...string) metrics.Counter { return c }
+
+func (c *counter) Add(delta float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.total += delta
+}
+
+func (c *counter) value() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+type gauge struct {
+	mu    sync.Mutex
+	total float64
+}
+
+func (g *gauge) With(...string) metrics.Gauge { return g }
+
+func (g *gauge) Set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.total = value
+}
+
+func (g *gauge) Add(delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.total += delta
+}
+
+func (g *gauge) value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.total
+}
+
+type histogram struct {
+	mu           sync.Mutex
+	observations []float64
+}
+
+func (h *histogram) With(...string) metrics.Histogram { return h }
+
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observations = append(h.observations, value)
+}
+
+func (h *histogram) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.observations)
+}
+
+func newQueueService(ctx context.Context, t *testing.T, mqttClient *mocks.MQTTClient, cfg agent.Config) agent.Service {
+	cfg.Heartbeat.Interval = time.Second
+	logger, err := logger.New(os.Stdout, "debug")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating logger: %s", err))
+
+	svc, err := agent.New(ctx, mqttClient, agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+	return svc
+}
+
+func TestPublishQueue(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.MQTT.QueueDir = t.TempDir()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	offline := mocks.NewMQTTClient()
+	offline.Disconnect(0)
+	svc := newQueueService(ctx, t, offline, cfg)
+	for i := 0; i < 3; i++ {
+		err := svc.Publish(context.Background(), "data", fmt.Sprintf("msg-%d", i), agent.PublishOpts{})
+		assert.Nil(t, err, fmt.Sprintf("publish while offline: unexpected error %s", err))
+	}
+	assert.Equal(t, 3, svc.QueueDepth(), "expected messages to be queued while offline")
+	assert.Equal(t, 3, svc.Healthz().QueueDepth, "expected health status to report queue depth")
+
+	// Restart.
+	cancel()
+	online := mocks.NewMQTTClient()
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	svc = newQueueService(ctx, t, online, cfg)
+
+	assert.Eventually(t, func() bool {
+		return svc.QueueDepth() == 0
+	}, 5*time.Second, 10*time.Millisecond, "expected queued messages to be published after restart")
+	var payloads []interface{}
+	for _, m := range online.Messages() {
+		payloads = append(payloads, m.Payload)
+	}
+	assert.Equal(t, []interface{}{"msg-0", "msg-1", "msg-2"}, payloads, "expected queued messages to be published in order")
+}
+
+func TestPublishQueueMaxBytes(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.MQTT.QueueDir = t.TempDir()
+	cfg.MQTT.QueueMaxBytes = 200
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mqttClient := mocks.NewMQTTClient()
+	mqttClient.Disconnect(0)
+	svc := newQueueService(ctx, t, mqttClient, cfg)
+
+	// Only a single message fits the queue.
+	for _, p := range []string{"a", "b", "c"} {
+		err := svc.Publish(context.Background(), "data", strings.Repeat(p, 100), agent.PublishOpts{})
+		assert.Nil(t, err, fmt.Sprintf("publish while offline: unexpected error %s", err))
+	}
+	assert.Equal(t, 1, svc.QueueDepth(), "expected oldest messages to be dropped")
+
+	err := svc.Publish(context.Background(), "data", strings.Repeat("d", 300), agent.PublishOpts{})
+	assert.True(t, errors.Contains(err, agent.ErrPublishFailed), fmt.Sprintf("expected error %s got %s", agent.ErrPublishFailed, err))
+
+	mqttClient.Connect()
+	assert.Eventually(t, func() bool {
+		return len(mqttClient.Messages()) == 1
+	}, 5*time.Second, 10*time.Millisecond, "expected queued message to be published")
+	assert.Equal(t, strings.Repeat("c", 100), mqttClient.Messages()[0].Payload)
+}
+
+func TestRotateMQTTCredentials(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.MQTT.Username = "thing"
+	cfg.MQTT.Password = "key"
+	svc, mqttClient, creds := newServiceWithCredentials(t, cfg)
+	mqttClient.SetConnectHandler(func() error {
+		if _, password := creds.Get(); password == "invalid" {
+			return errors.New("not authorized")
+		}
+		return nil
+	})
+
+	cases := []struct {
+		desc     string
+		creds    agent.MQTTCredentials
+		username string
+		password string
+		err      error
+	}{
+		{
+			desc:     "rotate to valid credentials",
+			creds:    agent.MQTTCredentials{Username: "new-thing", Password: "new-key"},
+			username: "new-thing",
+			password: "new-key",
+			err:      nil,
+		},
+		{
+			desc:     "rotate to invalid credentials",
+			creds:    agent.MQTTCredentials{Username: "other-thing", Password: "invalid"},
+			username: "new-thing",
+			password: "new-key",
+			err:      errors.New("failed to rotate MQTT credentials"),
+		},
+		{
+			desc:     "rotate to invalid client certificate",
+			creds:    agent.MQTTCredentials{Username: "other-thing", Password: "other-key", ClientCert: "cert", ClientKey: "key"},
+			username: "new-thing",
+			password: "new-key",
+			err:      errors.New("failed to rotate MQTT credentials"),
+		},
+	}
+
+	for _, tc := range cases {
+		err := svc.RotateMQTTCredentials(tc.creds)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		mc := svc.Config().MQTT
+		assert.Equal(t, tc.username, mc.Username, fmt.Sprintf("%s: expected username %s got %s", tc.desc, tc.username, mc.Username))
+		assert.Equal(t, tc.password, mc.Password, fmt.Sprintf("%s: expected password %s got %s", tc.desc, tc.password, mc.Password))
+		username, password := creds.Get()
+		assert.Equal(t, tc.username, username, fmt.Sprintf("%s: expected client username %s got %s", tc.desc, tc.username, username))
+		assert.Equal(t, tc.password, password, fmt.Sprintf("%s: expected client password %s got %s", tc.desc, tc.password, password))
+		assert.True(t, mqttClient.IsConnected(), fmt.Sprintf("%s: expected client to be connected", tc.desc))
+	}
+}
+
+func TestRotateMQTTCredentialsReconnect(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.MQTT.Username = "thing"
+	cfg.MQTT.Password = "key"
+	svc, mqttClient, _ := newServiceWithCredentials(t, cfg)
+	connecting := make(chan struct{})
+	release := make(chan struct{})
+	mqttClient.SetConnectHandler(func() error {
+		close(connecting)
+		<-release
+		return nil
+	})
+
+	errs := make(chan error)
+	go func() {
+		errs <- svc.RotateMQTTCredentials(agent.MQTTCredentials{Username: "new-thing", Password: "new-key"})
+	}()
+	<-connecting
+
+	// Config isn't locked while the client reconnects.
+	read := make(chan agent.Config)
+	go func() {
+		read <- svc.Config()
+	}()
+	select {
+	case c := <-read:
+		assert.Equal(t, "new-thing", c.MQTT.Username, fmt.Sprintf("expected username new-thing got %s", c.MQTT.Username))
+	case <-time.After(time.Second):
+		assert.Fail(t, "expected config to be read while reconnecting")
+	}
+
+	close(release)
+	err := <-errs
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+}
+
+func TestControlRotateCredentials(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.MQTT.Username = "thing"
+	cfg.MQTT.Password = "key"
+	svc, mqttClient, creds := newServiceWithCredentials(t, cfg)
+
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	// Password contains characters the command parser strips or splits on.
+	cmd := fmt.Sprintf("rotate-credentials,%s,%s", encode("new-thing"), encode("new key,1"))
+	err := svc.Control("1", cmd)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	assert.Eventually(t, func() bool {
+		return len(mqttClient.Messages()) == 1
+	}, time.Second, 10*time.Millisecond, "expected rotation result to be published")
+	username, password := creds.Get()
+	assert.Equal(t, "new-thing", username, fmt.Sprintf("expected username new-thing got %s", username))
+	assert.Equal(t, "new key,1", password, fmt.Sprintf("expected password 'new key,1' got %s", password))
+
+	err = svc.Control("1", "rotate-credentials,not-base64,"+encode("key"))
+	assert.NotNil(t, err, "expected error for malformed command")
+}
+
+func TestRotateMQTTCredentialsSaveFailure(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.MQTT.Username = "thing"
+	cfg.MQTT.Password = "key"
+	cfg.File = t.TempDir() + "/missing/config.toml"
+	svc, _, creds := newServiceWithCredentials(t, cfg)
+
+	err := svc.RotateMQTTCredentials(agent.MQTTCredentials{Username: "new-thing", Password: "new-key"})
+	assert.True(t, errors.Contains(err, errors.New("failed to rotate MQTT credentials")), fmt.Sprintf("expected rotation error got %s", err))
+
+	username, password := creds.Get()
+	assert.Equal(t, "thing", username, fmt.Sprintf("expected username to be rolled back got %s", username))
+	assert.Equal(t, "key", password, fmt.Sprintf("expected password to be rolled back got %s", password))
+	assert.Equal(t, "thing", svc.Config().MQTT.Username, "expected config username to be rolled back")
+}
+
+func TestLockdown(t *testing.T) {
+	svc, mqttClient := newService(t, agent.Config{})
+	require.True(t, mqttClient.IsConnected(), "expected MQTT client to be connected")
+
+	err := svc.Control("1", "lockdown,disconnect")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Eventually(t, func() bool {
+		return !mqttClient.IsConnected()
+	}, time.Second, 10*time.Millisecond, "expected MQTT client to be disconnected")
+
+	_, err = svc.Execute(context.Background(), "1", "echo,locked")
+	assert.True(t, errors.Contains(err, agent.ErrLockedDown), fmt.Sprintf("expected %s got %s", agent.ErrLockedDown, err))
+	err = svc.Terminal("1", "open")
+	assert.True(t, errors.Contains(err, agent.ErrLockedDown), fmt.Sprintf("expected %s got %s", agent.ErrLockedDown, err))
+	err = svc.Control("1", "edgex-ping,")
+	assert.True(t, errors.Contains(err, agent.ErrLockedDown), fmt.Sprintf("expected %s got %s", agent.ErrLockedDown, err))
+	err = svc.ServiceConfig(context.Background(), "1", "save,export,file,content")
+	assert.True(t, errors.Contains(err, agent.ErrLockedDown), fmt.Sprintf("expected %s got %s", agent.ErrLockedDown, err))
+	err = svc.AddConfig(agent.Config{})
+	assert.True(t, errors.Contains(err, agent.ErrLockedDown), fmt.Sprintf("expected %s got %s", agent.ErrLockedDown, err))
+
+	err = svc.Unlock()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.True(t, mqttClient.IsConnected(), "expected MQTT client to be reconnected")
+
+	_, err = svc.Execute(context.Background(), "1", "echo,unlocked")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+}
+
+func TestTerminalChar(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Terminal.SessionTimeout = time.Minute
+	cfg.Terminal.Shell = "sh"
+	svc, mqttClient := newService(t, cfg)
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	err := svc.Terminal("1", encode("open"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening terminal: %s", err))
+	defer svc.Terminal("1", encode("close"))
+
+	// Input without comma is empty, so it doesn't prefix the next one.
+	err = svc.Terminal("1", encode("c"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing empty input: %s", err))
+	// Result is computed, so the echoed input doesn't match it.
+	err = svc.Terminal("1", encode("c,echo $((1+2)),x\n"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing input: %s", err))
+
+	output := func() string {
+		var out strings.Builder
+		for _, msg := range mqttClient.Messages() {
+			rec, err := encoder.DecodeSenML([]byte(fmt.Sprint(msg.Payload)))
+			if err == nil {
+				out.WriteString(rec.Value)
+			}
+		}
+		return out.String()
+	}
+	assert.Eventually(t, func() bool {
+		return strings.Contains(output(), "3,x")
+	}, 5*time.Second, 10*time.Millisecond, "expected input with commas to be written as is")
+}
+
+func TestTerminalInput(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Terminal.SessionTimeout = time.Minute
+	cfg.Terminal.Shell = "sh"
+	svc, _ := newService(t, cfg)
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	err := svc.Terminal("1", encode("resize,30,100"))
+	assert.NotNil(t, err, "expected error resizing terminal without session")
+
+	err = svc.Terminal("1", encode("open"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening terminal: %s", err))
+	defer svc.Terminal("1", encode("close"))
+
+	cases := []struct {
+		desc string
+		cmd  string
+		err  error
+	}{
+		{desc: "resize terminal", cmd: "resize,30,100"},
+		{desc: "signal terminal", cmd: "signal,interrupt"},
+		{desc: "resize terminal to zero size", cmd: "resize,0,100", err: agent.ErrInvalidCommand},
+		{desc: "resize terminal with malformed size", cmd: "resize,30,wide", err: agent.ErrInvalidCommand},
+		{desc: "resize terminal without size", cmd: "resize", err: agent.ErrInvalidCommand},
+		{desc: "signal terminal with unknown signal", cmd: "signal,kill", err: agent.ErrInvalidCommand},
+	}
+
+	for _, tc := range cases {
+		err := svc.Terminal("1", encode(tc.cmd))
+		if tc.err == nil {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+			continue
+		}
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %s got %s", tc.desc, tc.err, err))
+	}
+}
+
+// running reports whether a process with the given command line exists.
+func running(t *testing.T, cmdline ...string) bool {
+	paths, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	want := strings.Join(cmdline, "\x00") + "\x00"
+	for _, p := range paths {
+		b, err := os.ReadFile(p)
+		if err == nil && string(b) == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExecuteTimeout(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Exec.Timeout = time.Second
+	svc, _ := newService(t, cfg)
+
+	// Unusual duration to tell the process apart from other sleeps.
+	const duration = "10.284"
+	begin := time.Now()
+	_, err := svc.Execute(context.Background(), "1", "sleep,"+duration)
+	assert.True(t, errors.Contains(err, agent.ErrExecTimeout), fmt.Sprintf("expected %s got %s", agent.ErrExecTimeout, err))
+	assert.Less(t, time.Since(begin), 5*time.Second, "expected command to be stopped on timeout")
+	assert.False(t, running(t, "sleep", duration), "expected process to be killed")
+
+	_, err = svc.Execute(context.Background(), "1", "echo,ok")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+}
+
+func TestExecuteConcurrency(t *testing.T) {
+	cases := []struct {
+		desc         string
+		queueTimeout time.Duration
+		rejected     int
+		waves        int
+	}{
+		{desc: "execute above limit rejecting excess", rejected: 2, waves: 1},
+		{desc: "execute above limit queueing excess", queueTimeout: 5 * time.Second, waves: 2},
+		{desc: "execute above limit until queue timeout", queueTimeout: 100 * time.Millisecond, rejected: 2, waves: 1},
+	}
+
+	for _, tc := range cases {
+		cfg := agent.Config{}
+		cfg.Exec.MaxConcurrent = 2
+		cfg.Exec.QueueTimeout = tc.queueTimeout
+		svc, _ := newService(t, cfg)
+
+		const sleep = 500 * time.Millisecond
+		errs := make(chan error, 4)
+		begin := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func(uuid string) {
+				defer wg.Done()
+				_, err := svc.ExecuteResult(context.Background(), uuid, "sleep,0.5", "")
+				errs <- err
+			}(fmt.Sprintf("%d", i))
+		}
+		wg.Wait()
+		elapsed := time.Since(begin)
+		close(errs)
+
+		rejected := 0
+		for err := range errs {
+			switch {
+			case errors.Contains(err, agent.ErrTooManyExecutions):
+				rejected++
+			default:
+				assert.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+			}
+		}
+		assert.Equal(t, tc.rejected, rejected, fmt.Sprintf("%s: expected %d rejected got %d", tc.desc, tc.rejected, rejected))
+		assert.GreaterOrEqual(t, elapsed, time.Duration(tc.waves)*sleep, fmt.Sprintf("%s: expected %d waves of commands", tc.desc, tc.waves))
+		assert.Less(t, elapsed, time.Duration(tc.waves+1)*sleep, fmt.Sprintf("%s: expected %d waves of commands", tc.desc, tc.waves))
+
+		_, err := svc.ExecuteResult(context.Background(), "1", "echo,ok", "")
+		assert.Nil(t, err, fmt.Sprintf("%s: expected slots to be released got %s", tc.desc, err))
+	}
+}
+
+func TestCancelExecute(t *testing.T) {
+	svc, _ := newService(t, agent.Config{})
+
+	err := svc.CancelExecute("1")
+	assert.True(t, errors.Contains(err, agent.ErrNoSuchExecution), fmt.Sprintf("expected %s got %s", agent.ErrNoSuchExecution, err))
+
+	// Unusual duration to tell the process apart from other sleeps.
+	const duration = "30.284"
+	begin := time.Now()
+	done := make(chan error)
+	go func() {
+		_, err := svc.ExecuteResult(context.Background(), "1", "sleep,"+duration, "")
+		done <- err
+	}()
+	assert.Eventually(t, func() bool {
+		return running(t, "sleep", duration)
+	}, 5*time.Second, 10*time.Millisecond, "expected command to be running")
+
+	err = svc.CancelExecute("1")
+	require.Nil(t, err, fmt.Sprintf("unexpected error cancelling execution: %s", err))
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		require.Fail(t, "expected command to be stopped on cancel")
+	}
+	assert.True(t, errors.Contains(err, agent.ErrExecCancelled), fmt.Sprintf("expected %s got %s", agent.ErrExecCancelled, err))
+	assert.Less(t, time.Since(begin), 5*time.Second, "expected command to be stopped promptly")
+	assert.False(t, running(t, "sleep", duration), "expected process to be killed")
+
+	err = svc.CancelExecute("1")
+	assert.True(t, errors.Contains(err, agent.ErrNoSuchExecution), fmt.Sprintf("expected completed execution to be removed got %s", err))
+}
+
+func TestExecuteCommandLists(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Exec.Allowlist = []string{"echo", "un*"}
+	cfg.Exec.Denylist = []string{"unset*"}
+	svc, _ := newService(t, cfg)
+
+	cases := []struct {
+		desc string
+		cmd  string
+		err  error
+	}{
+		{
+			desc: "execute allowed command",
+			cmd:  "echo,ok",
+			err:  nil,
+		},
+		{
+			desc: "execute glob matched command",
+			cmd:  "uname,-a",
+			err:  nil,
+		},
+		{
+			desc: "execute command not in allowlist",
+			cmd:  "ls,-la",
+			err:  agent.ErrCommandNotAllowed,
+		},
+		{
+			desc: "execute command in denylist",
+			cmd:  "unsetenv,PATH",
+			err:  agent.ErrCommandNotAllowed,
+		},
+		{
+			desc: "execute command matching pattern partially",
+			cmd:  "/bin/echo,ok",
+			err:  agent.ErrCommandNotAllowed,
+		},
+	}
+
+	for _, tc := range cases {
+		_, err := svc.Execute(context.Background(), "1", tc.cmd)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %s got %s", tc.desc, tc.err, err))
+	}
+
+	err := svc.Control("1", "edgex-ping,")
+	assert.True(t, errors.Contains(err, agent.ErrCommandNotAllowed), fmt.Sprintf("expected %s got %s", agent.ErrCommandNotAllowed, err))
+	err = svc.Control("1", "lockdown,keep")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+}
+
+// chunkWriter records output chunks with their arrival time.
+type chunkWriter struct {
+	mu     sync.Mutex
+	chunks []string
+	times  []time.Time
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.chunks = append(w.chunks, string(p))
+	w.times = append(w.times, time.Now())
+	return len(p), nil
+}
+
+func TestExecuteStream(t *testing.T) {
+	svc, mqttClient := newService(t, agent.Config{})
+
+	// Spaces are stripped from commands, tabs separate shell words instead.
+	script := "for\ti\tin\t1\t2\t3;\tdo\techo\tline$i;\tsleep\t0.2;\tdone"
+	w := &chunkWriter{}
+	code, err := svc.ExecuteStream(context.Background(), "1", "sh,-c,"+script, "", w, w)
+	end := time.Now()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, 0, code, "expected zero exit code")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	assert.Equal(t, "line1\nline2\nline3\n", strings.Join(w.chunks, ""), "unexpected output")
+	require.NotEmpty(t, w.times, "expected output chunks")
+	assert.Less(t, w.times[0], end.Add(-300*time.Millisecond), "expected output before the command completed")
+	assert.Empty(t, mqttClient.Messages(), "expected streamed output not to be published")
+}
+
+func TestExecuteStreamExit(t *testing.T) {
+	svc, _ := newService(t, agent.Config{})
+
+	var stdout, stderr chunkWriter
+	code, err := svc.ExecuteStream(context.Background(), "1", "sh,-c,echo\tout;echo\terr>&2;exit\t3", "", &stdout, &stderr)
+	assert.True(t, errors.Contains(err, agent.ErrExecFailed), fmt.Sprintf("expected %s got %s", agent.ErrExecFailed, err))
+	assert.Equal(t, 3, code, "expected exit code of the command")
+	assert.Equal(t, "out\n", strings.Join(stdout.chunks, ""), "expected standard output")
+	assert.Equal(t, "err\n", strings.Join(stderr.chunks, ""), "expected standard error")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = svc.ExecuteStream(ctx, "1", "sleep,10", "", &stdout, &stderr)
+	assert.True(t, errors.Contains(err, agent.ErrExecCancelled), fmt.Sprintf("expected %s got %s", agent.ErrExecCancelled, err))
+	assert.Less(t, time.Since(start), 5*time.Second, "expected command to be killed once the context is done")
+}
+
+func TestErrorsIs(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Channels = agent.ChanConfig{Control: "thing", Data: "thing2"}
+	cfg.MQTT.Username = "thing"
+	cfg.MQTT.TopicNamespace = "channels/{username}"
+	svc, mqttClient := newService(t, cfg)
+
+	cases := []struct {
+		desc string
+		call func() error
+		err  error
+	}{
+		{
+			desc: "execute malformed command",
+			call: func() error {
+				_, err := svc.Execute(context.Background(), "1", "ls")
+				return err
+			},
+			err: agent.ErrInvalidCommand,
+		},
+		{
+			desc: "execute failing command",
+			call: func() error {
+				_, err := svc.Execute(context.Background(), "1", "ls,/nonexistent")
+				return err
+			},
+			err: agent.ErrExecFailed,
+		},
+		{
+			desc: "terminal malformed command",
+			call: func() error {
+				return svc.Terminal("1", "not-base64")
+			},
+			err: agent.ErrInvalidCommand,
+		},
+		{
+			desc: "publish outside of namespace",
+			call: func() error {
+				return svc.Publish(context.Background(), "data", "payload", agent.PublishOpts{})
+			},
+			err: agent.ErrTopicNotAllowed,
+		},
+		{
+			desc: "publish with broker failure",
+			call: func() error {
+				mqttClient.SetError(goerrors.New("broker failure"))
+				defer mqttClient.SetError(nil)
+				return svc.Publish(context.Background(), "control", "payload", agent.PublishOpts{})
+			},
+			err: agent.ErrPublishFailed,
+		},
+		{
+			desc: "read missing config",
+			call: func() error {
+				_, err := agent.ReadConfig(filepath.Join(t.TempDir(), "config.toml"))
+				return err
+			},
+			err: agent.ErrConfigNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		err := tc.call()
+		assert.True(t, goerrors.Is(err, tc.err), fmt.Sprintf("%s: expected errors.Is %s got %s", tc.desc, tc.err, err))
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected errors.Contains %s got %s", tc.desc, tc.err, err))
+	}
+}
+
+func TestExecuteResult(t *testing.T) {
+	svc, _ := newService(t, agent.Config{})
+
+	script := "echo\tout;\techo\terr\t>&2;\texit\t3"
+	res, err := svc.ExecuteResult(context.Background(), "1", "sh,-c,"+script, "")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, 3, res.ExitCode, fmt.Sprintf("expected exit code 3 got %d", res.ExitCode))
+	assert.Equal(t, "out\n", res.Stdout, fmt.Sprintf("expected stdout 'out' got %s", res.Stdout))
+	assert.Equal(t, "err\n", res.Stderr, fmt.Sprintf("expected stderr 'err' got %s", res.Stderr))
+
+	_, err = svc.ExecuteResult(context.Background(), "1", "nonexistent-command,arg", "")
+	assert.True(t, errors.Contains(err, agent.ErrExecFailed), fmt.Sprintf("expected %s got %s", agent.ErrExecFailed, err))
+
+	// Execute still fails on non-zero exit code.
+	_, err = svc.Execute(context.Background(), "1", "sh,-c,"+script)
+	assert.True(t, errors.Contains(err, agent.ErrExecFailed), fmt.Sprintf("expected %s got %s", agent.ErrExecFailed, err))
+}
+
+func TestExecuteResultCache(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Exec.Cacheable = []string{"sh"}
+	cfg.Exec.CacheTTL = 200 * time.Millisecond
+	svc, _ := newService(t, cfg)
+
+	// Shell PID tells whether the command was run again.
+	pid := func(cmd, dir string) string {
+		res, err := svc.ExecuteResult(context.Background(), "1", cmd, dir)
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+		return res.Stdout
+	}
+	first := pid("sh,-c,echo\t$$", "")
+	assert.Equal(t, first, pid("sh,-c,echo\t$$", ""), "expected cached result")
+	assert.NotEqual(t, first, pid("sh,-c,echo\t$$", os.TempDir()), "expected command in other directory to run")
+	assert.NotEqual(t, pid("bash,-c,echo\t$$", ""), pid("bash,-c,echo\t$$", ""), "expected command not cacheable to run")
+
+	err := svc.Lockdown(false)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	_, err = svc.ExecuteResult(context.Background(), "1", "sh,-c,echo\t$$", "")
+	assert.True(t, errors.Contains(err, agent.ErrLockedDown), fmt.Sprintf("expected %s got %s", agent.ErrLockedDown, err))
+	err = svc.Unlock()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	time.Sleep(cfg.Exec.CacheTTL)
+	assert.NotEqual(t, first, pid("sh,-c,echo\t$$", ""), "expected expired result not to be used")
+}
+
+// flakyCommand returns the command counting its runs in the file, which
+// exits with the code until it ran the number of times.
+func flakyCommand(file string, runs, code int) string {
+	return fmt.Sprintf("sh,-c,echo\t>>\t%s;\tn=$(wc\t-l\t<\t%s);\techo\trun\t$n;\ttest\t$n\t-ge\t%d\t||\texit\t%d", file, file, runs, code)
+}
+
+func runs(t *testing.T, file string) int {
+	b, err := os.ReadFile(file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading runs: %s", err))
+	return bytes.Count(b, []byte("\n"))
+}
+
+func TestExecuteRetry(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Exec.Retryable = []string{"sh"}
+	cfg.Exec.RetryExitCodes = []int{75}
+	cfg.Exec.MaxRetries = 2
+	cfg.Exec.RetryDelay = 10 * time.Millisecond
+	svc, _ := newService(t, cfg)
+
+	file := filepath.Join(t.TempDir(), "runs")
+	payload, err := svc.Execute(context.Background(), "1", flakyCommand(file, 2, 75))
+	require.Nil(t, err, fmt.Sprintf("expected command to succeed once retried: %s", err))
+	assert.Equal(t, 2, runs(t, file), "expected command to be run again after transient failure")
+	assert.Contains(t, payload, "run 2", "expected output of the last run")
+	assert.NotContains(t, payload, "run 1", "expected output of the failed run to be discarded")
+
+	cases := []struct {
+		desc string
+		cmd  func(file string) string
+		runs int
+		code int
+	}{
+		{
+			desc: "retries exhausted",
+			cmd:  func(file string) string { return flakyCommand(file, 5, 75) },
+			runs: 3,
+			code: 75,
+		},
+		{
+			desc: "exit code not transient",
+			cmd:  func(file string) string { return flakyCommand(file, 2, 3) },
+			runs: 1,
+			code: 3,
+		},
+		{
+			desc: "command not retryable",
+			cmd: func(file string) string {
+				return strings.Replace(flakyCommand(file, 2, 75), "sh,", "bash,", 1)
+			},
+			runs: 1,
+			code: 75,
+		},
+	}
+
+	for _, tc := range cases {
+		file := filepath.Join(t.TempDir(), "runs")
+		res, err := svc.ExecuteResult(context.Background(), "1", tc.cmd(file), "")
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		assert.Equal(t, tc.code, res.ExitCode, fmt.Sprintf("%s: expected exit code %d got %d", tc.desc, tc.code, res.ExitCode))
+		assert.Equal(t, tc.runs, runs(t, file), fmt.Sprintf("%s: expected %d runs", tc.desc, tc.runs))
+	}
+}
+
+func TestExecuteResultContext(t *testing.T) {
+	cfg := validConfig()
+	cfg.Exec.Retryable = []string{"sh"}
+	cfg.Exec.RetryExitCodes = []int{75}
+	cfg.Exec.MaxRetries = 1
+	var out syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	svc, err := agent.New(context.TODO(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+
+	file := filepath.Join(t.TempDir(), "runs")
+	ctx := agent.WithRequestID(context.Background(), "request-1")
+	res, err := svc.ExecuteResult(ctx, "1", flakyCommand(file, 2, 75), t.TempDir())
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, 0, res.ExitCode, "expected command to succeed once retried")
+	assert.Contains(t, out.String(), `"request_id":"request-1"`, "expected retry to be logged with request ID")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	_, err = svc.ExecuteResult(ctx, "2", "sleep,10", "")
+	assert.True(t, errors.Contains(err, agent.ErrExecCancelled), fmt.Sprintf("expected %s got %s", agent.ErrExecCancelled, err))
+	assert.Less(t, time.Since(start), 5*time.Second, "expected command to be cancelled with the context")
+}
+
+func TestExecuteAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running commands as other user requires root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("user nobody not found: %s", err)
+	}
+	cfg := agent.Config{}
+	cfg.Exec.User = "nobody"
+	svc, _ := newService(t, cfg)
+
+	res, err := svc.ExecuteResult(context.Background(), "1", "id,-u", "")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, nobody.Uid+"\n", res.Stdout, "expected command to run as the configured user")
+}
+
+func TestNewMissingUser(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Exec.User = "agent-test-missing-user"
+	logger, err := logger.New(os.Stdout, "debug")
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating logger: %s", err))
+	_, err = agent.New(context.TODO(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	assert.True(t, errors.Contains(err, agent.ErrInvalidConfig), fmt.Sprintf("expected %s got %s", agent.ErrInvalidConfig, err))
+}
+
+func TestExecuteBatch(t *testing.T) {
+	cmds := []string{"echo,first", "sh,-c,exit\t2", "echo,last"}
+
+	cases := []struct {
+		desc            string
+		continueOnError bool
+		exitCodes       []int
+	}{
+		{
+			desc:      "stop on error",
+			exitCodes: []int{0, 2},
+		},
+		{
+			desc:            "continue on error",
+			continueOnError: true,
+			exitCodes:       []int{0, 2, 0},
+		},
+	}
+
+	for _, tc := range cases {
+		cfg := agent.Config{}
+		cfg.Exec.ContinueOnError = tc.continueOnError
+		svc, _ := newService(t, cfg)
+
+		results, err := svc.ExecuteBatch("1", cmds)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		codes := []int{}
+		for _, res := range results {
+			codes = append(codes, res.ExitCode)
+		}
+		assert.Equal(t, tc.exitCodes, codes, fmt.Sprintf("%s: unexpected exit codes", tc.desc))
+		assert.Equal(t, "first\n", results[0].Stdout, fmt.Sprintf("%s: unexpected output", tc.desc))
+	}
+
+	cfg := agent.Config{}
+	cfg.Exec.Allowlist = []string{"echo"}
+	svc, _ := newService(t, cfg)
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "marker")
+	// Disallowed command is rejected before any command runs.
+	results, err := svc.ExecuteBatch("1", []string{"echo,first", "touch," + marker})
+	assert.True(t, errors.Contains(err, agent.ErrCommandNotAllowed), fmt.Sprintf("expected %s got %s", agent.ErrCommandNotAllowed, err))
+	assert.Empty(t, results, "expected no commands executed")
+
+	_, err = svc.ExecuteBatch("1", nil)
+	assert.True(t, errors.Contains(err, agent.ErrInvalidCommand), fmt.Sprintf("expected %s got %s", agent.ErrInvalidCommand, err))
+}
+
+func TestExecuteMaxOutput(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Exec.MaxOutputBytes = 16
+	svc, _ := newService(t, cfg)
+
+	// Command producing infinite output is killed.
+	res, err := svc.ExecuteResult(context.Background(), "1", "yes,y", "")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.True(t, res.Truncated, "expected output to be truncated")
+	assert.Equal(t, -1, res.ExitCode, fmt.Sprintf("expected exit code -1 got %d", res.ExitCode))
+	assert.Equal(t, strings.Repeat("y\n", 8)+agent.TruncationMarker, res.Stdout, "expected truncated output with the marker")
+
+	payload, err := svc.Execute(context.Background(), "1", "yes,y")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Contains(t, payload, strings.TrimSpace(agent.TruncationMarker), "expected published output to carry the marker")
+
+	res, err = svc.ExecuteResult(context.Background(), "1", "echo,short", "")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.False(t, res.Truncated, "expected output within the limit not to be truncated")
+	assert.Equal(t, "short\n", res.Stdout)
+}
+
+func TestExecuteWorkDir(t *testing.T) {
+	base, err := filepath.EvalSymlinks(t.TempDir())
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	work := filepath.Join(base, "work")
+	other := filepath.Join(base, "work", "other")
+	require.Nil(t, os.MkdirAll(other, 0o755))
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	require.Nil(t, os.Symlink(outside, filepath.Join(work, "escape")))
+	cwd, err := os.Getwd()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	cwd, err = filepath.EvalSymlinks(cwd)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	cases := []struct {
+		desc    string
+		workDir string
+		baseDir string
+		dir     string
+		pwd     string
+		err     error
+	}{
+		{
+			desc: "execute in agent working directory",
+			pwd:  cwd,
+		},
+		{
+			desc:    "execute in default working directory",
+			workDir: work,
+			baseDir: base,
+			pwd:     work,
+		},
+		{
+			desc:    "execute in base directory",
+			baseDir: base,
+			pwd:     base,
+		},
+		{
+			desc:    "execute in requested directory",
+			workDir: work,
+			baseDir: base,
+			dir:     other,
+			pwd:     other,
+		},
+		{
+			desc:    "execute in requested relative directory",
+			workDir: work,
+			baseDir: base,
+			dir:     "other",
+			pwd:     other,
+		},
+		{
+			desc:    "execute in directory outside of base directory",
+			workDir: work,
+			baseDir: base,
+			dir:     "../..",
+			err:     agent.ErrInvalidWorkDir,
+		},
+		{
+			desc:    "execute in directory linked outside of base directory",
+			workDir: work,
+			baseDir: base,
+			dir:     "escape",
+			err:     agent.ErrInvalidWorkDir,
+		},
+		{
+			desc:    "execute in nonexistent directory",
+			workDir: work,
+			dir:     "nonexistent",
+			err:     agent.ErrInvalidWorkDir,
+		},
+	}
+
+	for _, tc := range cases {
+		cfg := agent.Config{}
+		cfg.Exec.Dir = tc.workDir
+		cfg.Exec.BaseDir = tc.baseDir
+		svc, _ := newService(t, cfg)
+		res, err := svc.ExecuteResult(context.Background(), "1", "pwd,-P", tc.dir)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		if tc.err == nil {
+			assert.Equal(t, tc.pwd+"\n", res.Stdout, fmt.Sprintf("%s: expected working directory %s got %s", tc.desc, tc.pwd, res.Stdout))
+		}
+	}
+}
+
+func TestExecuteEnv(t *testing.T) {
+	t.Setenv("MG_AGENT_MQTT_PASSWORD", "secret-password")
+	t.Setenv("AGENT_TEST_VISIBLE", "visible")
+
+	cases := []struct {
+		desc    string
+		env     agent.EnvConfig
+		present []string
+		absent  []string
+	}{
+		{
+			desc:    "execute with inherited environment",
+			env:     agent.EnvConfig{},
+			present: []string{"MG_AGENT_MQTT_PASSWORD=secret-password", "AGENT_TEST_VISIBLE=visible"},
+		},
+		{
+			desc:    "execute with inherited environment without denied variables",
+			env:     agent.EnvConfig{Policy: agent.EnvInherit, Denylist: []string{"MG_AGENT_*"}},
+			present: []string{"AGENT_TEST_VISIBLE=visible"},
+			absent:  []string{"MG_AGENT_MQTT_PASSWORD"},
+		},
+		{
+			desc:    "execute with clean environment",
+			env:     agent.EnvConfig{Policy: agent.EnvClean, Allowlist: []string{"PATH"}},
+			present: []string{"PATH="},
+			absent:  []string{"MG_AGENT_MQTT_PASSWORD", "AGENT_TEST_VISIBLE"},
+		},
+	}
+
+	for _, tc := range cases {
+		cfg := agent.Config{}
+		cfg.Exec.Env = tc.env
+		svc, _ := newService(t, cfg)
+		res, err := svc.ExecuteResult(context.Background(), "1", "env,-0", "")
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		env := strings.Split(res.Stdout, "\x00")
+		for _, v := range tc.present {
+			assert.True(t, slices.ContainsFunc(env, func(kv string) bool { return strings.HasPrefix(kv, v) }), fmt.Sprintf("%s: expected %s in environment", tc.desc, v))
+		}
+		for _, v := range tc.absent {
+			assert.False(t, slices.ContainsFunc(env, func(kv string) bool { return strings.HasPrefix(kv, v+"=") }), fmt.Sprintf("%s: expected %s not to be in environment", tc.desc, v))
+		}
+	}
+}
+
+func TestExecuteRequestID(t *testing.T) {
+	svc, mqttClient := newService(t, agent.Config{})
+
+	ctx := agent.WithRequestID(context.Background(), "request-1")
+	payload, err := svc.Execute(ctx, "1", "echo,out")
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	msgs := mqttClient.Messages()
+	require.NotEmpty(t, msgs, "expected message to be published")
+	assert.Equal(t, payload, msgs[len(msgs)-1].Payload, "expected returned payload to be published")
+
+	var records []struct {
+		Name  string `json:"n"`
+		Value string `json:"vs"`
+	}
+	err = json.Unmarshal([]byte(payload), &records)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding payload: %s", err))
+	require.Len(t, records, 2, "expected output and request ID records")
+	assert.Equal(t, "echo", records[0].Name)
+	assert.Equal(t, "out\n", records[0].Value)
+	assert.Equal(t, "request_id", records[1].Name)
+	assert.Equal(t, "request-1", records[1].Value)
+}
+
+func TestExecuteCompressed(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Exec.CompressThreshold = 1024
+	svc, mqttClient := newService(t, cfg)
+
+	cases := []struct {
+		desc       string
+		cmd        string
+		ctx        context.Context
+		out        string
+		compressed bool
+	}{
+		{desc: "execute with output below threshold", cmd: "echo,out", ctx: context.Background(), out: "out\n"},
+		{desc: "execute with output above threshold", cmd: "seq,1000", ctx: context.Background(), out: seq(1000), compressed: true},
+		{desc: "execute with request ID and output above threshold", cmd: "seq,1000", ctx: agent.WithRequestID(context.Background(), "request-1"), out: seq(1000), compressed: true},
+	}
+
+	for _, tc := range cases {
+		payload, err := svc.Execute(tc.ctx, "1", tc.cmd)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		msgs := mqttClient.Messages()
+		require.NotEmpty(t, msgs, fmt.Sprintf("%s: expected message to be published", tc.desc))
+		assert.Equal(t, payload, msgs[len(msgs)-1].Payload, fmt.Sprintf("%s: expected returned payload to be published", tc.desc))
+		if tc.compressed {
+			assert.Less(t, len(payload), len(tc.out), fmt.Sprintf("%s: expected compressed payload", tc.desc))
+		}
+
+		records, err := encoder.DecodeSenMLBatch([]byte(payload))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding payload: %s", tc.desc, err))
+		assert.Equal(t, tc.out, records[0].Value, fmt.Sprintf("%s: unexpected output", tc.desc))
+		assert.Equal(t, tc.compressed, records[0].Compressed, fmt.Sprintf("%s: unexpected compression", tc.desc))
+	}
+}
+
+func seq(n int) string {
+	var b strings.Builder
+	for i := 1; i <= n; i++ {
+		fmt.Fprintf(&b, "%d\n", i)
+	}
+	return b.String()
+}
+
+func TestHealthz(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Edgex.URL = "http://localhost:48090/api/v1/"
+	svc, mqttClient := newService(t, cfg)
+
+	hs := svc.Healthz()
+	assert.True(t, hs.Healthy(), fmt.Sprintf("expected healthy agent got %v", hs))
+	assert.Equal(t, agent.HealthPass, hs.Dependencies["mqtt"].Status, "expected MQTT to pass")
+	assert.Equal(t, agent.HealthPass, hs.Dependencies["edgex"].Status, "expected EdgeX to pass")
+
+	mqttClient.Disconnect(0)
+	hs = svc.Healthz()
+	assert.False(t, hs.Healthy(), "expected unhealthy agent with disconnected MQTT client")
+	assert.Equal(t, agent.HealthFail, hs.Dependencies["mqtt"].Status, "expected MQTT to fail")
+	assert.True(t, hs.Dependencies["mqtt"].Critical, "expected MQTT to be critical")
+}
+
+func TestUpdateConfig(t *testing.T) {
+	cfg := agent.Config{File: filepath.Join(t.TempDir(), "config.toml")}
+	cfg.Heartbeat.Interval = 10 * time.Second
+	cfg.Terminal.SessionTimeout = time.Minute
+	cfg.Log.Level = "info"
+	cfg.MQTT.URL = "localhost:1883"
+	cfg.MQTT.Username = "thing"
+	cfg.MQTT.Password = "key"
+	cfg.Channels = agent.ChanConfig{Control: "control", Data: "data"}
+	svc, _ := newService(t, cfg)
+
+	var patch agent.ConfigPatch
+	err := json.Unmarshal([]byte(`{"heartbeat":{"interval":"30s"}}`), &patch)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	err = svc.UpdateConfig(patch)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	want := cfg
+	want.Heartbeat.Interval = 30 * time.Second
+	assert.Equal(t, want, svc.Config(), "expected only heartbeat interval to change")
+
+	saved, err := agent.ReadConfig(cfg.File)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, want.Heartbeat, saved.Heartbeat, "expected updated config to be saved")
+	assert.Equal(t, want.MQTT.Password, saved.MQTT.Password, "expected MQTT password to be preserved")
+	assert.Equal(t, want.Channels, saved.Channels, "expected channels to be preserved")
+
+	err = svc.UpdateConfig(agent.ConfigPatch{})
+	assert.True(t, errors.Contains(err, agent.ErrMalformedEntity), fmt.Sprintf("expected %s got %s", agent.ErrMalformedEntity, err))
+}
+
+func TestUpdateConfigValidation(t *testing.T) {
+	cfg := validConfig()
+	cfg.File = filepath.Join(t.TempDir(), "config.toml")
+	svc, _ := newService(t, cfg)
+	err := agent.SaveConfig(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error saving config: %s", err))
+
+	cases := []struct {
+		desc  string
+		patch string
+	}{
+		{desc: "update with zero heartbeat interval", patch: `{"heartbeat":{"interval":0}}`},
+		{desc: "update with invalid QoS", patch: `{"mqtt":{"qos":3}}`},
+		{desc: "update with fractional session timeout", patch: `{"terminal":{"session_timeout":"1500ms"}}`},
+		{desc: "update with negative exec timeout", patch: `{"exec":{"timeout":"-1s"}}`},
+	}
+
+	for _, tc := range cases {
+		var patch agent.ConfigPatch
+		err := json.Unmarshal([]byte(tc.patch), &patch)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error: %s", tc.desc, err))
+		err = svc.UpdateConfig(patch)
+		assert.True(t, errors.Contains(err, agent.ErrInvalidConfig), fmt.Sprintf("%s: expected %s got %s", tc.desc, agent.ErrInvalidConfig, err))
+		assert.Equal(t, cfg, svc.Config(), fmt.Sprintf("%s: expected config not to change", tc.desc))
+		saved, err := agent.ReadConfig(cfg.File)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error reading config: %s", tc.desc, err))
+		assert.Empty(t, cfg.Diff(saved), fmt.Sprintf("%s: expected stored config not to change", tc.desc))
+	}
+}
+
+// syncBuffer is buffer safe for concurrent log writes.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf strings.Builder
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestUpdateConfigLogLevel(t *testing.T) {
+	cfg := validConfig()
+	cfg.Heartbeat.Interval = time.Second
+	cfg.Log.Level = "info"
+	var out syncBuffer
+	level := new(slog.LevelVar)
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: level}))
+	svc, err := agent.New(context.TODO(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, level)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+
+	logger.Debug("before update")
+	assert.NotContains(t, out.String(), "before update", "expected debug line to be suppressed")
+
+	// Logging goes on while the level changes.
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				logger.Debug("during update")
+			}
+		}
+	}()
+	debug := "debug"
+	err = svc.UpdateConfig(agent.ConfigPatch{Log: &agent.LogPatch{Level: &debug}})
+	close(done)
+	wg.Wait()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+
+	logger.Debug("after update")
+	assert.Contains(t, out.String(), "after update", "expected debug line to be logged")
+	assert.Equal(t, slog.LevelDebug, level.Level())
+
+	invalid := "verbose"
+	err = svc.UpdateConfig(agent.ConfigPatch{Log: &agent.LogPatch{Level: &invalid}})
+	assert.True(t, errors.Contains(err, agent.ErrInvalidConfig), fmt.Sprintf("expected %s got %s", agent.ErrInvalidConfig, err))
+	assert.Equal(t, slog.LevelDebug, level.Level(), "expected invalid level to be ignored")
+	assert.Equal(t, "debug", svc.Config().Log.Level)
+}
+
+func TestReload(t *testing.T) {
+	cfg := agent.Config{File: filepath.Join(t.TempDir(), "config.toml")}
+	cfg.Heartbeat.Interval = 10 * time.Second
+	cfg.Terminal.SessionTimeout = time.Minute
+	cfg.Log.Level = "info"
+	cfg.MQTT.URL = "localhost:1883"
+	cfg.Channels = agent.ChanConfig{Control: "control", Data: "data"}
+	level := new(slog.LevelVar)
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: level}))
+	svc, err := agent.New(context.TODO(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, agent.NewFileStore(cfg.File), mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, level)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+
+	reloaded := `
+[log]
+  level = "debug"
+
+[heartbeat]
+  interval = "30s"
+
+[exec]
+  allowlist = ["echo"]
+
+[mqtt]
+  url = "broker:1883"
+`
+	err = os.WriteFile(cfg.File, []byte(reloaded), 0o644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+	changes, err := svc.Reload()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	paths := []string{}
+	for _, ch := range changes {
+		paths = append(paths, ch.Path)
+	}
+	assert.Equal(t, []string{"exec.allowlist", "heartbeat.interval", "log.level"}, paths, "expected applied changes to be reported")
+
+	c := svc.Config()
+	assert.Equal(t, "debug", c.Log.Level)
+	assert.Equal(t, slog.LevelDebug, level.Level(), "expected log level to be applied")
+	assert.Equal(t, 30*time.Second, c.Heartbeat.Interval)
+	assert.Equal(t, []string{"echo"}, c.Exec.Allowlist)
+	assert.Equal(t, "localhost:1883", c.MQTT.URL, "expected MQTT config to be kept until restart")
+	_, err = svc.Execute(context.Background(), "1", "ls,-l")
+	assert.True(t, errors.Contains(err, agent.ErrCommandNotAllowed), fmt.Sprintf("expected %s got %s", agent.ErrCommandNotAllowed, err))
+
+	invalid := strings.ReplaceAll(reloaded, `"debug"`, `"verbose"`)
+	invalid = strings.ReplaceAll(invalid, `["echo"]`, `["ls"]`)
+	err = os.WriteFile(cfg.File, []byte(invalid), 0o644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+	changes, err = svc.Reload()
+	assert.True(t, errors.Contains(err, agent.ErrConfigRejected), fmt.Sprintf("expected %s got %s", agent.ErrConfigRejected, err))
+	assert.True(t, errors.Contains(err, agent.ErrInvalidConfig), fmt.Sprintf("expected %s got %s", agent.ErrInvalidConfig, err))
+	assert.Nil(t, changes, "expected no changes to be reported")
+	assert.Equal(t, c, svc.Config(), "expected invalid config not to be applied")
+	assert.Equal(t, slog.LevelDebug, level.Level(), "expected invalid level not to be applied")
+
+	err = os.Remove(cfg.File)
+	require.Nil(t, err, fmt.Sprintf("unexpected error removing config: %s", err))
+	_, err = svc.Reload()
+	assert.True(t, errors.Contains(err, agent.ErrConfigNotFound), fmt.Sprintf("expected %s got %s", agent.ErrConfigNotFound, err))
+}
+
+func TestControlVerbs(t *testing.T) {
+	cfg := agent.Config{File: filepath.Join(t.TempDir(), "config.toml")}
+	cfg.Heartbeat.Interval = 10 * time.Second
+	cfg.Terminal.SessionTimeout = time.Minute
+	cfg.Log.Level = "info"
+	cfg.MQTT.URL = "localhost:1883"
+	cfg.Channels = agent.ChanConfig{Control: "control", Data: "data"}
+	err := agent.SaveConfig(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error saving config: %s", err))
+
+	level := new(slog.LevelVar)
+	logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: level}))
+	mqttClient := mocks.NewMQTTClient()
+	broker := mocks.NewPubSub()
+	svc, err := agent.New(context.TODO(), mqttClient, agent.NewCredentials(cfg.MQTT), &cfg, agent.NewFileStore(cfg.File), mocks.NewEdgexClient(), broker, terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, level)
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+
+	err = broker.Deliver(&messaging.Message{Channel: "heartbeat.export.service"})
+	require.Nil(t, err, fmt.Sprintf("unexpected error registering service: %s", err))
+
+	var calls [][]string
+	err = svc.RegisterControl("greet", func(args []string) (string, error) {
+		calls = append(calls, args)
+		return "hello " + strings.Join(args, " "), nil
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error registering control: %s", err))
+
+	cases := []struct {
+		desc string
+		cmd  string
+		resp string
+		err  error
+	}{
+		{desc: "set level", cmd: "set-level debug", resp: "ok"},
+		{desc: "set level with comma", cmd: "set-level, warn", resp: "ok"},
+		{desc: "set level without level", cmd: "set-level", err: agent.ErrInvalidCommand},
+		{desc: "set invalid level", cmd: "set-level loud", err: agent.ErrInvalidConfig},
+		{desc: "reload", cmd: "reload", resp: "ok"},
+		{desc: "restart service", cmd: "restart export", resp: "ok"},
+		{desc: "restart unregistered service", cmd: "restart history", err: agent.ErrNoSuchService},
+		{desc: "restart without service", cmd: "restart", err: agent.ErrInvalidCommand},
+		{desc: "registered verb", cmd: "greet me twice", resp: "hello me twice"},
+		{desc: "edgex ping", cmd: "edgex-ping", resp: "body"},
+		{desc: "unknown verb", cmd: "shutdown now", err: agent.ErrUnknownControlVerb},
+		{desc: "empty command", cmd: " ", err: agent.ErrInvalidCommand},
+	}
+
+	for _, tc := range cases {
+		sent := len(mqttClient.Messages())
+		err := svc.Control("1", tc.cmd)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		if tc.err != nil {
+			assert.Len(t, mqttClient.Messages(), sent, fmt.Sprintf("%s: expected no response", tc.desc))
+			continue
+		}
+		msgs := mqttClient.Messages()[sent:]
+		require.Len(t, msgs, 1, fmt.Sprintf("%s: expected response to be published", tc.desc))
+		payload, ok := msgs[0].Payload.(string)
+		require.True(t, ok, fmt.Sprintf("%s: expected string payload", tc.desc))
+		rec, err := encoder.DecodeSenML([]byte(payload))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error decoding response: %s", tc.desc, err))
+		assert.Equal(t, tc.resp, rec.Value, fmt.Sprintf("%s: expected response %s got %s", tc.desc, tc.resp, rec.Value))
+	}
+
+	assert.Equal(t, [][]string{{"me", "twice"}}, calls, "expected registered handler to get args")
+	assert.Equal(t, "warn", svc.Config().Log.Level, "expected level to be saved and reloaded")
+	assert.Equal(t, []string{"commands.export.restart"}, broker.Published(), "expected restart to be requested from service")
+
+	err = svc.RegisterControl("", func([]string) (string, error) { return "", nil })
+	assert.True(t, errors.Contains(err, agent.ErrMalformedEntity), fmt.Sprintf("expected %s got %s", agent.ErrMalformedEntity, err))
+	err = svc.RegisterControl("greet", nil)
+	assert.True(t, errors.Contains(err, agent.ErrMalformedEntity), fmt.Sprintf("expected %s got %s", agent.ErrMalformedEntity, err))
+}
+
+// announcingBroker delivers heartbeat of the service on the heartbeat request.
+type announcingBroker struct {
+	*mocks.PubSub
+	heartbeat *messaging.Message
+}
+
+func (b announcingBroker) Publish(ctx context.Context, topic string, msg *messaging.Message) error {
+	if err := b.PubSub.Publish(ctx, topic, msg); err != nil {
+		return err
+	}
+	if topic != agent.HeartbeatRequest {
+		return nil
+	}
+	return b.Deliver(b.heartbeat)
+}
+
+func TestRefreshServices(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Heartbeat.Interval = 10 * time.Second
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	payload := fmt.Sprintf(`{"pid":%d}`, os.Getpid())
+	broker := announcingBroker{PubSub: mocks.NewPubSub(), heartbeat: &messaging.Message{Channel: "heartbeat.export.service", Payload: []byte(payload)}}
+	svc, err := agent.New(context.TODO(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, nil, mocks.NewEdgexClient(), broker, terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+
+	// Service stopped out of band reported the PID of the exited process.
+	cmd := exec.Command("true")
+	err = cmd.Run()
+	require.Nil(t, err, fmt.Sprintf("unexpected error running process: %s", err))
+	payload = fmt.Sprintf(`{"pid":%d}`, cmd.Process.Pid)
+	err = broker.Deliver(&messaging.Message{Channel: "heartbeat.duster.test", Payload: []byte(payload)})
+	require.Nil(t, err, fmt.Sprintf("unexpected error registering service: %s", err))
+	err = broker.Deliver(&messaging.Message{Channel: "heartbeat.adc.test"})
+	require.Nil(t, err, fmt.Sprintf("unexpected error registering service: %s", err))
+
+	names := func() []string {
+		names := []string{}
+		for _, info := range svc.Services() {
+			names = append(names, info.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"adc", "duster"}, names(), "expected services registered by heartbeats")
+
+	err = svc.RefreshServices()
+	require.Nil(t, err, fmt.Sprintf("unexpected error refreshing services: %s", err))
+	assert.Contains(t, broker.Published(), agent.HeartbeatRequest, "expected services to be asked for heartbeat")
+	assert.Equal(t, []string{"adc", "export"}, names(), "expected exited service removed and announced one registered")
+
+	_, err = svc.Service("duster")
+	assert.True(t, errors.Contains(err, agent.ErrNoSuchService), fmt.Sprintf("expected %s got %s", agent.ErrNoSuchService, err))
+}
+
+func TestFlushBatches(t *testing.T) {
+	cfg := agent.Config{}
+	cfg.Channels = agent.ChanConfig{Control: "control", Data: "data"}
+	cfg.MQTT.BatchWindow = time.Hour
+	cfg.MQTT.BatchTopics = []string{"channels/control/messages/res"}
+	svc, mqttClient := newService(t, cfg)
+
+	for i := 0; i < 3; i++ {
+		_, err := svc.Execute(context.Background(), "1", fmt.Sprintf("echo,%d", i))
+		require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	}
+	assert.Empty(t, mqttClient.Messages(), "expected responses to be batched")
+
+	err := svc.FlushBatches()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	msgs := mqttClient.Messages()
+	require.Len(t, msgs, 1, "expected responses to be published as a single message")
+	assert.Equal(t, "channels/control/messages/res", msgs[0].Topic, "expected batch to be published to the response topic")
+	p, err := senml.Decode([]byte(fmt.Sprint(msgs[0].Payload)), senml.JSON)
+	require.Nil(t, err, fmt.Sprintf("expected batch to be SenML pack: %s", err))
+	assert.Len(t, p.Records, 3, "expected batch to carry all the responses")
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+// slots bounds the number of commands running at once. The limit is passed
+// on every acquire, so changing it in the config takes effect for the
+// subsequent commands.
+type slots struct {
+	mu    sync.Mutex
+	used  int
+	freed chan struct{}
+}
+
+// acquire takes a slot if there are fewer than max used, waiting up to
+// timeout for one to be released otherwise. Zero max doesn't bound the
+// slots. Returns ErrTooManyExecutions if no slot is released in time.
+func (s *slots) acquire(max int, timeout time.Duration) error {
+	var expired <-chan time.Time
+	for {
+		s.mu.Lock()
+		if max <= 0 || s.used < max {
+			s.used++
+			// Releases signaled at once wake up a single command, which
+			// passes the signal on if there are slots left.
+			if max > 0 && s.used < max {
+				s.signal()
+			}
+			s.mu.Unlock()
+			return nil
+		}
+		freed := s.released()
+		s.mu.Unlock()
+
+		if timeout <= 0 {
+			return ErrTooManyExecutions
+		}
+		if expired == nil {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-freed:
+		case <-expired:
+			return ErrTooManyExecutions
+		}
+	}
+}
+
+// release releases the slot, waking up one of the waiting commands.
+func (s *slots) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used--
+	s.signal()
+}
+
+// signal wakes up one of the waiting commands, it must be called with s.mu
+// held.
+func (s *slots) signal() {
+	select {
+	case s.released() <- struct{}{}:
+	default:
+	}
+}
+
+// released returns channel signaling released slot, it must be called with
+// s.mu held.
+func (s *slots) released() chan struct{} {
+	if s.freed == nil {
+		s.freed = make(chan struct{}, 1)
+	}
+	return s.freed
+}
@@ -0,0 +1,72 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ConfigStore persists the agent config, so it survives restart.
+type ConfigStore interface {
+	// Load returns the stored config. Returns ErrConfigNotFound if no config
+	// is stored.
+	Load() (Config, error)
+
+	// Save stores the config, replacing the stored one.
+	Save(Config) error
+}
+
+var (
+	_ ConfigStore = (*fileStore)(nil)
+	_ ConfigStore = (*memoryStore)(nil)
+)
+
+// fileStore stores the config in the TOML file, with MQTT credentials kept
+// in the credentials file if it's set.
+type fileStore struct {
+	file string
+}
+
+// NewFileStore returns the store keeping the config in the file.
+func NewFileStore(file string) ConfigStore {
+	return fileStore{file: file}
+}
+
+func (fs fileStore) Load() (Config, error) {
+	return ReadConfig(fs.file)
+}
+
+func (fs fileStore) Save(c Config) error {
+	c.File = fs.file
+	return SaveConfig(c)
+}
+
+// memoryStore keeps the config in memory, so it's lost on restart.
+type memoryStore struct {
+	mu     sync.Mutex
+	config *Config
+}
+
+// NewMemoryStore returns the store keeping the config in memory, useful for
+// testing and for devices without writable storage.
+func NewMemoryStore() ConfigStore {
+	return &memoryStore{}
+}
+
+func (ms *memoryStore) Load() (Config, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.config == nil {
+		return Config{}, wrap(ErrConfigNotFound, fmt.Errorf("config isn't stored"))
+	}
+	return *ms.config, nil
+}
+
+func (ms *memoryStore) Save(c Config) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.config = &c
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package agent_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"testing"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/andychao217/agent/pkg/terminal"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	cases := []struct {
+		desc  string
+		store agent.ConfigStore
+		file  string
+	}{
+		{desc: "file store", store: agent.NewFileStore(file), file: file},
+		{desc: "memory store", store: agent.NewMemoryStore()},
+	}
+
+	for _, tc := range cases {
+		_, err := tc.store.Load()
+		assert.True(t, errors.Contains(err, agent.ErrConfigNotFound), fmt.Sprintf("%s: expected %s got %s", tc.desc, agent.ErrConfigNotFound, err))
+
+		cfg := validConfig()
+		cfg.File = tc.file
+		cfg.MQTT.Username = "thing"
+		cfg.MQTT.Password = "key"
+		err = tc.store.Save(cfg)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error saving config: %s", tc.desc, err))
+		c, err := tc.store.Load()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error loading config: %s", tc.desc, err))
+		// Lists are loaded from the file empty rather than nil.
+		assert.Empty(t, cfg.Diff(c), fmt.Sprintf("%s: expected saved config to be loaded", tc.desc))
+
+		cfg.Server.Port = "9999"
+		err = tc.store.Save(cfg)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error saving config: %s", tc.desc, err))
+		c, err = tc.store.Load()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error loading config: %s", tc.desc, err))
+		assert.Equal(t, "9999", c.Server.Port, fmt.Sprintf("%s: expected config to be replaced", tc.desc))
+	}
+}
+
+func TestFileStoreFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.toml")
+	store := agent.NewFileStore(file)
+
+	cfg := validConfig()
+	cfg.File = filepath.Join(t.TempDir(), "other.toml")
+	err := store.Save(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error saving config: %s", err))
+
+	c, err := agent.ReadConfig(file)
+	require.Nil(t, err, fmt.Sprintf("expected config to be saved to the store file: %s", err))
+	assert.Equal(t, file, c.File, "expected file of the store to be saved")
+}
+
+func TestAddConfigStore(t *testing.T) {
+	store := agent.NewMemoryStore()
+	svc := newStoreService(t, store)
+
+	cfg := validConfig()
+	cfg.Server.Port = "9999"
+	err := svc.AddConfig(cfg)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	c, err := store.Load()
+	require.Nil(t, err, fmt.Sprintf("unexpected error loading config: %s", err))
+	assert.Equal(t, "9999", c.Server.Port, "expected config to be saved to the store")
+
+	level := "debug"
+	err = svc.UpdateConfig(agent.ConfigPatch{Log: &agent.LogPatch{Level: &level}})
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	c, err = store.Load()
+	require.Nil(t, err, fmt.Sprintf("unexpected error loading config: %s", err))
+	assert.Equal(t, level, c.Log.Level, "expected updated config to be saved to the store")
+
+	changes, err := svc.Reload()
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Empty(t, changes, "expected no changes reloading the saved config")
+
+	svc = newStoreService(t, nil)
+	err = svc.AddConfig(cfg)
+	assert.NotNil(t, err, "expected error adding config without store")
+	_, err = svc.Reload()
+	assert.True(t, errors.Contains(err, agent.ErrConfigNotFound), fmt.Sprintf("expected %s got %s", agent.ErrConfigNotFound, err))
+}
+
+func newStoreService(t *testing.T, store agent.ConfigStore) agent.Service {
+	cfg := validConfig()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	svc, err := agent.New(context.TODO(), mocks.NewMQTTClient(), agent.NewCredentials(cfg.MQTT), &cfg, store, mocks.NewEdgexClient(), mocks.NewPubSub(), terminal.NewSessionManager(terminal.Metrics{}, logger), agent.MQTTMetrics{}, logger, new(slog.LevelVar))
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating service: %s", err))
+	return svc
+}
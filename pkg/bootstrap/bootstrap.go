@@ -4,35 +4,143 @@
 package bootstrap
 
 import (
-	"crypto/tls"
-	"crypto/x509"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
+	"reflect"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/andychao217/agent/internal/tlsconfig"
 	"github.com/andychao217/agent/pkg/agent"
 
 	"github.com/andychao217/magistrala/bootstrap"
 	errors "github.com/andychao217/magistrala/pkg/errors"
+	"github.com/go-kit/kit/metrics"
 	export "github.com/mainflux/export/pkg/config"
+	"github.com/pelletier/go-toml"
 )
 
-const exportConfigFile = "/configs/export/config.toml"
+const (
+	exportConfigFile = "/configs/export/config.toml"
+	etagFileExt      = ".etag"
+	checksumFileExt  = ".sha256"
+	// SignatureHeader carries base64 encoded Ed25519 signature of the
+	// config response body.
+	SignatureHeader = "X-Config-Signature"
+)
+
+// ErrConfigUnchanged indicates that the config hasn't changed since the last
+// bootstrap, so the local config is kept.
+var ErrConfigUnchanged = errors.New("bootstrap config unchanged")
+
+// ErrConfigRejected indicates that the bootstrap server refused the bootstrap
+// ID or key, so the request isn't retried.
+var ErrConfigRejected = errors.New("bootstrap server rejected config request, check bootstrap ID and key")
+
+// ErrInvalidSignature indicates that the config isn't signed by the trusted
+// key, so it's rejected.
+var ErrInvalidSignature = errors.New("bootstrap config signature missing or invalid")
+
+// ErrChannelCollision indicates that the control and data channels of the
+// config are the same channel, so commands and telemetry can't be told apart.
+var ErrChannelCollision = errors.New("bootstrap config control and data channels collide")
+
+// ErrMixedExportCredentials indicates that the export config client
+// credentials aren't a complete inline certificate and key pair, nor a
+// complete pair of their file paths.
+var ErrMixedExportCredentials = errors.New("bootstrap export config mixes inline and file client credentials")
+
+// ErrInsecureKeyFile indicates that the bootstrap key file is accessible by
+// other users, so the key is refused.
+var ErrInsecureKeyFile = errors.New("bootstrap key file is accessible by other users")
+
+// Sources of the device config.
+const (
+	// SourceHTTP fetches the config from the bootstrap server.
+	SourceHTTP = "http"
+	// SourceFile reads the config from LocalConfigPath.
+	SourceFile = "file"
+)
+
+var (
+	errInvalidProxyURL = errors.New("invalid bootstrap proxy URL")
+	errInvalidSource   = errors.New("invalid bootstrap config source")
+	errReadingKeyFile  = errors.New("failed to read bootstrap key file")
+)
 
 // Config represents the parameters for bootstrapping.
 type Config struct {
-	URL           string
-	ID            string
-	Key           string
+	URL string
+	ID  string
+	Key string
+	// KeyFile, if set, holds the bootstrap key instead of Key, so the key
+	// isn't kept in the environment. It's read on every fetch and mustn't
+	// be accessible by other users.
+	KeyFile       string
 	Retries       string
 	RetryDelaySec string
 	Encrypt       string
 	SkipTLS       bool
+	// CA holds PEM encoded certificates of the private CA trusted in
+	// addition to the system certificate pool.
+	CA []byte
+	// FallbackCA holds PEM encoded certificates trusted instead of the
+	// system certificate pool if it's empty.
+	FallbackCA []byte
+	// MinTLSVersion is the minimum TLS version of the bootstrap server,
+	// such as tls.VersionTLS12. Go default if zero.
+	MinTLSVersion uint16
+	// CipherSuites, if set, restricts the TLS 1.2 cipher suites of the
+	// bootstrap server.
+	CipherSuites []uint16
+	// Fallback provides heartbeat interval, terminal session timeout and
+	// MQTT credentials file if the fetched config lacks them.
+	Fallback agent.Config
+	// DryRun fetches and parses the config without saving it.
+	DryRun bool
+	// ForceExportUpdate replaces the export config even if it was edited
+	// locally.
+	ForceExportUpdate bool
+	// ExportConfigPath is the export config file used unless the fetched
+	// config sets it. Defaults to /configs/export/config.toml.
+	ExportConfigPath string
+	// ProxyURL of HTTP or SOCKS5 proxy used to fetch the config, taking
+	// precedence over HTTP_PROXY, HTTPS_PROXY and NO_PROXY env vars.
+	ProxyURL string
+	// Source of the device config, SourceHTTP or SourceFile. Empty source
+	// reads the config from LocalConfigPath if it's set and Retries is
+	// zero, and fetches it from the bootstrap server otherwise.
+	Source string
+	// LocalConfigPath is the JSON file holding device config in the format
+	// served by the bootstrap server, e.g. on a provisioning USB stick.
+	LocalConfigPath string
+	// TrustedPubKey, if set, must verify the signature of the config
+	// fetched from the bootstrap server, sent in SignatureHeader. The
+	// local config isn't signed.
+	TrustedPubKey ed25519.PublicKey
+	// Headers are added to the requests to the bootstrap server, e.g. the
+	// ones required by the API gateway in front of it. They replace the
+	// Authorization header computed from Key only if they set it.
+	Headers map[string]string
+	// RetriesCounter, if set, counts the retries consumed fetching the
+	// config.
+	RetriesCounter metrics.Counter
+	// Store persists the agent config. Defaults to the file store of the
+	// agent config file.
+	Store agent.ConfigStore
 }
 
 type ServicesConfig struct {
@@ -54,58 +162,310 @@ type deviceConfig struct {
 	SvcsConf         ServicesConfig      `json:"-"`
 }
 
-// Bootstrap - Retrieve device config.
+// Outcomes of the bootstrap.
+const (
+	// OutcomeSaved means the fetched config was saved.
+	OutcomeSaved = "saved"
+	// OutcomeFetched means the config was fetched in the dry run, but not
+	// saved.
+	OutcomeFetched = "fetched"
+	// OutcomeUnchanged means the config hasn't changed since the last
+	// bootstrap.
+	OutcomeUnchanged = "unchanged"
+	// OutcomeDisabled means bootstrapping is disabled.
+	OutcomeDisabled = "disabled"
+	// OutcomeExhausted means the retries are exhausted, so the local config
+	// is used.
+	OutcomeExhausted = "exhausted"
+	// OutcomeFailed means the bootstrap failed with an error.
+	OutcomeFailed = "failed"
+)
+
+// Result reports how the bootstrap went.
+type Result struct {
+	// Attempts is the number of config requests sent to the bootstrap
+	// server, zero if the config was read from the local file.
+	Attempts int
+	// Outcome is one of the Outcome constants.
+	Outcome string
+}
+
+// Retries returns the number of the retries consumed.
+func (r Result) Retries() int {
+	return max(r.Attempts-1, 0)
+}
+
+// Bootstrap - Retrieve device config. Returns ErrConfigUnchanged if the
+// config hasn't changed since the last bootstrap.
 func Bootstrap(cfg Config, logger *slog.Logger, file string) error {
-	retries, err := strconv.ParseUint(cfg.Retries, 10, 64)
+	_, err := BootstrapWithResult(cfg, logger, file)
+	return err
+}
+
+// BootstrapWithResult retrieves device config the same way Bootstrap does,
+// and reports the number of attempts made and the outcome.
+func BootstrapWithResult(cfg Config, logger *slog.Logger, file string) (Result, error) {
+	if cfg.DryRun {
+		_, res, err := dryRun(cfg, logger, file)
+		return res, err
+	}
+
+	f, res, err := fetch(cfg, logger, file)
+	if err != nil || res.Outcome != OutcomeFetched {
+		return res, err
+	}
+
+	saveExportConfig(f.export, cfg.ForceExportUpdate, logger)
+
+	if err := cfg.store(file).Save(f.config); err != nil {
+		res.Outcome = OutcomeFailed
+		return res, err
+	}
+	if err := saveETag(file, f.etag); err != nil {
+		res.Outcome = OutcomeFailed
+		return res, err
+	}
+	res.Outcome = OutcomeSaved
+	return res, nil
+}
+
+// key returns the bootstrap key, read from KeyFile if it's set. Returns
+// ErrInsecureKeyFile if the file is accessible by other users.
+func (cfg Config) key() (string, error) {
+	if cfg.KeyFile == "" {
+		return cfg.Key, nil
+	}
+	fi, err := os.Stat(cfg.KeyFile)
+	if err != nil {
+		return "", errors.Wrap(errReadingKeyFile, err)
+	}
+	if perm := fi.Mode().Perm(); perm&0o007 != 0 {
+		return "", errors.Wrap(ErrInsecureKeyFile, fmt.Errorf("%s has permissions %04o, expected no access by others, e.g. 0600", cfg.KeyFile, perm))
+	}
+	data, err := os.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return "", errors.Wrap(errReadingKeyFile, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// store returns the store of the agent config saved in file.
+func (cfg Config) store(file string) agent.ConfigStore {
+	if cfg.Store != nil {
+		return cfg.Store
+	}
+	return agent.NewFileStore(file)
+}
+
+// BootstrapDryRun retrieves and parses device config the same way Bootstrap
+// does, but only logs the configs, along with the changes of the agent
+// config saved in file, instead of saving them. It returns zero
+// config if bootstrapping is disabled or the retries are exhausted, and
+// ErrConfigUnchanged if the config is unchanged.
+func BootstrapDryRun(cfg Config, logger *slog.Logger, file string) (agent.Config, error) {
+	c, _, err := dryRun(cfg, logger, file)
+	return c, err
+}
+
+func dryRun(cfg Config, logger *slog.Logger, file string) (agent.Config, Result, error) {
+	f, res, err := fetch(cfg, logger, file)
+	if err != nil || res.Outcome != OutcomeFetched {
+		return agent.Config{}, res, err
+	}
+
+	logger.Info("Dry run, agent config not saved", slog.String("file", file), slog.Any("config", f.config.Redacted()))
+	// Missing or unreadable config is reported as replaced entirely.
+	current, err := cfg.store(file).Load()
 	if err != nil {
-		return errors.New(fmt.Sprintf("Invalid BOOTSTRAP_RETRIES value: %s", err))
+		current = agent.Config{}
+	}
+	logger.Info("Dry run, agent config changes", slog.String("file", file), slog.Any("changes", current.Diff(f.config)))
+	logger.Info("Dry run, export config not saved", slog.String("file", f.export.File), slog.Any("config", redactExportConfig(f.export)))
+
+	return f.config, res, nil
+}
+
+// BootstrapWatch fetches device config from the bootstrap server every
+// interval until the context is cancelled, and calls apply with the agent
+// config if it changed since the last fetch. Config matching the ETag of the
+// last applied one isn't sent by the server, so it isn't fetched again. If
+// apply fails, the config is applied again on the next fetch. Non-positive
+// interval disables watching.
+func BootstrapWatch(ctx context.Context, cfg Config, interval time.Duration, apply func(agent.Config) error, logger *slog.Logger, file string) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	tlsOpts := tlsOptions(cfg, logger)
+	etag := readETag(file)
+	var last *agent.Config
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		key, err := cfg.key()
+		if err != nil {
+			logger.Warn("Failed to read bootstrap key", slog.Any("error", err))
+			continue
+		}
+		dc, newETag, err := getConfig(cfg.ID, key, cfg.URL, etag, cfg.ProxyURL, tlsOpts, cfg.TrustedPubKey, cfg.Headers, logger)
+		if errors.Contains(err, ErrConfigUnchanged) {
+			continue
+		}
+		if err != nil {
+			logger.Warn("Failed to fetch bootstrap config", slog.Any("error", err))
+			continue
+		}
+		f, _, err := build(cfg, dc, newETag, file, logger)
+		if err != nil {
+			logger.Warn("Failed to build bootstrap config", slog.Any("error", err))
+			continue
+		}
+		// Servers not tagging config send it on every fetch.
+		if last != nil && reflect.DeepEqual(*last, f.config) {
+			continue
+		}
+		logger.Info("Bootstrap config changed, applying it")
+		if err := apply(f.config); err != nil {
+			logger.Warn("Failed to apply bootstrap config", slog.Any("error", err))
+			continue
+		}
+		last = &f.config
+		etag = newETag
+		saveExportConfig(f.export, cfg.ForceExportUpdate, logger)
+		if err := saveETag(file, etag); err != nil {
+			logger.Warn("Failed to save bootstrap config ETag", slog.Any("error", err))
+		}
+	}
+}
+
+// fetched holds the configs built from the fetched device config.
+type fetched struct {
+	config agent.Config
+	export export.Config
+	etag   string
+}
+
+// dataChannels returns IDs of the data channels by names set in their
+// "name" metadata. Data channels without a name are left out.
+func dataChannels(channels []bootstrap.Channel) map[string]string {
+	var named map[string]string
+	for _, ch := range channels {
+		name, ok := ch.Metadata["name"].(string)
+		if ch.Metadata["type"] != "data" || !ok || name == "" {
+			continue
+		}
+		if named == nil {
+			named = make(map[string]string)
+		}
+		named[name] = ch.ID
+	}
+	return named
+}
+
+// fetch retrieves device config and builds agent and export configs from it.
+// The outcome isn't OutcomeFetched if bootstrapping is disabled or the retries
+// are exhausted, so the local config is used.
+func fetch(cfg Config, logger *slog.Logger, file string) (fetched, Result, error) {
+	res := Result{Outcome: OutcomeFailed}
+	if cfg.Source != "" && cfg.Source != SourceHTTP && cfg.Source != SourceFile {
+		return fetched{}, res, errors.Wrap(errInvalidSource, fmt.Errorf("unknown source %q", cfg.Source))
+	}
+
+	retries, err := strconv.ParseUint(cfg.Retries, 10, 64)
+	if err != nil && cfg.Source != SourceFile {
+		return fetched{}, res, errors.New(fmt.Sprintf("Invalid BOOTSTRAP_RETRIES value: %s", err))
+	}
+
+	if cfg.Source == SourceFile || (cfg.Source == "" && retries == 0 && cfg.LocalConfigPath != "") {
+		logger.Info("Reading config", slog.String("file", cfg.LocalConfigPath))
+		dc, err := readConfig(cfg.LocalConfigPath)
+		if err != nil {
+			return fetched{}, res, err
+		}
+		f, ok, err := build(cfg, dc, "", file, logger)
+		return f, fetchedResult(res, ok, err), err
 	}
 
 	if retries == 0 {
 		logger.Info("No bootstrapping, environment variables will be used")
-		return nil
+		res.Outcome = OutcomeDisabled
+		return fetched{}, res, nil
 	}
 
 	retryDelaySec, err := strconv.ParseUint(cfg.RetryDelaySec, 10, 64)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Invalid BOOTSTRAP_RETRY_DELAY_SECONDS value: %s", err))
+		return fetched{}, res, errors.New(fmt.Sprintf("Invalid BOOTSTRAP_RETRY_DELAY_SECONDS value: %s", err))
+	}
+
+	key, err := cfg.key()
+	if err != nil {
+		return fetched{}, res, err
 	}
 
 	logger.Info("Requesting config", slog.String("config_id", cfg.ID), slog.String("config_url", cfg.URL))
 
+	localETag := readETag(file)
 	dc := deviceConfig{}
+	etag := ""
 
 	for i := 0; i < int(retries); i++ {
-		dc, err = getConfig(cfg.ID, cfg.Key, cfg.URL, cfg.SkipTLS, logger)
+		if i > 0 && cfg.RetriesCounter != nil {
+			cfg.RetriesCounter.Add(1)
+		}
+		res.Attempts++
+		dc, etag, err = getConfig(cfg.ID, key, cfg.URL, localETag, cfg.ProxyURL, tlsOptions(cfg, logger), cfg.TrustedPubKey, cfg.Headers, logger)
 		if err == nil {
 			break
 		}
+		if errors.Contains(err, ErrConfigUnchanged) {
+			logger.Info("Config unchanged, continuing with local config")
+			res.Outcome = OutcomeUnchanged
+			return fetched{}, res, err
+		}
 		logger.Error("Fetching bootstrap failed", slog.Any("error", err))
+		// Retrying won't fix the response missing the required fields or
+		// the signature, nor the rejected bootstrap ID or key.
+		if errors.Contains(err, agent.ErrMalformedEntity) || errors.Contains(err, ErrConfigRejected) || errors.Contains(err, ErrInvalidSignature) {
+			return fetched{}, res, err
+		}
 
 		logger.Debug("Retrying...", slog.Uint64("retries_remaining", retries), slog.Uint64("delay", retryDelaySec))
 		time.Sleep(time.Duration(retryDelaySec) * time.Second)
 		if i == int(retries)-1 {
 			logger.Warn("Retries exhausted")
 			logger.Info("Continuing with local config")
-			return nil
+			res.Outcome = OutcomeExhausted
+			return fetched{}, res, nil
 		}
 	}
 
-	if len(dc.MainfluxChannels) < 2 {
-		return agent.ErrMalformedEntity
-	}
+	f, ok, err := build(cfg, dc, etag, file, logger)
+	return f, fetchedResult(res, ok, err), err
+}
 
-	ctrlChan := dc.MainfluxChannels[0].ID
-	dataChan := dc.MainfluxChannels[1].ID
-	if dc.MainfluxChannels[0].Metadata["type"] == "data" {
-		ctrlChan = dc.MainfluxChannels[1].ID
-		dataChan = dc.MainfluxChannels[0].ID
+// fetchedResult sets the outcome of building the configs.
+func fetchedResult(res Result, ok bool, err error) Result {
+	if err == nil && ok {
+		res.Outcome = OutcomeFetched
 	}
+	return res
+}
+
+// build builds agent and export configs from the device config.
+func build(cfg Config, dc deviceConfig, etag, file string, logger *slog.Logger) (fetched, bool, error) {
+	ctrlChan, dataChan := dc.channels()
 
 	sc := dc.SvcsConf.Agent.Server
 	cc := agent.ChanConfig{
-		Control: ctrlChan,
-		Data:    dataChan,
+		Control:      ctrlChan,
+		Data:         dataChan,
+		DataChannels: dataChannels(dc.MainfluxChannels),
 	}
 	ec := dc.SvcsConf.Agent.Edgex
 	lc := dc.SvcsConf.Agent.Log
@@ -116,113 +476,358 @@ func Bootstrap(cfg Config, logger *slog.Logger, file string) error {
 	mc.ClientCert = dc.ClientCert
 	mc.ClientKey = dc.ClientKey
 	mc.CaCert = dc.CaCert
+	// Credentials are kept apart from the config file if requested.
+	if mc.CredentialsFile == "" {
+		mc.CredentialsFile = cfg.Fallback.MQTT.CredentialsFile
+	}
 
 	hc := dc.SvcsConf.Agent.Heartbeat
 	tc := dc.SvcsConf.Agent.Terminal
-	c := agent.NewConfig(sc, cc, ec, lc, mc, hc, tc, file)
+	xc := dc.SvcsConf.Agent.Exec
+	c := agent.NewConfig(sc, cc, ec, lc, mc, hc, tc, xc, file)
+	if c.Heartbeat.Interval <= 0 {
+		c.Heartbeat.Interval = cfg.Fallback.Heartbeat.Interval
+	}
+	if c.Terminal.SessionTimeout <= 0 {
+		c.Terminal.SessionTimeout = cfg.Fallback.Terminal.SessionTimeout
+	}
+	if err := c.Validate(); err != nil {
+		return fetched{}, false, err
+	}
 
-	dc.SvcsConf.Export = fillExportConfig(dc.SvcsConf.Export, c)
+	econf, err := fillExportConfig(dc.SvcsConf.Export, c, logger)
+	if err != nil {
+		return fetched{}, false, err
+	}
+	if econf.File == "" {
+		econf.File = cfg.ExportConfigPath
+	}
+	if econf.File == "" {
+		econf.File = exportConfigFile
+	}
 
-	saveExportConfig(dc.SvcsConf.Export, logger)
+	return fetched{config: c, export: econf, etag: etag}, true, nil
+}
 
-	return agent.SaveConfig(c)
+// etagFile returns the file keeping ETag of the config saved to file.
+func etagFile(file string) string {
+	return file + etagFileExt
 }
 
-// if export config isnt filled use agent configs.
-func fillExportConfig(econf export.Config, c agent.Config) export.Config {
+// readETag returns ETag of the config saved to file. The ETag is ignored if
+// the config is missing, so the config is fetched again.
+func readETag(file string) string {
+	if _, err := os.Stat(file); err != nil {
+		return ""
+	}
+	etag, err := os.ReadFile(etagFile(file))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(etag))
+}
+
+// saveETag saves ETag of the config saved to file, removing the stale one if
+// the server didn't send it.
+func saveETag(file, etag string) error {
+	if etag == "" {
+		if err := os.Remove(etagFile(file)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(etagFile(file), []byte(etag), 0o644)
+}
+
+// redactExportConfig returns copy of the export config without the secrets,
+// for logging.
+func redactExportConfig(econf export.Config) export.Config {
+	if econf.MQTT.Password != "" {
+		econf.MQTT.Password = agent.Redacted
+	}
+	if econf.MQTT.ClientCertKey != "" {
+		econf.MQTT.ClientCertKey = agent.Redacted
+	}
+	if econf.Server.CachePass != "" {
+		econf.Server.CachePass = agent.Redacted
+	}
+	return econf
+}
+
+// if export config isnt filled use agent configs. Client credentials are
+// filled as the pair, either the inline certificate and key or their paths,
+// the same way the agent uses them. Routes that are identical once their MQTT
+// topic is filled are merged.
+func fillExportConfig(econf export.Config, c agent.Config, logger *slog.Logger) (export.Config, error) {
 	if econf.MQTT.Username == "" {
 		econf.MQTT.Username = c.MQTT.Username
 	}
 	if econf.MQTT.Password == "" {
 		econf.MQTT.Password = c.MQTT.Password
 	}
-	if econf.MQTT.ClientCert == "" {
-		econf.MQTT.ClientCert = c.MQTT.ClientCert
-	}
-	if econf.MQTT.ClientCertKey == "" {
-		econf.MQTT.ClientCertKey = c.MQTT.ClientKey
+	if err := validateExportCredentials(econf.MQTT); err != nil {
+		return export.Config{}, err
 	}
-	if econf.MQTT.ClientCertPath == "" {
-		econf.MQTT.ClientCertPath = c.MQTT.CertPath
-	}
-	if econf.MQTT.ClientPrivKeyPath == "" {
-		econf.MQTT.ClientPrivKeyPath = c.MQTT.PrivKeyPath
+	// Valid credentials are either unset or the complete pair.
+	if econf.MQTT.ClientCert == "" && econf.MQTT.ClientCertPath == "" {
+		// Agent reads the certificate files in favour of the inline one.
+		if c.MQTT.CertPath != "" {
+			econf.MQTT.ClientCertPath = c.MQTT.CertPath
+			econf.MQTT.ClientPrivKeyPath = c.MQTT.PrivKeyPath
+		} else {
+			econf.MQTT.ClientCert = c.MQTT.ClientCert
+			econf.MQTT.ClientCertKey = c.MQTT.ClientKey
+		}
 	}
-	for i, route := range econf.Routes {
+	// Routes resolving to the same one would forward each message twice,
+	// so only the first of them is kept.
+	var routes []export.Route
+	for _, route := range econf.Routes {
 		if route.MqttTopic == "" {
-			econf.Routes[i].MqttTopic = "channels/" + c.Channels.Data + "/messages"
+			route.MqttTopic = "channels/" + c.Channels.Data + "/messages"
+		}
+		if slices.Contains(routes, route) {
+			logger.Warn("Dropped duplicate export route",
+				slog.String("nats_topic", route.NatsTopic), slog.String("mqtt_topic", route.MqttTopic), slog.String("subtopic", route.SubTopic))
+			continue
 		}
+		routes = append(routes, route)
 	}
-	return econf
+	econf.Routes = routes
+	return econf, nil
 }
 
-func saveExportConfig(econf export.Config, logger *slog.Logger) {
-	if econf.File == "" {
-		econf.File = exportConfigFile
+// validateExportCredentials returns ErrMixedExportCredentials unless the
+// client credentials are unset, or are either the complete inline pair or
+// the complete pair of paths.
+func validateExportCredentials(mc export.MQTT) error {
+	inline := mc.ClientCert != "" || mc.ClientCertKey != ""
+	paths := mc.ClientCertPath != "" || mc.ClientPrivKeyPath != ""
+	switch {
+	case inline && paths:
+		return errors.Wrap(agent.ErrMalformedEntity, errors.Wrap(ErrMixedExportCredentials, fmt.Errorf("both inline client certificate and its paths are set")))
+	case inline && (mc.ClientCert == "" || mc.ClientCertKey == ""):
+		return errors.Wrap(agent.ErrMalformedEntity, errors.Wrap(ErrMixedExportCredentials, fmt.Errorf("inline client certificate and key must be set together")))
+	case paths && (mc.ClientCertPath == "" || mc.ClientPrivKeyPath == ""):
+		return errors.Wrap(agent.ErrMalformedEntity, errors.Wrap(ErrMixedExportCredentials, fmt.Errorf("client certificate and private key paths must be set together")))
 	}
-	exConfFileExist := false
-	if _, err := os.Stat(econf.File); err == nil {
-		exConfFileExist = true
-		logger.Info("Export config file exists", slog.Any("file", econf.File))
+	return nil
+}
+
+// saveExportConfig saves the export config unless the saved one is equal.
+// The differing saved config is replaced only if it's the one written by the
+// previous bootstrap, so local edits are kept unless force is set.
+func saveExportConfig(econf export.Config, force bool, logger *slog.Logger) {
+	data, err := toml.Marshal(econf)
+	if err != nil {
+		logger.Warn("Failed to encode export config", slog.Any("error", err))
+		return
 	}
-	if !exConfFileExist {
+
+	saved, err := os.ReadFile(econf.File)
+	switch {
+	case os.IsNotExist(err):
 		logger.Info("Saving export config file", slog.Any("file", econf.File))
-		if err := export.Save(econf); err != nil {
-			logger.Warn("Failed to save export config file", slog.Any("error", err))
-		}
+	case err == nil && bytes.Equal(saved, data):
+		logger.Info("Export config file is up to date", slog.Any("file", econf.File))
+		// Configs saved before checksums were kept are recognized from now on.
+		saveChecksum(econf.File, data, logger)
+		return
+	case force:
+		logger.Info("Overwriting export config file", slog.Any("file", econf.File))
+	case err == nil && checksum(saved) == readChecksum(econf.File):
+		logger.Info("Updating export config file", slog.Any("file", econf.File))
+	default:
+		logger.Warn("Export config file changed locally, keeping it", slog.Any("file", econf.File))
+		return
 	}
+
+	if err := export.Save(econf); err != nil {
+		logger.Warn("Failed to save export config file", slog.Any("error", err))
+		return
+	}
+	saveChecksum(econf.File, data, logger)
 }
 
-func getConfig(bsID, bsKey, bsSvrURL string, skipTLS bool, logger *slog.Logger) (deviceConfig, error) {
-	// Get the SystemCertPool, continue with an empty pool on error.
-	rootCAs, err := x509.SystemCertPool()
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// readChecksum returns checksum of the export config saved by the previous
+// bootstrap.
+func readChecksum(file string) string {
+	sum, err := os.ReadFile(file + checksumFileExt)
 	if err != nil {
-		logger.Error(err.Error())
+		return ""
+	}
+	return strings.TrimSpace(string(sum))
+}
+
+func saveChecksum(file string, data []byte, logger *slog.Logger) {
+	if err := os.WriteFile(file+checksumFileExt, []byte(checksum(data)), 0o644); err != nil {
+		logger.Warn("Failed to save export config checksum", slog.Any("error", err))
+	}
+}
+
+// tlsOptions returns TLS options of the connection to the bootstrap server.
+func tlsOptions(cfg Config, logger *slog.Logger) tlsconfig.Options {
+	return tlsconfig.Options{
+		SkipVerify:   cfg.SkipTLS,
+		CA:           cfg.CA,
+		FallbackCA:   cfg.FallbackCA,
+		Logger:       logger,
+		MinVersion:   cfg.MinTLSVersion,
+		CipherSuites: cfg.CipherSuites,
 	}
-	if rootCAs == nil {
-		rootCAs = x509.NewCertPool()
+}
+
+// getConfig fetches device config, sending the ETag of the local config if
+// any. It returns the config and its ETag, or ErrConfigUnchanged if the
+// config matches the ETag. The proxy is taken from the environment unless
+// proxyURL is set. If pubKey is set, the config must be signed with it.
+func getConfig(bsID, bsKey, bsSvrURL, etag, proxyURL string, tlsOpts tlsconfig.Options, pubKey ed25519.PublicKey, headers map[string]string, logger *slog.Logger) (deviceConfig, string, error) {
+	config, err := tlsconfig.Build(tlsOpts)
+	if err != nil {
+		return deviceConfig{}, "", err
 	}
-	// Trust the augmented cert pool in our client.
-	config := &tls.Config{
-		InsecureSkipVerify: skipTLS,
-		RootCAs:            rootCAs,
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return deviceConfig{}, "", errors.Wrap(errInvalidProxyURL, err)
+		}
+		proxy = http.ProxyURL(u)
 	}
-	tr := &http.Transport{TLSClientConfig: config}
+	tr := &http.Transport{TLSClientConfig: config, Proxy: proxy}
 	client := &http.Client{Transport: tr}
 	url := fmt.Sprintf("%s/%s", bsSvrURL, bsID)
 
 	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return deviceConfig{}, err
+		return deviceConfig{}, "", err
 	}
 
 	req.Header.Add("Authorization", fmt.Sprintf("Thing %s", bsKey))
+	if etag != "" {
+		req.Header.Add("If-None-Match", etag)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		return deviceConfig{}, err
+		return deviceConfig{}, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return deviceConfig{}, etag, ErrConfigUnchanged
+	}
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return deviceConfig{}, "", errors.Wrap(ErrConfigRejected, errors.New(http.StatusText(resp.StatusCode)))
 	}
 	if resp.StatusCode >= http.StatusBadRequest {
-		return deviceConfig{}, errors.New(http.StatusText(resp.StatusCode))
+		return deviceConfig{}, "", errors.New(http.StatusText(resp.StatusCode))
 	}
 
 	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return deviceConfig{}, "", err
+	}
+	if pubKey != nil {
+		if err := verifySignature(pubKey, body, resp.Header.Get(SignatureHeader)); err != nil {
+			return deviceConfig{}, "", err
+		}
+	}
+	dc, err := parseConfig(body)
+	if err != nil {
+		return deviceConfig{}, "", err
+	}
+	return dc, resp.Header.Get("ETag"), nil
+}
+
+// verifySignature checks that the base64 encoded signature is the signature
+// of the body by the key.
+func verifySignature(pubKey ed25519.PublicKey, body []byte, signature string) error {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return errors.Wrap(ErrInvalidSignature, fmt.Errorf("trusted key has %d bytes instead of %d", len(pubKey), ed25519.PublicKeySize))
+	}
+	if signature == "" {
+		return errors.Wrap(ErrInvalidSignature, fmt.Errorf("missing %s header", SignatureHeader))
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.Wrap(ErrInvalidSignature, err)
+	}
+	if !ed25519.Verify(pubKey, body, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// readConfig reads device config from the local file.
+func readConfig(path string) (deviceConfig, error) {
+	body, err := os.ReadFile(path)
 	if err != nil {
 		return deviceConfig{}, err
 	}
-	defer resp.Body.Close()
+	return parseConfig(body)
+}
+
+// parseConfig parses device config along with the services config carried
+// in its content.
+func parseConfig(body []byte) (deviceConfig, error) {
 	dc := deviceConfig{}
 	h := ConfigContent{}
-	if err := json.Unmarshal([]byte(body), &h); err != nil {
+	if err := json.Unmarshal(body, &h); err != nil {
 		return deviceConfig{}, err
 	}
-	fmt.Println(h.Content)
 	sc := ServicesConfig{}
 	if err := json.Unmarshal([]byte(h.Content), &sc); err != nil {
 		return deviceConfig{}, err
 	}
-	if err := json.Unmarshal([]byte(body), &dc); err != nil {
+	if err := json.Unmarshal(body, &dc); err != nil {
 		return deviceConfig{}, err
 	}
 	dc.SvcsConf = sc
+	if err := dc.validate(); err != nil {
+		return deviceConfig{}, err
+	}
 	return dc, nil
 }
+
+// validate returns ErrMalformedEntity naming the missing required fields, or
+// wrapping ErrChannelCollision if the control and data channels share the ID.
+func (dc deviceConfig) validate() error {
+	var missing []string
+	if dc.MainfluxID == "" {
+		missing = append(missing, "mainflux_id")
+	}
+	if dc.MainfluxKey == "" {
+		missing = append(missing, "mainflux_key")
+	}
+	// Control and data channels are required.
+	for i := 0; i < 2; i++ {
+		if i >= len(dc.MainfluxChannels) || dc.MainfluxChannels[i].ID == "" {
+			missing = append(missing, fmt.Sprintf("mainflux_channels[%d].id", i))
+		}
+	}
+	if len(missing) > 0 {
+		return errors.Wrap(agent.ErrMalformedEntity, fmt.Errorf("bootstrap config missing %s", strings.Join(missing, ", ")))
+	}
+	if ctrl, data := dc.channels(); ctrl == data {
+		return errors.Wrap(agent.ErrMalformedEntity, errors.Wrap(ErrChannelCollision, fmt.Errorf("control and data channels share ID %q", ctrl)))
+	}
+	return nil
+}
+
+// channels returns IDs of the control and data channels. The first two
+// channels are the control and data one, in that order unless the first
+// one has the data type.
+func (dc deviceConfig) channels() (string, string) {
+	if dc.MainfluxChannels[0].Metadata["type"] == "data" {
+		return dc.MainfluxChannels[1].ID, dc.MainfluxChannels[0].ID
+	}
+	return dc.MainfluxChannels[0].ID, dc.MainfluxChannels[1].ID
+}
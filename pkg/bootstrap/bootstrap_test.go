@@ -0,0 +1,1170 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package bootstrap_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent"
+	"github.com/andychao217/agent/pkg/bootstrap"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/go-kit/kit/metrics"
+	export "github.com/mainflux/export/pkg/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	thingID  = "thing"
+	thingKey = "key"
+	localCfg = "local config"
+)
+
+// bootstrapServer serves the config with the export config. If etag is set, the config is tagged with it and conditional
+// requests matching it are answered with 304.
+type bootstrapServer struct {
+	*httptest.Server
+	mu          sync.Mutex
+	ifNoneMatch []string
+}
+
+func newBootstrapServer(t *testing.T, econf map[string]any, etag string) *bootstrapServer {
+	bs := newUnstartedBootstrapServer(t, econf, etag)
+	bs.Start()
+	return bs
+}
+
+func newUnstartedBootstrapServer(t *testing.T, econf map[string]any, etag string) *bootstrapServer {
+	content, err := json.Marshal(map[string]any{
+		"agent": map[string]any{
+			"mqtt": map[string]any{"url": "localhost:1883"},
+		},
+		"export": econf,
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error marshaling content: %s", err))
+	body, err := json.Marshal(map[string]any{
+		"mainflux_id":  thingID,
+		"mainflux_key": thingKey,
+		"mainflux_channels": []map[string]any{
+			{"id": "control", "metadata": map[string]any{"type": "control"}},
+			{"id": "data", "metadata": map[string]any{"type": "data"}},
+			{"id": "temperature", "metadata": map[string]any{"type": "data", "name": "temperature"}},
+			{"id": "humidity", "metadata": map[string]any{"type": "data", "name": "humidity"}},
+			{"id": "unnamed", "metadata": map[string]any{"type": "data"}},
+		},
+		"content": string(content),
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error marshaling body: %s", err))
+
+	bs := &bootstrapServer{}
+	bs.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/"+thingID || r.Header.Get("Authorization") != "Thing "+thingKey {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		inm := r.Header.Get("If-None-Match")
+		bs.mu.Lock()
+		bs.ifNoneMatch = append(bs.ifNoneMatch, inm)
+		bs.mu.Unlock()
+		if etag != "" {
+			if inm == etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", etag)
+		}
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(bs.Close)
+	return bs
+}
+
+func (bs *bootstrapServer) requests() []string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return append([]string{}, bs.ifNoneMatch...)
+}
+
+func newConfig(url string) bootstrap.Config {
+	return bootstrap.Config{
+		URL:           url,
+		ID:            thingID,
+		Key:           thingKey,
+		Retries:       "1",
+		RetryDelaySec: "0",
+		Fallback: agent.Config{
+			Heartbeat: agent.HeartbeatConfig{Interval: time.Second},
+			Terminal:  agent.TerminalConfig{SessionTimeout: time.Minute},
+		},
+	}
+}
+
+func readDir(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading dir: %s", err))
+	files := map[string]string{}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		require.Nil(t, err, fmt.Sprintf("unexpected error reading file: %s", err))
+		files[e.Name()] = string(data)
+	}
+	return files
+}
+
+func TestBootstrapDryRun(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cases := []struct {
+		desc   string
+		dryRun bool
+		saved  bool
+	}{
+		{desc: "bootstrap", dryRun: false, saved: true},
+		{desc: "bootstrap with dry run", dryRun: true, saved: false},
+	}
+
+	for _, tc := range cases {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "config.toml")
+		exportFile := filepath.Join(dir, "export.toml")
+		err := os.WriteFile(file, []byte(localCfg), 0o644)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error writing config: %s", tc.desc, err))
+		before := readDir(t, dir)
+
+		cfg := newConfig(newBootstrapServer(t, map[string]any{"file": exportFile}, "").URL)
+		cfg.DryRun = tc.dryRun
+		err = bootstrap.Bootstrap(cfg, logger, file)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		after := readDir(t, dir)
+		if !tc.saved {
+			assert.Equal(t, before, after, fmt.Sprintf("%s: expected files to be unchanged", tc.desc))
+			continue
+		}
+		assert.NotEqual(t, localCfg, after["config.toml"], fmt.Sprintf("%s: expected config to be saved", tc.desc))
+		assert.Contains(t, after, "export.toml", fmt.Sprintf("%s: expected export config to be saved", tc.desc))
+	}
+}
+
+func TestBootstrapDryRunConfig(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&logs, nil))
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+
+	cfg := newConfig(newBootstrapServer(t, map[string]any{"file": filepath.Join(dir, "export.toml")}, "").URL)
+	c, err := bootstrap.BootstrapDryRun(cfg, logger, file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	channels := agent.ChanConfig{
+		Control:      "control",
+		Data:         "data",
+		DataChannels: map[string]string{"temperature": "temperature", "humidity": "humidity"},
+	}
+	assert.Equal(t, channels, c.Channels)
+	assert.Equal(t, thingID, c.MQTT.Username)
+	assert.Equal(t, thingKey, c.MQTT.Password)
+	assert.Equal(t, file, c.File)
+	assert.Empty(t, readDir(t, dir), "expected no files to be written")
+	assert.Contains(t, logs.String(), `{"path":"mqtt.username","old":"","new":"thing"}`, "expected changes to be logged")
+	assert.Contains(t, logs.String(), `{"path":"mqtt.password","old":"","new":"[redacted]"}`, "expected secret changes to be redacted")
+}
+
+func TestBootstrapCredentialsFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+	credsFile := filepath.Join(dir, "credentials.toml")
+
+	cfg := newConfig(newBootstrapServer(t, map[string]any{"file": filepath.Join(dir, "export.toml")}, "").URL)
+	cfg.Fallback.MQTT.CredentialsFile = credsFile
+	err := bootstrap.Bootstrap(cfg, logger, file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+
+	files := readDir(t, dir)
+	assert.NotContains(t, files["config.toml"], `password = "`+thingKey+`"`, "expected config file not to contain password")
+	assert.Contains(t, files["credentials.toml"], `password = "`+thingKey+`"`, "expected credentials file to contain password")
+	fi, err := os.Stat(credsFile)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading credentials file: %s", err))
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm(), "expected credentials file readable by owner only")
+
+	c, err := agent.ReadConfig(file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading config: %s", err))
+	assert.Equal(t, thingID, c.MQTT.Username)
+	assert.Equal(t, thingKey, c.MQTT.Password)
+}
+
+func TestBootstrapStore(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+
+	cfg := newConfig(newBootstrapServer(t, map[string]any{"file": filepath.Join(dir, "export.toml")}, "").URL)
+	cfg.Store = agent.NewMemoryStore()
+	err := bootstrap.Bootstrap(cfg, logger, file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+
+	assert.NotContains(t, readDir(t, dir), "config.toml", "expected config file not to be written")
+	c, err := cfg.Store.Load()
+	require.Nil(t, err, fmt.Sprintf("unexpected error loading config: %s", err))
+	assert.Equal(t, thingID, c.MQTT.Username)
+	assert.Equal(t, thingKey, c.MQTT.Password)
+	assert.Equal(t, "control", c.Channels.Control)
+}
+
+func TestBootstrapETag(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+	etag := `"v1"`
+	bs := newBootstrapServer(t, map[string]any{"file": filepath.Join(dir, "export.toml")}, etag)
+	cfg := newConfig(bs.URL)
+
+	err := bootstrap.Bootstrap(cfg, logger, file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	saved, err := os.ReadFile(file + ".etag")
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading etag: %s", err))
+	assert.Equal(t, etag, string(saved))
+
+	// Local edit shows whether the config is overwritten.
+	err = os.WriteFile(file, []byte(localCfg), 0o644)
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing config: %s", err))
+	err = bootstrap.Bootstrap(cfg, logger, file)
+	assert.True(t, errors.Contains(err, bootstrap.ErrConfigUnchanged), fmt.Sprintf("expected error %s got %s", bootstrap.ErrConfigUnchanged, err))
+	data, err := os.ReadFile(file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading config: %s", err))
+	assert.Equal(t, localCfg, string(data), "expected local config to be kept")
+
+	// ETag is ignored without the config it belongs to.
+	err = os.Remove(file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error removing config: %s", err))
+	err = bootstrap.Bootstrap(cfg, logger, file)
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+	_, err = agent.ReadConfig(file)
+	assert.Nil(t, err, fmt.Sprintf("expected config to be saved got %s", err))
+
+	assert.Equal(t, []string{"", etag, ""}, bs.requests())
+}
+
+func TestBootstrapExportConfig(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	const localEdit = "local edit"
+
+	exportConfig := func(file, subtopic string) map[string]any {
+		return map[string]any{
+			"file":   file,
+			"routes": []map[string]any{{"nats_topic": "export", "subtopic": subtopic}},
+		}
+	}
+
+	cases := []struct {
+		desc     string
+		previous string
+		edit     bool
+		current  string
+		force    bool
+		updated  bool
+	}{
+		{desc: "save new export config", current: "v1", updated: true},
+		{desc: "keep unchanged export config", previous: "v1", current: "v1", updated: false},
+		{desc: "update changed export config", previous: "v1", current: "v2", updated: true},
+		{desc: "keep locally edited export config", previous: "v1", edit: true, current: "v2", updated: false},
+		{desc: "force update of locally edited export config", previous: "v1", edit: true, current: "v2", force: true, updated: true},
+	}
+
+	for _, tc := range cases {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "config.toml")
+		exportFile := filepath.Join(dir, "export.toml")
+
+		if tc.previous != "" {
+			bs := newBootstrapServer(t, exportConfig(exportFile, tc.previous), "")
+			err := bootstrap.Bootstrap(newConfig(bs.URL), logger, file)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		}
+		if tc.edit {
+			err := os.WriteFile(exportFile, []byte(localEdit), 0o644)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error writing export config: %s", tc.desc, err))
+		}
+		before, _ := os.ReadFile(exportFile)
+
+		cfg := newConfig(newBootstrapServer(t, exportConfig(exportFile, tc.current), "").URL)
+		cfg.ForceExportUpdate = tc.force
+		err := bootstrap.Bootstrap(cfg, logger, file)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		econf, err := export.ReadFile(exportFile)
+		if tc.updated {
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error reading export config: %s", tc.desc, err))
+			require.Len(t, econf.Routes, 1, fmt.Sprintf("%s: unexpected routes", tc.desc))
+			assert.Equal(t, tc.current, econf.Routes[0].SubTopic, fmt.Sprintf("%s: expected export config to be updated", tc.desc))
+			assert.Equal(t, "channels/data/messages", econf.Routes[0].MqttTopic, fmt.Sprintf("%s: expected route topic to be filled", tc.desc))
+			continue
+		}
+		after, err := os.ReadFile(exportFile)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error reading export config: %s", tc.desc, err))
+		assert.Equal(t, string(before), string(after), fmt.Sprintf("%s: expected export config to be kept", tc.desc))
+	}
+}
+
+func TestBootstrapExportRoutes(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	exportFile := filepath.Join(dir, "export.toml")
+	econf := map[string]any{
+		"file": exportFile,
+		"routes": []map[string]any{
+			{"nats_topic": "export", "workers": 10},
+			{"nats_topic": "export", "workers": 10, "mqtt_topic": "channels/data/messages"},
+			{"nats_topic": "export", "workers": 10},
+			{"nats_topic": "export", "workers": 10, "subtopic": "temperature"},
+		},
+	}
+
+	err := bootstrap.Bootstrap(newConfig(newBootstrapServer(t, econf, "").URL), logger, filepath.Join(dir, "config.toml"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error %s", err))
+
+	saved, err := export.ReadFile(exportFile)
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading export config: %s", err))
+	expected := []export.Route{
+		{NatsTopic: "export", MqttTopic: "channels/data/messages", Workers: 10},
+		{NatsTopic: "export", MqttTopic: "channels/data/messages", SubTopic: "temperature", Workers: 10},
+	}
+	assert.Equal(t, expected, saved.Routes, "expected routes defaulting to the same data topic to be merged")
+}
+
+func TestBootstrapExportCredentials(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cases := []struct {
+		desc   string
+		mqtt   map[string]any
+		expect export.MQTT
+		err    error
+	}{
+		{
+			desc:   "bootstrap with inline client credentials",
+			mqtt:   map[string]any{"client_cert": "cert", "client_cert_key": "key"},
+			expect: export.MQTT{ClientCert: "cert", ClientCertKey: "key"},
+		},
+		{
+			desc:   "bootstrap with client credentials paths",
+			mqtt:   map[string]any{"client_cert_path": "cert.pem", "client_priv_key_path": "key.pem"},
+			expect: export.MQTT{ClientCertPath: "cert.pem", ClientPrivKeyPath: "key.pem"},
+		},
+		{
+			desc:   "bootstrap without client credentials",
+			mqtt:   map[string]any{},
+			expect: export.MQTT{},
+		},
+		{
+			desc: "bootstrap with inline certificate and key path",
+			mqtt: map[string]any{"client_cert": "cert", "client_priv_key_path": "key.pem"},
+			err:  bootstrap.ErrMixedExportCredentials,
+		},
+		{
+			desc: "bootstrap with both inline client credentials and paths",
+			mqtt: map[string]any{"client_cert": "cert", "client_cert_key": "key", "client_cert_path": "cert.pem", "client_priv_key_path": "key.pem"},
+			err:  bootstrap.ErrMixedExportCredentials,
+		},
+		{
+			desc: "bootstrap with inline certificate without key",
+			mqtt: map[string]any{"client_cert": "cert"},
+			err:  bootstrap.ErrMixedExportCredentials,
+		},
+		{
+			desc: "bootstrap with key path without certificate path",
+			mqtt: map[string]any{"client_priv_key_path": "key.pem"},
+			err:  bootstrap.ErrMixedExportCredentials,
+		},
+	}
+
+	for _, tc := range cases {
+		dir := t.TempDir()
+		exportFile := filepath.Join(dir, "export.toml")
+		econf := map[string]any{"file": exportFile, "mqtt": tc.mqtt}
+		err := bootstrap.Bootstrap(newConfig(newBootstrapServer(t, econf, "").URL), logger, filepath.Join(dir, "config.toml"))
+		if tc.err != nil {
+			assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+			assert.Empty(t, readDir(t, dir), fmt.Sprintf("%s: expected no files to be written", tc.desc))
+			continue
+		}
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		saved, err := export.ReadFile(exportFile)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error reading export config: %s", tc.desc, err))
+		creds := export.MQTT{
+			ClientCert:        saved.MQTT.ClientCert,
+			ClientCertKey:     saved.MQTT.ClientCertKey,
+			ClientCertPath:    saved.MQTT.ClientCertPath,
+			ClientPrivKeyPath: saved.MQTT.ClientPrivKeyPath,
+		}
+		assert.Equal(t, tc.expect, creds, fmt.Sprintf("%s: unexpected export client credentials", tc.desc))
+	}
+}
+
+func TestBootstrapExportConfigPath(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cases := []struct {
+		desc   string
+		econf  func(dir string) map[string]any
+		path   string
+		expect string
+	}{
+		{
+			desc:   "save export config to configured path",
+			econf:  func(string) map[string]any { return map[string]any{} },
+			path:   "configured.toml",
+			expect: "configured.toml",
+		},
+		{
+			desc: "save export config to path from bootstrap config",
+			econf: func(dir string) map[string]any {
+				return map[string]any{"file": filepath.Join(dir, "fetched.toml")}
+			},
+			path:   "configured.toml",
+			expect: "fetched.toml",
+		},
+	}
+
+	for _, tc := range cases {
+		dir := t.TempDir()
+		cfg := newConfig(newBootstrapServer(t, tc.econf(dir), "").URL)
+		cfg.ExportConfigPath = filepath.Join(dir, tc.path)
+		err := bootstrap.Bootstrap(cfg, logger, filepath.Join(dir, "config.toml"))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		econf, err := export.ReadFile(filepath.Join(dir, tc.expect))
+		require.Nil(t, err, fmt.Sprintf("%s: expected export config to be saved got %s", tc.desc, err))
+		assert.Equal(t, thingID, econf.MQTT.Username, fmt.Sprintf("%s: expected export config filled from agent config", tc.desc))
+	}
+}
+
+func TestBootstrapMalformedConfig(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	channels := []map[string]any{
+		{"id": "control", "metadata": map[string]any{"type": "control"}},
+		{"id": "data", "metadata": map[string]any{"type": "data"}},
+	}
+
+	cases := []struct {
+		desc    string
+		body    map[string]any
+		missing string
+	}{
+		{
+			desc:    "bootstrap config without thing ID",
+			body:    map[string]any{"mainflux_key": thingKey, "mainflux_channels": channels},
+			missing: "mainflux_id",
+		},
+		{
+			desc:    "bootstrap config without thing key",
+			body:    map[string]any{"mainflux_id": thingID, "mainflux_channels": channels},
+			missing: "mainflux_key",
+		},
+		{
+			desc:    "bootstrap config without channels",
+			body:    map[string]any{"mainflux_id": thingID, "mainflux_key": thingKey},
+			missing: "mainflux_channels[0].id, mainflux_channels[1].id",
+		},
+		{
+			desc:    "bootstrap config with single channel",
+			body:    map[string]any{"mainflux_id": thingID, "mainflux_key": thingKey, "mainflux_channels": channels[:1]},
+			missing: "mainflux_channels[1].id",
+		},
+		{
+			desc:    "bootstrap config with channel without ID",
+			body:    map[string]any{"mainflux_id": thingID, "mainflux_key": thingKey, "mainflux_channels": []map[string]any{channels[0], {}}},
+			missing: "mainflux_channels[1].id",
+		},
+		{
+			desc:    "empty bootstrap config",
+			body:    map[string]any{},
+			missing: "mainflux_id, mainflux_key, mainflux_channels[0].id, mainflux_channels[1].id",
+		},
+	}
+
+	for _, tc := range cases {
+		tc.body["content"] = "{}"
+		body, err := json.Marshal(tc.body)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error marshaling body: %s", tc.desc, err))
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			_, _ = w.Write(body)
+		}))
+
+		dir := t.TempDir()
+		cfg := newConfig(srv.URL)
+		cfg.Retries = "3"
+		err = bootstrap.Bootstrap(cfg, logger, filepath.Join(dir, "config.toml"))
+		srv.Close()
+		assert.True(t, errors.Contains(err, agent.ErrMalformedEntity), fmt.Sprintf("%s: expected error %s got %s", tc.desc, agent.ErrMalformedEntity, err))
+		assert.ErrorContains(t, err, "missing "+tc.missing, fmt.Sprintf("%s: expected missing fields in error", tc.desc))
+		assert.Equal(t, 1, requests, fmt.Sprintf("%s: expected malformed config not to be retried", tc.desc))
+		assert.Empty(t, readDir(t, dir), fmt.Sprintf("%s: expected no files to be written", tc.desc))
+	}
+}
+
+func TestBootstrapChannelCollision(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	body, err := json.Marshal(map[string]any{
+		"mainflux_id":  thingID,
+		"mainflux_key": thingKey,
+		"mainflux_channels": []map[string]any{
+			{"id": "shared", "metadata": map[string]any{"type": "control"}},
+			{"id": "shared", "metadata": map[string]any{"type": "data"}},
+		},
+		"content": "{}",
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error marshaling body: %s", err))
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cfg := newConfig(srv.URL)
+	cfg.Retries = "3"
+	res, err := bootstrap.BootstrapWithResult(cfg, logger, filepath.Join(dir, "config.toml"))
+	assert.True(t, errors.Contains(err, bootstrap.ErrChannelCollision), fmt.Sprintf("expected error %s got %s", bootstrap.ErrChannelCollision, err))
+	assert.ErrorContains(t, err, `share ID "shared"`, "expected colliding channel ID in error")
+	assert.Equal(t, bootstrap.OutcomeFailed, res.Outcome, "expected bootstrap to fail")
+	assert.Equal(t, 1, requests, "expected colliding config not to be retried")
+	assert.Empty(t, readDir(t, dir), "expected no files to be written")
+}
+
+func TestBootstrapHeaders(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bs := newBootstrapServer(t, map[string]any{"file": filepath.Join(t.TempDir(), "export.toml")}, "")
+
+	cases := []struct {
+		desc    string
+		headers map[string]string
+		auth    string
+		err     error
+	}{
+		{
+			desc:    "bootstrap with custom headers",
+			headers: map[string]string{"X-Api-Key": "api-key", "X-Tenant": "tenant"},
+			auth:    "Thing " + thingKey,
+		},
+		{
+			desc:    "bootstrap with custom authorization header",
+			headers: map[string]string{"X-Api-Key": "api-key", "X-Tenant": "tenant", "Authorization": "Bearer token"},
+			auth:    "Bearer token",
+			err:     bootstrap.ErrConfigRejected,
+		},
+	}
+
+	for _, tc := range cases {
+		var received http.Header
+		// Gateway in front of the bootstrap server records the headers.
+		gw := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			received = r.Header.Clone()
+			bs.Config.Handler.ServeHTTP(w, r)
+		}))
+
+		cfg := newConfig(gw.URL)
+		cfg.Headers = tc.headers
+		err := bootstrap.Bootstrap(cfg, logger, filepath.Join(t.TempDir(), "config.toml"))
+		gw.Close()
+		if tc.err == nil {
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		} else {
+			assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		}
+		require.NotNil(t, received, fmt.Sprintf("%s: expected request to reach the server", tc.desc))
+		assert.Equal(t, "api-key", received.Get("X-Api-Key"), fmt.Sprintf("%s: expected API key header", tc.desc))
+		assert.Equal(t, "tenant", received.Get("X-Tenant"), fmt.Sprintf("%s: expected tenant header", tc.desc))
+		assert.Equal(t, tc.auth, received.Get("Authorization"), fmt.Sprintf("%s: unexpected authorization header", tc.desc))
+	}
+}
+
+func TestBootstrapLocalConfig(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cases := []struct {
+		desc    string
+		source  string
+		retries string
+		path    string
+		saved   bool
+		err     bool
+	}{
+		{desc: "bootstrap from file source", source: bootstrap.SourceFile, retries: "", path: "testdata/config.json", saved: true},
+		{desc: "bootstrap from local file without retries", retries: "0", path: "testdata/config.json", saved: true},
+		{desc: "bootstrap without retries nor local file", retries: "0"},
+		{desc: "bootstrap from missing file", source: bootstrap.SourceFile, path: "testdata/missing.json", err: true},
+		{desc: "bootstrap from unknown source", source: "usb", retries: "0", path: "testdata/config.json", err: true},
+	}
+
+	for _, tc := range cases {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "config.toml")
+		cfg := newConfig("http://localhost:0")
+		cfg.Source = tc.source
+		cfg.Retries = tc.retries
+		cfg.LocalConfigPath = tc.path
+		cfg.ExportConfigPath = filepath.Join(dir, "export.toml")
+		err := bootstrap.Bootstrap(cfg, logger, file)
+		if tc.err {
+			assert.NotNil(t, err, fmt.Sprintf("%s: expected error", tc.desc))
+			assert.Empty(t, readDir(t, dir), fmt.Sprintf("%s: expected no files to be written", tc.desc))
+			continue
+		}
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		if !tc.saved {
+			assert.Empty(t, readDir(t, dir), fmt.Sprintf("%s: expected no files to be written", tc.desc))
+			continue
+		}
+
+		c, err := agent.ReadConfig(file)
+		require.Nil(t, err, fmt.Sprintf("%s: expected config to be saved got %s", tc.desc, err))
+		channels := agent.ChanConfig{
+			Control:      "control",
+			Data:         "data",
+			DataChannels: map[string]string{"temperature": "temperature"},
+		}
+		assert.Equal(t, channels, c.Channels, fmt.Sprintf("%s: unexpected channels", tc.desc))
+		assert.Equal(t, thingID, c.MQTT.Username, fmt.Sprintf("%s: unexpected username", tc.desc))
+		assert.Equal(t, "localhost:1883", c.MQTT.URL, fmt.Sprintf("%s: unexpected MQTT URL", tc.desc))
+		econf, err := export.ReadFile(cfg.ExportConfigPath)
+		require.Nil(t, err, fmt.Sprintf("%s: expected export config to be saved got %s", tc.desc, err))
+		assert.Equal(t, thingID, econf.MQTT.Username, fmt.Sprintf("%s: expected export config filled from agent config", tc.desc))
+	}
+}
+
+func TestBootstrapRetries(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ok := newUnstartedBootstrapServer(t, map[string]any{}, "").Config.Handler
+
+	cases := []struct {
+		desc     string
+		status   int
+		requests int
+		err      error
+	}{
+		{desc: "bootstrap with unauthorized response", status: http.StatusUnauthorized, requests: 1, err: bootstrap.ErrConfigRejected},
+		{desc: "bootstrap with forbidden response", status: http.StatusForbidden, requests: 1, err: bootstrap.ErrConfigRejected},
+		{desc: "bootstrap with not found response", status: http.StatusNotFound, requests: 1, err: bootstrap.ErrConfigRejected},
+		{desc: "bootstrap with unavailable response", status: http.StatusServiceUnavailable, requests: 2},
+	}
+
+	for _, tc := range cases {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			// The first request fails, the following ones succeed.
+			if requests == 1 {
+				w.WriteHeader(tc.status)
+				return
+			}
+			ok.ServeHTTP(w, r)
+		}))
+
+		dir := t.TempDir()
+		cfg := newConfig(srv.URL)
+		cfg.Retries = "3"
+		cfg.ExportConfigPath = filepath.Join(dir, "export.toml")
+		err := bootstrap.Bootstrap(cfg, logger, filepath.Join(dir, "config.toml"))
+		srv.Close()
+		assert.Equal(t, tc.requests, requests, fmt.Sprintf("%s: expected %d requests got %d", tc.desc, tc.requests, requests))
+		if tc.err != nil {
+			assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+			assert.Empty(t, readDir(t, dir), fmt.Sprintf("%s: expected no files to be written", tc.desc))
+			continue
+		}
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Contains(t, readDir(t, dir), "config.toml", fmt.Sprintf("%s: expected config to be saved", tc.desc))
+	}
+}
+
+// counter sums the added values.
+type counter struct {
+	value float64
+}
+
+func (c *counter) With(...string) metrics.Counter {
+	return c
+}
+
+func (c *counter) Add(delta float64) {
+	c.value += delta
+}
+
+func TestBootstrapWithResult(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ok := newUnstartedBootstrapServer(t, map[string]any{}, "").Config.Handler
+
+	cases := []struct {
+		desc     string
+		failures int
+		retries  string
+		status   int
+		result   bootstrap.Result
+		err      error
+	}{
+		{desc: "bootstrap succeeding at once", retries: "3", result: bootstrap.Result{Attempts: 1, Outcome: bootstrap.OutcomeSaved}},
+		{desc: "bootstrap succeeding after failures", failures: 2, retries: "3", status: http.StatusServiceUnavailable, result: bootstrap.Result{Attempts: 3, Outcome: bootstrap.OutcomeSaved}},
+		{desc: "bootstrap exhausting retries", failures: 3, retries: "3", status: http.StatusServiceUnavailable, result: bootstrap.Result{Attempts: 3, Outcome: bootstrap.OutcomeExhausted}},
+		{desc: "bootstrap rejected after failure", failures: 2, retries: "3", status: http.StatusForbidden, result: bootstrap.Result{Attempts: 1, Outcome: bootstrap.OutcomeFailed}, err: bootstrap.ErrConfigRejected},
+		{desc: "bootstrap disabled", retries: "0", result: bootstrap.Result{Outcome: bootstrap.OutcomeDisabled}},
+	}
+
+	for _, tc := range cases {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= tc.failures {
+				w.WriteHeader(tc.status)
+				return
+			}
+			ok.ServeHTTP(w, r)
+		}))
+
+		dir := t.TempDir()
+		retries := &counter{}
+		cfg := newConfig(srv.URL)
+		cfg.Retries = tc.retries
+		cfg.RetriesCounter = retries
+		cfg.ExportConfigPath = filepath.Join(dir, "export.toml")
+		res, err := bootstrap.BootstrapWithResult(cfg, logger, filepath.Join(dir, "config.toml"))
+		srv.Close()
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		assert.Equal(t, tc.result, res, fmt.Sprintf("%s: unexpected result", tc.desc))
+		assert.Equal(t, requests, res.Attempts, fmt.Sprintf("%s: expected attempts to match requests", tc.desc))
+		assert.Equal(t, float64(res.Retries()), retries.value, fmt.Sprintf("%s: unexpected retries counted", tc.desc))
+	}
+}
+
+func TestBootstrapTLSVersion(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cases := []struct {
+		desc         string
+		server       *tls.Config
+		minVersion   uint16
+		cipherSuites []uint16
+		outcome      string
+	}{
+		{
+			desc:       "bootstrap from TLS 1.1 server with minimum TLS 1.1",
+			server:     &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11},
+			minVersion: tls.VersionTLS11,
+			outcome:    bootstrap.OutcomeSaved,
+		},
+		{
+			desc:       "bootstrap from TLS 1.1 server with minimum TLS 1.2",
+			server:     &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11},
+			minVersion: tls.VersionTLS12,
+			outcome:    bootstrap.OutcomeExhausted,
+		},
+		{
+			desc:         "bootstrap with allowed cipher suite",
+			server:       &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+			minVersion:   tls.VersionTLS12,
+			cipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			outcome:      bootstrap.OutcomeSaved,
+		},
+		{
+			desc:         "bootstrap with cipher suite not allowed",
+			server:       &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}},
+			minVersion:   tls.VersionTLS12,
+			cipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+			outcome:      bootstrap.OutcomeExhausted,
+		},
+	}
+
+	for _, tc := range cases {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "config.toml")
+		bs := newUnstartedBootstrapServer(t, map[string]any{"file": filepath.Join(dir, "export.toml")}, "")
+		bs.TLS = tc.server
+		bs.StartTLS()
+
+		cfg := newConfig(bs.URL)
+		cfg.CA = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bs.Certificate().Raw})
+		cfg.MinTLSVersion = tc.minVersion
+		cfg.CipherSuites = tc.cipherSuites
+		res, err := bootstrap.BootstrapWithResult(cfg, logger, file)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Equal(t, tc.outcome, res.Outcome, fmt.Sprintf("%s: expected outcome %s got %s", tc.desc, tc.outcome, res.Outcome))
+		_, err = agent.ReadConfig(file)
+		saved := tc.outcome == bootstrap.OutcomeSaved
+		assert.Equal(t, saved, err == nil, fmt.Sprintf("%s: expected config saved %t got error %v", tc.desc, saved, err))
+	}
+}
+
+// newProxy returns HTTP proxy tunneling CONNECT requests and recording their
+// targets.
+func newProxy(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var targets []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		targets = append(targets, r.Method+" "+r.Host)
+		mu.Unlock()
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		dst, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer dst.Close()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return
+		}
+		go func() {
+			_, _ = io.Copy(dst, conn)
+		}()
+		_, _ = io.Copy(conn, dst)
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, targets...)
+	}
+}
+
+func TestBootstrapProxy(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	cases := []struct {
+		desc    string
+		trusted bool
+		saved   bool
+	}{
+		{desc: "bootstrap through proxy", trusted: true, saved: true},
+		{desc: "bootstrap through proxy with untrusted server certificate", trusted: false, saved: false},
+	}
+
+	for _, tc := range cases {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "config.toml")
+		bs := newUnstartedBootstrapServer(t, map[string]any{"file": filepath.Join(dir, "export.toml")}, "")
+		bs.StartTLS()
+		proxy, targets := newProxy(t)
+
+		cfg := newConfig(bs.URL)
+		cfg.ProxyURL = proxy.URL
+		if tc.trusted {
+			cfg.CA = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: bs.Certificate().Raw})
+		}
+		err := bootstrap.Bootstrap(cfg, logger, file)
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+
+		assert.Equal(t, []string{"CONNECT " + bs.Listener.Addr().String()}, targets(), fmt.Sprintf("%s: expected request through proxy", tc.desc))
+		_, err = agent.ReadConfig(file)
+		assert.Equal(t, tc.saved, err == nil, fmt.Sprintf("%s: expected config saved %t got error %v", tc.desc, tc.saved, err))
+	}
+}
+
+// levels are the log levels of the config versions served by versionedServer.
+var levels = []string{"info", "debug", "warn", "error"}
+
+// versionedServer serves the config with the log level of the current
+// version, tagged with the version.
+type versionedServer struct {
+	*httptest.Server
+	mu      sync.Mutex
+	version int
+	fetches int
+}
+
+func newVersionedServer(t *testing.T, exportFile string) *versionedServer {
+	vs := &versionedServer{version: 1}
+	vs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vs.mu.Lock()
+		defer vs.mu.Unlock()
+		vs.fetches++
+		etag := fmt.Sprintf(`"v%d"`, vs.version)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		content, err := json.Marshal(map[string]any{
+			"agent": map[string]any{
+				"mqtt": map[string]any{"url": "localhost:1883"},
+				"log":  map[string]any{"level": levels[vs.version-1]},
+			},
+			"export": map[string]any{"file": exportFile},
+		})
+		require.Nil(t, err, fmt.Sprintf("unexpected error marshaling content: %s", err))
+		w.Header().Set("ETag", etag)
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"mainflux_id":  thingID,
+			"mainflux_key": thingKey,
+			"mainflux_channels": []map[string]any{
+				{"id": "control", "metadata": map[string]any{"type": "control"}},
+				{"id": "data", "metadata": map[string]any{"type": "data"}},
+			},
+			"content": string(content),
+		})
+	}))
+	t.Cleanup(vs.Close)
+	return vs
+}
+
+func (vs *versionedServer) update() {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	vs.version++
+}
+
+func (vs *versionedServer) fetched() int {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+	return vs.fetches
+}
+
+func TestBootstrapWatch(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	file := filepath.Join(dir, "config.toml")
+	vs := newVersionedServer(t, filepath.Join(dir, "export.toml"))
+
+	applied := make(chan agent.Config, 10)
+	apply := func(c agent.Config) error {
+		applied <- c
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		bootstrap.BootstrapWatch(ctx, newConfig(vs.URL), 10*time.Millisecond, apply, logger, file)
+		close(done)
+	}()
+
+	next := func() agent.Config {
+		select {
+		case c := <-applied:
+			return c
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected config to be applied")
+			return agent.Config{}
+		}
+	}
+	c := next()
+	assert.Equal(t, "info", c.Log.Level)
+	assert.Equal(t, thingID, c.MQTT.Username)
+
+	// Unchanged config isn't applied again.
+	fetches := vs.fetched()
+	assert.Eventually(t, func() bool { return vs.fetched() >= fetches+3 }, 5*time.Second, time.Millisecond, "expected config to be fetched again")
+	assert.Empty(t, applied, "expected unchanged config not to be applied")
+
+	vs.update()
+	c = next()
+	assert.Equal(t, "debug", c.Log.Level)
+	saved, err := os.ReadFile(file + ".etag")
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading etag: %s", err))
+	assert.Equal(t, `"v2"`, string(saved))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected watch to stop on cancel")
+	}
+	fetches = vs.fetched()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, fetches, vs.fetched(), "expected no fetches after cancel")
+}
+
+func TestBootstrapWatchApplyFailure(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	dir := t.TempDir()
+	vs := newVersionedServer(t, filepath.Join(dir, "export.toml"))
+
+	var mu sync.Mutex
+	calls := 0
+	apply := func(c agent.Config) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			return errors.New("failed")
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bootstrap.BootstrapWatch(ctx, newConfig(vs.URL), 10*time.Millisecond, apply, logger, filepath.Join(dir, "config.toml"))
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls == 2
+	}, 5*time.Second, time.Millisecond, "expected failed config to be applied again")
+}
+
+func TestBootstrapWatchDisabled(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	vs := newVersionedServer(t, "")
+
+	done := make(chan struct{})
+	go func() {
+		bootstrap.BootstrapWatch(context.Background(), newConfig(vs.URL), 0, func(agent.Config) error { return nil }, logger, "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected watching to be disabled by zero interval")
+	}
+	assert.Equal(t, 0, vs.fetched(), "expected no fetches")
+}
+
+func TestBootstrapSignature(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ok := newUnstartedBootstrapServer(t, map[string]any{}, "").Config.Handler
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err, fmt.Sprintf("unexpected error generating key: %s", err))
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	require.Nil(t, err, fmt.Sprintf("unexpected error generating key: %s", err))
+
+	cases := []struct {
+		desc   string
+		sign   func(body []byte) string
+		pubKey ed25519.PublicKey
+		err    error
+	}{
+		{
+			desc:   "bootstrap with valid signature",
+			sign:   func(body []byte) string { return base64.StdEncoding.EncodeToString(ed25519.Sign(privKey, body)) },
+			pubKey: pubKey,
+		},
+		{
+			desc:   "bootstrap with signature of other key",
+			sign:   func(body []byte) string { return base64.StdEncoding.EncodeToString(ed25519.Sign(otherKey, body)) },
+			pubKey: pubKey,
+			err:    bootstrap.ErrInvalidSignature,
+		},
+		{
+			desc: "bootstrap with signature of other content",
+			sign: func(body []byte) string {
+				return base64.StdEncoding.EncodeToString(ed25519.Sign(privKey, append(body, '\n')))
+			},
+			pubKey: pubKey,
+			err:    bootstrap.ErrInvalidSignature,
+		},
+		{
+			desc:   "bootstrap with malformed signature",
+			sign:   func([]byte) string { return "not base64" },
+			pubKey: pubKey,
+			err:    bootstrap.ErrInvalidSignature,
+		},
+		{
+			desc:   "bootstrap without signature",
+			sign:   func([]byte) string { return "" },
+			pubKey: pubKey,
+			err:    bootstrap.ErrInvalidSignature,
+		},
+		{
+			desc: "bootstrap without signature and trusted key",
+			sign: func([]byte) string { return "" },
+		},
+	}
+
+	for _, tc := range cases {
+		requests := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			rec := httptest.NewRecorder()
+			ok.ServeHTTP(rec, r)
+			if sig := tc.sign(rec.Body.Bytes()); sig != "" {
+				w.Header().Set(bootstrap.SignatureHeader, sig)
+			}
+			_, _ = w.Write(rec.Body.Bytes())
+		}))
+
+		dir := t.TempDir()
+		cfg := newConfig(srv.URL)
+		cfg.Retries = "3"
+		cfg.ExportConfigPath = filepath.Join(dir, "export.toml")
+		cfg.TrustedPubKey = tc.pubKey
+		err := bootstrap.Bootstrap(cfg, logger, filepath.Join(dir, "config.toml"))
+		srv.Close()
+		assert.Equal(t, 1, requests, fmt.Sprintf("%s: expected single request got %d", tc.desc, requests))
+		if tc.err != nil {
+			assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+			assert.Empty(t, readDir(t, dir), fmt.Sprintf("%s: expected no files to be written", tc.desc))
+			continue
+		}
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		assert.Contains(t, readDir(t, dir), "config.toml", fmt.Sprintf("%s: expected config to be saved", tc.desc))
+	}
+}
+
+func TestBootstrapKeyFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	bs := newBootstrapServer(t, map[string]any{"file": filepath.Join(t.TempDir(), "export.toml")}, "")
+
+	cases := []struct {
+		desc    string
+		key     string
+		perm    os.FileMode
+		missing bool
+		err     error
+	}{
+		{desc: "bootstrap with key file", key: thingKey + "\n", perm: 0o600},
+		{desc: "bootstrap with key file readable by group", key: thingKey, perm: 0o640},
+		{desc: "bootstrap with world readable key file", key: thingKey, perm: 0o644, err: bootstrap.ErrInsecureKeyFile},
+		{desc: "bootstrap with wrong key in key file", key: "wrong", perm: 0o600, err: bootstrap.ErrConfigRejected},
+		{desc: "bootstrap with missing key file", missing: true, err: errors.New("failed to read bootstrap key file")},
+	}
+
+	for _, tc := range cases {
+		keyFile := filepath.Join(t.TempDir(), "bootstrap.key")
+		if !tc.missing {
+			err := os.WriteFile(keyFile, []byte(tc.key), tc.perm)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error writing key file: %s", tc.desc, err))
+			// Permissions of the created file are masked by umask.
+			err = os.Chmod(keyFile, tc.perm)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error setting key file permissions: %s", tc.desc, err))
+		}
+
+		cfg := newConfig(bs.URL)
+		cfg.Key = ""
+		cfg.KeyFile = keyFile
+		file := filepath.Join(t.TempDir(), "config.toml")
+		err := bootstrap.Bootstrap(cfg, logger, file)
+		if tc.err != nil {
+			assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+			continue
+		}
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error %s", tc.desc, err))
+		_, err = agent.ReadConfig(file)
+		assert.Nil(t, err, fmt.Sprintf("%s: expected config to be saved: %s", tc.desc, err))
+	}
+}
@@ -38,6 +38,10 @@ var _ MqttBroker = (*broker)(nil)
 type MqttBroker interface {
 	// Subscribes to given topic and receives events.
 	Subscribe(ctx context.Context) error
+
+	// Resubscribe renews subscriptions made by Subscribe, which are dropped
+	// by the MQTT broker when clean session client reconnects.
+	Resubscribe() error
 }
 
 type broker struct {
@@ -62,8 +66,17 @@ func NewBroker(svc agent.Service, client mqtt.Client, chann string, messBroker m
 
 // Subscribe subscribes to the MQTT message broker.
 func (b *broker) Subscribe(ctx context.Context) error {
-	topic := fmt.Sprintf("channels/%s/messages/%s", b.channel, reqTopic)
 	b.ctx = ctx
+	return b.subscribe()
+}
+
+// Resubscribe renews subscriptions to the MQTT message broker.
+func (b *broker) Resubscribe() error {
+	return b.subscribe()
+}
+
+func (b *broker) subscribe() error {
+	topic := fmt.Sprintf("channels/%s/messages/%s", b.channel, reqTopic)
 	s := b.client.Subscribe(topic, 0, b.handleMsg)
 	if err := s.Error(); s.Wait() && err != nil {
 		return err
@@ -130,7 +143,7 @@ func (b *broker) handleMsg(mc mqtt.Client, msg mqtt.Message) {
 		}
 	case exec:
 		b.logger.Info("Execute command", slog.String("uuid", uuid), slog.String("command", cmdStr))
-		if _, err := b.svc.Execute(uuid, cmdStr); err != nil {
+		if _, err := b.svc.Execute(b.ctx, uuid, cmdStr); err != nil {
 			b.logger.Warn("Execute operation failed", slog.Any("error", err))
 		}
 	case config:
@@ -6,14 +6,20 @@ package edgex
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"strings"
 
+	"github.com/andychao217/magistrala/pkg/errors"
 	model "github.com/edgexfoundry/go-mod-core-contracts/models"
 )
 
+// ErrRequestFailed indicates that EdgeX responded with an error status.
+var ErrRequestFailed = errors.New("edgex request failed")
+
 type Client interface {
 	// PushOperation - pushes operation to EdgeX components.
 	PushOperation([]string) (string, error)
@@ -26,18 +32,32 @@ type Client interface {
 
 	// Ping - ping EdgeX SMA.
 	Ping() (string, error)
+
+	// FetchReadings - fetches at most limit readings created between start
+	// and end, in milliseconds since epoch, from EdgeX core data.
+	FetchReadings(start, end int64, limit int) ([]model.Reading, error)
+
+	// Command - issues the device command through EdgeX core command. The
+	// command is read if params are empty and set with the params otherwise.
+	Command(device, command string, params map[string]string) (string, error)
 }
 
 type edgexClient struct {
-	url    string
-	logger *slog.Logger
+	url        string
+	dataURL    string
+	commandURL string
+	logger     *slog.Logger
 }
 
-// NewClient - Creates ne EdgeX client.
-func NewClient(edgexURL string, logger *slog.Logger) Client {
+// NewClient - Creates ne EdgeX client. The edgexURL is the base URL of the
+// system management agent, dataURL and commandURL are base URLs of core data
+// and core command services.
+func NewClient(edgexURL, dataURL, commandURL string, logger *slog.Logger) Client {
 	return &edgexClient{
-		url:    edgexURL,
-		logger: logger,
+		url:        edgexURL,
+		dataURL:    dataURL,
+		commandURL: commandURL,
+		logger:     logger,
 	}
 }
 
@@ -120,3 +140,69 @@ func (ec *edgexClient) Ping() (string, error) {
 
 	return string(body), nil
 }
+
+// FetchReadings - fetches readings from EdgeX core data.
+func (ec *edgexClient) FetchReadings(start, end int64, limit int) ([]model.Reading, error) {
+	resp, err := http.Get(fmt.Sprintf("%sreading/%d/%d/%d", ec.dataURL, start, end, limit))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	var readings []model.Reading
+	if err := json.Unmarshal(body, &readings); err != nil {
+		return nil, err
+	}
+	return readings, nil
+}
+
+// Command - issues the device command through EdgeX core command.
+func (ec *edgexClient) Command(device, command string, params map[string]string) (string, error) {
+	cmdURL := fmt.Sprintf("%sdevice/name/%s/command/%s", ec.commandURL, url.PathEscape(device), url.PathEscape(command))
+
+	req, err := http.NewRequest(http.MethodGet, cmdURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(params) > 0 {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return "", err
+		}
+		req, err = http.NewRequest(http.MethodPut, cmdURL, bytes.NewReader(data))
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := readBody(resp)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
+// readBody reads the response body, failing on error statuses so that the
+// EdgeX error isn't mistaken for the result.
+func readBody(resp *http.Response) ([]byte, error) {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, errors.Wrap(ErrRequestFailed, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body))))
+	}
+	return body, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package edgex_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andychao217/agent/pkg/edgex"
+	"github.com/andychao217/magistrala/pkg/errors"
+	model "github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetchReadings(t *testing.T) {
+	readings := []model.Reading{
+		{Device: "thermostat", Name: "temperature", Value: "21.5", Origin: 1500000000000000000},
+		{Device: "thermostat", Name: "humidity", Value: "40", Created: 1500000000000},
+	}
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if err := json.NewEncoder(w).Encode(readings); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer ts.Close()
+
+	client := edgex.NewClient("", ts.URL+"/api/v1/", "", slog.Default())
+	got, err := client.FetchReadings(1000, 2000, 10)
+	require.Nil(t, err, fmt.Sprintf("unexpected error: %s", err))
+	assert.Equal(t, "/api/v1/reading/1000/2000/10", path)
+	require.Len(t, got, len(readings))
+	for i, r := range readings {
+		// Unmarshalling validates the reading, so compare it field by field.
+		assert.Equal(t, r.Device, got[i].Device)
+		assert.Equal(t, r.Name, got[i].Name)
+		assert.Equal(t, r.Value, got[i].Value)
+		assert.Equal(t, r.Origin, got[i].Origin)
+		assert.Equal(t, r.Created, got[i].Created)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	type request struct {
+		method string
+		path   string
+		body   string
+	}
+	var req request
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req = request{method: r.Method, path: r.URL.Path, body: string(body)}
+		if r.URL.Path == "/api/v1/device/name/missing/command/switch" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte("device not found"))
+			return
+		}
+		_, _ = w.Write([]byte(`{"readings":[]}`))
+	}))
+	defer ts.Close()
+
+	client := edgex.NewClient("", "", ts.URL+"/api/v1/", slog.Default())
+
+	cases := []struct {
+		desc    string
+		device  string
+		command string
+		params  map[string]string
+		req     request
+		resp    string
+		err     error
+	}{
+		{
+			desc:    "read command",
+			device:  "lamp",
+			command: "switch",
+			req:     request{method: http.MethodGet, path: "/api/v1/device/name/lamp/command/switch"},
+			resp:    `{"readings":[]}`,
+		},
+		{
+			desc:    "set command",
+			device:  "lamp",
+			command: "switch",
+			params:  map[string]string{"on": "true"},
+			req:     request{method: http.MethodPut, path: "/api/v1/device/name/lamp/command/switch", body: `{"on":"true"}`},
+			resp:    `{"readings":[]}`,
+		},
+		{
+			desc:    "command of unknown device",
+			device:  "missing",
+			command: "switch",
+			req:     request{method: http.MethodGet, path: "/api/v1/device/name/missing/command/switch"},
+			err:     edgex.ErrRequestFailed,
+		},
+	}
+
+	for _, tc := range cases {
+		resp, err := client.Command(tc.device, tc.command, tc.params)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %s got %s", tc.desc, tc.err, err))
+		assert.Equal(t, tc.resp, resp, fmt.Sprintf("%s: unexpected response", tc.desc))
+		assert.Equal(t, tc.req, req, fmt.Sprintf("%s: unexpected request", tc.desc))
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package encoder
+
+import (
+	goerrors "errors"
+	"sync"
+	"time"
+
+	"github.com/absmach/senml"
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+// EncodeSenMLBatch encodes records into a single SenML JSON pack, preserving their order.
+// Records without time are stamped with the current time. Base name is emitted only
+// when it differs from the base name of the previous record, as base fields apply
+// to all the subsequent records of the pack. Time of the first record is used as
+// the pack base time, and record times are relative to it.
+func EncodeSenMLBatch(records []Record) ([]byte, error) {
+	if len(records) == 0 {
+		return nil, ErrEmptyPack
+	}
+	now := senMLTime(time.Now())
+	bt := records[0].Time
+	if bt == 0 {
+		bt = now
+	}
+	p := senml.Pack{
+		Records: make([]senml.Record, len(records)),
+	}
+	bn := ""
+	for i, r := range records {
+		rec := senml.Record{
+			Name: r.Name,
+			Unit: r.Unit,
+			Time: r.Time,
+		}
+		if err := setValue(&rec, r.Value, r.Compressed); err != nil {
+			return nil, err
+		}
+		if rec.Time == 0 {
+			rec.Time = now
+		}
+		rec.Time -= bt
+		if i == 0 {
+			rec.BaseTime = bt
+		}
+		if i == 0 || r.BaseName != bn {
+			rec.BaseName = r.BaseName
+			bn = r.BaseName
+		}
+		p.Records[i] = rec
+	}
+	if err := senml.Validate(p); err != nil {
+		return nil, errors.Wrap(ErrMalformedPack, err)
+	}
+	return senml.Encode(p, senml.JSON)
+}
+
+// DecodeSenMLBatch parses SenML JSON pack produced by EncodeSenMLBatch,
+// resolving base name and base time of the records. Compressed values are
+// decompressed.
+func DecodeSenMLBatch(payload []byte) ([]Record, error) {
+	p, err := senml.Decode(payload, senml.JSON)
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformedPack, err)
+	}
+	if len(p.Records) == 0 {
+		return nil, ErrEmptyPack
+	}
+	records := make([]Record, len(p.Records))
+	bn, bt := "", 0.0
+	for i, r := range p.Records {
+		if r.BaseName != "" {
+			bn = r.BaseName
+		}
+		if r.BaseTime != 0 {
+			bt = r.BaseTime
+		}
+		sv, compressed, err := value(r)
+		if err != nil {
+			return nil, err
+		}
+		unit := r.Unit
+		if compressed {
+			unit = ""
+		}
+		records[i] = Record{
+			BaseName:   bn,
+			Name:       r.Name,
+			Unit:       unit,
+			Value:      sv,
+			Time:       bt + r.Time,
+			Compressed: compressed,
+		}
+	}
+	return records, nil
+}
+
+// SplitSenML decodes SenML JSON pack into records resolved to carry their
+// base name and absolute time, so records of different packs can be joined
+// by JoinSenML. Returns ErrMalformedPack if payload isn't SenML JSON pack or
+// uses base fields other than base name and base time.
+func SplitSenML(payload []byte) ([]senml.Record, error) {
+	p, err := senml.Decode(payload, senml.JSON)
+	if err != nil {
+		return nil, errors.Wrap(ErrMalformedPack, err)
+	}
+	if len(p.Records) == 0 {
+		return nil, ErrEmptyPack
+	}
+	bn, bt := "", 0.0
+	for i, r := range p.Records {
+		if r.BaseUnit != "" || r.BaseValue != 0 || r.BaseSum != 0 {
+			return nil, errors.Wrap(ErrMalformedPack, errors.New("unsupported SenML base field"))
+		}
+		if r.BaseName != "" {
+			bn = r.BaseName
+		}
+		if r.BaseTime != 0 {
+			bt = r.BaseTime
+		}
+		r.BaseName = bn
+		r.BaseTime = 0
+		r.Time += bt
+		p.Records[i] = r
+	}
+	return p.Records, nil
+}
+
+// JoinSenML encodes records split by SplitSenML into a single SenML JSON pack,
+// preserving their order. Base name is emitted only when it differs from
+// the base name of the previous record.
+func JoinSenML(records []senml.Record) ([]byte, error) {
+	if len(records) == 0 {
+		return nil, ErrEmptyPack
+	}
+	p := senml.Pack{Records: make([]senml.Record, len(records))}
+	bn := ""
+	for i, r := range records {
+		if i > 0 && r.BaseName == bn {
+			r.BaseName = ""
+		}
+		bn = records[i].BaseName
+		p.Records[i] = r
+	}
+	if err := senml.Validate(p); err != nil {
+		return nil, errors.Wrap(ErrMalformedPack, err)
+	}
+	return senml.Encode(p, senml.JSON)
+}
+
+// BatchWriter accumulates written chunks as SenML records and flushes them as
+// a single SenML pack once maxRecords are buffered or window elapses since the
+// first buffered record, whichever comes first.
+type BatchWriter struct {
+	bn         string
+	n          string
+	maxRecords int
+	window     time.Duration
+	flush      func(payload []byte) error
+	records    []Record
+	timer      *time.Timer
+	err        error
+	mu         sync.Mutex
+}
+
+// NewBatchWriter returns batch writer encoding written chunks as records with base
+// name bn and name n, and passing encoded packs to flush.
+func NewBatchWriter(bn, n string, maxRecords int, window time.Duration, flush func(payload []byte) error) *BatchWriter {
+	return &BatchWriter{
+		bn:         bn,
+		n:          n,
+		maxRecords: maxRecords,
+		window:     window,
+		flush:      flush,
+	}
+}
+
+// Write buffers p as a single record. Error of the flush triggered by the
+// time window is returned by the subsequent Write or Flush.
+func (w *BatchWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.err; err != nil {
+		w.err = nil
+		return 0, err
+	}
+	w.records = append(w.records, Record{
+		BaseName: w.bn,
+		Name:     w.n,
+		Value:    string(p),
+		Time:     senMLTime(time.Now()),
+	})
+	if len(w.records) >= w.maxRecords {
+		return len(p), w.flushRecords()
+	}
+	if w.timer == nil && w.window > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(w.window, func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			// Records may have been flushed meanwhile, and the timer of the
+			// records buffered since armed.
+			if w.timer != timer {
+				return
+			}
+			w.timer = nil
+			if err := w.flushRecords(); err != nil {
+				w.err = err
+			}
+		})
+		w.timer = timer
+	}
+	return len(p), nil
+}
+
+// Flush flushes buffered records. Error of the flush triggered by the time
+// window, if any, is returned along with the error of this flush.
+func (w *BatchWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	err := w.err
+	w.err = nil
+	return goerrors.Join(err, w.flushRecords())
+}
+
+func (w *BatchWriter) flushRecords() error {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	if len(w.records) == 0 {
+		return nil
+	}
+	records := w.records
+	w.records = nil
+	payload, err := EncodeSenMLBatch(records)
+	if err != nil {
+		return err
+	}
+	return w.flush(payload)
+}
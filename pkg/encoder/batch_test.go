@@ -0,0 +1,187 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package encoder_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/absmach/senml"
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeSenMLBatch(t *testing.T) {
+	records := []encoder.Record{
+		{BaseName: "1:", Name: "term", Value: "a"},
+		{BaseName: "1:", Name: "term", Value: "b"},
+		{BaseName: "2:", Name: "term", Value: "c"},
+	}
+
+	payload, err := encoder.EncodeSenMLBatch(records)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error encoding batch: %s", err))
+
+	p, err := senml.Decode(payload, senml.JSON)
+	assert.Nil(t, err, fmt.Sprintf("expected valid SenML pack got error: %s", err))
+	p, err = senml.Normalize(p)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error normalizing pack: %s", err))
+	assert.Len(t, p.Records, len(records), "expected all the records in a single pack")
+	for i, rec := range records {
+		assert.Equal(t, rec.BaseName+rec.Name, p.Records[i].Name, fmt.Sprintf("record %d: unexpected name", i))
+		assert.Equal(t, rec.Value, *p.Records[i].StringValue, fmt.Sprintf("record %d: expected order to be preserved", i))
+	}
+
+	for i := 1; i < len(p.Records); i++ {
+		assert.GreaterOrEqual(t, p.Records[i].Time, p.Records[i-1].Time, fmt.Sprintf("record %d: expected resolved time not to decrease", i))
+	}
+
+	ts := 1700000000.0
+	payload, err = encoder.EncodeSenMLBatch([]encoder.Record{
+		{BaseName: "1:", Name: "term", Value: "a", Time: ts},
+		{BaseName: "1:", Name: "term", Value: "b", Time: ts + 2},
+	})
+	assert.Nil(t, err, fmt.Sprintf("unexpected error encoding batch: %s", err))
+	expected := `[{"bn":"1:","bt":1700000000,"n":"term","vs":"a"},{"n":"term","t":2,"vs":"b"}]`
+	assert.Equal(t, expected, string(payload), "expected record times relative to base time")
+
+	_, err = encoder.EncodeSenMLBatch(nil)
+	assert.Equal(t, encoder.ErrEmptyPack, err, fmt.Sprintf("expected error %s got %s", encoder.ErrEmptyPack, err))
+}
+
+func TestBatchWriter(t *testing.T) {
+	var mu sync.Mutex
+	packs := [][]string{}
+	flush := func(payload []byte) error {
+		p, err := senml.Decode(payload, senml.JSON)
+		assert.Nil(t, err, fmt.Sprintf("expected valid SenML pack got error: %s", err))
+		values := []string{}
+		for _, r := range p.Records {
+			values = append(values, *r.StringValue)
+		}
+		mu.Lock()
+		packs = append(packs, values)
+		mu.Unlock()
+		return nil
+	}
+	flushed := func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string{}, packs...)
+	}
+
+	w := encoder.NewBatchWriter("1:", "term", 3, 50*time.Millisecond, flush)
+	for _, v := range []string{"a", "b", "c", "d"} {
+		_, err := w.Write([]byte(v))
+		assert.Nil(t, err, fmt.Sprintf("unexpected error writing: %s", err))
+	}
+	assert.Equal(t, [][]string{{"a", "b", "c"}}, flushed(), "expected pack to be flushed on size threshold")
+
+	assert.Eventually(t, func() bool {
+		return len(flushed()) == 2
+	}, time.Second, 10*time.Millisecond, "expected pack to be flushed on time window")
+	assert.Equal(t, []string{"d"}, flushed()[1], "expected remaining record in the second pack")
+
+	err := w.Flush()
+	assert.Nil(t, err, fmt.Sprintf("unexpected error flushing: %s", err))
+	assert.Len(t, flushed(), 2, "expected empty flush not to publish")
+}
+
+func TestBatchWriterFlushError(t *testing.T) {
+	errFlush := errors.New("flush failed")
+	var mu sync.Mutex
+	calls := 0
+	flush := func(payload []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		calls++
+		if calls == 1 {
+			return errFlush
+		}
+		return nil
+	}
+	flushes := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls
+	}
+
+	w := encoder.NewBatchWriter("1:", "term", 3, 10*time.Millisecond, flush)
+	_, err := w.Write([]byte("a"))
+	assert.Nil(t, err, fmt.Sprintf("unexpected error writing: %s", err))
+	assert.Eventually(t, func() bool {
+		return flushes() == 1
+	}, time.Second, 5*time.Millisecond, "expected pack to be flushed on time window")
+
+	err = w.Flush()
+	assert.True(t, errors.Contains(err, errFlush), fmt.Sprintf("expected error %s got %s", errFlush, err))
+	err = w.Flush()
+	assert.Nil(t, err, fmt.Sprintf("expected flush error to be returned once got %s", err))
+
+	_, err = w.Write([]byte("b"))
+	assert.Nil(t, err, fmt.Sprintf("unexpected error writing: %s", err))
+	err = w.Flush()
+	assert.Nil(t, err, fmt.Sprintf("unexpected error flushing: %s", err))
+	assert.Equal(t, 2, flushes(), "expected buffered record to be flushed")
+}
+
+func TestDecodeSenMLBatch(t *testing.T) {
+	ts := 1700000000.0
+	records := []encoder.Record{
+		{BaseName: "1:", Name: "exec", Value: strings.Repeat("out\n", 100), Time: ts, Compressed: true},
+		{BaseName: "1:", Name: "request_id", Value: "request-1", Time: ts + 1},
+		{BaseName: "2:", Name: "exec", Unit: "B", Value: "c", Time: ts + 2},
+	}
+
+	payload, err := encoder.EncodeSenMLBatch(records)
+	require.Nil(t, err, fmt.Sprintf("unexpected error encoding batch: %s", err))
+	got, err := encoder.DecodeSenMLBatch(payload)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding batch: %s", err))
+	assert.Equal(t, records, got, "expected records to round trip")
+
+	_, err = encoder.DecodeSenMLBatch([]byte("[]"))
+	assert.True(t, errors.Contains(err, encoder.ErrEmptyPack), fmt.Sprintf("expected error %s got %s", encoder.ErrEmptyPack, err))
+	_, err = encoder.DecodeSenMLBatch([]byte(`[{"bn":"1:","n":"exec","v":1}]`))
+	assert.True(t, errors.Contains(err, encoder.ErrMissingValue), fmt.Sprintf("expected error %s got %s", encoder.ErrMissingValue, err))
+}
+
+func TestSplitJoinSenML(t *testing.T) {
+	packs := []string{
+		`[{"bn":"1:","bt":1700000000,"n":"exec","vs":"a"},{"n":"exec","t":2,"vs":"b"}]`,
+		`[{"bn":"1:","bt":1700000005,"n":"exec","vs":"c"}]`,
+		`[{"bn":"2:","n":"exec","t":1700000006,"vs":"d"}]`,
+	}
+	var records []senml.Record
+	for _, p := range packs {
+		recs, err := encoder.SplitSenML([]byte(p))
+		require.Nil(t, err, fmt.Sprintf("unexpected error splitting pack: %s", err))
+		records = append(records, recs...)
+	}
+
+	payload, err := encoder.JoinSenML(records)
+	require.Nil(t, err, fmt.Sprintf("unexpected error joining records: %s", err))
+	expected := `[{"bn":"1:","n":"exec","t":1700000000,"vs":"a"},{"n":"exec","t":1700000002,"vs":"b"},{"n":"exec","t":1700000005,"vs":"c"},{"bn":"2:","n":"exec","t":1700000006,"vs":"d"}]`
+	assert.Equal(t, expected, string(payload), "expected records of all the packs with resolved base fields")
+
+	cases := []struct {
+		desc    string
+		payload string
+		err     error
+	}{
+		{desc: "split non-SenML payload", payload: "output", err: encoder.ErrMalformedPack},
+		{desc: "split empty pack", payload: "[]", err: encoder.ErrEmptyPack},
+		{desc: "split pack with base unit", payload: `[{"bn":"1:","bu":"A","n":"current","v":1}]`, err: encoder.ErrMalformedPack},
+	}
+	for _, tc := range cases {
+		_, err := encoder.SplitSenML([]byte(tc.payload))
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+	}
+
+	_, err = encoder.JoinSenML(nil)
+	assert.Equal(t, encoder.ErrEmptyPack, err, fmt.Sprintf("expected error %s got %s", encoder.ErrEmptyPack, err))
+}
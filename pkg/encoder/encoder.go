@@ -4,26 +4,262 @@
 package encoder
 
 import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
 	"time"
 
 	"github.com/absmach/senml"
+	"github.com/andychao217/magistrala/pkg/errors"
 )
 
+const (
+	// JSON is a SenML JSON format.
+	JSON = "json"
+
+	// CBOR is a SenML CBOR format.
+	CBOR = "cbor"
+
+	// Gzip is the unit of SenML record carrying gzip compressed string value
+	// as base64 encoded data value.
+	Gzip = "gzip"
+)
+
+var (
+	// ErrUnsupportedFormat indicates that SenML format is not supported.
+	ErrUnsupportedFormat = errors.New("unsupported SenML format")
+
+	// ErrMalformedPack indicates that payload is not a valid SenML pack.
+	ErrMalformedPack = errors.New("malformed SenML pack")
+
+	// ErrEmptyPack indicates that decoded SenML pack contains no records.
+	ErrEmptyPack = errors.New("empty SenML pack")
+
+	// ErrTooManyRecords indicates that SenML pack contains more than one record.
+	ErrTooManyRecords = errors.New("too many SenML records")
+
+	// ErrMissingBaseName indicates that SenML record has no base name.
+	ErrMissingBaseName = errors.New("missing SenML base name")
+
+	// ErrMissingName indicates that SenML record has no name.
+	ErrMissingName = errors.New("missing SenML name")
+
+	// ErrMissingValue indicates that SenML record has no string value.
+	ErrMissingValue = errors.New("missing SenML string value")
+
+	// ErrMalformedCompressed indicates that compressed SenML value can't be
+	// decompressed.
+	ErrMalformedCompressed = errors.New("malformed compressed SenML value")
+)
+
+// Record represents the single SenML record produced by the agent.
+type Record struct {
+	BaseName string
+	Name     string
+	Unit     string
+	Value    string
+	Time     float64
+	// Compressed value is encoded as gzip compressed data value with Gzip
+	// unit, replacing the unit.
+	Compressed bool
+}
+
+// Options set the fields of the encoded record. Zero values keep the
+// defaults, which are no base name, name or unit, JSON format and the
+// current time.
+type Options struct {
+	BaseName string
+	Name     string
+	Unit     string
+	// Format is either JSON or CBOR.
+	Format string
+	Time   time.Time
+	// Compress encodes the value gzip compressed, see Record.Compressed.
+	Compress bool
+}
+
+// EncodeSenML encodes the record with string value sv, stamped with the current time.
 func EncodeSenML(bn, n, sv string) ([]byte, error) {
-	ts := float64(time.Now().UnixNano()) / float64(time.Second)
+	return EncodeWithOptions(sv, Options{BaseName: bn, Name: n})
+}
+
+// EncodeSenMLAt encodes the record the same way as EncodeSenML, stamped with the given time.
+func EncodeSenMLAt(bn, n, sv string, t time.Time) ([]byte, error) {
+	return EncodeWithOptions(sv, Options{BaseName: bn, Name: n, Time: t})
+}
+
+// EncodeSenMLCBOR encodes the record the same way as EncodeSenML, using SenML CBOR representation.
+func EncodeSenMLCBOR(bn, n, sv string) ([]byte, error) {
+	return EncodeWithOptions(sv, Options{BaseName: bn, Name: n, Format: CBOR})
+}
+
+// EncodeSenMLCompressed encodes the record the same way as EncodeSenML, with
+// gzip compressed value. DecodeSenML decompresses it.
+func EncodeSenMLCompressed(bn, n, sv string) ([]byte, error) {
+	return EncodeWithOptions(sv, Options{BaseName: bn, Name: n, Compress: true})
+}
+
+// Encode encodes the record using the given format, which is either JSON or CBOR.
+func Encode(format, bn, n, sv string) ([]byte, error) {
+	if format == "" {
+		return nil, ErrUnsupportedFormat
+	}
+	return EncodeWithOptions(sv, Options{BaseName: bn, Name: n, Format: format})
+}
+
+// EncodeWithOptions encodes the record with string value sv and the fields
+// set by the options. Returns ErrUnsupportedFormat if the format is neither
+// JSON nor CBOR.
+func EncodeWithOptions(sv string, opts Options) ([]byte, error) {
+	var format senml.Format
+	switch opts.Format {
+	case "", JSON:
+		format = senml.JSON
+	case CBOR:
+		format = senml.CBOR
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+	t := opts.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	rec := senml.Record{
+		BaseName: opts.BaseName,
+		Name:     opts.Name,
+		Unit:     opts.Unit,
+		Time:     senMLTime(t),
+	}
+	if err := setValue(&rec, sv, opts.Compress); err != nil {
+		return nil, err
+	}
+	s := senml.Pack{
+		Records: []senml.Record{rec},
+	}
+	return senml.Encode(s, format)
+}
+
+// setValue sets the string value of the record, or its gzip compressed data
+// value.
+func setValue(rec *senml.Record, sv string, compress bool) error {
+	if !compress {
+		rec.StringValue = &sv
+		return nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(sv)); err != nil {
+		return errors.New(err.Error())
+	}
+	if err := zw.Close(); err != nil {
+		return errors.New(err.Error())
+	}
+	dv := base64.StdEncoding.EncodeToString(buf.Bytes())
+	rec.DataValue = &dv
+	rec.Unit = Gzip
+	return nil
+}
+
+// value returns the string value of the record, decompressing the compressed
+// one.
+func value(r senml.Record) (string, bool, error) {
+	if r.Unit != Gzip || r.DataValue == nil {
+		if r.StringValue == nil {
+			return "", false, ErrMissingValue
+		}
+		return *r.StringValue, false, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(*r.DataValue)
+	if err != nil {
+		return "", false, errors.Wrap(ErrMalformedCompressed, err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", false, errors.Wrap(ErrMalformedCompressed, err)
+	}
+	defer zr.Close()
+	sv, err := io.ReadAll(zr)
+	if err != nil {
+		return "", false, errors.Wrap(ErrMalformedCompressed, err)
+	}
+	return string(sv), true, nil
+}
+
+// EncodeHeartbeat encodes liveness message carrying uptime in seconds,
+// version and the numbers of online and offline services, stamped with the
+// given time.
+func EncodeHeartbeat(bn string, uptime time.Duration, version string, online, offline int, t time.Time) ([]byte, error) {
+	up := uptime.Seconds()
+	on, off := float64(online), float64(offline)
 	s := senml.Pack{
 		Records: []senml.Record{
 			{
-				BaseName:    bn,
-				Name:        n,
-				Time:        ts,
-				StringValue: &sv,
+				BaseName: bn,
+				BaseTime: senMLTime(t),
+				Name:     "uptime",
+				Unit:     "s",
+				Value:    &up,
+			},
+			{
+				Name:        "version",
+				StringValue: &version,
+			},
+			{
+				Name:  "services_online",
+				Value: &on,
+			},
+			{
+				Name:  "services_offline",
+				Value: &off,
 			},
 		},
 	}
-	payload, err := senml.Encode(s, senml.JSON)
+	return senml.Encode(s, senml.JSON)
+}
+
+// senMLTime converts t to SenML time, which is Unix time in seconds.
+func senMLTime(t time.Time) float64 {
+	return float64(t.UnixNano()) / float64(time.Second)
+}
+
+// DecodeSenML parses SenML payload produced by EncodeSenML.
+// The payload must contain exactly one record. Compressed value is
+// decompressed.
+func DecodeSenML(payload []byte) (Record, error) {
+	p, err := senml.Decode(payload, senml.JSON)
 	if err != nil {
-		return nil, err
+		return Record{}, errors.Wrap(ErrMalformedPack, err)
+	}
+	switch {
+	case len(p.Records) == 0:
+		return Record{}, ErrEmptyPack
+	case len(p.Records) > 1:
+		return Record{}, ErrTooManyRecords
+	}
+
+	r := p.Records[0]
+	switch {
+	case r.BaseName == "":
+		return Record{}, ErrMissingBaseName
+	case r.Name == "":
+		return Record{}, ErrMissingName
 	}
-	return payload, nil
+	sv, compressed, err := value(r)
+	if err != nil {
+		return Record{}, err
+	}
+	unit := r.Unit
+	if compressed {
+		unit = ""
+	}
+
+	return Record{
+		BaseName:   r.BaseName,
+		Name:       r.Name,
+		Unit:       unit,
+		Value:      sv,
+		Time:       r.Time,
+		Compressed: compressed,
+	}, nil
 }
@@ -0,0 +1,217 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package encoder_test
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/absmach/senml"
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeSenML(t *testing.T) {
+	valid, err := encoder.EncodeSenML("1:", "exec", "output")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error encoding SenML: %s", err))
+	noBaseName, err := encoder.EncodeSenML("", "exec", "output")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error encoding SenML: %s", err))
+
+	cases := []struct {
+		desc    string
+		payload []byte
+		bn      string
+		n       string
+		value   string
+		err     error
+	}{
+		{
+			desc:    "decode encoded record",
+			payload: valid,
+			bn:      "1:",
+			n:       "exec",
+			value:   "output",
+		},
+		{
+			desc:    "decode record without base name",
+			payload: noBaseName,
+			err:     encoder.ErrMissingBaseName,
+		},
+		{
+			desc:    "decode record without name",
+			payload: []byte(`[{"bn":"1:exec","vs":"output"}]`),
+			err:     encoder.ErrMissingName,
+		},
+		{
+			desc:    "decode record without string value",
+			payload: []byte(`[{"bn":"1:","n":"exec","v":1}]`),
+			err:     encoder.ErrMissingValue,
+		},
+		{
+			desc:    "decode pack with multiple records",
+			payload: []byte(`[{"bn":"1:","n":"exec","vs":"a"},{"n":"exec","vs":"b"}]`),
+			err:     encoder.ErrTooManyRecords,
+		},
+		{
+			desc:    "decode malformed pack",
+			payload: []byte(`{`),
+			err:     encoder.ErrMalformedPack,
+		},
+		{
+			desc:    "decode empty pack",
+			payload: []byte(`[]`),
+			err:     encoder.ErrEmptyPack,
+		},
+	}
+
+	for _, tc := range cases {
+		rec, err := encoder.DecodeSenML(tc.payload)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		if tc.err != nil {
+			continue
+		}
+		assert.Equal(t, tc.bn, rec.BaseName, fmt.Sprintf("%s: expected base name %s got %s", tc.desc, tc.bn, rec.BaseName))
+		assert.Equal(t, tc.n, rec.Name, fmt.Sprintf("%s: expected name %s got %s", tc.desc, tc.n, rec.Name))
+		assert.Equal(t, tc.value, rec.Value, fmt.Sprintf("%s: expected value %s got %s", tc.desc, tc.value, rec.Value))
+		assert.Empty(t, rec.Unit, fmt.Sprintf("%s: expected empty unit got %s", tc.desc, rec.Unit))
+		assert.NotZero(t, rec.Time, fmt.Sprintf("%s: expected time to be set", tc.desc))
+	}
+}
+
+func TestEncodeSenMLCBOR(t *testing.T) {
+	// Known-good SenML CBOR encoding of
+	// [{"bn":"1:","n":"term","t":1700000000.5,"vs":"ls"}].
+	fixture := "81a42162313a00647465726d06fb41d954fc4020000003626c73"
+
+	opts := encoder.Options{BaseName: "1:", Name: "term", Format: encoder.CBOR, Time: time.Unix(1700000000, 500000000)}
+	payload, err := encoder.EncodeWithOptions("ls", opts)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error encoding SenML CBOR: %s", err))
+	assert.Equal(t, fixture, hex.EncodeToString(payload), "expected CBOR to match the fixture")
+
+	payload, err = encoder.EncodeSenMLCBOR("1:", "term", "ls")
+	assert.Nil(t, err, fmt.Sprintf("unexpected error encoding SenML CBOR: %s", err))
+	p, err := senml.Decode(payload, senml.CBOR)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error decoding SenML CBOR: %s", err))
+	assert.Len(t, p.Records, 1, "expected single SenML record")
+}
+
+func TestEncode(t *testing.T) {
+	cases := []struct {
+		desc   string
+		format string
+		err    error
+	}{
+		{desc: "encode JSON", format: encoder.JSON},
+		{desc: "encode CBOR", format: encoder.CBOR},
+		{desc: "encode unsupported format", format: "xml", err: encoder.ErrUnsupportedFormat},
+	}
+
+	for _, tc := range cases {
+		_, err := encoder.Encode(tc.format, "1:", "term", "ls")
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+	}
+}
+
+func TestEncodeSenMLTime(t *testing.T) {
+	ts := time.Unix(1700000000, 500000000)
+	payload, err := encoder.EncodeSenMLAt("1:", "exec", "output", ts)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error encoding SenML: %s", err))
+	assert.Equal(t, `[{"bn":"1:","n":"exec","t":1700000000.5,"vs":"output"}]`, string(payload), "expected record stamped with given time")
+
+	prev := 0.0
+	for i := 0; i < 5; i++ {
+		payload, err := encoder.EncodeSenML("1:", "exec", "output")
+		assert.Nil(t, err, fmt.Sprintf("unexpected error encoding SenML: %s", err))
+		rec, err := encoder.DecodeSenML(payload)
+		assert.Nil(t, err, fmt.Sprintf("unexpected error decoding SenML: %s", err))
+		assert.NotZero(t, rec.Time, "expected t field to be present")
+		assert.GreaterOrEqual(t, rec.Time, prev, "expected time to be monotonic")
+		prev = rec.Time
+	}
+}
+
+func TestEncodeWithOptions(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	cases := []struct {
+		desc    string
+		opts    encoder.Options
+		payload string
+		err     error
+	}{
+		{
+			desc:    "encode with base name, name and unit",
+			opts:    encoder.Options{BaseName: "device:", Name: "term", Unit: "B", Time: ts},
+			payload: `[{"bn":"device:","n":"term","u":"B","t":1700000000,"vs":"ls"}]`,
+		},
+		{
+			desc:    "encode with name only",
+			opts:    encoder.Options{Name: "term", Time: ts},
+			payload: `[{"n":"term","t":1700000000,"vs":"ls"}]`,
+		},
+		{
+			desc:    "encode with explicit JSON format",
+			opts:    encoder.Options{BaseName: "device:", Name: "term", Format: encoder.JSON, Time: ts},
+			payload: `[{"bn":"device:","n":"term","t":1700000000,"vs":"ls"}]`,
+		},
+		{
+			desc: "encode with unsupported format",
+			opts: encoder.Options{Name: "term", Format: "xml"},
+			err:  encoder.ErrUnsupportedFormat,
+		},
+	}
+
+	for _, tc := range cases {
+		payload, err := encoder.EncodeWithOptions("ls", tc.opts)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		if tc.err != nil {
+			continue
+		}
+		assert.Equal(t, tc.payload, string(payload), fmt.Sprintf("%s: unexpected payload", tc.desc))
+	}
+
+	// CBOR carries the same fields.
+	payload, err := encoder.EncodeWithOptions("ls", encoder.Options{BaseName: "device:", Name: "term", Unit: "B", Format: encoder.CBOR})
+	require.Nil(t, err, fmt.Sprintf("unexpected error encoding SenML CBOR: %s", err))
+	pack, err := senml.Decode(payload, senml.CBOR)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding SenML CBOR: %s", err))
+	require.Len(t, pack.Records, 1)
+	assert.Equal(t, "device:", pack.Records[0].BaseName)
+	assert.Equal(t, "term", pack.Records[0].Name)
+	assert.Equal(t, "B", pack.Records[0].Unit)
+	assert.Equal(t, "ls", *pack.Records[0].StringValue)
+	assert.NotZero(t, pack.Records[0].Time, "expected record stamped with the current time")
+}
+
+func TestEncodeSenMLCompressed(t *testing.T) {
+	out := strings.Repeat("total 0\ndrwxr-xr-x 2 root root 40 Jan  1 00:00 .\n", 1000)
+
+	payload, err := encoder.EncodeSenMLCompressed("1:", "exec", out)
+	require.Nil(t, err, fmt.Sprintf("unexpected error encoding compressed SenML: %s", err))
+	assert.Less(t, len(payload), len(out)/10, "expected compressible output to shrink")
+
+	pack, err := senml.Decode(payload, senml.JSON)
+	require.Nil(t, err, fmt.Sprintf("expected valid SenML pack got error: %s", err))
+	require.Len(t, pack.Records, 1)
+	assert.Equal(t, encoder.Gzip, pack.Records[0].Unit, "expected compressed record marked with gzip unit")
+	assert.Nil(t, pack.Records[0].StringValue, "expected compressed value not to be sent as string value")
+	assert.NotNil(t, pack.Records[0].DataValue, "expected compressed value sent as data value")
+
+	rec, err := encoder.DecodeSenML(payload)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding compressed SenML: %s", err))
+	assert.Equal(t, encoder.Record{BaseName: "1:", Name: "exec", Value: out, Time: rec.Time, Compressed: true}, rec)
+
+	records, err := encoder.DecodeSenMLBatch(payload)
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding compressed SenML pack: %s", err))
+	require.Len(t, records, 1)
+	assert.Equal(t, rec, records[0], "expected batch decoding to decompress the value")
+
+	malformed := `[{"bn":"1:","n":"exec","u":"gzip","vd":"bm90IGd6aXA="}]`
+	_, err = encoder.DecodeSenML([]byte(malformed))
+	assert.True(t, errors.Contains(err, encoder.ErrMalformedCompressed), fmt.Sprintf("expected error %s got %s", encoder.ErrMalformedCompressed, err))
+}
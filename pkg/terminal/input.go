@@ -0,0 +1,112 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package terminal
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/creack/pty"
+	"golang.org/x/sys/unix"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+// ErrInvalidInput indicates that the input event is malformed, such as
+// resize to zero size or unknown signal.
+var ErrInvalidInput = errors.New("invalid terminal input")
+
+// eofChar ends the input of the foreground process, the same as ctrl-d.
+const eofChar = 0x04
+
+// Input is the event of the session input, one of InputData, InputResize
+// and InputSignal.
+type Input interface {
+	isInput()
+}
+
+// InputData is written to the shell as is, e.g. keystrokes.
+type InputData []byte
+
+// InputResize resizes the window of the session terminal.
+type InputResize struct {
+	Rows uint16
+	Cols uint16
+}
+
+// InputSignal is sent to the foreground process of the session, the same as
+// the terminal sends it on the control keys.
+type InputSignal string
+
+const (
+	// SignalInterrupt sends SIGINT, as ctrl-c does.
+	SignalInterrupt InputSignal = "interrupt"
+	// SignalQuit sends SIGQUIT, as ctrl-\ does.
+	SignalQuit InputSignal = "quit"
+	// SignalSuspend sends SIGTSTP, as ctrl-z does.
+	SignalSuspend InputSignal = "suspend"
+	// SignalEOF ends the input of the foreground process, as ctrl-d does.
+	SignalEOF InputSignal = "eof"
+)
+
+var signals = map[InputSignal]syscall.Signal{
+	SignalInterrupt: syscall.SIGINT,
+	SignalQuit:      syscall.SIGQUIT,
+	SignalSuspend:   syscall.SIGTSTP,
+}
+
+func (InputData) isInput()   {}
+func (InputResize) isInput() {}
+func (InputSignal) isInput() {}
+
+func (t *term) Input(in Input) error {
+	switch in := in.(type) {
+	case InputData:
+		return t.Send(in)
+	case InputResize:
+		if in.Rows == 0 || in.Cols == 0 {
+			return errors.Wrap(ErrInvalidInput, fmt.Errorf("window size %dx%d", in.Cols, in.Rows))
+		}
+		t.resetCounter(t.resetTimeout)
+		if err := pty.Setsize(t.ptmx, &pty.Winsize{Rows: in.Rows, Cols: in.Cols}); err != nil {
+			return errors.New(err.Error())
+		}
+		return nil
+	case InputSignal:
+		if in == SignalEOF {
+			return t.Send([]byte{eofChar})
+		}
+		sig, ok := signals[in]
+		if !ok {
+			return errors.Wrap(ErrInvalidInput, fmt.Errorf("unknown signal %q", in))
+		}
+		t.resetCounter(t.resetTimeout)
+		return t.signal(sig)
+	}
+	return errors.Wrap(ErrInvalidInput, fmt.Errorf("unknown input %T", in))
+}
+
+// signal sends the signal to the foreground process group of the session
+// terminal, which is the shell unless it runs a command.
+func (t *term) signal(sig syscall.Signal) error {
+	// Fd would switch the PTY to blocking mode, breaking the output reader.
+	conn, err := t.ptmx.SyscallConn()
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	var pgrp int
+	var ioctlErr error
+	if err := conn.Control(func(fd uintptr) {
+		pgrp, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+	}); err != nil {
+		return errors.New(err.Error())
+	}
+	if ioctlErr != nil {
+		return errors.New(ioctlErr.Error())
+	}
+	if err := syscall.Kill(-pgrp, sig); err != nil {
+		return errors.New(err.Error())
+	}
+	return nil
+}
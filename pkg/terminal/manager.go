@@ -0,0 +1,236 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package terminal
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+var (
+	// ErrSessionExists indicates that session with the UUID is already open.
+	ErrSessionExists = errors.New("terminal session already exists")
+
+	// ErrTooManySessions indicates that the maximum number of sessions is
+	// already open.
+	ErrTooManySessions = errors.New("too many terminal sessions")
+)
+
+// Metrics instruments terminal sessions.
+type Metrics struct {
+	// Sessions is the number of open sessions.
+	Sessions metrics.Gauge
+
+	// Duration observes durations of the ended sessions in seconds.
+	Duration metrics.Histogram
+}
+
+type managed struct {
+	session Session
+	opened  time.Time
+}
+
+// SessionManager keeps terminal sessions by their UUID. Sessions are removed
+// once closed or timed out, and kept as ended until reaped.
+type SessionManager struct {
+	mu         sync.Mutex
+	sessions   map[string]managed
+	ended      []Session
+	metrics    Metrics
+	logger     *slog.Logger
+	newSession func(uuid string, cfg Config, publish func(channel, payload string) error, logger *slog.Logger) (Session, error)
+}
+
+// NewSessionManager returns session manager reporting to the metrics. Unset
+// metrics are discarded.
+func NewSessionManager(m Metrics, logger *slog.Logger) *SessionManager {
+	if m.Sessions == nil {
+		m.Sessions = discard.NewGauge()
+	}
+	if m.Duration == nil {
+		m.Duration = discard.NewHistogram()
+	}
+	return &SessionManager{
+		sessions:   make(map[string]managed),
+		metrics:    m,
+		logger:     logger,
+		newSession: NewSession,
+	}
+}
+
+// Open returns the session with the UUID, starting a new one if there's none.
+func (m *SessionManager) Open(uuid string, cfg Config, publish func(channel, payload string) error) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[uuid]; ok {
+		return s.session, nil
+	}
+	return m.start(uuid, cfg, publish)
+}
+
+// Start starts a new session with the UUID. Returns ErrSessionExists if
+// there's one already. Both Open and Start return ErrTooManySessions if
+// MaxSessions of cfg are already open.
+func (m *SessionManager) Start(uuid string, cfg Config, publish func(channel, payload string) error) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.sessions[uuid]; ok {
+		return nil, ErrSessionExists
+	}
+	return m.start(uuid, cfg, publish)
+}
+
+// start must be called with m.mu held.
+func (m *SessionManager) start(uuid string, cfg Config, publish func(channel, payload string) error) (Session, error) {
+	if cfg.MaxSessions > 0 && len(m.sessions) >= cfg.MaxSessions {
+		return nil, ErrTooManySessions
+	}
+	session, err := m.newSession(uuid, cfg, publish, m.logger)
+	if err != nil {
+		return nil, err
+	}
+	m.sessions[uuid] = managed{session: session, opened: time.Now()}
+	m.metrics.Sessions.Add(1)
+
+	go func() {
+		select {
+		case <-session.IsDone():
+			// Terminal is inactive or expired, should be closed.
+			m.logger.Debug(fmt.Sprintf("Closing terminal session %s", uuid))
+		case <-session.Closed():
+			m.logger.Debug(fmt.Sprintf("Terminal session %s ended", uuid))
+		}
+		m.remove(uuid, session)
+	}()
+	return session, nil
+}
+
+// Get returns the open session with the UUID.
+func (m *SessionManager) Get(uuid string) (Session, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[uuid]
+	return s.session, ok
+}
+
+// Close removes the session with the UUID and hangs its shell up. It returns
+// false if there's no such session.
+func (m *SessionManager) Close(uuid string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[uuid]
+	if ok {
+		m.end(uuid, s)
+	}
+	return ok
+}
+
+// Len returns the number of open sessions.
+func (m *SessionManager) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+// remove removes the timed out session unless it was already replaced.
+func (m *SessionManager) remove(uuid string, session Session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.sessions[uuid]; ok && s.session == session {
+		m.end(uuid, s)
+	}
+}
+
+// Reap kills shells of the ended sessions which are still running and returns
+// the number of killed shells.
+func (m *SessionManager) Reap() (int, error) {
+	m.mu.Lock()
+	ended := m.ended
+	m.ended = nil
+	m.mu.Unlock()
+
+	reaped := 0
+	var err error
+	for _, s := range ended {
+		if !s.Alive() {
+			continue
+		}
+		if kerr := s.Kill(); kerr != nil {
+			// Keep the session failed to be killed for the next reap.
+			m.mu.Lock()
+			m.ended = append(m.ended, s)
+			m.mu.Unlock()
+			err = errors.Wrap(kerr, err)
+			continue
+		}
+		reaped++
+	}
+	return reaped, err
+}
+
+// CloseAll ends all the sessions, open and ended alike, and waits for them
+// to close. Sessions still running once the context is done are killed.
+func (m *SessionManager) CloseAll(ctx context.Context) error {
+	m.mu.Lock()
+	for uuid, s := range m.sessions {
+		m.end(uuid, s)
+	}
+	sessions := slices.DeleteFunc(m.ended, func(s Session) bool {
+		select {
+		case <-s.Closed():
+			return true
+		default:
+			return false
+		}
+	})
+	m.ended = nil
+	m.mu.Unlock()
+
+	var err error
+	for _, s := range sessions {
+		if cerr := s.Close(); cerr != nil {
+			err = errors.Wrap(cerr, err)
+		}
+	}
+
+	var stragglers []Session
+	for _, s := range sessions {
+		select {
+		case <-s.Closed():
+		case <-ctx.Done():
+			stragglers = append(stragglers, s)
+		}
+	}
+	for _, s := range stragglers {
+		if kerr := s.Kill(); kerr != nil {
+			err = errors.Wrap(kerr, err)
+			continue
+		}
+		<-s.Closed()
+	}
+	return err
+}
+
+// end removes the session and hangs its shell up, it must be called with
+// m.mu held. Hanging up doesn't wait for the shell to exit, shells that keep
+// running are killed by Reap.
+func (m *SessionManager) end(uuid string, s managed) {
+	delete(m.sessions, uuid)
+	if err := s.session.Close(); err != nil {
+		m.logger.Warn(fmt.Sprintf("Failed to close terminal session %s: %s", uuid, err))
+	}
+	// Sessions whose shell exited need no reaping.
+	m.ended = slices.DeleteFunc(m.ended, func(s Session) bool { return !s.Alive() })
+	m.ended = append(m.ended, s.session)
+	m.metrics.Sessions.Add(-1)
+	m.metrics.Duration.Observe(time.Since(s.opened).Seconds())
+}
@@ -0,0 +1,282 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package terminal
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/go-kit/kit/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSession stands for the session without starting a shell.
+type fakeSession struct {
+	Session
+	done chan bool
+}
+
+func (s *fakeSession) IsDone() chan bool {
+	return s.done
+}
+
+func (s *fakeSession) Alive() bool {
+	return true
+}
+
+func (s *fakeSession) Closed() <-chan struct{} {
+	return nil
+}
+
+func (s *fakeSession) Close() error {
+	return nil
+}
+
+type gauge struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (g *gauge) With(...string) metrics.Gauge { return g }
+
+func (g *gauge) Set(value float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value = value
+}
+
+func (g *gauge) Add(delta float64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.value += delta
+}
+
+func (g *gauge) Value() float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.value
+}
+
+type histogram struct {
+	mu           sync.Mutex
+	observations []float64
+}
+
+func (h *histogram) With(...string) metrics.Histogram { return h }
+
+func (h *histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observations = append(h.observations, value)
+}
+
+func (h *histogram) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.observations)
+}
+
+func newTestManager() (*SessionManager, *gauge, *histogram) {
+	g, h := &gauge{}, &histogram{}
+	m := NewSessionManager(Metrics{Sessions: g, Duration: h}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	m.newSession = func(string, Config, func(channel, payload string) error, *slog.Logger) (Session, error) {
+		return &fakeSession{done: make(chan bool)}, nil
+	}
+	return m, g, h
+}
+
+func TestSessionManagerMetrics(t *testing.T) {
+	m, gauge, hist := newTestManager()
+	pub := mocks.NewPublisher()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(uuid string) {
+			defer wg.Done()
+			_, err := m.Open(uuid, Config{}, pub.Publish)
+			assert.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+		}(fmt.Sprintf("%d", i%5))
+	}
+	wg.Wait()
+	assert.Equal(t, 5, m.Len(), "expected sessions with the same UUID to be shared")
+	assert.Equal(t, float64(5), gauge.Value(), "expected gauge to count open sessions")
+
+	ok := m.Close("0")
+	assert.True(t, ok, "expected session to be closed")
+	ok = m.Close("0")
+	assert.False(t, ok, "expected closed session to be missing")
+	assert.Equal(t, float64(4), gauge.Value(), "expected gauge to drop closed session")
+
+	s, ok := m.Get("1")
+	require.True(t, ok, "expected open session")
+	s.IsDone() <- true
+	assert.Eventually(t, func() bool {
+		_, ok := m.Get("1")
+		return !ok
+	}, time.Second, 10*time.Millisecond, "expected timed out session to be removed")
+	assert.Equal(t, float64(3), gauge.Value(), "expected gauge to drop timed out session")
+
+	assert.Equal(t, 3, m.Len())
+	assert.Equal(t, 2, hist.count(), "expected durations of the ended sessions")
+}
+
+func TestSessionManagerReopen(t *testing.T) {
+	m, gauge, _ := newTestManager()
+	pub := mocks.NewPublisher()
+
+	first, err := m.Open("1", Config{}, pub.Publish)
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	m.Close("1")
+	second, err := m.Open("1", Config{}, pub.Publish)
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	assert.NotSame(t, first, second, "expected new session after close")
+
+	// Closed session timing out later doesn't end its replacement.
+	first.IsDone() <- true
+	assert.Never(t, func() bool {
+		s, ok := m.Get("1")
+		return !ok || s != second
+	}, 100*time.Millisecond, 10*time.Millisecond, "expected replacement session to stay open")
+	assert.Equal(t, float64(1), gauge.Value())
+}
+
+func TestSessionManagerStart(t *testing.T) {
+	m, gauge, _ := newTestManager()
+	pub := mocks.NewPublisher()
+
+	first, err := m.Start("1", Config{}, pub.Publish)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting session: %s", err))
+	_, err = m.Start("1", Config{}, pub.Publish)
+	assert.ErrorIs(t, err, ErrSessionExists, fmt.Sprintf("expected %s got %s", ErrSessionExists, err))
+	opened, err := m.Open("1", Config{}, pub.Publish)
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	assert.Same(t, first, opened, "expected started session to be opened")
+
+	m.Close("1")
+	second, err := m.Start("1", Config{}, pub.Publish)
+	require.Nil(t, err, fmt.Sprintf("unexpected error starting session: %s", err))
+	assert.NotSame(t, first, second, "expected new session after close")
+	assert.Equal(t, float64(1), gauge.Value())
+}
+
+func TestSessionManagerMaxSessions(t *testing.T) {
+	m, _, _ := newTestManager()
+	pub := mocks.NewPublisher()
+	cfg := Config{MaxSessions: 2}
+
+	for _, uuid := range []string{"1", "2"} {
+		_, err := m.Open(uuid, cfg, pub.Publish)
+		require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	}
+	_, err := m.Open("3", cfg, pub.Publish)
+	assert.ErrorIs(t, err, ErrTooManySessions, fmt.Sprintf("expected %s got %s", ErrTooManySessions, err))
+	_, err = m.Start("3", cfg, pub.Publish)
+	assert.ErrorIs(t, err, ErrTooManySessions, fmt.Sprintf("expected %s got %s", ErrTooManySessions, err))
+	_, err = m.Open("1", cfg, pub.Publish)
+	assert.Nil(t, err, fmt.Sprintf("expected open session to be returned got %s", err))
+
+	m.Close("1")
+	_, err = m.Open("3", cfg, pub.Publish)
+	assert.Nil(t, err, fmt.Sprintf("expected session to be opened after close got %s", err))
+	assert.Equal(t, 2, m.Len())
+}
+
+func TestSessionManagerClose(t *testing.T) {
+	m := NewSessionManager(Metrics{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	pub := mocks.NewPublisher()
+
+	s, err := m.Open("1", Config{Timeout: time.Minute, Shell: "sh"}, pub.Publish)
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	pid := s.(*term).cmd.Process.Pid
+
+	assert.True(t, m.Close("1"), "expected session to be closed")
+	select {
+	case <-s.Closed():
+	case <-time.After(time.Second):
+		require.Fail(t, "expected session to end once closed")
+	}
+	assert.False(t, s.Alive(), "expected shell of the closed session to exit")
+	_, err = os.Stat(fmt.Sprintf("/proc/%d", pid))
+	assert.True(t, os.IsNotExist(err), fmt.Sprintf("expected process %d to be gone got %v", pid, err))
+
+	reaped, err := m.Reap()
+	require.Nil(t, err, fmt.Sprintf("unexpected error reaping sessions: %s", err))
+	assert.Equal(t, 0, reaped, "expected no shell to reap")
+}
+
+func TestSessionManagerReap(t *testing.T) {
+	m := NewSessionManager(Metrics{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	pub := mocks.NewPublisher()
+
+	stuck, err := m.Open("1", Config{Timeout: time.Minute, Shell: "sh"}, pub.Publish)
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	open, err := m.Open("2", Config{Timeout: time.Minute}, pub.Publish)
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	defer open.Kill()
+
+	// Shell ignoring the hangup keeps running once its session is closed.
+	err = stuck.Send([]byte("trap '' HUP; echo tra''pped\n"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error writing input: %s", err))
+	assert.Eventually(t, func() bool {
+		return strings.Contains(published(t, pub), "trapped")
+	}, 5*time.Second, 10*time.Millisecond, "expected shell to ignore hangup")
+	m.Close("1")
+	time.Sleep(100 * time.Millisecond)
+	require.True(t, stuck.Alive(), "expected shell of the closed session to run")
+	pid := stuck.(*term).cmd.Process.Pid
+
+	reaped, err := m.Reap()
+	require.Nil(t, err, fmt.Sprintf("unexpected error reaping sessions: %s", err))
+	assert.Equal(t, 1, reaped, "expected shell of the closed session to be reaped")
+	assert.False(t, stuck.Alive(), "expected reaped shell to exit")
+	_, err = os.Stat(fmt.Sprintf("/proc/%d", pid))
+	assert.True(t, os.IsNotExist(err), fmt.Sprintf("expected process %d to be gone got %v", pid, err))
+	assert.True(t, open.Alive(), "expected shell of the open session to run")
+
+	reaped, err = m.Reap()
+	require.Nil(t, err, fmt.Sprintf("unexpected error reaping sessions: %s", err))
+	assert.Equal(t, 0, reaped, "expected no sessions to reap")
+}
+
+func TestSessionManagerCloseAll(t *testing.T) {
+	m := NewSessionManager(Metrics{}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	pub := mocks.NewPublisher()
+	goroutines := runtime.NumGoroutine()
+
+	var pids []int
+	for i := 0; i < 3; i++ {
+		s, err := m.Open(fmt.Sprintf("%d", i), Config{Timeout: time.Minute}, pub.Publish)
+		require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+		pids = append(pids, s.(*term).cmd.Process.Pid)
+	}
+	// Closed session shell is ended as well.
+	m.Close("0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := m.CloseAll(ctx)
+	require.Nil(t, err, fmt.Sprintf("unexpected error closing sessions: %s", err))
+	assert.Equal(t, 0, m.Len(), "expected no open sessions")
+
+	for _, pid := range pids {
+		_, err = os.Stat(fmt.Sprintf("/proc/%d", pid))
+		assert.True(t, os.IsNotExist(err), fmt.Sprintf("expected process %d to be gone got %v", pid, err))
+	}
+	// Polling in place, as Eventually runs the condition on its own goroutine.
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > goroutines && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.LessOrEqual(t, runtime.NumGoroutine(), goroutines, "expected session goroutines to exit")
+}
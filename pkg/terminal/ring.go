@@ -0,0 +1,44 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package terminal
+
+// ring keeps the last len(buf) bytes written to it.
+type ring struct {
+	buf   []byte
+	start int
+	n     int
+}
+
+func newRing(size int) *ring {
+	return &ring{buf: make([]byte, size)}
+}
+
+// write appends p, overwriting the oldest bytes once the ring is full.
+func (r *ring) write(p []byte) {
+	size := len(r.buf)
+	if len(p) >= size {
+		copy(r.buf, p[len(p)-size:])
+		r.start, r.n = 0, size
+		return
+	}
+	end := (r.start + r.n) % size
+	copied := copy(r.buf[end:], p)
+	copy(r.buf, p[copied:])
+	r.n += len(p)
+	if r.n > size {
+		r.start = (r.start + r.n - size) % size
+		r.n = size
+	}
+}
+
+// bytes returns copy of the kept bytes, oldest first.
+func (r *ring) bytes() []byte {
+	out := make([]byte, 0, r.n)
+	end := r.start + r.n
+	if end <= len(r.buf) {
+		return append(out, r.buf[r.start:end]...)
+	}
+	out = append(out, r.buf[r.start:]...)
+	return append(out, r.buf[:end-len(r.buf)]...)
+}
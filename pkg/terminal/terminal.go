@@ -4,84 +4,320 @@
 package terminal
 
 import (
-	"bytes"
+	goerrors "errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"os/exec"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/creack/pty"
+	"golang.org/x/time/rate"
 
 	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/agent/pkg/topic"
 	"github.com/andychao217/magistrala/pkg/errors"
 )
 
+var (
+	// ErrFlowControlDisabled indicates that session output isn't acknowledged.
+	ErrFlowControlDisabled = errors.New("terminal output flow control disabled")
+
+	// ErrShellNotFound indicates that the session shell isn't installed.
+	ErrShellNotFound = errors.New("terminal shell not found")
+
+	// ErrInputTooLarge indicates that the input exceeds the maximum size of
+	// a single write.
+	ErrInputTooLarge = errors.New("terminal input too large")
+
+	// ErrSessionClosed indicates that the session ended while the input was
+	// paced.
+	ErrSessionClosed = errors.New("terminal session closed")
+)
+
 const (
-	terminal = "term"
-	second   = time.Duration(1 * time.Second)
+	terminal     = "term"
+	second       = time.Duration(1 * time.Second)
+	defaultShell = "bash"
 )
 
+// Config represents terminal session configuration.
+type Config struct {
+	// Timeout after which session without input is closed. Session output
+	// doesn't keep it open.
+	Timeout time.Duration
+
+	// MaxDuration after which session is closed regardless of the activity,
+	// zero disables it.
+	MaxDuration time.Duration
+
+	// Format of SenML messages carrying session output, either
+	// encoder.JSON or encoder.CBOR. Defaults to encoder.JSON.
+	Format string
+
+	// AckWindow enables output flow control when positive. Output messages
+	// are then numbered, named "term:<seq>", and up to AckWindow messages
+	// not yet acknowledged by the client are kept for retransmission.
+	AckWindow int
+
+	// ReplayBuffer is the number of the most recent output bytes kept for
+	// the reconnecting clients, zero disables it.
+	ReplayBuffer int
+
+	// Env is the environment of the session shell, nil inherits the agent
+	// environment.
+	Env []string
+
+	// Shell run by the session, looked up in the agent PATH unless it's a
+	// path. Defaults to bash.
+	Shell string
+
+	// Credential of the user the shell runs as, nil runs it as the agent
+	// user.
+	Credential *syscall.Credential
+
+	// InputRate paces the input written to the shell to the number of bytes
+	// per second, zero leaves it unlimited. Send blocks until its input is
+	// written.
+	InputRate int
+
+	// MaxInput is the maximum size of the input sent at once, zero leaves
+	// it unlimited.
+	MaxInput int
+
+	// MaxSessions bounds the number of sessions open in the session manager
+	// when the session is started, zero leaves it unbounded.
+	MaxSessions int
+
+	// Topic the session output is published to, "term/<uuid>" if not set.
+	Topic string
+
+	// Banner, if set, is the first output of the session, sent before any
+	// shell output, e.g. a compliance notice. Its line feeds are sent as
+	// CRLF, as the terminal expects them.
+	Banner string
+}
+
+// output is published output message kept until acknowledged.
+type output struct {
+	seq     uint64
+	payload string
+}
+
 type term struct {
 	uuid         string
+	format       string
 	ptmx         *os.File
+	cmd          *exec.Cmd
+	exited       chan struct{}
 	done         chan bool
+	stop         chan struct{}
+	stopOnce     sync.Once
+	closed       chan struct{}
+	closePTY     func() error
 	topic        string
 	timeout      time.Duration
 	resetTimeout time.Duration
+	maxDuration  time.Duration
+	elapsed      time.Duration
 	timer        *time.Ticker
 	publish      func(channel, payload string) error
 	logger       *slog.Logger
 	mu           sync.Mutex
+	ackWindow    int
+	seq          uint64
+	unacked      []output
+	ackMu        sync.Mutex
+	replay       *ring
+	replayMu     sync.Mutex
+	input        *rate.Limiter
+	inputMu      sync.Mutex
+	maxInput     int
 }
 
 type Session interface {
 	Send(p []byte) error
+
+	// Input routes the input event, writing data to the shell, resizing
+	// the terminal window or signalling the foreground process.
+	Input(in Input) error
+
 	IsDone() chan bool
+
+	// Ack acknowledges output messages up to and including last. Messages
+	// between last and highest received sequence number are retransmitted.
+	Ack(last, highest uint64) error
+
+	// Replay returns the most recent session output kept in the replay
+	// buffer, oldest first.
+	Replay() []byte
+
+	// Alive reports whether the session shell is still running.
+	Alive() bool
+
+	// Kill force-kills the session shell and releases its PTY.
+	Kill() error
+
+	// Close signals the session to end by hanging up its shell. It doesn't
+	// wait for the shell to exit.
+	Close() error
+
+	// Closed is closed once the session shell exited and the session
+	// goroutines returned.
+	Closed() <-chan struct{}
 	io.Writer
 }
 
-func NewSession(uuid string, timeout time.Duration, publish func(channel, payload string) error, logger *slog.Logger) (Session, error) {
+// NewSession starts the session shell and the goroutines publishing its output
+// and timing the session out. On error no session is returned.
+func NewSession(uuid string, cfg Config, publish func(channel, payload string) error, logger *slog.Logger) (Session, error) {
+	format := cfg.Format
+	if format == "" {
+		format = encoder.JSON
+	}
+	if format != encoder.JSON && format != encoder.CBOR {
+		return nil, encoder.ErrUnsupportedFormat
+	}
+	outTopic := cfg.Topic
+	if outTopic == "" {
+		outTopic = fmt.Sprintf("term/%s", uuid)
+	}
+	if err := topic.Validate(outTopic); err != nil {
+		return nil, err
+	}
+	shell := cfg.Shell
+	if shell == "" {
+		shell = defaultShell
+	}
+	shellPath, err := exec.LookPath(shell)
+	if err != nil {
+		return nil, errors.Wrap(ErrShellNotFound, err)
+	}
 	t := &term{
 		logger:       logger,
 		uuid:         uuid,
+		format:       format,
+		ackWindow:    cfg.AckWindow,
 		publish:      publish,
-		timeout:      timeout,
-		resetTimeout: timeout,
-		topic:        fmt.Sprintf("term/%s", uuid),
+		timeout:      cfg.Timeout,
+		resetTimeout: cfg.Timeout,
+		maxDuration:  cfg.MaxDuration,
+		maxInput:     cfg.MaxInput,
+		input:        inputLimiter(cfg.InputRate),
+		topic:        outTopic,
 		done:         make(chan bool),
+		stop:         make(chan struct{}),
+		closed:       make(chan struct{}),
+	}
+	if cfg.ReplayBuffer > 0 {
+		t.replay = newRing(cfg.ReplayBuffer)
 	}
 
-	c := exec.Command("bash")
+	c := exec.Command(shellPath)
+	c.Env = cfg.Env
+	if cfg.Credential != nil {
+		c.SysProcAttr = &syscall.SysProcAttr{Credential: cfg.Credential}
+	}
+	// Nothing is started before the shell, so there's nothing to clean up
+	// if it fails to start.
 	ptmx, err := pty.Start(c)
 	if err != nil {
-		return t, errors.New(err.Error())
+		return nil, errors.New(err.Error())
 	}
 	t.ptmx = ptmx
+	t.closePTY = sync.OnceValue(ptmx.Close)
+	t.cmd = c
+	t.exited = make(chan struct{})
+
+	// Shell output isn't read yet, so the banner comes first.
+	if cfg.Banner != "" {
+		if _, err := t.Write([]byte(banner(cfg.Banner))); err != nil {
+			t.logger.Warn(fmt.Sprintf("Failed to send terminal session %s banner: %s", uuid, err))
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		// Waiting releases the exited shell process.
+		if err := c.Wait(); err != nil {
+			t.logger.Debug(fmt.Sprintf("Terminal session %s shell exited: %s", uuid, err))
+		}
+		close(t.exited)
+	}()
 
 	// Copy output to mqtt
 	go func() {
+		defer wg.Done()
 		n, err := io.Copy(t, t.ptmx)
-		if err != nil {
-			t.logger.Error(fmt.Sprintf("Error sending data: %s", err))
-		}
 		t.logger.Debug(fmt.Sprintf("Data being sent: %d", n))
+		if err != nil && !shellExited(err) {
+			t.logger.Warn(fmt.Sprintf("Terminal session %s output failed: %s", uuid, err))
+			return
+		}
+		// Shell exit ends the session the same way as its timeout.
+		t.logger.Debug(fmt.Sprintf("Terminal session %s output ended", uuid))
+		select {
+		case t.done <- true:
+		case <-t.stop:
+		}
+		t.stopOnce.Do(func() { close(t.stop) })
 	}()
 
 	t.timer = time.NewTicker(1 * time.Second)
 
 	go func() {
-		for range t.timer.C {
-			t.decrementCounter()
+		defer wg.Done()
+		defer t.timer.Stop()
+		for {
+			select {
+			case <-t.timer.C:
+				if !t.decrementCounter() {
+					continue
+				}
+				select {
+				case t.done <- true:
+				case <-t.stop:
+				}
+			case <-t.stop:
+			}
+			t.logger.Debug("exiting timer routine")
+			return
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		if err := t.closePTY(); err != nil {
+			t.logger.Debug(fmt.Sprintf("Failed to close terminal session %s PTY: %s", uuid, err))
 		}
-		t.logger.Debug("exiting timer routine")
+		close(t.closed)
 	}()
 
 	return t, nil
 }
 
+// banner returns the banner with CRLF line endings, ending with a line break
+// so the shell prompt starts on its own line.
+func banner(b string) string {
+	b = strings.ReplaceAll(strings.ReplaceAll(b, "\r\n", "\n"), "\n", "\r\n")
+	if !strings.HasSuffix(b, "\r\n") {
+		b += "\r\n"
+	}
+	return b
+}
+
+// shellExited reports whether the PTY read failed because its shell exited,
+// which Linux reports as EIO, or because the PTY was closed.
+func shellExited(err error) bool {
+	return goerrors.Is(err, syscall.EIO) || goerrors.Is(err, os.ErrClosed)
+}
+
 func (t *term) resetCounter(timeout time.Duration) {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -91,14 +327,22 @@ func (t *term) resetCounter(timeout time.Duration) {
 	}
 }
 
-func (t *term) decrementCounter() {
+// decrementCounter counts down a second of the session and reports whether
+// the session timed out, either idle or reaching its maximum duration.
+func (t *term) decrementCounter() bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
 	t.timeout -= second
-	if t.timeout == 0 {
-		t.done <- true
-		t.timer.Stop()
+	t.elapsed += second
+	if t.timeout <= 0 {
+		t.logger.Debug(fmt.Sprintf("Terminal session %s idle timed out", t.uuid))
+		return true
+	}
+	if t.maxDuration > 0 && t.elapsed >= t.maxDuration {
+		t.logger.Debug(fmt.Sprintf("Terminal session %s reached maximum duration", t.uuid))
+		return true
 	}
+	return false
 }
 
 func (t *term) IsDone() chan bool {
@@ -106,9 +350,12 @@ func (t *term) IsDone() chan bool {
 }
 
 func (t *term) Write(p []byte) (int, error) {
-	t.resetCounter(t.resetTimeout)
 	n := len(p)
-	payload, err := encoder.EncodeSenML(t.uuid, terminal, string(p))
+	t.record(p)
+	if t.ackWindow > 0 {
+		return n, t.writeSeq(p)
+	}
+	payload, err := encoder.EncodeWithOptions(string(p), t.encoding(terminal))
 	if err != nil {
 		return n, err
 	}
@@ -119,12 +366,159 @@ func (t *term) Write(p []byte) (int, error) {
 	return n, nil
 }
 
-func (t *term) Send(p []byte) error {
-	in := bytes.NewReader(p)
-	nr, err := io.Copy(t.ptmx, in)
-	t.logger.Debug(fmt.Sprintf("Written to ptmx: %d", nr))
+// encoding returns options of the output record named n, which is grouped
+// under the session uuid as base name.
+func (t *term) encoding(n string) encoder.Options {
+	return encoder.Options{
+		BaseName: t.uuid,
+		Name:     n,
+		Format:   t.format,
+	}
+}
+
+// writeSeq publishes numbered output message and keeps it for retransmission.
+func (t *term) writeSeq(p []byte) error {
+	t.ackMu.Lock()
+	defer t.ackMu.Unlock()
+
+	t.seq++
+	payload, err := encoder.EncodeWithOptions(string(p), t.encoding(fmt.Sprintf("%s:%d", terminal, t.seq)))
 	if err != nil {
+		return err
+	}
+	if len(t.unacked) == t.ackWindow {
+		t.logger.Debug(fmt.Sprintf("Output %d of terminal session %s dropped from replay buffer", t.unacked[0].seq, t.uuid))
+		t.unacked = t.unacked[1:]
+	}
+	t.unacked = append(t.unacked, output{seq: t.seq, payload: string(payload)})
+
+	// Publish failure is recovered by retransmission on the client gap ack.
+	if err := t.publish(t.topic, string(payload)); err != nil {
+		t.logger.Warn(fmt.Sprintf("Failed to publish output %d of terminal session %s: %s", t.seq, t.uuid, err))
+	}
+	return nil
+}
+
+func (t *term) Ack(last, highest uint64) error {
+	t.ackMu.Lock()
+	defer t.ackMu.Unlock()
+
+	if t.ackWindow <= 0 {
+		return ErrFlowControlDisabled
+	}
+	i := 0
+	for i < len(t.unacked) && t.unacked[i].seq <= last {
+		i++
+	}
+	t.unacked = t.unacked[i:]
+	for _, o := range t.unacked {
+		if o.seq >= highest {
+			break
+		}
+		if err := t.publish(t.topic, o.payload); err != nil {
+			return errors.New(err.Error())
+		}
+	}
+	return nil
+}
+
+func (t *term) record(p []byte) {
+	if t.replay == nil {
+		return
+	}
+	t.replayMu.Lock()
+	defer t.replayMu.Unlock()
+	t.replay.write(p)
+}
+
+func (t *term) Replay() []byte {
+	if t.replay == nil {
+		return nil
+	}
+	t.replayMu.Lock()
+	defer t.replayMu.Unlock()
+	return t.replay.bytes()
+}
+
+func (t *term) Alive() bool {
+	select {
+	case <-t.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+func (t *term) Kill() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	if err := t.cmd.Process.Kill(); err != nil && err != os.ErrProcessDone {
+		return errors.New(err.Error())
+	}
+	<-t.exited
+	if err := t.closePTY(); err != nil {
 		return errors.New(err.Error())
 	}
 	return nil
 }
+
+func (t *term) Close() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	if err := t.cmd.Process.Signal(syscall.SIGHUP); err != nil && err != os.ErrProcessDone {
+		return errors.New(err.Error())
+	}
+	return nil
+}
+
+func (t *term) Closed() <-chan struct{} {
+	return t.closed
+}
+
+func (t *term) Send(p []byte) error {
+	if t.maxInput > 0 && len(p) > t.maxInput {
+		return ErrInputTooLarge
+	}
+	t.resetCounter(t.resetTimeout)
+
+	// Paced input of the concurrent sends isn't interleaved.
+	t.inputMu.Lock()
+	defer t.inputMu.Unlock()
+	for len(p) > 0 {
+		n := len(p)
+		if t.input != nil {
+			n = min(n, t.input.Burst())
+			if err := t.pace(n); err != nil {
+				return err
+			}
+		}
+		nw, err := t.ptmx.Write(p[:n])
+		t.logger.Debug(fmt.Sprintf("Written to ptmx: %d", nw))
+		if err != nil {
+			return errors.New(err.Error())
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// inputLimiter returns limiter of the input rate in bytes per second, nil if
+// it's unlimited. Up to a second of input is written at once.
+func inputLimiter(bps int) *rate.Limiter {
+	if bps <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(rate.Limit(bps), bps)
+}
+
+// pace waits until n bytes of input may be written at the input rate.
+func (t *term) pace(n int) error {
+	r := t.input.ReserveN(time.Now(), n)
+	timer := time.NewTimer(r.Delay())
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-t.stop:
+		r.Cancel()
+		return ErrSessionClosed
+	}
+}
@@ -0,0 +1,450 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package terminal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/andychao217/agent/pkg/agent/mocks"
+	"github.com/andychao217/agent/pkg/encoder"
+	"github.com/andychao217/agent/pkg/topic"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// names returns names of the published output records.
+func names(t *testing.T, pub *mocks.Publisher) []string {
+	names := []string{}
+	for _, msg := range pub.Published() {
+		rec, err := encoder.DecodeSenML([]byte(msg.Payload))
+		assert.Nil(t, err, fmt.Sprintf("unexpected error decoding output: %s", err))
+		names = append(names, rec.Name)
+	}
+	return names
+}
+
+func newTerm(cfg Config, pub *mocks.Publisher) *term {
+	return &term{
+		uuid:         "1:",
+		format:       encoder.JSON,
+		topic:        "term/1",
+		ackWindow:    cfg.AckWindow,
+		timeout:      cfg.Timeout,
+		resetTimeout: cfg.Timeout,
+		maxDuration:  cfg.MaxDuration,
+		maxInput:     cfg.MaxInput,
+		input:        inputLimiter(cfg.InputRate),
+		publish:      pub.Publish,
+		replay:       newReplay(cfg.ReplayBuffer),
+		logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+}
+
+func TestAck(t *testing.T) {
+	// Second output message is lost on the way to the client.
+	pub := mocks.NewPublisher()
+	pub.FailNth(2, errors.New("message lost"))
+	term := newTerm(Config{AckWindow: 4}, pub)
+
+	for _, out := range []string{"a", "b", "c"} {
+		_, err := term.Write([]byte(out))
+		assert.Nil(t, err, fmt.Sprintf("unexpected error writing output: %s", err))
+	}
+	assert.Equal(t, []string{"term:1", "term:3"}, names(t, pub), "expected second output to be lost")
+
+	// Client received output 1 and 3, so it reports a gap.
+	err := term.Ack(1, 3)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error acknowledging output: %s", err))
+	assert.Equal(t, []string{"term:1", "term:3", "term:2"}, names(t, pub), "expected lost output to be retransmitted")
+
+	// Output with no gap triggers no retransmission.
+	err = term.Ack(3, 3)
+	assert.Nil(t, err, fmt.Sprintf("unexpected error acknowledging output: %s", err))
+	assert.Len(t, names(t, pub), 3, "expected no retransmission")
+	assert.Empty(t, term.unacked, "expected acknowledged output to be released")
+}
+
+func TestAckDisabled(t *testing.T) {
+	pub := mocks.NewPublisher()
+	term := newTerm(Config{}, pub)
+
+	_, err := term.Write([]byte("a"))
+	assert.Nil(t, err, fmt.Sprintf("unexpected error writing output: %s", err))
+	assert.Equal(t, []string{"term"}, names(t, pub), "expected output without sequence number")
+
+	err = term.Ack(1, 1)
+	assert.True(t, errors.Contains(err, ErrFlowControlDisabled), fmt.Sprintf("expected error %s got %s", ErrFlowControlDisabled, err))
+}
+
+func TestNewSessionInvalidTopic(t *testing.T) {
+	pub := mocks.NewPublisher()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, err := NewSession("1/#", Config{}, pub.Publish, logger)
+	assert.True(t, errors.Contains(err, topic.ErrInvalidTopic), fmt.Sprintf("expected %s got %s", topic.ErrInvalidTopic, err))
+}
+
+func TestNewSessionShellNotFound(t *testing.T) {
+	pub := mocks.NewPublisher()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	goroutines := runtime.NumGoroutine()
+
+	s, err := NewSession("1", Config{Timeout: time.Minute, Shell: "agent-test-missing-shell"}, pub.Publish, logger)
+	assert.True(t, errors.Contains(err, ErrShellNotFound), fmt.Sprintf("expected %s got %s", ErrShellNotFound, err))
+	assert.Nil(t, s, "expected no session")
+	assert.Equal(t, goroutines, runtime.NumGoroutine(), "expected no goroutines started")
+	assert.Empty(t, names(t, pub), "expected no output published")
+}
+
+func TestTimeout(t *testing.T) {
+	cases := []struct {
+		desc      string
+		cfg       Config
+		input     bool
+		output    bool
+		ticks     int
+		expiredAt int
+	}{
+		{
+			desc:      "idle session",
+			cfg:       Config{Timeout: 3 * time.Second},
+			ticks:     5,
+			expiredAt: 3,
+		},
+		{
+			desc:      "session with output only",
+			cfg:       Config{Timeout: 3 * time.Second},
+			output:    true,
+			ticks:     5,
+			expiredAt: 3,
+		},
+		{
+			desc:      "session with input",
+			cfg:       Config{Timeout: 3 * time.Second},
+			input:     true,
+			ticks:     10,
+			expiredAt: 0,
+		},
+		{
+			desc:      "session with input reaching maximum duration",
+			cfg:       Config{Timeout: 3 * time.Second, MaxDuration: 5 * time.Second},
+			input:     true,
+			ticks:     10,
+			expiredAt: 5,
+		},
+	}
+
+	for _, tc := range cases {
+		pub := mocks.NewPublisher()
+		term := newTerm(tc.cfg, pub)
+		r, w, err := os.Pipe()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating pipe: %s", tc.desc, err))
+		go func() {
+			_, _ = io.Copy(io.Discard, r)
+		}()
+		term.ptmx = w
+
+		expiredAt := 0
+		for i := 1; i <= tc.ticks; i++ {
+			if tc.output {
+				_, err := term.Write([]byte("log line\n"))
+				assert.Nil(t, err, fmt.Sprintf("%s: unexpected error writing output: %s", tc.desc, err))
+			}
+			if tc.input {
+				err := term.Send([]byte("\n"))
+				assert.Nil(t, err, fmt.Sprintf("%s: unexpected error sending input: %s", tc.desc, err))
+			}
+			if term.decrementCounter() {
+				expiredAt = i
+				break
+			}
+		}
+		assert.Equal(t, tc.expiredAt, expiredAt, fmt.Sprintf("%s: expected session to expire at tick %d got %d", tc.desc, tc.expiredAt, expiredAt))
+		w.Close()
+		r.Close()
+	}
+}
+
+func newReplay(size int) *ring {
+	if size <= 0 {
+		return nil
+	}
+	return newRing(size)
+}
+
+func TestReplay(t *testing.T) {
+	cases := []struct {
+		desc   string
+		size   int
+		writes []string
+		replay string
+	}{
+		{desc: "replay disabled", size: 0, writes: []string{"abc"}, replay: ""},
+		{desc: "replay without output", size: 4, writes: nil, replay: ""},
+		{desc: "replay output within buffer", size: 8, writes: []string{"ab", "cd"}, replay: "abcd"},
+		{desc: "replay output filling buffer", size: 4, writes: []string{"ab", "cd"}, replay: "abcd"},
+		{desc: "replay output trimming oldest", size: 4, writes: []string{"abc", "def"}, replay: "cdef"},
+		{desc: "replay output wrapping repeatedly", size: 5, writes: []string{"abc", "def", "ghi", "j"}, replay: "fghij"},
+		{desc: "replay output larger than buffer", size: 3, writes: []string{"a", "bcdefg"}, replay: "efg"},
+	}
+
+	for _, tc := range cases {
+		pub := mocks.NewPublisher()
+		term := newTerm(Config{ReplayBuffer: tc.size}, pub)
+		for _, w := range tc.writes {
+			_, err := term.Write([]byte(w))
+			assert.Nil(t, err, fmt.Sprintf("%s: unexpected error writing output: %s", tc.desc, err))
+		}
+		assert.Equal(t, tc.replay, string(term.Replay()), fmt.Sprintf("%s: unexpected replay", tc.desc))
+	}
+}
+
+func TestSendPaced(t *testing.T) {
+	cases := []struct {
+		desc     string
+		rate     int
+		maxInput int
+		input    int
+		minTime  time.Duration
+		maxTime  time.Duration
+		err      error
+	}{
+		{desc: "send unlimited input", input: 4096, maxTime: 500 * time.Millisecond},
+		{desc: "send input within the rate", rate: 4096, input: 4096, maxTime: 500 * time.Millisecond},
+		{desc: "send input exceeding the rate", rate: 2048, input: 6144, minTime: 1900 * time.Millisecond, maxTime: 3 * time.Second},
+		{desc: "send input exceeding the maximum size", maxInput: 1024, input: 1025, err: ErrInputTooLarge},
+	}
+
+	for _, tc := range cases {
+		r, w, err := os.Pipe()
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error creating pipe: %s", tc.desc, err))
+		received := make(chan []byte)
+		go func() {
+			data, _ := io.ReadAll(r)
+			received <- data
+		}()
+
+		term := newTerm(Config{Timeout: time.Minute, InputRate: tc.rate, MaxInput: tc.maxInput}, mocks.NewPublisher())
+		term.ptmx = w
+		input := []byte(strings.Repeat("a", tc.input))
+
+		start := time.Now()
+		err = term.Send(input)
+		elapsed := time.Since(start)
+		w.Close()
+		data := <-received
+		r.Close()
+
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected error %s got %s", tc.desc, tc.err, err))
+		if tc.err != nil {
+			assert.Empty(t, data, fmt.Sprintf("%s: expected no input to be written", tc.desc))
+			continue
+		}
+		assert.Equal(t, input, data, fmt.Sprintf("%s: unexpected input written", tc.desc))
+		assert.GreaterOrEqual(t, elapsed, tc.minTime, fmt.Sprintf("%s: expected input to be paced", tc.desc))
+		assert.Less(t, elapsed, tc.maxTime, fmt.Sprintf("%s: input written too slowly", tc.desc))
+	}
+}
+
+func TestSendPacedClosed(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.Nil(t, err, fmt.Sprintf("unexpected error creating pipe: %s", err))
+	defer r.Close()
+	defer w.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, r)
+	}()
+
+	term := newTerm(Config{Timeout: time.Minute, InputRate: 1024}, mocks.NewPublisher())
+	term.ptmx = w
+	term.stop = make(chan struct{})
+	errs := make(chan error)
+	go func() {
+		errs <- term.Send([]byte(strings.Repeat("a", 10240)))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(term.stop)
+
+	select {
+	case err := <-errs:
+		assert.True(t, errors.Contains(err, ErrSessionClosed), fmt.Sprintf("expected error %s got %s", ErrSessionClosed, err))
+	case <-time.After(time.Second):
+		t.Fatal("expected paced send to end with the session")
+	}
+}
+
+func TestNewSessionEnv(t *testing.T) {
+	t.Setenv("AGENT_TEST_SECRET", "secret")
+	pub := mocks.NewPublisher()
+	path := "PATH=" + os.Getenv("PATH")
+
+	s, err := NewSession("1", Config{Timeout: time.Minute, Env: []string{path}}, pub.Publish, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	defer s.Kill()
+
+	environ, err := os.ReadFile(fmt.Sprintf("/proc/%d/environ", s.(*term).cmd.Process.Pid))
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading shell environment: %s", err))
+	env := strings.Split(string(environ), "\x00")
+	assert.Contains(t, env, path, "expected shell to get the configured environment")
+	assert.NotContains(t, string(environ), "AGENT_TEST_SECRET", "expected shell not to inherit agent environment")
+}
+
+func TestShellExit(t *testing.T) {
+	pub := mocks.NewPublisher()
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelWarn}))
+
+	s, err := NewSession("1", Config{Timeout: time.Minute}, pub.Publish, logger)
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	defer s.Kill()
+
+	err = s.Send([]byte("exit\n"))
+	require.Nil(t, err, fmt.Sprintf("unexpected error sending input: %s", err))
+	select {
+	case <-s.IsDone():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected session to be done once its shell exited")
+	}
+	select {
+	case <-s.Closed():
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected session to be closed once its shell exited")
+	}
+	assert.False(t, s.Alive(), "expected shell to have exited")
+	assert.Empty(t, logs.String(), "expected shell exit not to be logged as failure")
+}
+
+func TestNewSessionCredential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("running shell as other user requires root")
+	}
+	pub := mocks.NewPublisher()
+	cred := &syscall.Credential{Uid: 65534, Gid: 65534}
+
+	s, err := NewSession("1", Config{Timeout: time.Minute, Credential: cred}, pub.Publish, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	defer s.Kill()
+
+	status, err := os.ReadFile(fmt.Sprintf("/proc/%d/status", s.(*term).cmd.Process.Pid))
+	require.Nil(t, err, fmt.Sprintf("unexpected error reading shell status: %s", err))
+	assert.Regexp(t, `(?m)^Uid:\t65534\t`, string(status), "expected shell to run as the configured user")
+	assert.Regexp(t, `(?m)^Gid:\t65534\t`, string(status), "expected shell to run with the configured group")
+}
+
+func TestNewSessionBanner(t *testing.T) {
+	pub := mocks.NewPublisher()
+	// Shell prints right away, racing the banner.
+	env := []string{"PATH=" + os.Getenv("PATH"), "PS1=prompt$ "}
+
+	s, err := NewSession("1", Config{Timeout: time.Minute, Env: env, Banner: "Device 1\nAuthorized use only"}, pub.Publish, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	defer s.Kill()
+
+	assert.Eventually(t, func() bool {
+		return len(pub.Published()) > 1
+	}, 5*time.Second, 10*time.Millisecond, "expected shell output after the banner")
+	rec, err := encoder.DecodeSenML([]byte(pub.Published()[0].Payload))
+	require.Nil(t, err, fmt.Sprintf("unexpected error decoding output: %s", err))
+	assert.Equal(t, "Device 1\r\nAuthorized use only\r\n", rec.Value, "expected banner to be the first output")
+}
+
+// published returns the session output published so far.
+func published(t *testing.T, pub *mocks.Publisher) string {
+	var out strings.Builder
+	for _, msg := range pub.Published() {
+		rec, err := encoder.DecodeSenML([]byte(msg.Payload))
+		require.Nil(t, err, fmt.Sprintf("unexpected error decoding output: %s", err))
+		out.WriteString(rec.Value)
+	}
+	return out.String()
+}
+
+// foreground returns the foreground process group of the session terminal.
+func foreground(t *testing.T, term *term) int {
+	conn, err := term.ptmx.SyscallConn()
+	require.Nil(t, err, fmt.Sprintf("unexpected error getting PTY: %s", err))
+	var pgrp int
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		pgrp, ioctlErr = unix.IoctlGetInt(int(fd), unix.TIOCGPGRP)
+	})
+	require.Nil(t, err, fmt.Sprintf("unexpected error getting PTY descriptor: %s", err))
+	require.Nil(t, ioctlErr, fmt.Sprintf("unexpected error getting foreground process group: %s", ioctlErr))
+	return pgrp
+}
+
+func TestInput(t *testing.T) {
+	// Command results are computed, so the echoed input doesn't match them.
+	cases := []struct {
+		desc   string
+		inputs []Input
+		expect string
+	}{
+		{
+			desc:   "input data",
+			inputs: []Input{InputData("echo $((6*7))\n")},
+			expect: "42",
+		},
+		{
+			desc:   "input resize",
+			inputs: []Input{InputResize{Rows: 33, Cols: 111}, InputData("stty size\n")},
+			expect: "33 111",
+		},
+		{
+			desc:   "input interrupt signal",
+			inputs: []Input{InputData("sleep 30; echo $((6*8))\n"), SignalInterrupt, InputData("echo $((6*7))\n")},
+			expect: "42",
+		},
+		{
+			desc:   "input EOF signal",
+			inputs: []Input{InputData("cat\n"), SignalEOF, InputData("echo $((6*7))\n")},
+			expect: "42",
+		},
+	}
+
+	for _, tc := range cases {
+		pub := mocks.NewPublisher()
+		env := []string{"PATH=" + os.Getenv("PATH"), "PS1=prompt$ "}
+		s, err := NewSession("1", Config{Timeout: time.Minute, Env: env, Shell: "sh"}, pub.Publish, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		require.Nil(t, err, fmt.Sprintf("%s: unexpected error opening session: %s", tc.desc, err))
+
+		for _, in := range tc.inputs {
+			// Signal is sent once the command runs in the foreground.
+			if _, ok := in.(InputSignal); ok {
+				assert.Eventually(t, func() bool {
+					return foreground(t, s.(*term)) != s.(*term).cmd.Process.Pid
+				}, 5*time.Second, 10*time.Millisecond, fmt.Sprintf("%s: expected command to run in the foreground", tc.desc))
+			}
+			err := s.Input(in)
+			require.Nil(t, err, fmt.Sprintf("%s: unexpected error sending input: %s", tc.desc, err))
+		}
+		assert.Eventually(t, func() bool {
+			return strings.Contains(published(t, pub), tc.expect)
+		}, 5*time.Second, 10*time.Millisecond, fmt.Sprintf("%s: expected %q in output", tc.desc, tc.expect))
+		assert.NotContains(t, published(t, pub), "48", fmt.Sprintf("%s: expected interrupted command not to complete", tc.desc))
+		s.Kill()
+	}
+}
+
+func TestInputInvalid(t *testing.T) {
+	pub := mocks.NewPublisher()
+	s, err := NewSession("1", Config{Timeout: time.Minute}, pub.Publish, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	require.Nil(t, err, fmt.Sprintf("unexpected error opening session: %s", err))
+	defer s.Kill()
+
+	for _, in := range []Input{InputResize{Rows: 0, Cols: 80}, InputSignal("kill")} {
+		err := s.Input(in)
+		assert.True(t, errors.Contains(err, ErrInvalidInput), fmt.Sprintf("%#v: expected %s got %s", in, ErrInvalidInput, err))
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+// Package topic validates MQTT topics the agent publishes to.
+package topic
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/andychao217/magistrala/pkg/errors"
+)
+
+// MaxLength is the maximum length of the topic in bytes.
+const MaxLength = 1024
+
+// ErrInvalidTopic indicates topic which can't be published to.
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// Validate checks that topic is non-empty, doesn't contain wildcards or null
+// characters, and isn't longer than MaxLength.
+func Validate(topic string) error {
+	switch {
+	case topic == "":
+		return errors.Wrap(ErrInvalidTopic, errors.New("topic is empty"))
+	case strings.ContainsAny(topic, "+#"):
+		return errors.Wrap(ErrInvalidTopic, errors.New("topic contains wildcards"))
+	case strings.ContainsRune(topic, 0):
+		return errors.Wrap(ErrInvalidTopic, errors.New("topic contains null character"))
+	case len(topic) > MaxLength:
+		return errors.Wrap(ErrInvalidTopic, fmt.Errorf("topic is longer than %d bytes", MaxLength))
+	}
+	return nil
+}
+
+// Placeholders of the topic templates.
+const (
+	// Prefix is replaced with the response topic prefix of the channel,
+	// "channels/<channel>/messages/res".
+	Prefix = "prefix"
+	// Channel is replaced with the channel ID.
+	Channel = "channel"
+	// UUID is replaced with the terminal session UUID.
+	UUID = "uuid"
+)
+
+// ErrInvalidTemplate indicates topic template which can't be rendered into
+// a valid topic.
+var ErrInvalidTemplate = errors.New("invalid topic template")
+
+// ValidateTemplate checks that template only uses the placeholders, written
+// as "{name}", and renders into a valid topic.
+func ValidateTemplate(tmpl string, placeholders ...string) error {
+	values := make(map[string]string, len(placeholders))
+	for _, p := range placeholders {
+		values[p] = p
+	}
+	rest := tmpl
+	for {
+		start := strings.IndexAny(rest, "{}")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if rest[start] == '}' || end < 0 {
+			return errors.Wrap(ErrInvalidTemplate, fmt.Errorf("template %q has unbalanced braces", tmpl))
+		}
+		name := rest[start+1 : start+end]
+		if _, ok := values[name]; !ok {
+			return errors.Wrap(ErrInvalidTemplate, fmt.Errorf("template %q has unknown placeholder {%s}", tmpl, name))
+		}
+		rest = rest[start+end+1:]
+	}
+	if err := Validate(Render(tmpl, values)); err != nil {
+		return errors.Wrap(ErrInvalidTemplate, err)
+	}
+	return nil
+}
+
+// Render replaces the placeholders of the template with their values.
+func Render(tmpl string, values map[string]string) string {
+	pairs := make([]string, 0, 2*len(values))
+	for name, value := range values {
+		pairs = append(pairs, "{"+name+"}", value)
+	}
+	return strings.NewReplacer(pairs...).Replace(tmpl)
+}
+
+// Match reports whether topic matches the filter, which may use the "+"
+// single level and "#" multi level wildcards.
+func Match(filter, topic string) bool {
+	filters, levels := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, f := range filters {
+		switch {
+		case f == "#":
+			return true
+		case i >= len(levels):
+			return false
+		case f != "+" && f != levels[i]:
+			return false
+		}
+	}
+	return len(filters) == len(levels)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) Abstract Machines
+// SPDX-License-Identifier: Apache-2.0
+
+package topic_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/andychao217/agent/pkg/topic"
+	"github.com/andychao217/magistrala/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		desc  string
+		topic string
+		err   error
+	}{
+		{"valid topic", "term/1", nil},
+		{"topic of maximum length", strings.Repeat("a", topic.MaxLength), nil},
+		{"empty topic", "", topic.ErrInvalidTopic},
+		{"topic with single level wildcard", "term/+", topic.ErrInvalidTopic},
+		{"topic with multi level wildcard", "term/#", topic.ErrInvalidTopic},
+		{"topic with null character", "term/\x00", topic.ErrInvalidTopic},
+		{"overly long topic", strings.Repeat("a", topic.MaxLength+1), topic.ErrInvalidTopic},
+	}
+
+	for _, tc := range cases {
+		err := topic.Validate(tc.topic)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %s got %s", tc.desc, tc.err, err))
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	cases := []struct {
+		desc string
+		tmpl string
+		err  error
+	}{
+		{"template with placeholders", "{prefix}/term/{uuid}", nil},
+		{"template without placeholders", "term", nil},
+		{"template with repeated placeholder", "{uuid}/{uuid}", nil},
+		{"template with unknown placeholder", "{prefix}/term/{session}", topic.ErrInvalidTemplate},
+		{"template with empty placeholder", "{prefix}/{}", topic.ErrInvalidTemplate},
+		{"template with unclosed brace", "{prefix/term", topic.ErrInvalidTemplate},
+		{"template with unopened brace", "prefix}/term", topic.ErrInvalidTemplate},
+		{"template with wildcard", "{prefix}/#", topic.ErrInvalidTemplate},
+		{"empty template", "", topic.ErrInvalidTemplate},
+	}
+
+	for _, tc := range cases {
+		err := topic.ValidateTemplate(tc.tmpl, topic.Prefix, topic.UUID)
+		assert.True(t, errors.Contains(err, tc.err), fmt.Sprintf("%s: expected %s got %s", tc.desc, tc.err, err))
+	}
+}
+
+func TestRender(t *testing.T) {
+	values := map[string]string{topic.Prefix: "channels/1/messages/res", topic.UUID: "abc"}
+	cases := []struct {
+		desc  string
+		tmpl  string
+		topic string
+	}{
+		{"render template", "{prefix}/term/{uuid}", "channels/1/messages/res/term/abc"},
+		{"render template without placeholders", "term", "term"},
+		{"render template with repeated placeholder", "{uuid}/{uuid}", "abc/abc"},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.topic, topic.Render(tc.tmpl, values), tc.desc)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		desc   string
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"match equal topic", "channels/1/messages", "channels/1/messages", true},
+		{"match different topic", "channels/1/messages", "channels/2/messages", false},
+		{"match single level wildcard", "channels/+/messages", "channels/1/messages", true},
+		{"match single level wildcard with extra level", "channels/+", "channels/1/messages", false},
+		{"match multi level wildcard", "channels/1/#", "channels/1/messages/res", true},
+		{"match multi level wildcard with parent level", "channels/1/#", "channels/1", true},
+		{"match shorter topic", "channels/1/messages", "channels/1", false},
+		{"match longer topic", "channels/1", "channels/1/messages", false},
+	}
+
+	for _, tc := range cases {
+		assert.Equal(t, tc.match, topic.Match(tc.filter, tc.topic), tc.desc)
+	}
+}